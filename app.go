@@ -0,0 +1,220 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// An AppProtocol represents an application protocol of UDP probe
+// payload.
+// Probe packets carrying a valid application message to the
+// well-known port of the protocol are likely to pass through packet
+// filters that drop the probe packets of traceroute.
+type AppProtocol int
+
+const (
+	AppDNS  AppProtocol = iota + 1 // DNS query for the root name servers
+	AppNTP                         // NTP client request
+	AppSNMP                        // SNMPv2c get request for sysUpTime.0
+)
+
+var appProtocols = map[AppProtocol]struct {
+	name string
+	port int
+}{
+	AppDNS:  {"dns", 53},
+	AppNTP:  {"ntp", 123},
+	AppSNMP: {"snmp", 161},
+}
+
+func (p AppProtocol) String() string {
+	ap, ok := appProtocols[p]
+	if !ok {
+		return "<nil>"
+	}
+	return ap.name
+}
+
+// Port returns the well-known UDP port of p.
+func (p AppProtocol) Port() int {
+	return appProtocols[p].port
+}
+
+// ParseAppProtocol parses s as an application protocol name.
+func ParseAppProtocol(s string) (AppProtocol, error) {
+	for p, ap := range appProtocols {
+		if ap.name == s {
+			return p, nil
+		}
+	}
+	return 0, errors.New("unknown application protocol: " + s)
+}
+
+// An AppReply represents an application-level reply to a probe
+// payload made by MarshalAppProbe.
+type AppReply struct {
+	Protocol AppProtocol
+	ID       int // identifier of the probe payload
+
+	RCode       int       // DNS response code, set only for AppDNS
+	Stratum     int       // NTP stratum, set only for AppNTP
+	Time        time.Time // NTP transmit timestamp, set only for AppNTP
+	ErrorStatus int       // SNMP error status, set only for AppSNMP
+}
+
+var errInvalidAppReply = errors.New("invalid application reply")
+
+const (
+	dnsHeaderLen  = 12
+	ntpPacketLen  = 48
+	snmpCommunity = "public"
+)
+
+// snmpSysUpTime is the BER encoding of the object identifier
+// 1.3.6.1.2.1.1.3.0.
+var snmpSysUpTime = []byte{0x2b, 0x06, 0x01, 0x02, 0x01, 0x01, 0x03, 0x00}
+
+// MarshalAppProbe returns the binary encoding of a request message of
+// p that carries the 16-bit identifier id.
+// The identifier is placed in the DNS message ID, the low-order bits
+// of NTP transmit timestamp, or the SNMP request ID, which are
+// returned by the responder as they are.
+func MarshalAppProbe(p AppProtocol, id int) ([]byte, error) {
+	switch p {
+	case AppDNS:
+		b := make([]byte, dnsHeaderLen, dnsHeaderLen+5)
+		binary.BigEndian.PutUint16(b[0:2], uint16(id))
+		b[2] = 0x01 // recursion desired
+		binary.BigEndian.PutUint16(b[4:6], 1)
+		return append(b, 0, 0, 2, 0, 1), nil // ". IN NS"
+	case AppNTP:
+		b := make([]byte, ntpPacketLen)
+		b[0] = 4<<3 | 3 // version 4, client mode
+		putNTPTime(b[40:48], time.Now())
+		binary.BigEndian.PutUint16(b[46:48], uint16(id))
+		return b, nil
+	case AppSNMP:
+		varbind := berTLV(0x30, append(berTLV(0x06, snmpSysUpTime), 0x05, 0x00))
+		pdu := append(berInteger(id&0xffff), berInteger(0)...)
+		pdu = append(pdu, berInteger(0)...)
+		pdu = append(pdu, berTLV(0x30, varbind)...)
+		msg := append(berInteger(1), berTLV(0x04, []byte(snmpCommunity))...) // version 2c
+		msg = append(msg, berTLV(0xa0, pdu)...)
+		return berTLV(0x30, msg), nil
+	default:
+		return nil, errors.New("unknown application protocol")
+	}
+}
+
+// ParseAppReply parses b as a reply message of p.
+func ParseAppReply(p AppProtocol, b []byte) (*AppReply, error) {
+	r := AppReply{Protocol: p}
+	switch p {
+	case AppDNS:
+		if len(b) < dnsHeaderLen || b[2]&0x80 == 0 {
+			return nil, errInvalidAppReply
+		}
+		r.ID = int(binary.BigEndian.Uint16(b[0:2]))
+		r.RCode = int(b[3] & 0x0f)
+	case AppNTP:
+		if len(b) < ntpPacketLen || b[0]&0x07 != 4 { // server mode
+			return nil, errInvalidAppReply
+		}
+		r.ID = int(binary.BigEndian.Uint16(b[30:32]))
+		r.Stratum = int(b[1])
+		r.Time = parseNTPTime(b[40:48])
+	case AppSNMP:
+		tag, msg, _, err := parseBERTLV(b)
+		if err != nil || tag != 0x30 {
+			return nil, errInvalidAppReply
+		}
+		var vals [][]byte
+		for i, want := range []byte{0x02, 0x04, 0xa2} { // version, community, response PDU
+			var v []byte
+			if tag, v, msg, err = parseBERTLV(msg); err != nil || tag != want {
+				return nil, errInvalidAppReply
+			}
+			if i == 2 {
+				msg = v
+			}
+		}
+		for _, want := range []byte{0x02, 0x02} { // request ID, error status
+			var v []byte
+			if tag, v, msg, err = parseBERTLV(msg); err != nil || tag != want || len(v) == 0 || len(v) > 4 {
+				return nil, errInvalidAppReply
+			}
+			vals = append(vals, v)
+		}
+		r.ID, r.ErrorStatus = berIntegerValue(vals[0])&0xffff, berIntegerValue(vals[1])
+	default:
+		return nil, errors.New("unknown application protocol")
+	}
+	return &r, nil
+}
+
+// berTLV returns the BER encoding of the tag, length and value.
+func berTLV(tag byte, v []byte) []byte {
+	b := []byte{tag}
+	switch n := len(v); {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n < 0x100:
+		b = append(b, 0x81, byte(n))
+	default:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	}
+	return append(b, v...)
+}
+
+// berInteger returns the BER encoding of the non-negative integer v.
+func berInteger(v int) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+		if v == 0 {
+			break
+		}
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berTLV(0x02, b)
+}
+
+func berIntegerValue(b []byte) int {
+	var v int
+	for _, c := range b {
+		v = v<<8 | int(c)
+	}
+	return v
+}
+
+// parseBERTLV parses the first BER-encoded element of b, and returns
+// the tag, the value and the rest of b.
+func parseBERTLV(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errInvalidAppReply
+	}
+	tag, n, b := b[0], int(b[1]), b[2:]
+	if n&0x80 != 0 {
+		l := n & 0x7f
+		if l == 0 || l > 2 || len(b) < l {
+			return 0, nil, nil, errInvalidAppReply
+		}
+		n = 0
+		for _, c := range b[:l] {
+			n = n<<8 | int(c)
+		}
+		b = b[l:]
+	}
+	if len(b) < n {
+		return 0, nil, nil, errInvalidAppReply
+	}
+	return tag, b[:n], b[n:], nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mikioh/ipoam"
+)
+
+func TestAppProbe(t *testing.T) {
+	snmpGetRequest := []byte{
+		0x30, 0x27, 0x02, 0x01, 0x01, 0x04, 0x06, 'p', 'u', 'b', 'l', 'i', 'c',
+		0xa0, 0x1a, 0x02, 0x02, 0x12, 0x34, 0x02, 0x01, 0x00, 0x02, 0x01, 0x00,
+		0x30, 0x0e, 0x30, 0x0c, 0x06, 0x08, 0x2b, 0x06, 0x01, 0x02, 0x01, 0x01, 0x03, 0x00, 0x05, 0x00,
+	}
+
+	for _, tt := range []struct {
+		proto ipoam.AppProtocol
+		port  int
+		reply func([]byte) []byte
+	}{
+		{
+			ipoam.AppDNS, 53,
+			func(b []byte) []byte {
+				b[2] |= 0x80
+				b[3] = 0x05 // refused
+				return b
+			},
+		},
+		{
+			ipoam.AppNTP, 123,
+			func(b []byte) []byte {
+				rep := make([]byte, len(b))
+				rep[0], rep[1] = 4<<3|4, 2
+				copy(rep[24:32], b[40:48])
+				copy(rep[40:48], b[40:48])
+				return rep
+			},
+		},
+		{
+			ipoam.AppSNMP, 161,
+			func(b []byte) []byte {
+				if !bytes.Equal(b, snmpGetRequest) {
+					t.Errorf("got %#v; want %#v", b, snmpGetRequest)
+				}
+				b[13] = 0xa2
+				return b
+			},
+		},
+	} {
+		if tt.proto.Port() != tt.port {
+			t.Errorf("%v: got %d; want %d", tt.proto, tt.proto.Port(), tt.port)
+		}
+		if p, err := ipoam.ParseAppProtocol(tt.proto.String()); err != nil || p != tt.proto {
+			t.Errorf("%v: got %v, %v", tt.proto, p, err)
+		}
+		b, err := ipoam.MarshalAppProbe(tt.proto, 0x1234)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ipoam.ParseAppReply(tt.proto, b); err == nil {
+			t.Errorf("%v: got nil for request; want error", tt.proto)
+		}
+		r, err := ipoam.ParseAppReply(tt.proto, tt.reply(b))
+		if err != nil {
+			t.Fatalf("%v: %v", tt.proto, err)
+		}
+		if r.Protocol != tt.proto || r.ID != 0x1234 {
+			t.Errorf("%v: got %+v", tt.proto, r)
+		}
+		switch tt.proto {
+		case ipoam.AppDNS:
+			if r.RCode != 5 {
+				t.Errorf("got %d; want 5", r.RCode)
+			}
+		case ipoam.AppNTP:
+			if r.Stratum != 2 || r.Time.IsZero() {
+				t.Errorf("got %d, %v", r.Stratum, r.Time)
+			}
+		}
+	}
+	if _, err := ipoam.ParseAppProtocol("http"); err == nil {
+		t.Error("got nil for unknown protocol; want error")
+	}
+}
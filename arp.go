@@ -0,0 +1,294 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	arpHardwareEthernet = 1
+	arpProtocolIPv4     = 0x0800
+	arpMsgLen           = 28 // length of ARP message for Ethernet and IPv4
+
+	arpOpRequest = 1
+	arpOpReply   = 2
+)
+
+var (
+	errInvalidARPMessage = errors.New("invalid ARP message")
+
+	ethernetBroadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+)
+
+// An ARPMode represents a mode of ARP request.
+type ARPMode int
+
+const (
+	// ARPRequest is an ordinary request that carries one of the
+	// IPv4 addresses of the interface as the sender protocol
+	// address.
+	ARPRequest ARPMode = iota
+
+	// ARPGratuitous is a gratuitous request that carries the
+	// target protocol address as the sender protocol address.
+	// It updates the neighbor caches on the link, and some nodes
+	// that own the same address respond or defend it.
+	// The target must be one of the IPv4 addresses of the
+	// interface.
+	ARPGratuitous
+
+	// ARPProbe is a request for address conflict detection that
+	// carries the unspecified address as the sender protocol
+	// address.
+	// See RFC 5227.
+	ARPProbe
+)
+
+var arpModes = map[ARPMode]string{
+	ARPRequest:    "request",
+	ARPGratuitous: "gratuitous",
+	ARPProbe:      "probe",
+}
+
+func (m ARPMode) String() string {
+	s, ok := arpModes[m]
+	if !ok {
+		return "<nil>"
+	}
+	return s
+}
+
+// An arpMessage represents an ARP message for Ethernet and IPv4.
+// See RFC 826.
+type arpMessage struct {
+	op       int
+	senderHW net.HardwareAddr
+	senderIP net.IP
+	targetHW net.HardwareAddr
+	targetIP net.IP
+}
+
+func (m *arpMessage) marshal() []byte {
+	b := make([]byte, arpMsgLen)
+	binary.BigEndian.PutUint16(b[0:2], arpHardwareEthernet)
+	binary.BigEndian.PutUint16(b[2:4], arpProtocolIPv4)
+	b[4], b[5] = 6, 4
+	binary.BigEndian.PutUint16(b[6:8], uint16(m.op))
+	copy(b[8:14], m.senderHW)
+	copy(b[14:18], m.senderIP.To4())
+	copy(b[18:24], m.targetHW)
+	copy(b[24:28], m.targetIP.To4())
+	return b
+}
+
+func parseARPMessage(b []byte) (*arpMessage, error) {
+	if len(b) < arpMsgLen || binary.BigEndian.Uint16(b[0:2]) != arpHardwareEthernet || binary.BigEndian.Uint16(b[2:4]) != arpProtocolIPv4 || b[4] != 6 || b[5] != 4 {
+		return nil, errInvalidARPMessage
+	}
+	m := arpMessage{
+		op:       int(binary.BigEndian.Uint16(b[6:8])),
+		senderHW: net.HardwareAddr(append([]byte(nil), b[8:14]...)),
+		senderIP: net.IPv4(b[14], b[15], b[16], b[17]),
+		targetHW: net.HardwareAddr(append([]byte(nil), b[18:24]...)),
+		targetIP: net.IPv4(b[24], b[25], b[26], b[27]),
+	}
+	if m.op != arpOpRequest && m.op != arpOpReply {
+		return nil, errInvalidARPMessage
+	}
+	return &m, nil
+}
+
+// An ARPReport represents a test report of ARP tester.
+type ARPReport struct {
+	Error      error            // on-link operation error
+	Time       time.Time        // time packet received
+	Src        net.IP           // sender protocol address
+	LinkAddr   net.HardwareAddr // sender hardware address
+	Dst        net.IP           // target protocol address
+	Reply      bool             // received packet is a reply, otherwise a request
+	Gratuitous bool             // sender and target protocol addresses are same
+	RTT        time.Duration    // round-trip time, zero if unknown
+}
+
+// An ARPTester represents a tester for IPv4 neighbor reachability
+// using ARP.
+// It currently works on Linux only.
+type ARPTester struct {
+	ifi    *net.Interface
+	c      *linkConn
+	report chan ARPReport
+	done   chan struct{}
+
+	closeOnce sync.Once
+
+	mu   sync.Mutex
+	sent map[string]time.Time // transmission time of latest request for target
+}
+
+// NewARPTester makes a tester that transmits and receives ARP
+// messages via ifi.
+// It requires the privilege to open link-layer sockets.
+func NewARPTester(ifi *net.Interface) (*ARPTester, error) {
+	if ifi == nil || len(ifi.HardwareAddr) != 6 {
+		return nil, errors.New("no Ethernet interface for ARP")
+	}
+	c, err := listenLink(ifi, etherTypeARP)
+	if err != nil {
+		return nil, err
+	}
+	t := ARPTester{ifi: ifi, c: c, report: make(chan ARPReport, 1), done: make(chan struct{}), sent: make(map[string]time.Time)}
+	go t.monitor()
+	return &t, nil
+}
+
+// Report returns the buffered test report channel.
+func (t *ARPTester) Report() <-chan ARPReport {
+	return t.report
+}
+
+// Close closes the underlying link-layer socket.
+func (t *ARPTester) Close() error {
+	err := error(syscall.EINVAL)
+	t.closeOnce.Do(func() {
+		close(t.done)
+		err = t.c.close()
+	})
+	return err
+}
+
+// Probe transmits an ARP request for the IPv4 address ip in the mode
+// m.
+// The request is addressed to dst when it is not nil, otherwise to
+// the broadcast address; a unicast request is useful for refreshing
+// a known neighbor entry.
+// Each ARP message that carries ip as the sender protocol address,
+// or as the target protocol address of a probe for address conflict
+// detection, is reported, except for the messages transmitted by t
+// itself.
+func (t *ARPTester) Probe(ip net.IP, dst net.HardwareAddr, m ARPMode) error {
+	ip = ip.To4()
+	if ip == nil {
+		return errors.New("non-IPv4 ARP target")
+	}
+	req := arpMessage{op: arpOpRequest, senderHW: t.ifi.HardwareAddr, targetHW: make(net.HardwareAddr, 6), targetIP: ip}
+	switch m {
+	case ARPRequest:
+		req.senderIP = t.source(ip)
+	case ARPGratuitous:
+		if !t.assigned(ip) {
+			return errors.New("gratuitous ARP target not assigned to " + t.ifi.Name)
+		}
+		req.senderIP = ip
+	case ARPProbe:
+		req.senderIP = net.IPv4zero
+	default:
+		return errors.New("unknown ARP mode")
+	}
+	if dst == nil {
+		dst = ethernetBroadcast
+	}
+	t.mu.Lock()
+	t.sent[ip.String()] = time.Now()
+	t.mu.Unlock()
+	return t.c.writeTo(req.marshal(), dst)
+}
+
+// source returns the IPv4 address of t's interface on the same
+// subnet as ip, or the first IPv4 address when no such address is
+// found.
+func (t *ARPTester) source(ip net.IP) net.IP {
+	ifat, err := t.ifi.Addrs()
+	if err != nil {
+		return net.IPv4zero
+	}
+	var first net.IP
+	for _, ifa := range ifat {
+		ipn, ok := ifa.(*net.IPNet)
+		if !ok || ipn.IP.To4() == nil {
+			continue
+		}
+		if ipn.Contains(ip) {
+			return ipn.IP.To4()
+		}
+		if first == nil {
+			first = ipn.IP.To4()
+		}
+	}
+	if first == nil {
+		return net.IPv4zero
+	}
+	return first
+}
+
+// assigned reports whether ip is one of the IPv4 addresses of t's
+// interface.
+func (t *ARPTester) assigned(ip net.IP) bool {
+	ifat, err := t.ifi.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, ifa := range ifat {
+		if ipn, ok := ifa.(*net.IPNet); ok && ipn.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *ARPTester) emit(r *ARPReport) {
+	select {
+	case t.report <- *r:
+	case <-t.done:
+	}
+}
+
+func (t *ARPTester) monitor() {
+	b := make([]byte, 1<<16)
+	for {
+		n, _, err := t.c.readFrom(b)
+		if err != nil {
+			select {
+			case <-t.done:
+			default:
+				t.emit(&ARPReport{Error: err, Time: time.Now()})
+			}
+			return
+		}
+		now := time.Now()
+		m, err := parseARPMessage(b[:n])
+		if err != nil || bytes.Equal(m.senderHW, t.ifi.HardwareAddr) {
+			continue
+		}
+		ip := m.senderIP
+		if ip.Equal(net.IPv4zero) {
+			ip = m.targetIP
+		}
+		t.mu.Lock()
+		sent, ok := t.sent[ip.String()]
+		t.mu.Unlock()
+		if !ok {
+			continue
+		}
+		r := ARPReport{
+			Time:       now,
+			Src:        m.senderIP,
+			LinkAddr:   m.senderHW,
+			Dst:        m.targetIP,
+			Reply:      m.op == arpOpReply,
+			Gratuitous: m.senderIP.Equal(m.targetIP),
+		}
+		if r.Reply {
+			r.RTT = now.Sub(sent)
+		}
+		t.emit(&r)
+	}
+}
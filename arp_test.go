@@ -0,0 +1,65 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestARPMessage(t *testing.T) {
+	m := arpMessage{
+		op:       arpOpReply,
+		senderHW: net.HardwareAddr{0x02, 0x00, 0x5e, 0x10, 0x00, 0x01},
+		senderIP: net.IPv4(192, 0, 2, 1),
+		targetHW: net.HardwareAddr{0x02, 0x00, 0x5e, 0x10, 0x00, 0x02},
+		targetIP: net.IPv4(192, 0, 2, 2),
+	}
+	b := m.marshal()
+	want := []byte{
+		0x00, 0x01, 0x08, 0x00, 0x06, 0x04, 0x00, 0x02,
+		0x02, 0x00, 0x5e, 0x10, 0x00, 0x01, 0xc0, 0x00, 0x02, 0x01,
+		0x02, 0x00, 0x5e, 0x10, 0x00, 0x02, 0xc0, 0x00, 0x02, 0x02,
+	}
+	if !reflect.DeepEqual(b, want) {
+		t.Fatalf("got %#v; want %#v", b, want)
+	}
+	mm, err := parseARPMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mm, &m) {
+		t.Errorf("got %+v; want %+v", mm, &m)
+	}
+
+	for _, b := range [][]byte{
+		b[:arpMsgLen-1],
+		append([]byte{0x00, 0x06}, b[2:]...),
+		append(append([]byte(nil), b[:7]...), append([]byte{0x03}, b[8:]...)...),
+	} {
+		if _, err := parseARPMessage(b); err == nil {
+			t.Errorf("%x: got nil; want error", b)
+		}
+	}
+}
+
+func TestARPGratuitousTarget(t *testing.T) {
+	ift, err := net.Interfaces()
+	if err != nil {
+		t.Skip(err)
+	}
+	for i := range ift {
+		if ift[i].Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		at := ARPTester{ifi: &ift[i]}
+		if err := at.Probe(net.IPv4(192, 0, 2, 1), nil, ARPGratuitous); err == nil {
+			t.Errorf("%s: gratuitous request for 192.0.2.1 transmitted", ift[i].Name)
+		}
+		return
+	}
+	t.Skip("no loopback interface")
+}
@@ -5,6 +5,7 @@
 package ipoam_test
 
 import (
+	"fmt"
 	"net"
 	"os"
 	"testing"
@@ -44,3 +45,43 @@ func BenchmarkTester(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkTesterBatch(b *testing.B) {
+	for _, bb := range []struct {
+		name                     string
+		network, address, target string
+	}{
+		{"IPv4", "ip4:icmp", "0.0.0.0", "127.0.0.1"},
+		{"IPv6", "ip6:ipv6-icmp", "::", "::1"},
+	} {
+		for _, n := range []int{1, 8, 16} {
+			b.Run(fmt.Sprintf("%s/%d", bb.name, n), func(b *testing.B) {
+				ipt, err := ipoam.NewTester(bb.network, bb.address)
+				if err != nil {
+					b.Log(err)
+					return
+				}
+				defer ipt.Close()
+				ip := net.ParseIP(bb.target)
+				cms := make([]ipoam.ControlMessage, n)
+				ips := make([]net.IP, n)
+				for i := range cms {
+					cms[i].ID = os.Getpid() & 0xffff
+					ips[i] = ip
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					for j := range cms {
+						cms[j].Seq = (i*n+j)&0xffff + 1
+					}
+					if _, err := ipt.ProbeBatch([]byte("HELLO-R-U-THERE"), cms, ips, nil); err != nil {
+						b.Fatal(err)
+					}
+					for j := 0; j < n; j++ {
+						<-ipt.Report()
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,972 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// BFD UDP port numbers.
+const (
+	BFDPort         = 3784 // single-hop control packets
+	BFDEchoPort     = 3785 // single-hop echo packets
+	BFDMultihopPort = 4784 // multihop control packets
+)
+
+// A BFDState represents a BFD session state.
+type BFDState int
+
+const (
+	BFDAdminDown BFDState = 0 // administratively down
+	BFDDown      BFDState = 1 // down
+	BFDInit      BFDState = 2 // initializing
+	BFDUp        BFDState = 3 // up
+)
+
+var bfdStates = map[BFDState]string{
+	BFDAdminDown: "AdminDown",
+	BFDDown:      "Down",
+	BFDInit:      "Init",
+	BFDUp:        "Up",
+}
+
+func (st BFDState) String() string {
+	if s, ok := bfdStates[st]; ok {
+		return s
+	}
+	return fmt.Sprintf("state %d", int(st))
+}
+
+// A BFDDiag represents a BFD diagnostic code.
+type BFDDiag int
+
+const (
+	BFDDiagNone                BFDDiag = 0 // no diagnostic
+	BFDDiagTimeExpired         BFDDiag = 1 // control detection time expired
+	BFDDiagEchoFailed          BFDDiag = 2 // echo function failed
+	BFDDiagNeighborDown        BFDDiag = 3 // neighbor signaled session down
+	BFDDiagForwardingReset     BFDDiag = 4 // forwarding plane reset
+	BFDDiagPathDown            BFDDiag = 5 // path down
+	BFDDiagConcatPathDown      BFDDiag = 6 // concatenated path down
+	BFDDiagAdminDown           BFDDiag = 7 // administratively down
+	BFDDiagReverseConcatPathDn BFDDiag = 8 // reverse concatenated path down
+)
+
+var bfdDiags = map[BFDDiag]string{
+	BFDDiagNone:                "no diagnostic",
+	BFDDiagTimeExpired:         "control detection time expired",
+	BFDDiagEchoFailed:          "echo function failed",
+	BFDDiagNeighborDown:        "neighbor signaled session down",
+	BFDDiagForwardingReset:     "forwarding plane reset",
+	BFDDiagPathDown:            "path down",
+	BFDDiagConcatPathDown:      "concatenated path down",
+	BFDDiagAdminDown:           "administratively down",
+	BFDDiagReverseConcatPathDn: "reverse concatenated path down",
+}
+
+func (d BFDDiag) String() string {
+	if s, ok := bfdDiags[d]; ok {
+		return s
+	}
+	return fmt.Sprintf("diagnostic %d", int(d))
+}
+
+// A BFDAuthType represents a BFD authentication type.
+type BFDAuthType int
+
+const (
+	BFDAuthNone                BFDAuthType = 0 // no authentication
+	BFDAuthSimplePassword      BFDAuthType = 1 // simple password
+	BFDAuthKeyedMD5            BFDAuthType = 2 // keyed MD5
+	BFDAuthMeticulousKeyedMD5  BFDAuthType = 3 // meticulous keyed MD5
+	BFDAuthKeyedSHA1           BFDAuthType = 4 // keyed SHA1
+	BFDAuthMeticulousKeyedSHA1 BFDAuthType = 5 // meticulous keyed SHA1
+)
+
+var bfdAuthTypes = map[BFDAuthType]string{
+	BFDAuthNone:                "none",
+	BFDAuthSimplePassword:      "simple",
+	BFDAuthKeyedMD5:            "md5",
+	BFDAuthMeticulousKeyedMD5:  "meticulous-md5",
+	BFDAuthKeyedSHA1:           "sha1",
+	BFDAuthMeticulousKeyedSHA1: "meticulous-sha1",
+}
+
+func (typ BFDAuthType) String() string {
+	if s, ok := bfdAuthTypes[typ]; ok {
+		return s
+	}
+	return fmt.Sprintf("auth type %d", int(typ))
+}
+
+// ParseBFDAuthType parses s as the name of a BFD authentication type,
+// such as "md5" or "meticulous-sha1".
+func ParseBFDAuthType(s string) (BFDAuthType, error) {
+	for typ, name := range bfdAuthTypes {
+		if s == name {
+			return typ, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown BFD authentication type: %s", s)
+}
+
+// digestLen returns the length of digest, or zero when typ doesn't
+// use a digest.
+func (typ BFDAuthType) digestLen() int {
+	switch typ {
+	case BFDAuthKeyedMD5, BFDAuthMeticulousKeyedMD5:
+		return md5.Size
+	case BFDAuthKeyedSHA1, BFDAuthMeticulousKeyedSHA1:
+		return sha1.Size
+	}
+	return 0
+}
+
+func (typ BFDAuthType) meticulous() bool {
+	return typ == BFDAuthMeticulousKeyedMD5 || typ == BFDAuthMeticulousKeyedSHA1
+}
+
+// A BFDAuth represents an authentication section of BFD control
+// packet.
+type BFDAuth struct {
+	Type  BFDAuthType
+	KeyID int
+	Seq   uint32 // sequence number, not used by simple password authentication
+
+	// Key specifies the password of simple password
+	// authentication, or the secret key of keyed MD5 and SHA1
+	// authentication on transmission.
+	// It holds the password or digest carried in the packet on
+	// reception.
+	Key []byte
+}
+
+// sectionLen returns the length of authentication section for a.
+// It returns an error when the type, key ID or key length is invalid
+// for transmission.
+func (a *BFDAuth) sectionLen() (int, error) {
+	if a.KeyID < 0 || a.KeyID > 255 {
+		return 0, errInvalidBFDAuth
+	}
+	switch a.Type {
+	case BFDAuthSimplePassword:
+		if len(a.Key) < 1 || len(a.Key) > 16 {
+			return 0, errInvalidBFDAuth
+		}
+		return 3 + len(a.Key), nil
+	default:
+		n := a.Type.digestLen()
+		if n == 0 || len(a.Key) < 1 || len(a.Key) > n {
+			return 0, errInvalidBFDAuth
+		}
+		return 8 + n, nil
+	}
+}
+
+// A BFDControl represents a BFD control packet.
+type BFDControl struct {
+	Diag              BFDDiag
+	State             BFDState
+	Poll              bool
+	Final             bool
+	CPI               bool // control plane independent
+	Demand            bool
+	Multipoint        bool
+	DetectMult        int
+	MyDiscriminator   uint32
+	YourDiscriminator uint32
+	DesiredMinTx      time.Duration
+	RequiredMinRx     time.Duration
+	RequiredMinEchoRx time.Duration
+	Auth              *BFDAuth // nil if not present
+}
+
+const (
+	bfdVersion   = 1
+	bfdHeaderLen = 24
+)
+
+var (
+	errInvalidBFDControl  = errors.New("invalid BFD control packet")
+	errUnknownBFDVersion  = errors.New("unknown BFD version")
+	errInvalidBFDAuth     = errors.New("invalid BFD authentication section")
+	errBFDAuthFailed      = errors.New("BFD authentication failed")
+	errBFDSessionStarted  = errors.New("BFD session already started")
+	errInvalidBFDInterval = errors.New("invalid BFD interval")
+)
+
+// Marshal returns the binary encoding of m.
+// It computes the digest of keyed MD5 and SHA1 authentication with
+// m.Auth.Key.
+func (m *BFDControl) Marshal() ([]byte, error) {
+	var alen int
+	if m.Auth != nil {
+		var err error
+		if alen, err = m.Auth.sectionLen(); err != nil {
+			return nil, err
+		}
+	}
+	if m.DetectMult < 0 || m.DetectMult > 255 {
+		return nil, errInvalidBFDControl
+	}
+	b := make([]byte, bfdHeaderLen+alen)
+	b[0] = bfdVersion<<5 | byte(m.Diag)&0x1f
+	b[1] = byte(m.State) << 6
+	for i, f := range []bool{m.Poll, m.Final, m.CPI, m.Auth != nil, m.Demand, m.Multipoint} {
+		if f {
+			b[1] |= 0x20 >> uint(i)
+		}
+	}
+	b[2] = byte(m.DetectMult)
+	b[3] = byte(len(b))
+	binary.BigEndian.PutUint32(b[4:8], m.MyDiscriminator)
+	binary.BigEndian.PutUint32(b[8:12], m.YourDiscriminator)
+	binary.BigEndian.PutUint32(b[12:16], uint32(m.DesiredMinTx/time.Microsecond))
+	binary.BigEndian.PutUint32(b[16:20], uint32(m.RequiredMinRx/time.Microsecond))
+	binary.BigEndian.PutUint32(b[20:24], uint32(m.RequiredMinEchoRx/time.Microsecond))
+	if m.Auth == nil {
+		return b, nil
+	}
+	a := b[bfdHeaderLen:]
+	a[0], a[1], a[2] = byte(m.Auth.Type), byte(alen), byte(m.Auth.KeyID)
+	if m.Auth.Type == BFDAuthSimplePassword {
+		copy(a[3:], m.Auth.Key)
+		return b, nil
+	}
+	binary.BigEndian.PutUint32(a[4:8], m.Auth.Seq)
+	copy(a[8:], bfdDigest(b, m.Auth.Type, m.Auth.Key))
+	return b, nil
+}
+
+// bfdDigest returns the digest of the control packet b that carries
+// a keyed MD5 or SHA1 authentication section, computed with key.
+func bfdDigest(b []byte, typ BFDAuthType, key []byte) []byte {
+	p := make([]byte, len(b))
+	copy(p, b)
+	d := p[bfdHeaderLen+8:]
+	for i := range d {
+		d[i] = 0
+	}
+	copy(d, key)
+	if typ.digestLen() == md5.Size {
+		sum := md5.Sum(p)
+		return sum[:]
+	}
+	sum := sha1.Sum(p)
+	return sum[:]
+}
+
+// ParseBFDControl parses b as a BFD control packet.
+// It doesn't verify the authentication section.
+func ParseBFDControl(b []byte) (*BFDControl, error) {
+	if len(b) < bfdHeaderLen {
+		return nil, errInvalidBFDControl
+	}
+	if b[0]>>5 != bfdVersion {
+		return nil, errUnknownBFDVersion
+	}
+	l := int(b[3])
+	if l < bfdHeaderLen || l > len(b) {
+		return nil, errInvalidBFDControl
+	}
+	m := BFDControl{
+		Diag:              BFDDiag(b[0] & 0x1f),
+		State:             BFDState(b[1] >> 6),
+		Poll:              b[1]&0x20 != 0,
+		Final:             b[1]&0x10 != 0,
+		CPI:               b[1]&0x08 != 0,
+		Demand:            b[1]&0x02 != 0,
+		Multipoint:        b[1]&0x01 != 0,
+		DetectMult:        int(b[2]),
+		MyDiscriminator:   binary.BigEndian.Uint32(b[4:8]),
+		YourDiscriminator: binary.BigEndian.Uint32(b[8:12]),
+		DesiredMinTx:      time.Duration(binary.BigEndian.Uint32(b[12:16])) * time.Microsecond,
+		RequiredMinRx:     time.Duration(binary.BigEndian.Uint32(b[16:20])) * time.Microsecond,
+		RequiredMinEchoRx: time.Duration(binary.BigEndian.Uint32(b[20:24])) * time.Microsecond,
+	}
+	if b[1]&0x04 == 0 {
+		return &m, nil
+	}
+	a := b[bfdHeaderLen:l]
+	if len(a) < 3 || int(a[1]) != len(a) {
+		return nil, errInvalidBFDAuth
+	}
+	m.Auth = &BFDAuth{Type: BFDAuthType(a[0]), KeyID: int(a[2])}
+	switch m.Auth.Type {
+	case BFDAuthSimplePassword:
+		if len(a) < 4 || len(a) > 19 {
+			return nil, errInvalidBFDAuth
+		}
+		m.Auth.Key = append([]byte(nil), a[3:]...)
+	default:
+		n := m.Auth.Type.digestLen()
+		if n == 0 || len(a) != 8+n {
+			return nil, errInvalidBFDAuth
+		}
+		m.Auth.Seq = binary.BigEndian.Uint32(a[4:8])
+		m.Auth.Key = append([]byte(nil), a[8:]...)
+	}
+	return &m, nil
+}
+
+// A BFDConfig represents the configuration of BFD session.
+// Zero values select the defaults.
+type BFDConfig struct {
+	// Multihop specifies the session is a multihop session,
+	// which accepts control packets with any IPv4 TTL or IPv6 hop
+	// limit and doesn't run the echo function.
+	Multihop bool
+
+	LocalDiscriminator uint32        // default: random
+	DesiredMinTx       time.Duration // default: 1s
+	RequiredMinRx      time.Duration // default: 1s
+	DetectMult         int           // default: 3
+
+	// RequiredMinEchoRx specifies the minimum interval between
+	// received echo packets that the session reflects.
+	// The session doesn't reflect echo packets when it's zero.
+	RequiredMinEchoRx time.Duration
+
+	// EchoInterval specifies the interval between echo packets
+	// transmitted by the session.
+	// The session doesn't transmit echo packets when it's zero.
+	EchoInterval time.Duration
+
+	// EchoPort specifies the UDP port number of echo packets.
+	// The default is BFDEchoPort.
+	EchoPort int
+
+	// Auth specifies the authentication type, key ID and key.
+	// The session doesn't authenticate control packets when it's
+	// nil.
+	// NewBFDSession returns an error when the key ID or key
+	// length is invalid for the type.
+	Auth *BFDAuth
+}
+
+// A BFDEvent represents a state change of BFD session.
+type BFDEvent struct {
+	Error       error     // on-link operation error
+	Time        time.Time // time of state change
+	Peer        net.Addr  // peer address
+	State       BFDState  // new state
+	OldState    BFDState  // previous state
+	Diag        BFDDiag   // local diagnostic code
+	RemoteState BFDState  // remote state
+	RemoteDiag  BFDDiag   // remote diagnostic code
+
+	LocalDiscriminator  uint32
+	RemoteDiscriminator uint32
+
+	TxInterval time.Duration // negotiated transmit interval
+	DetectTime time.Duration // detection time
+}
+
+// A BFDSession represents a BFD session in asynchronous mode.
+type BFDSession struct {
+	cfg BFDConfig
+	c   net.PacketConn // control packet receiver
+	p4  *ipv4.PacketConn
+	p6  *ipv6.PacketConn
+	tx  net.PacketConn // control packet transmitter
+	ec  net.PacketConn // echo packet transmitter and reflector, nil if not used
+
+	startOnce sync.Once
+	closeOnce sync.Once
+	admin     chan bool
+	event     chan BFDEvent
+	done      chan struct{} // closed when s is no longer used
+	stopped   chan struct{} // closed when the session loop returns
+
+	mu    sync.RWMutex
+	state BFDState
+}
+
+// NewBFDSession makes network connections for a BFD session.
+// The network must be "udp", "udp4" or "udp6".
+// The address usually specifies BFDPort or BFDMultihopPort.
+// Control packets are transmitted from a port in the range of 49152
+// through 65535 with the IPv4 TTL or IPv6 hop limit of 255.
+//
+// Examples:
+//
+//	NewBFDSession("udp4", "192.0.2.1:3784", nil)
+//	NewBFDSession("udp6", "[2001:db8::1]:4784", &BFDConfig{Multihop: true})
+func NewBFDSession(network, address string, cfg *BFDConfig) (*BFDSession, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	s := BFDSession{admin: make(chan bool), event: make(chan BFDEvent, 16), done: make(chan struct{}), stopped: make(chan struct{}), state: BFDDown}
+	if cfg != nil {
+		s.cfg = *cfg
+	}
+	if s.cfg.LocalDiscriminator == 0 {
+		s.cfg.LocalDiscriminator = rand.Uint32()>>1 + 1
+	}
+	if s.cfg.DesiredMinTx == 0 {
+		s.cfg.DesiredMinTx = time.Second
+	}
+	if s.cfg.RequiredMinRx == 0 {
+		s.cfg.RequiredMinRx = time.Second
+	}
+	if s.cfg.DetectMult == 0 {
+		s.cfg.DetectMult = 3
+	}
+	if s.cfg.EchoPort == 0 {
+		s.cfg.EchoPort = BFDEchoPort
+	}
+	if s.cfg.DesiredMinTx < 0 || s.cfg.RequiredMinRx < 0 || s.cfg.RequiredMinEchoRx < 0 || s.cfg.EchoInterval < 0 {
+		return nil, errInvalidBFDInterval
+	}
+	if s.cfg.Auth != nil {
+		if _, err := s.cfg.Auth.sectionLen(); err != nil {
+			return nil, err
+		}
+	}
+	if s.cfg.Multihop {
+		s.cfg.RequiredMinEchoRx, s.cfg.EchoInterval = 0, 0
+	}
+
+	var err error
+	s.c, err = net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	la := s.c.LocalAddr().(*net.UDPAddr)
+	if la.IP.To4() != nil {
+		s.p4 = ipv4.NewPacketConn(s.c)
+		err = s.p4.SetControlMessage(ipv4.FlagTTL, true)
+	} else {
+		s.p6 = ipv6.NewPacketConn(s.c)
+		err = s.p6.SetControlMessage(ipv6.FlagHopLimit, true)
+	}
+	if err == nil {
+		s.tx, err = listenBFDSourcePort(network, la.IP)
+	}
+	if err == nil && (s.cfg.RequiredMinEchoRx > 0 || s.cfg.EchoInterval > 0) {
+		s.ec, err = net.ListenPacket(network, net.JoinHostPort(ipString(la.IP), strconv.Itoa(s.cfg.EchoPort)))
+	}
+	if err != nil {
+		s.closeConns()
+		return nil, err
+	}
+	return &s, nil
+}
+
+// listenBFDSourcePort returns a connection bound to a port in the
+// range of 49152 through 65535, with the IPv4 TTL or IPv6 hop limit
+// of 255.
+func listenBFDSourcePort(network string, ip net.IP) (net.PacketConn, error) {
+	var err error
+	for i := 0; i < 64; i++ {
+		var c net.PacketConn
+		c, err = net.ListenPacket(network, net.JoinHostPort(ipString(ip), strconv.Itoa(49152+rand.Intn(16384))))
+		if err != nil {
+			continue
+		}
+		if ip.To4() != nil {
+			ipv4.NewPacketConn(c).SetTTL(255)
+		} else {
+			ipv6.NewPacketConn(c).SetHopLimit(255)
+			if network == "udp" {
+				ipv4.NewPacketConn(c).SetTTL(255)
+			}
+		}
+		return c, nil
+	}
+	return nil, err
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil || ip.IsUnspecified() {
+		return ""
+	}
+	return ip.String()
+}
+
+// Addr returns the local network address of control packet receiver.
+func (s *BFDSession) Addr() net.Addr {
+	return s.c.LocalAddr()
+}
+
+// LocalDiscriminator returns the local discriminator of s.
+func (s *BFDSession) LocalDiscriminator() uint32 {
+	return s.cfg.LocalDiscriminator
+}
+
+// State returns the current state of s.
+func (s *BFDSession) State() BFDState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.state
+}
+
+// Event returns the buffered session state-change event channel.
+// Events are discarded when the channel is full.
+func (s *BFDSession) Event() <-chan BFDEvent {
+	return s.event
+}
+
+// Start starts the session with peer, the network address of control
+// packet receiver of the remote system.
+func (s *BFDSession) Start(peer net.Addr) error {
+	ua, ok := peer.(*net.UDPAddr)
+	if !ok {
+		return &net.AddrError{Err: "invalid peer address", Addr: peer.String()}
+	}
+	err := errBFDSessionStarted
+	s.startOnce.Do(func() {
+		err = nil
+		rx := make(chan bfdPacket)
+		go s.readControl(ua, rx)
+		var echo chan time.Time
+		if s.ec != nil {
+			echo = make(chan time.Time)
+			go s.readEcho(ua, echo)
+		}
+		go s.run(ua, rx, echo)
+	})
+	return err
+}
+
+// SetAdminDown administratively disables or enables s.
+func (s *BFDSession) SetAdminDown(down bool) {
+	select {
+	case s.admin <- down:
+	case <-s.done:
+	}
+}
+
+// Close stops s and closes the network connections of s.
+// It transmits a control packet with the AdminDown state to the peer
+// when s is started.
+func (s *BFDSession) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		started := true
+		s.startOnce.Do(func() { started = false })
+		if started {
+			<-s.stopped
+		}
+		err = s.closeConns()
+	})
+	return err
+}
+
+func (s *BFDSession) closeConns() error {
+	var err error
+	for _, c := range []net.PacketConn{s.c, s.tx, s.ec} {
+		if c == nil {
+			continue
+		}
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+type bfdPacket struct {
+	b   []byte
+	m   *BFDControl
+	err error
+}
+
+// readControl reads control packets from peer and passes them to rx.
+func (s *BFDSession) readControl(peer *net.UDPAddr, rx chan<- bfdPacket) {
+	b := make([]byte, 1<<16)
+	for {
+		var n, hops int
+		var src net.Addr
+		var err error
+		if s.p4 != nil {
+			var cm *ipv4.ControlMessage
+			n, cm, src, err = s.p4.ReadFrom(b)
+			if cm != nil {
+				hops = cm.TTL
+			}
+		} else {
+			var cm *ipv6.ControlMessage
+			n, cm, src, err = s.p6.ReadFrom(b)
+			if cm != nil {
+				hops = cm.HopLimit
+			}
+		}
+		if err != nil {
+			select {
+			case rx <- bfdPacket{err: err}:
+			case <-s.done:
+			}
+			return
+		}
+		if ua, ok := src.(*net.UDPAddr); !ok || !ua.IP.Equal(peer.IP) {
+			continue
+		}
+		// Single-hop control packets must be received with the
+		// IPv4 TTL or IPv6 hop limit of 255.
+		// See RFC 5881.
+		if !s.cfg.Multihop && hops != 255 {
+			continue
+		}
+		m, err := ParseBFDControl(b[:n])
+		if err != nil {
+			continue
+		}
+		p := bfdPacket{b: append([]byte(nil), b[:n]...), m: m}
+		select {
+		case rx <- p:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+const bfdEchoLen = 16
+
+// readEcho reflects echo packets from peer, and passes the
+// transmission time of echo packets returned by peer to echo.
+func (s *BFDSession) readEcho(peer *net.UDPAddr, echo chan<- time.Time) {
+	b := make([]byte, 1<<16)
+	for {
+		n, src, err := s.ec.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		ua, ok := src.(*net.UDPAddr)
+		if !ok || !ua.IP.Equal(peer.IP) || n != bfdEchoLen {
+			continue
+		}
+		if binary.BigEndian.Uint32(b[:4]) == s.cfg.LocalDiscriminator {
+			select {
+			case echo <- parseNTPTime(b[8:16]):
+			case <-s.done:
+				return
+			}
+			continue
+		}
+		if s.cfg.RequiredMinEchoRx > 0 {
+			s.ec.WriteTo(b[:n], src)
+		}
+	}
+}
+
+// bfdVars holds the state variables of BFD session.
+// See RFC 5880.
+type bfdVars struct {
+	state            BFDState
+	remoteState      BFDState
+	remoteDisc       uint32
+	diag             BFDDiag
+	remoteDiag       BFDDiag
+	desiredMinTx     time.Duration
+	remoteDesiredTx  time.Duration
+	remoteMinRx      time.Duration
+	remoteMinEchoRx  time.Duration
+	remoteDetectMult int
+	polling          bool
+	xmitAuthSeq      uint32
+	rcvAuthSeq       uint32
+	authSeqKnown     bool
+}
+
+// run runs the session state machine until s is closed.
+func (s *BFDSession) run(peer *net.UDPAddr, rx <-chan bfdPacket, echo <-chan time.Time) {
+	defer close(s.stopped)
+	v := bfdVars{state: BFDDown, remoteState: BFDDown, remoteMinRx: 1, xmitAuthSeq: rand.Uint32()}
+	v.desiredMinTx = s.slowTx()
+
+	var txArmed time.Duration // transmit interval of txTimer
+	txTimer := time.NewTimer(0)
+	defer txTimer.Stop()
+	detectTimer := time.NewTimer(time.Hour)
+	detectTimer.Stop()
+	defer detectTimer.Stop()
+	echoTimer := time.NewTimer(time.Hour)
+	echoTimer.Stop()
+	defer echoTimer.Stop()
+	var echoDetect <-chan time.Time
+	var echoSeq uint32
+
+	setState := func(st BFDState, diag BFDDiag) {
+		old := v.state
+		v.state, v.diag = st, diag
+		s.mu.Lock()
+		s.state = st
+		s.mu.Unlock()
+		if st == BFDUp {
+			// Switches to the configured transmit interval
+			// with a poll sequence.
+			v.desiredMinTx = s.cfg.DesiredMinTx
+			v.polling = true
+			if s.echoInterval(&v) > 0 {
+				echoTimer.Reset(0)
+			}
+		} else {
+			v.desiredMinTx = s.slowTx()
+			v.polling = false
+			echoTimer.Stop()
+			echoDetect = nil
+		}
+		if st == BFDDown || st == BFDAdminDown {
+			detectTimer.Stop()
+		}
+		s.emit(BFDEvent{Time: time.Now(), Peer: peer, State: st, OldState: old, Diag: diag, RemoteState: v.remoteState, RemoteDiag: v.remoteDiag, LocalDiscriminator: s.cfg.LocalDiscriminator, RemoteDiscriminator: v.remoteDisc, TxInterval: s.txInterval(&v), DetectTime: s.detectTime(&v)})
+	}
+	send := func(final bool) {
+		if v.remoteMinRx == 0 {
+			return
+		}
+		m := BFDControl{
+			Diag:              v.diag,
+			State:             v.state,
+			Poll:              v.polling && !final,
+			Final:             final,
+			DetectMult:        s.cfg.DetectMult,
+			MyDiscriminator:   s.cfg.LocalDiscriminator,
+			YourDiscriminator: v.remoteDisc,
+			DesiredMinTx:      v.desiredMinTx,
+			RequiredMinRx:     s.cfg.RequiredMinRx,
+			RequiredMinEchoRx: s.cfg.RequiredMinEchoRx,
+		}
+		if s.cfg.Auth != nil {
+			v.xmitAuthSeq++
+			m.Auth = &BFDAuth{Type: s.cfg.Auth.Type, KeyID: s.cfg.Auth.KeyID, Seq: v.xmitAuthSeq, Key: s.cfg.Auth.Key}
+		}
+		b, err := m.Marshal()
+		if err == nil {
+			_, err = s.tx.WriteTo(b, peer)
+		}
+		if err != nil {
+			s.emit(BFDEvent{Error: err, Time: time.Now(), Peer: peer, State: v.state, OldState: v.state})
+		}
+	}
+
+	for {
+		select {
+		case <-s.done:
+			if v.state != BFDAdminDown {
+				v.state, v.diag, v.polling = BFDAdminDown, BFDDiagAdminDown, false
+				send(false)
+			}
+			return
+		case down := <-s.admin:
+			if down && v.state != BFDAdminDown {
+				setState(BFDAdminDown, BFDDiagAdminDown)
+				send(false)
+			}
+			if !down && v.state == BFDAdminDown {
+				setState(BFDDown, BFDDiagNone)
+			}
+		case p := <-rx:
+			if p.err != nil {
+				s.emit(BFDEvent{Error: p.err, Time: time.Now(), Peer: peer, State: v.state, OldState: v.state})
+				<-s.done
+				return
+			}
+			if !s.accept(&v, p) {
+				continue
+			}
+			m := p.m
+			v.remoteDisc = m.MyDiscriminator
+			v.remoteState, v.remoteDiag = m.State, m.Diag
+			v.remoteDesiredTx, v.remoteMinRx, v.remoteMinEchoRx = m.DesiredMinTx, m.RequiredMinRx, m.RequiredMinEchoRx
+			v.remoteDetectMult = m.DetectMult
+			if v.remoteMinEchoRx == 0 {
+				echoTimer.Stop()
+				echoDetect = nil
+			}
+			if m.Final {
+				v.polling = false
+			}
+			if v.state != BFDAdminDown {
+				switch {
+				case m.State == BFDAdminDown:
+					if v.state != BFDDown {
+						setState(BFDDown, BFDDiagNeighborDown)
+					}
+				case v.state == BFDDown && m.State == BFDDown:
+					setState(BFDInit, BFDDiagNone)
+				case v.state == BFDDown && m.State == BFDInit:
+					setState(BFDUp, BFDDiagNone)
+				case v.state == BFDInit && (m.State == BFDInit || m.State == BFDUp):
+					setState(BFDUp, BFDDiagNone)
+				case v.state == BFDUp && m.State == BFDDown:
+					setState(BFDDown, BFDDiagNeighborDown)
+				}
+				if v.state == BFDInit || v.state == BFDUp {
+					detectTimer.Reset(s.detectTime(&v))
+				}
+			}
+			if m.Poll {
+				send(true)
+			}
+		case <-detectTimer.C:
+			if v.state == BFDInit || v.state == BFDUp {
+				v.remoteDisc = 0
+				v.authSeqKnown = false
+				setState(BFDDown, BFDDiagTimeExpired)
+			}
+		case <-txTimer.C:
+			if v.state != BFDAdminDown {
+				send(false)
+			}
+			txArmed = s.txInterval(&v)
+			txTimer.Reset(s.jitter(txArmed))
+		case <-echoTimer.C:
+			if d := s.echoInterval(&v); d > 0 && v.state == BFDUp {
+				echoSeq++
+				b := make([]byte, bfdEchoLen)
+				binary.BigEndian.PutUint32(b[:4], s.cfg.LocalDiscriminator)
+				binary.BigEndian.PutUint32(b[4:8], echoSeq)
+				putNTPTime(b[8:16], time.Now())
+				s.ec.WriteTo(b, &net.UDPAddr{IP: peer.IP, Port: s.cfg.EchoPort, Zone: peer.Zone})
+				if echoDetect == nil {
+					echoDetect = time.After(d * time.Duration(s.cfg.DetectMult))
+				}
+				echoTimer.Reset(d)
+			}
+		case <-echo:
+			if d := s.echoInterval(&v); d > 0 && v.state == BFDUp {
+				echoDetect = time.After(d * time.Duration(s.cfg.DetectMult))
+			}
+		case <-echoDetect:
+			echoDetect = nil
+			if v.state == BFDUp {
+				setState(BFDDown, BFDDiagEchoFailed)
+			}
+		}
+		// A shorter transmit interval takes effect immediately
+		// so that the peer doesn't declare the session down
+		// with the detection time derived from it.
+		if d := s.txInterval(&v); d < txArmed {
+			txArmed = d
+			txTimer.Reset(s.jitter(d))
+		}
+	}
+}
+
+// accept reports whether the control packet p passes the reception
+// checks.
+// See RFC 5880, section 6.8.6.
+func (s *BFDSession) accept(v *bfdVars, p bfdPacket) bool {
+	m := p.m
+	if m.DetectMult == 0 || m.Multipoint || m.MyDiscriminator == 0 {
+		return false
+	}
+	if m.YourDiscriminator != 0 && m.YourDiscriminator != s.cfg.LocalDiscriminator {
+		return false
+	}
+	if m.YourDiscriminator == 0 && m.State != BFDDown && m.State != BFDAdminDown {
+		return false
+	}
+	if (m.Auth != nil) != (s.cfg.Auth != nil) {
+		return false
+	}
+	if m.Auth == nil {
+		return true
+	}
+	return verifyBFDAuth(v, p.b, m.Auth, s.cfg.Auth, s.cfg.DetectMult) == nil
+}
+
+// verifyBFDAuth verifies the authentication section a of the control
+// packet b with the configuration conf, and updates the received
+// sequence number in v.
+func verifyBFDAuth(v *bfdVars, b []byte, a, conf *BFDAuth, detectMult int) error {
+	if a.Type != conf.Type || a.KeyID != conf.KeyID {
+		return errBFDAuthFailed
+	}
+	if a.Type == BFDAuthSimplePassword {
+		if subtle.ConstantTimeCompare(a.Key, conf.Key) != 1 {
+			return errBFDAuthFailed
+		}
+		return nil
+	}
+	if v.authSeqKnown {
+		// The sequence number must be in the window of 3 times
+		// the detection multiplier, and must be incremented
+		// for meticulous authentication.
+		d := a.Seq - v.rcvAuthSeq
+		if d > uint32(3*detectMult) || d == 0 && a.Type.meticulous() {
+			return errBFDAuthFailed
+		}
+	}
+	if subtle.ConstantTimeCompare(a.Key, bfdDigest(b[:int(b[3])], a.Type, conf.Key)) != 1 {
+		return errBFDAuthFailed
+	}
+	v.rcvAuthSeq, v.authSeqKnown = a.Seq, true
+	return nil
+}
+
+func (s *BFDSession) emit(ev BFDEvent) {
+	select {
+	case s.event <- ev:
+	default:
+	}
+}
+
+// slowTx returns the desired transmit interval used while the
+// session is not up, which must be at least one second.
+func (s *BFDSession) slowTx() time.Duration {
+	if s.cfg.DesiredMinTx < time.Second {
+		return time.Second
+	}
+	return s.cfg.DesiredMinTx
+}
+
+// txInterval returns the negotiated transmit interval.
+func (s *BFDSession) txInterval(v *bfdVars) time.Duration {
+	if v.remoteMinRx > v.desiredMinTx {
+		return v.remoteMinRx
+	}
+	return v.desiredMinTx
+}
+
+// detectTime returns the detection time in asynchronous mode.
+func (s *BFDSession) detectTime(v *bfdVars) time.Duration {
+	d := v.remoteDesiredTx
+	if s.cfg.RequiredMinRx > d {
+		d = s.cfg.RequiredMinRx
+	}
+	return d * time.Duration(v.remoteDetectMult)
+}
+
+// echoInterval returns the transmit interval of echo packets, or zero
+// when the echo function is not active.
+func (s *BFDSession) echoInterval(v *bfdVars) time.Duration {
+	if s.cfg.EchoInterval == 0 || v.remoteMinEchoRx == 0 {
+		return 0
+	}
+	if v.remoteMinEchoRx > s.cfg.EchoInterval {
+		return v.remoteMinEchoRx
+	}
+	return s.cfg.EchoInterval
+}
+
+// jitter returns d reduced by 0 to 25 percent, or 10 to 25 percent
+// when the detection multiplier is 1.
+// See RFC 5880, section 6.8.7.
+func (s *BFDSession) jitter(d time.Duration) time.Duration {
+	max := 1.0
+	if s.cfg.DetectMult == 1 {
+		max = 0.9
+	}
+	return time.Duration(float64(d) * (0.75 + rand.Float64()*(max-0.75)))
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mikioh/ipoam"
+)
+
+func TestBFDControl(t *testing.T) {
+	for _, auth := range []*ipoam.BFDAuth{
+		nil,
+		{Type: ipoam.BFDAuthSimplePassword, KeyID: 1, Key: []byte("secret")},
+		{Type: ipoam.BFDAuthKeyedMD5, KeyID: 2, Seq: 3, Key: []byte("secret")},
+		{Type: ipoam.BFDAuthMeticulousKeyedSHA1, KeyID: 4, Seq: 5, Key: []byte("secret")},
+	} {
+		m := ipoam.BFDControl{
+			Diag:              ipoam.BFDDiagNeighborDown,
+			State:             ipoam.BFDUp,
+			Poll:              true,
+			DetectMult:        3,
+			MyDiscriminator:   1,
+			YourDiscriminator: 2,
+			DesiredMinTx:      50 * time.Millisecond,
+			RequiredMinRx:     100 * time.Millisecond,
+			Auth:              auth,
+		}
+		b, err := m.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(b[3]) != len(b) {
+			t.Fatalf("got length %d; want %d", b[3], len(b))
+		}
+		got, err := ipoam.ParseBFDControl(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Diag != m.Diag || got.State != m.State || !got.Poll || got.Final || got.DetectMult != m.DetectMult || got.MyDiscriminator != m.MyDiscriminator || got.YourDiscriminator != m.YourDiscriminator || got.DesiredMinTx != m.DesiredMinTx || got.RequiredMinRx != m.RequiredMinRx {
+			t.Errorf("got %+v; want %+v", got, m)
+		}
+		if (got.Auth == nil) != (auth == nil) {
+			t.Fatalf("got %v; want %v", got.Auth, auth)
+		}
+		if auth != nil && (got.Auth.Type != auth.Type || got.Auth.KeyID != auth.KeyID || got.Auth.Seq != auth.Seq) {
+			t.Errorf("got %+v; want %+v", got.Auth, auth)
+		}
+	}
+	if _, err := ipoam.ParseBFDControl(make([]byte, 24)); err == nil {
+		t.Error("got nil; want error")
+	}
+}
+
+func TestBFDSession(t *testing.T) {
+	cfg := ipoam.BFDConfig{
+		DesiredMinTx:  50 * time.Millisecond,
+		RequiredMinRx: 50 * time.Millisecond,
+		Auth:          &ipoam.BFDAuth{Type: ipoam.BFDAuthMeticulousKeyedMD5, KeyID: 1, Key: []byte("secret")},
+	}
+	for _, auth := range []*ipoam.BFDAuth{
+		{Type: ipoam.BFDAuthNone, KeyID: 1, Key: []byte("secret")},
+		{Type: ipoam.BFDAuthSimplePassword, KeyID: 1},
+		{Type: ipoam.BFDAuthSimplePassword, KeyID: 1, Key: make([]byte, 17)},
+		{Type: ipoam.BFDAuthKeyedMD5, KeyID: 256, Key: []byte("secret")},
+		{Type: ipoam.BFDAuthKeyedSHA1, KeyID: 1, Key: make([]byte, 21)},
+		{Type: 6, KeyID: 1, Key: []byte("secret")},
+	} {
+		if s, err := ipoam.NewBFDSession("udp4", "127.0.0.1:0", &ipoam.BFDConfig{Auth: auth}); err == nil {
+			s.Close()
+			t.Errorf("%+v: got nil; want error", auth)
+		}
+	}
+
+	var ss [2]*ipoam.BFDSession
+	for i := range ss {
+		s, err := ipoam.NewBFDSession("udp4", "127.0.0.1:0", &cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		ss[i] = s
+	}
+	for i, s := range ss {
+		if err := s.Start(ss[1-i].Addr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitState := func(s *ipoam.BFDSession, st ipoam.BFDState) ipoam.BFDEvent {
+		tm := time.NewTimer(5 * time.Second)
+		defer tm.Stop()
+		for {
+			select {
+			case ev := <-s.Event():
+				if ev.Error != nil {
+					t.Fatal(ev.Error)
+				}
+				if ev.State == st {
+					return ev
+				}
+			case <-tm.C:
+				t.Fatalf("got %v; want %v", s.State(), st)
+			}
+		}
+	}
+	for _, s := range ss {
+		waitState(s, ipoam.BFDUp)
+	}
+	ss[1].Close()
+	ev := waitState(ss[0], ipoam.BFDDown)
+	if ev.Diag != ipoam.BFDDiagNeighborDown || ev.RemoteState != ipoam.BFDAdminDown {
+		t.Errorf("got %+v; want neighbor signaled session down", ev)
+	}
+}
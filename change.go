@@ -0,0 +1,396 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// A HeaderChange represents a header field of probe packet that is
+// modified by a node along the path, such as a middlebox.
+// It is detected by comparing the original datagram in an ICMP error
+// message with the probe packet.
+//
+// The Field is one of the following:
+//
+//	dscp          DSCP field, int
+//	ecn           ECN field, int
+//	ttl           IPv4 TTL or IPv6 hop limit, int
+//	len           IPv4 total length or IPv6 payload length, int
+//	src           source address, net.IP
+//	dst           destination address, net.IP
+//	ipv4.opts     IPv4 option types, []int
+//	ipv6.exthdrs  IPv6 extension header types, []int
+//	udp.sport     UDP source port, int
+//	udp.dport     UDP destination port, int
+//	udp.len       UDP length, int
+//	udp.csum      UDP checksum, int
+//	icmp.csum     ICMP checksum, int
+//
+// The ttl is reported only when an ICMP time exceeded message quotes
+// a TTL or hop limit greater than one.
+// The IPv4 identification field is not compared because it is
+// assigned by the kernel.
+type HeaderChange struct {
+	Field  string      // header field name
+	Sent   interface{} // value on probe packet
+	Quoted interface{} // value on original datagram
+}
+
+func (hc HeaderChange) String() string {
+	return fmt.Sprintf("%s=%v->%v", hc.Field, hc.Sent, hc.Quoted)
+}
+
+// A sentProbe holds the header fields of a probe packet that are
+// compared with the original datagram in an ICMP error message.
+type sentProbe struct {
+	tc       int    // IPv4 TOS or IPv6 traffic class, -1 if unknown
+	hops     int    // IPv4 TTL or IPv6 hop limit, -1 if unknown
+	totalLen int    // IPv4 total length or IPv6 payload length, 0 if unknown
+	src      net.IP // source address, nil if unknown
+	dst      net.IP // final destination address
+	rthdr    bool   // true if the probe packet carries a routing header
+	opts     []int  // IPv4 option types
+	exts     []int  // IPv6 extension header types
+
+	protocol int    // upper-layer protocol
+	sport    int    // UDP source port
+	dport    int    // UDP destination port
+	ulen     int    // upper-layer length
+	usum     uint32 // sum of upper-layer header and data, excluding checksum
+	csum     bool   // true if the upper-layer checksum can be compared
+}
+
+// A sockState holds the socket options of a probe network
+// connection that are stamped on outgoing probe packets.
+type sockState struct {
+	tc        int // IPv4 TOS or IPv6 traffic class, -1 if unknown
+	hops      int // unicast IPv4 TTL or IPv6 hop limit, -1 if unknown
+	mcastHops int // multicast IPv4 TTL or IPv6 hop limit, -1 if unknown
+}
+
+// sockState returns the socket options for outgoing packets to ip.
+// The options are read from the socket on the first call after
+// resetSockState, and cached until the next resetSockState, so that
+// a batch of probe packets costs a single set of system calls.
+// The caller must hold c.bmu.
+func (c *conn) sockState(ip net.IP) *sockState {
+	i := 0
+	if ip.To4() == nil {
+		i = 1
+	}
+	if c.socks[i] != nil {
+		return c.socks[i]
+	}
+	ss := sockState{tc: -1, hops: -1, mcastHops: -1}
+	var err error
+	switch {
+	case i == 0 && c.p4 != nil:
+		if ss.tc, err = c.p4.TOS(); err != nil {
+			ss.tc = -1
+		}
+		if ss.hops, err = c.p4.TTL(); err != nil {
+			ss.hops = -1
+		}
+		if ss.mcastHops, err = c.p4.MulticastTTL(); err != nil {
+			ss.mcastHops = -1
+		}
+	case i == 1 && c.p6 != nil:
+		if ss.tc, err = c.p6.TrafficClass(); err != nil {
+			ss.tc = -1
+		}
+		if ss.hops, err = c.p6.HopLimit(); err != nil {
+			ss.hops = -1
+		}
+		if ss.mcastHops, err = c.p6.MulticastHopLimit(); err != nil {
+			ss.mcastHops = -1
+		}
+	}
+	c.socks[i] = &ss
+	return &ss
+}
+
+// resetSockState discards the cached socket options.
+// It must be called before building probe packets because the
+// options may be changed through the ipv4.PacketConn or
+// ipv6.PacketConn of the tester at any time.
+func (c *conn) resetSockState() {
+	c.bmu.Lock()
+	c.socks = [2]*sockState{}
+	c.bmu.Unlock()
+}
+
+// newSentProbe returns the header fields of a probe packet that
+// carries b to ip on c.
+// The b must be an ICMP message for ICMP and the UDP payload for
+// UDP.
+func newSentProbe(c *conn, b []byte, ip net.IP, port int, group bool) *sentProbe {
+	sp := sentProbe{dst: ip, protocol: c.protocol}
+	if !c.ip.IsUnspecified() {
+		sp.src = c.ip
+	}
+
+	switch c.protocol {
+	case ianaProtocolUDP:
+		sp.sport, sp.dport = c.sport, port
+		sp.ulen = 8 + len(b)
+		sp.usum = onesSum(0, b)
+		sp.csum = true
+	default:
+		if ip.To4() == nil {
+			sp.protocol = ianaProtocolIPv6ICMP
+		} else {
+			sp.protocol = ianaProtocolICMP
+		}
+		sp.ulen = len(b)
+		if len(b) >= 4 {
+			sp.usum = onesSum(onesSum(0, b[:2]), b[4:])
+		}
+		// The kernel may rewrite the echo identifier on
+		// non-privileged datagram-oriented ICMP endpoints.
+		sp.csum = c.rawSocket
+	}
+
+	c.bmu.Lock()
+	defer c.bmu.Unlock()
+	ss := c.sockState(ip)
+	sp.tc, sp.hops = ss.tc, ss.hops
+	if group {
+		sp.hops = ss.mcastHops
+	}
+	if ip.To4() != nil {
+		sp.opts = ipv4OptionTypes(c.opts)
+		sp.totalLen = ipv4.HeaderLen + (len(c.opts)+3)&^3 + sp.ulen
+		return &sp
+	}
+	sp.totalLen = sp.ulen
+	if st := c.ext; st != nil {
+		if st.hbh != nil {
+			sp.exts = append(sp.exts, IPv6HopByHop)
+			sp.totalLen += len(st.hbh)
+		}
+		if st.rthdr != nil {
+			sp.exts = append(sp.exts, IPv6Routing)
+			sp.totalLen += len(st.rthdr)
+			sp.rthdr = true
+		}
+		if st.dstopts != nil {
+			sp.totalLen += len(st.dstopts)
+		}
+		if st.frag && ipv6.HeaderLen+sp.totalLen > minIPv6MTU {
+			sp.exts = append(sp.exts, IPv6Fragment)
+			sp.totalLen = 0 // the original datagram is a fragment
+		}
+		if st.dstopts != nil {
+			sp.exts = append(sp.exts, IPv6DstOpts)
+		}
+	}
+	return &sp
+}
+
+// compare returns the header fields modified along the path by
+// comparing the original datagram in r with sp.
+func (sp *sentProbe) compare(r *Report) []HeaderChange {
+	var hcs []HeaderChange
+	add := func(field string, sent, quoted interface{}) {
+		hcs = append(hcs, HeaderChange{Field: field, Sent: sent, Quoted: quoted})
+	}
+	var tc, hops, totalLen int
+	var qsrc, qdst net.IP
+	var timeExceeded bool
+	switch h := r.OrigHeader.(type) {
+	case *ipv4.Header:
+		tc, hops, totalLen, qsrc, qdst = h.TOS, h.TTL, h.TotalLen, h.Src, h.Dst
+		timeExceeded = r.ICMP.Type == ipv4.ICMPTypeTimeExceeded && r.ICMP.Code == 0
+		if opts := ipv4OptionTypes(h.Options); !equalInts(opts, sp.opts) {
+			add("ipv4.opts", sp.opts, opts)
+		}
+	case *ipv6.Header:
+		tc, hops, totalLen, qsrc, qdst = h.TrafficClass, h.HopLimit, h.PayloadLen, h.Src, h.Dst
+		timeExceeded = r.ICMP.Type == ipv6.ICMPTypeTimeExceeded && r.ICMP.Code == 0
+		exts, sent := origExtHeaders(h.NextHeader, r.OrigPayload), sp.exts
+		if !timeExceeded { // the destination may quote a reassembled packet
+			exts, sent = removeInt(exts, IPv6Fragment), removeInt(sent, IPv6Fragment)
+		}
+		if !equalInts(exts, sent) {
+			add("ipv6.exthdrs", sp.exts, exts)
+		}
+	default:
+		return nil
+	}
+	if sp.tc >= 0 {
+		if tc>>2 != sp.tc>>2 {
+			add("dscp", sp.tc>>2, tc>>2)
+		}
+		if tc&0x03 != sp.tc&0x03 {
+			add("ecn", sp.tc&0x03, tc&0x03)
+		}
+	}
+	if timeExceeded && hops > 1 {
+		add("ttl", sp.hops, hops)
+	}
+	if sp.totalLen > 0 && totalLen != sp.totalLen {
+		add("len", sp.totalLen, totalLen)
+	}
+	src := sp.src
+	if src == nil {
+		src = r.Dst
+	}
+	if src != nil && !src.Equal(qsrc) {
+		add("src", src, qsrc)
+	}
+	// The destination address is the active segment when the
+	// probe packet carries a routing header.
+	if !sp.rthdr && !sp.dst.Equal(qdst) {
+		add("dst", sp.dst, qdst)
+	}
+
+	protocol, b := parseOrigIP(r.OrigHeader, r.OrigPayload)
+	if protocol != sp.protocol || len(b) < 4 {
+		return hcs
+	}
+	psum, csum := uint32(0), sp.csum
+	if r.Interface != nil && r.Interface.Flags&net.FlagLoopback != 0 {
+		csum = false // checksum offloading leaves checksums incomplete on loopback
+	}
+	if protocol == ianaProtocolUDP || protocol == ianaProtocolIPv6ICMP {
+		if src != nil {
+			psum = pseudoHeaderSum(src, sp.dst, protocol, sp.ulen)
+		} else {
+			csum = false
+		}
+	}
+	switch protocol {
+	case ianaProtocolUDP:
+		if len(b) < 8 {
+			return hcs
+		}
+		sport, dport := parseOrigUDP(b)
+		if sport != sp.sport {
+			add("udp.sport", sp.sport, sport)
+		}
+		if dport != sp.dport {
+			add("udp.dport", sp.dport, dport)
+		}
+		if ulen := int(binary.BigEndian.Uint16(b[4:6])); ulen != sp.ulen {
+			add("udp.len", sp.ulen, ulen)
+		}
+		if !csum {
+			return hcs
+		}
+		var h [6]byte
+		binary.BigEndian.PutUint16(h[0:2], uint16(sp.sport))
+		binary.BigEndian.PutUint16(h[2:4], uint16(sp.dport))
+		binary.BigEndian.PutUint16(h[4:6], uint16(sp.ulen))
+		sum := foldChecksum(onesSum(psum+sp.usum, h[:]))
+		if sum == 0 {
+			sum = 0xffff
+		}
+		if qsum := binary.BigEndian.Uint16(b[6:8]); qsum != 0 && qsum != sum {
+			add("udp.csum", int(sum), int(qsum))
+		}
+	case ianaProtocolICMP, ianaProtocolIPv6ICMP:
+		if !csum {
+			return hcs
+		}
+		sum := foldChecksum(psum + sp.usum)
+		if qsum := binary.BigEndian.Uint16(b[2:4]); qsum != sum {
+			add("icmp.csum", int(sum), int(qsum))
+		}
+	}
+	return hcs
+}
+
+// origExtHeaders returns the IPv6 extension header types in the
+// original datagram.
+func origExtHeaders(nh int, b []byte) []int {
+	var exts []int
+	for {
+		next, rest, ok := nextExtHeader(nh, b)
+		if !ok {
+			if nh == IPv6Fragment { // non-first fragment
+				exts = append(exts, nh)
+			}
+			return exts
+		}
+		exts = append(exts, nh)
+		nh, b = next, rest
+	}
+}
+
+// ipv4OptionTypes returns the option types in b, excluding
+// end-of-options-list and no-operation.
+func ipv4OptionTypes(b []byte) []int {
+	var opts []int
+	for len(b) > 0 {
+		switch b[0] {
+		case ipv4OptEOL:
+			return opts
+		case ipv4OptNOP:
+			b = b[1:]
+			continue
+		}
+		opts = append(opts, int(b[0]))
+		if len(b) < 2 || int(b[1]) < 2 || int(b[1]) > len(b) {
+			return opts
+		}
+		b = b[b[1]:]
+	}
+	return opts
+}
+
+func pseudoHeaderSum(src, dst net.IP, protocol, ulen int) uint32 {
+	var s uint32
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		s = onesSum(onesSum(0, src4), dst4)
+	} else {
+		s = onesSum(onesSum(0, src.To16()), dst.To16())
+	}
+	return s + uint32(protocol) + uint32(ulen)
+}
+
+func onesSum(s uint32, b []byte) uint32 {
+	for ; len(b) > 1; b = b[2:] {
+		s += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		s += uint32(b[0]) << 8
+	}
+	return s
+}
+
+func foldChecksum(s uint32) uint16 {
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
+
+func removeInt(a []int, v int) []int {
+	var b []int
+	for _, x := range a {
+		if x != v {
+			b = append(b, x)
+		}
+	}
+	return b
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestSentProbeCompare(t *testing.T) {
+	src, dst := net.IPv4(192, 0, 2, 1), net.IPv4(198, 51, 100, 1)
+	payload := []byte("hello")
+	sp := &sentProbe{tc: 0, hops: 1, totalLen: ipv4.HeaderLen + 8 + len(payload), src: src, dst: dst, protocol: ianaProtocolUDP, sport: 49152, dport: 33434, ulen: 8 + len(payload), usum: onesSum(0, payload), csum: true}
+
+	udp := func(sport, dport int, src net.IP) []byte {
+		b := make([]byte, 8+len(payload))
+		binary.BigEndian.PutUint16(b[0:2], uint16(sport))
+		binary.BigEndian.PutUint16(b[2:4], uint16(dport))
+		binary.BigEndian.PutUint16(b[4:6], uint16(len(b)))
+		copy(b[8:], payload)
+		binary.BigEndian.PutUint16(b[6:8], foldChecksum(onesSum(pseudoHeaderSum(src, dst, ianaProtocolUDP, len(b)), b)))
+		if s := foldChecksum(onesSum(pseudoHeaderSum(src, dst, ianaProtocolUDP, len(b)), b)); s != 0 {
+			t.Fatalf("invalid checksum: %#x", s)
+		}
+		return b
+	}
+	report := func(tos int, src net.IP, b []byte) *Report {
+		return &Report{
+			ICMP:        &icmp.Message{Type: ipv4.ICMPTypeTimeExceeded},
+			OrigHeader:  &ipv4.Header{Version: ipv4.Version, Len: ipv4.HeaderLen, TOS: tos, TotalLen: ipv4.HeaderLen + len(b), TTL: 1, Protocol: ianaProtocolUDP, Src: src, Dst: dst},
+			OrigPayload: b,
+		}
+	}
+
+	natsrc := net.IPv4(203, 0, 113, 1)
+	sent, nat := udp(49152, 33434, src), udp(1024, 33434, natsrc)
+	csum := func(b []byte) int { return int(binary.BigEndian.Uint16(b[6:8])) }
+
+	for i, tt := range []struct {
+		r   *Report
+		hcs []HeaderChange
+	}{
+		{report(0, src, sent), nil},
+		{report(0x22, src, sent), []HeaderChange{{"dscp", 0, 8}, {"ecn", 0, 2}}},
+		{
+			report(0, natsrc, nat),
+			[]HeaderChange{{"src", src, natsrc}, {"udp.sport", 49152, 1024}, {"udp.csum", csum(sent), csum(nat)}},
+		},
+	} {
+		hcs := sp.compare(tt.r)
+		if len(hcs) != len(tt.hcs) {
+			t.Errorf("#%d: got %v; want %v", i, hcs, tt.hcs)
+			continue
+		}
+		for j := range hcs {
+			if !reflect.DeepEqual(hcs[j], tt.hcs[j]) {
+				t.Errorf("#%d: got %v; want %v", i, hcs[j], tt.hcs[j])
+			}
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mikioh/ipoam"
+)
+
+var arpingUsageTmpl = `Usage:
+	ipoam {{.Name}} [flags] target
+
+target
+	A hostname, DNS reg-name or IPv4 address of neighbor.
+
+`
+
+var (
+	cmdARPing = &Command{
+		Func:      arpingMain,
+		Usage:     cmdUsage,
+		UsageTmpl: arpingUsageTmpl,
+		CanonName: "arping",
+		Descr:     "Verify IPv4 neighbor reachability with ARP",
+	}
+
+	arpDAD         bool
+	arpGratuitous  bool
+	arpNoRevLookup bool
+	arpQuiet       bool
+	arpUnicast     bool
+	arpVerbose     bool
+
+	arpCount int
+	arpWait  int
+
+	arpOutboundIf string
+)
+
+func init() {
+	cmdARPing.Flag.BoolVar(&arpDAD, "dad", false, "Detect address conflict with ARP probes carrying the unspecified sender address")
+	cmdARPing.Flag.BoolVar(&arpGratuitous, "gratuitous", false, "Transmit gratuitous ARP requests carrying the target, one of the interface addresses, as the sender address")
+	cmdARPing.Flag.BoolVar(&arpNoRevLookup, "n", false, "Don't use DNS reverse lookup")
+	cmdARPing.Flag.BoolVar(&arpQuiet, "q", false, "Quiet output except summary")
+	cmdARPing.Flag.BoolVar(&arpUnicast, "unicast", false, "Refresh the neighbor with unicast requests once its link-layer address is known")
+	cmdARPing.Flag.BoolVar(&arpVerbose, "v", false, "Show verbose information")
+
+	cmdARPing.Flag.IntVar(&arpCount, "count", 0, "Iteration count, less than or equal to zero will run until interrupted")
+	cmdARPing.Flag.IntVar(&arpWait, "wait", 1, "Seconds between transmitting each request")
+
+	cmdARPing.Flag.StringVar(&arpOutboundIf, "if", "", "Outbound interface name")
+}
+
+func arpingMain(cmd *Command, args []string) {
+	if len(args) == 0 {
+		cmd.Flag.Usage()
+	}
+	if arpDAD && arpGratuitous {
+		cmd.fatal(fmt.Errorf("dad and gratuitous are mutually exclusive"))
+	}
+	ipa, err := net.ResolveIPAddr("ip4", args[0])
+	if err != nil {
+		cmd.fatal(err)
+	}
+	target := ipa.IP.To4()
+	var ifi *net.Interface
+	if arpOutboundIf != "" {
+		if ifi, err = net.InterfaceByName(arpOutboundIf); err != nil {
+			cmd.fatal(err)
+		}
+	} else if ifi = onlinkInterface(target); ifi == nil {
+		cmd.fatal(fmt.Errorf("no interface on link with %v", target))
+	}
+	if arpGratuitous && !assignedAddr(ifi, target) {
+		cmd.fatal(fmt.Errorf("gratuitous target %v not assigned to %s", target, ifi.Name))
+	}
+	if arpWait <= 0 {
+		arpWait = 1
+	}
+	mode := ipoam.ARPRequest
+	if arpGratuitous {
+		mode = ipoam.ARPGratuitous
+	}
+	if arpDAD {
+		mode = ipoam.ARPProbe
+	}
+
+	t, err := ipoam.NewARPTester(ifi)
+	if err != nil {
+		cmd.fatal(err)
+	}
+	defer t.Close()
+
+	bw := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(bw, "Neighbor reachability verification for %v via %s", target, ifi.Name)
+	if arpVerbose {
+		fmt.Fprintf(bw, " [%v from %v]", mode, ifi.HardwareAddr)
+	}
+	fmt.Fprintf(bw, "\n")
+	bw.Flush()
+
+	st := cvStat{minRTT: math.MaxInt64}
+	var responders []net.HardwareAddr
+	var dups uint64
+	var dst net.HardwareAddr
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	for i := 1; ; i++ {
+		tm := time.NewTimer(time.Duration(arpWait) * time.Second)
+		st.transmitted++
+		if err := t.Probe(target, dst, mode); err != nil {
+			st.opErrors++
+			fmt.Fprintf(bw, "error=%q\n", err)
+			bw.Flush()
+		}
+
+		// Each round expects a single reply; the others come
+		// from duplicate owners of the target.
+		var round []net.HardwareAddr
+	loop:
+		for {
+			select {
+			case <-sig:
+				printARPSummary(bw, target, mode, &st, responders, dups)
+				os.Exit(0)
+			case <-tm.C:
+				break loop
+			case r := <-t.Report():
+				if r.Error != nil {
+					st.opErrors++
+					if !arpQuiet {
+						fmt.Fprintf(bw, "error=%q\n", r.Error)
+						bw.Flush()
+					}
+					continue
+				}
+				// Requests from the target are not responses
+				// to ordinary requests.
+				if mode == ipoam.ARPRequest && !r.Reply {
+					continue
+				}
+				if !containsHardwareAddr(responders, r.LinkAddr) {
+					responders = append(responders, r.LinkAddr)
+				}
+				// Any response to a gratuitous request or
+				// probe indicates that another node owns the
+				// target.
+				dup := mode != ipoam.ARPRequest || len(round) > 0 && !containsHardwareAddr(round, r.LinkAddr)
+				round = append(round, r.LinkAddr)
+				if dup {
+					dups++
+				}
+				if len(round) == 1 {
+					st.onRTT(r.RTT)
+					if arpUnicast {
+						dst = r.LinkAddr
+					}
+				}
+				if !arpQuiet || dup {
+					printARPReport(bw, &r, dup)
+				}
+			}
+		}
+		tm.Stop()
+
+		if arpCount > 0 && i == arpCount {
+			printARPSummary(bw, target, mode, &st, responders, dups)
+			os.Exit(0)
+		}
+	}
+}
+
+// onlinkInterface returns the interface that has an IPv4 address on
+// the same subnet as ip.
+func onlinkInterface(ip net.IP) *net.Interface {
+	ift, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for i := range ift {
+		ifat, err := ift[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, ifa := range ifat {
+			if ipn, ok := ifa.(*net.IPNet); ok && ipn.IP.To4() != nil && ipn.Contains(ip) {
+				return &ift[i]
+			}
+		}
+	}
+	return nil
+}
+
+// assignedAddr reports whether ip is one of the addresses of ifi.
+func assignedAddr(ifi *net.Interface, ip net.IP) bool {
+	ifat, err := ifi.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, ifa := range ifat {
+		if ipn, ok := ifa.(*net.IPNet); ok && ipn.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsHardwareAddr(hws []net.HardwareAddr, hw net.HardwareAddr) bool {
+	for _, h := range hws {
+		if h.String() == hw.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func printARPReport(bw *bufio.Writer, r *ipoam.ARPReport, dup bool) {
+	fmt.Fprintf(bw, "from=%s lladdr=%v", literalOrName(r.Src.String(), arpNoRevLookup), r.LinkAddr)
+	if arpVerbose {
+		op := "request"
+		if r.Reply {
+			op = "reply"
+		}
+		fmt.Fprintf(bw, " op=%s to=%v", op, r.Dst)
+		if r.Gratuitous {
+			fmt.Fprintf(bw, " gratuitous")
+		}
+	}
+	if r.RTT > 0 {
+		fmt.Fprintf(bw, " rtt=%v", r.RTT)
+	}
+	if dup {
+		fmt.Fprintf(bw, " duplicate")
+	}
+	fmt.Fprintf(bw, "\n")
+	bw.Flush()
+}
+
+func printARPSummary(bw *bufio.Writer, target net.IP, mode ipoam.ARPMode, st *cvStat, responders []net.HardwareAddr, dups uint64) {
+	fmt.Fprintf(bw, "\nStatistical information for %v:\n", target)
+	fmt.Fprintf(bw, "neighbor:")
+	if st.transmitted > 0 && mode == ipoam.ARPRequest {
+		fmt.Fprintf(bw, " loss=%.1f%%", float64(st.transmitted-st.received)*100.0/float64(st.transmitted))
+	}
+	fmt.Fprintf(bw, " rcvd=%d sent=%d op.err=%d", st.received, st.transmitted, st.opErrors)
+	printCVRTT(bw, st)
+	fmt.Fprintf(bw, "\n")
+	if len(responders) > 1 || dups > 0 {
+		fmt.Fprintf(bw, "duplicate owners: dup=%d", dups)
+		for _, hw := range responders {
+			fmt.Fprintf(bw, " %v", hw)
+		}
+		fmt.Fprintf(bw, "\n")
+	}
+	bw.Flush()
+}
@@ -0,0 +1,166 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/mikioh/ipoam"
+)
+
+var bfdUsageTmpl = `Usage:
+	ipoam {{.Name}} [flags] peer
+
+peer
+	A hostname, DNS reg-name or IP address of BFD peer.
+
+`
+
+var (
+	cmdBFD = &Command{
+		Func:      bfdMain,
+		Usage:     cmdUsage,
+		UsageTmpl: bfdUsageTmpl,
+		CanonName: "bfd",
+		Descr:     "Run a BFD session",
+	}
+
+	bfdIPv4only    bool
+	bfdIPv6only    bool
+	bfdMultihop    bool
+	bfdNoRevLookup bool
+	bfdVerbose     bool
+
+	bfdDetectMult int
+	bfdEcho       int
+	bfdEchoRx     int
+	bfdKeyID      int
+	bfdPort       int
+	bfdRx         int
+	bfdTx         int
+
+	bfdAuth string
+	bfdKey  string
+	bfdSrc  string
+)
+
+func init() {
+	cmdBFD.Flag.BoolVar(&bfdIPv4only, "4", false, "Run IPv4 session only")
+	cmdBFD.Flag.BoolVar(&bfdIPv6only, "6", false, "Run IPv6 session only")
+	cmdBFD.Flag.BoolVar(&bfdMultihop, "multihop", false, "Run multihop session")
+	cmdBFD.Flag.BoolVar(&bfdNoRevLookup, "n", false, "Don't use DNS reverse lookup")
+	cmdBFD.Flag.BoolVar(&bfdVerbose, "v", false, "Show verbose information")
+
+	cmdBFD.Flag.IntVar(&bfdDetectMult, "mult", 3, "Detection time multiplier")
+	cmdBFD.Flag.IntVar(&bfdEcho, "echo", 0, "Milliseconds between transmitting each echo packet, zero disables echo function")
+	cmdBFD.Flag.IntVar(&bfdEchoRx, "echorx", 0, "Required minimum echo receive interval in milliseconds, zero disables reflecting echo packets")
+	cmdBFD.Flag.IntVar(&bfdKeyID, "keyid", 1, "Authentication key ID")
+	cmdBFD.Flag.IntVar(&bfdPort, "port", 0, "Control packet port, 3784 for single-hop or 4784 for multihop session by default")
+	cmdBFD.Flag.IntVar(&bfdRx, "rx", 1000, "Required minimum receive interval in milliseconds")
+	cmdBFD.Flag.IntVar(&bfdTx, "tx", 1000, "Desired minimum transmit interval in milliseconds")
+
+	cmdBFD.Flag.StringVar(&bfdAuth, "auth", "", "Authentication type, either simple, md5, meticulous-md5, sha1 or meticulous-sha1")
+	cmdBFD.Flag.StringVar(&bfdKey, "key", "", "Authentication password or key")
+	cmdBFD.Flag.StringVar(&bfdSrc, "src", "", "Source IP address")
+}
+
+func bfdMain(cmd *Command, args []string) {
+	if len(args) == 0 {
+		cmd.Flag.Usage()
+	}
+
+	cfg := ipoam.BFDConfig{
+		Multihop:          bfdMultihop,
+		DesiredMinTx:      time.Duration(bfdTx) * time.Millisecond,
+		RequiredMinRx:     time.Duration(bfdRx) * time.Millisecond,
+		DetectMult:        bfdDetectMult,
+		RequiredMinEchoRx: time.Duration(bfdEchoRx) * time.Millisecond,
+		EchoInterval:      time.Duration(bfdEcho) * time.Millisecond,
+	}
+	if bfdAuth != "" {
+		typ, err := ipoam.ParseBFDAuthType(bfdAuth)
+		if err != nil {
+			cmd.fatal(err)
+		}
+		if typ != ipoam.BFDAuthNone {
+			cfg.Auth = &ipoam.BFDAuth{Type: typ, KeyID: bfdKeyID, Key: []byte(bfdKey)}
+		}
+	}
+	if bfdPort == 0 {
+		bfdPort = ipoam.BFDPort
+		if bfdMultihop {
+			bfdPort = ipoam.BFDMultihopPort
+		}
+	}
+
+	network := "udp"
+	if bfdIPv4only {
+		network = "udp4"
+	}
+	if bfdIPv6only {
+		network = "udp6"
+	}
+	peer, err := net.ResolveUDPAddr(network, net.JoinHostPort(args[0], strconv.Itoa(bfdPort)))
+	if err != nil {
+		cmd.fatal(err)
+	}
+	network = "udp4"
+	if peer.IP.To4() == nil {
+		network = "udp6"
+	}
+	s, err := ipoam.NewBFDSession(network, net.JoinHostPort(bfdSrc, strconv.Itoa(bfdPort)), &cfg)
+	if err != nil {
+		cmd.fatal(err)
+	}
+	defer s.Close()
+	if err := s.Start(peer); err != nil {
+		cmd.fatal(err)
+	}
+
+	bw := bufio.NewWriter(os.Stdout)
+	mode := "single-hop"
+	if bfdMultihop {
+		mode = "multihop"
+	}
+	fmt.Fprintf(bw, "BFD %s session with %v on %v: discriminator=%d\n", mode, literalOrName(peer.IP.String(), bfdNoRevLookup), s.Addr(), s.LocalDiscriminator())
+	bw.Flush()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	for {
+		select {
+		case <-sig:
+			s.Close()
+			os.Exit(0)
+		case ev := <-s.Event():
+			printBFDEvent(bw, &ev)
+		}
+	}
+}
+
+func printBFDEvent(bw *bufio.Writer, ev *ipoam.BFDEvent) {
+	fmt.Fprintf(bw, "%s ", ev.Time.Format("15:04:05.000"))
+	if ev.Error != nil {
+		fmt.Fprintf(bw, "error=%q\n", ev.Error)
+		bw.Flush()
+		return
+	}
+	fmt.Fprintf(bw, "state=%v old=%v diag=%d remote.state=%v remote.diag=%d", ev.State, ev.OldState, ev.Diag, ev.RemoteState, ev.RemoteDiag)
+	if bfdVerbose {
+		fmt.Fprintf(bw, " disc=%d remote.disc=%d tx=%v detect=%v", ev.LocalDiscriminator, ev.RemoteDiscriminator, ev.TxInterval, ev.DetectTime)
+	}
+	if ev.Diag != ipoam.BFDDiagNone {
+		fmt.Fprintf(bw, " (%v)", ev.Diag)
+	}
+	fmt.Fprintf(bw, "\n")
+	bw.Flush()
+}
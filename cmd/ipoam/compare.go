@@ -0,0 +1,229 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/mikioh/ipaddr"
+	"github.com/mikioh/ipoam"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// heAttemptDelay is the recommended Connection Attempt Delay of
+// Happy Eyeballs, the time a client waits for an IPv6 connection
+// before it starts an IPv4 connection.
+// See RFC 8305.
+const heAttemptDelay = 250 * time.Millisecond
+
+// Address family indices of a cvComparison, same as the testers in
+// cvMain.
+const (
+	famIPv4 = iota
+	famIPv6
+	famNone // neither family
+)
+
+var famNames = [2]string{"ipv4", "ipv6"}
+
+// A cvComparison represents a dual-stack comparison of an IPv4 and an
+// IPv6 destination probed in lock-step.
+type cvComparison struct {
+	dsts [2]net.IP
+
+	// Per-round state.
+	seq    int
+	sentAt [2]time.Time
+	rtts   [2]time.Duration // zero if not answered
+
+	sent    [2]int
+	rcvd    [2]int
+	samples [2][]time.Duration
+	diffs   []time.Duration // IPv6 RTT minus IPv4 RTT in rounds both answered
+	choices [3]int          // rounds a Happy Eyeballs client would choose IPv4, IPv6 or neither
+}
+
+// newCVComparison returns a dual-stack comparison of the first
+// unicast IPv4 and IPv6 destinations in c.
+func newCVComparison(c *ipaddr.Cursor) (*cvComparison, error) {
+	var cmp cvComparison
+	for pos := c.First(); pos != nil; pos = c.Next() {
+		if pos.IP.IsMulticast() {
+			continue
+		}
+		fam := famIPv6
+		if pos.IP.To4() != nil {
+			fam = famIPv4
+		}
+		if cmp.dsts[fam] == nil {
+			cmp.dsts[fam] = pos.IP
+		}
+	}
+	c.Reset(nil)
+	if cmp.dsts[famIPv4] == nil || cmp.dsts[famIPv6] == nil {
+		return nil, fmt.Errorf("comparison requires both IPv4 and IPv6 unicast destinations")
+	}
+	return &cmp, nil
+}
+
+// begin starts the round seq, and returns the destinations in the
+// order of transmission.
+// The order alternates every round to cancel out the bias caused by
+// transmission order.
+func (cmp *cvComparison) begin(seq int) []net.IP {
+	cmp.seq = seq
+	cmp.rtts = [2]time.Duration{}
+	if seq%2 == 0 {
+		return []net.IP{cmp.dsts[famIPv6], cmp.dsts[famIPv4]}
+	}
+	return []net.IP{cmp.dsts[famIPv4], cmp.dsts[famIPv6]}
+}
+
+// onDeparture records the transmission of a probe to ip.
+func (cmp *cvComparison) onDeparture(ip net.IP) {
+	fam := famOf(ip)
+	cmp.sent[fam]++
+	cmp.sentAt[fam] = time.Now()
+}
+
+// rtt returns the round-trip time of r.
+// It measures from the transmission of the probe to the same address
+// family when cmp is not nil, otherwise from begin.
+func (cmp *cvComparison) rtt(r *ipoam.Report, begin time.Time) time.Duration {
+	if cmp == nil || r.Error != nil || r.Time.IsZero() {
+		return time.Since(begin)
+	}
+	return r.Time.Sub(cmp.sentAt[famOf(r.Src)])
+}
+
+// onArrival records the echo reply in r for the current round.
+func (cmp *cvComparison) onArrival(rtt time.Duration, r *ipoam.Report) {
+	if cmp == nil || r.Error != nil {
+		return
+	}
+	if r.ICMP.Type != ipv4.ICMPTypeEchoReply && r.ICMP.Type != ipv6.ICMPTypeEchoReply {
+		return
+	}
+	echo, ok := r.ICMP.Body.(*icmp.Echo)
+	if !ok || echo.Seq != cmp.seq {
+		return
+	}
+	fam := famOf(r.Src)
+	if !r.Src.Equal(cmp.dsts[fam]) || cmp.rtts[fam] > 0 {
+		return
+	}
+	if rtt <= 0 {
+		rtt = 1
+	}
+	cmp.rtts[fam] = rtt
+	cmp.rcvd[fam]++
+	cmp.samples[fam] = append(cmp.samples[fam], rtt)
+}
+
+// end ends the current round and prints the comparison of the round.
+func (cmp *cvComparison) end(bw *bufio.Writer) {
+	if cmp == nil {
+		return
+	}
+	rtt4, rtt6 := cmp.rtts[famIPv4], cmp.rtts[famIPv6]
+	choice := happyEyeballs(rtt4, rtt6)
+	cmp.choices[choice]++
+	if rtt4 > 0 && rtt6 > 0 {
+		cmp.diffs = append(cmp.diffs, rtt6-rtt4)
+	}
+	if cvQuiet {
+		return
+	}
+	fmt.Fprintf(bw, "compare: seq=%d", cmp.seq)
+	for fam, rtt := range cmp.rtts {
+		if rtt > 0 {
+			fmt.Fprintf(bw, " %s.rtt=%v", famNames[fam], rtt)
+		} else {
+			fmt.Fprintf(bw, " %s.rtt=lost", famNames[fam])
+		}
+	}
+	if rtt4 > 0 && rtt6 > 0 {
+		fmt.Fprintf(bw, " diff=%v", rtt6-rtt4)
+	}
+	fmt.Fprintf(bw, " he=%s\n", heChoiceName(choice))
+	bw.Flush()
+}
+
+// happyEyeballs returns the address family that a Happy Eyeballs
+// client would choose when the handshakes to the IPv4 and IPv6
+// destinations take rtt4 and rtt6.
+// It returns famNone when neither answers.
+func happyEyeballs(rtt4, rtt6 time.Duration) int {
+	switch {
+	case rtt6 > 0 && (rtt4 == 0 || rtt6 <= rtt4+heAttemptDelay):
+		return famIPv6
+	case rtt4 > 0:
+		return famIPv4
+	}
+	return famNone
+}
+
+func heChoiceName(choice int) string {
+	if choice < len(famNames) {
+		return famNames[choice]
+	}
+	return "none"
+}
+
+func famOf(ip net.IP) int {
+	if ip.To4() != nil {
+		return famIPv4
+	}
+	return famIPv6
+}
+
+func printCVComparison(bw *bufio.Writer, cmp *cvComparison) {
+	if cmp == nil {
+		return
+	}
+	fmt.Fprintf(bw, "\nDual-stack comparison for %v and %v:\n", cmp.dsts[famIPv4], cmp.dsts[famIPv6])
+	for fam := range cmp.dsts {
+		fmt.Fprintf(bw, "%s:", famNames[fam])
+		if cmp.sent[fam] > 0 && cmp.rcvd[fam] <= cmp.sent[fam] {
+			fmt.Fprintf(bw, " loss=%.1f%%", float64(cmp.sent[fam]-cmp.rcvd[fam])*100.0/float64(cmp.sent[fam]))
+		}
+		fmt.Fprintf(bw, " rcvd=%d sent=%d", cmp.rcvd[fam], cmp.sent[fam])
+		printDurations(bw, cmp.samples[fam])
+		fmt.Fprintf(bw, "\n")
+	}
+	fmt.Fprintf(bw, "diff: rounds=%d", len(cmp.diffs))
+	printDurations(bw, cmp.diffs)
+	fmt.Fprintf(bw, "\n")
+	rounds := cmp.choices[famIPv4] + cmp.choices[famIPv6] + cmp.choices[famNone]
+	fmt.Fprintf(bw, "happy-eyeballs: ipv4=%d ipv6=%d none=%d", cmp.choices[famIPv4], cmp.choices[famIPv6], cmp.choices[famNone])
+	if rounds > 0 {
+		choice := famIPv6
+		if cmp.choices[famIPv4] > cmp.choices[famIPv6] {
+			choice = famIPv4
+		}
+		if cmp.choices[choice] > 0 {
+			fmt.Fprintf(bw, " preferred=%s (%.1f%%)", famNames[choice], float64(cmp.choices[choice])*100.0/float64(rounds))
+		}
+	}
+	fmt.Fprintf(bw, "\n")
+	bw.Flush()
+}
+
+// printDurations prints the distribution of ds.
+func printDurations(bw *bufio.Writer, ds []time.Duration) {
+	if len(ds) == 0 {
+		return
+	}
+	ds = append([]time.Duration(nil), ds...)
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	pct := func(p float64) time.Duration { return ds[int(p*float64(len(ds)-1)+0.5)] }
+	fmt.Fprintf(bw, " min=%v p50=%v p90=%v max=%v", ds[0], pct(0.5), pct(0.9), ds[len(ds)-1])
+}
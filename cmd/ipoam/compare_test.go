@@ -0,0 +1,139 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mikioh/ipaddr"
+	"github.com/mikioh/ipoam"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestNewCVComparison(t *testing.T) {
+	var ps []ipaddr.Prefix
+	for _, s := range []string{"ff02::1", "192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2"} {
+		ps = append(ps, *newPrefix(net.ParseIP(s)))
+	}
+	cmp, err := newCVComparison(ipaddr.NewCursor(ps))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [2]net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}; !cmp.dsts[famIPv4].Equal(want[famIPv4]) || !cmp.dsts[famIPv6].Equal(want[famIPv6]) {
+		t.Errorf("got %v; want %v", cmp.dsts, want)
+	}
+	if got, want := cmp.begin(1), []net.IP{cmp.dsts[famIPv4], cmp.dsts[famIPv6]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+	if got, want := cmp.begin(2), []net.IP{cmp.dsts[famIPv6], cmp.dsts[famIPv4]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+
+	for _, dsts := range []string{"192.0.2.1,192.0.2.2", "2001:db8::1", "ff02::1,ff02::2"} {
+		c, _, err := parseDsts(dsts, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newCVComparison(c); err == nil {
+			t.Errorf("%s: got nil; want error", dsts)
+		}
+	}
+}
+
+func TestCVComparison(t *testing.T) {
+	quiet := cvQuiet
+	defer func() { cvQuiet = quiet }()
+	cvQuiet = false
+
+	ip4, ip6 := net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+	cmp := &cvComparison{dsts: [2]net.IP{ip4, ip6}}
+	reply := func(src net.IP, seq int) *ipoam.Report {
+		typ := icmp.Type(ipv6.ICMPTypeEchoReply)
+		if src.To4() != nil {
+			typ = ipv4.ICMPTypeEchoReply
+		}
+		return &ipoam.Report{Src: src, ICMP: &icmp.Message{Type: typ, Body: &icmp.Echo{Seq: seq}}}
+	}
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	for _, round := range []struct {
+		seq        int
+		rtt4, rtt6 time.Duration // zero if lost
+	}{
+		{1, 10 * time.Millisecond, 20 * time.Millisecond},
+		{2, 10 * time.Millisecond, 0},
+		{3, 0, 0},
+		{4, time.Millisecond, 300 * time.Millisecond},
+	} {
+		for _, ip := range cmp.begin(round.seq) {
+			cmp.onDeparture(ip)
+		}
+		// Replies not belonging to the round are ignored.
+		cmp.onArrival(time.Second, reply(ip4, round.seq-1))
+		cmp.onArrival(time.Second, reply(net.ParseIP("192.0.2.2"), round.seq))
+		cmp.onArrival(time.Second, &ipoam.Report{Src: ip6, ICMP: &icmp.Message{Type: ipv6.ICMPTypeDestinationUnreachable, Body: &icmp.DstUnreach{}}})
+		cmp.onArrival(time.Second, &ipoam.Report{Error: errors.New("operation error")})
+		if round.rtt4 > 0 {
+			cmp.onArrival(round.rtt4, reply(ip4, round.seq))
+			cmp.onArrival(time.Second, reply(ip4, round.seq)) // duplicate
+		}
+		if round.rtt6 > 0 {
+			cmp.onArrival(round.rtt6, reply(ip6, round.seq))
+		}
+		cmp.end(bw)
+	}
+	printCVComparison(bw, cmp)
+	want := "compare: seq=1 ipv4.rtt=10ms ipv6.rtt=20ms diff=10ms he=ipv6\n" +
+		"compare: seq=2 ipv4.rtt=10ms ipv6.rtt=lost he=ipv4\n" +
+		"compare: seq=3 ipv4.rtt=lost ipv6.rtt=lost he=none\n" +
+		"compare: seq=4 ipv4.rtt=1ms ipv6.rtt=300ms diff=299ms he=ipv4\n" +
+		"\nDual-stack comparison for 192.0.2.1 and 2001:db8::1:\n" +
+		"ipv4: loss=25.0% rcvd=3 sent=4 min=1ms p50=10ms p90=10ms max=10ms\n" +
+		"ipv6: loss=50.0% rcvd=2 sent=4 min=20ms p50=300ms p90=300ms max=300ms\n" +
+		"diff: rounds=2 min=10ms p50=299ms p90=299ms max=299ms\n" +
+		"happy-eyeballs: ipv4=2 ipv6=1 none=1 preferred=ipv4 (50.0%)\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCVComparisonRTT(t *testing.T) {
+	ip4, ip6 := net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+	now := time.Now()
+	cmp := &cvComparison{dsts: [2]net.IP{ip4, ip6}}
+	cmp.sentAt = [2]time.Time{now, now.Add(5 * time.Millisecond)}
+	if rtt := cmp.rtt(&ipoam.Report{Src: ip4, Time: now.Add(20 * time.Millisecond)}, now); rtt != 20*time.Millisecond {
+		t.Errorf("got %v; want 20ms", rtt)
+	}
+	if rtt := cmp.rtt(&ipoam.Report{Src: ip6, Time: now.Add(20 * time.Millisecond)}, now); rtt != 15*time.Millisecond {
+		t.Errorf("got %v; want 15ms", rtt)
+	}
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	for _, tt := range []struct {
+		rtt4, rtt6 time.Duration
+		want       int
+	}{
+		{0, 0, famNone},
+		{10 * time.Millisecond, 0, famIPv4},
+		{0, 10 * time.Millisecond, famIPv6},
+		{10 * time.Millisecond, 5 * time.Millisecond, famIPv6},
+		{10 * time.Millisecond, 10*time.Millisecond + heAttemptDelay, famIPv6},
+		{10 * time.Millisecond, 10*time.Millisecond + heAttemptDelay + 1, famIPv4},
+	} {
+		if got := happyEyeballs(tt.rtt4, tt.rtt6); got != tt.want {
+			t.Errorf("%v, %v: got %s; want %s", tt.rtt4, tt.rtt6, heChoiceName(got), heChoiceName(tt.want))
+		}
+	}
+}
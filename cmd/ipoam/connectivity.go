@@ -9,9 +9,11 @@ import (
 	"bytes"
 	"fmt"
 	"math"
+	"math/bits"
 	"net"
 	"os"
 	"os/signal"
+	"sort"
 	"syscall"
 	"time"
 
@@ -42,44 +44,68 @@ var (
 		Descr:     "Verify IP-layer connectivity",
 	}
 
-	cvPayload []byte
-	cvData    = []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	cvPayload  []byte
+	cvData     = []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	cvAppProto ipoam.AppProtocol
+	cvFrags    []ipoam.FragmentRange
 
+	cvCompare     bool
 	cvIPv4only    bool
 	cvIPv6only    bool
 	cvNoRevLookup bool
+	cvPace        bool
 	cvQuiet       bool
+	cvRecordRoute bool
 	cvXmitOnly    bool
 	cvVerbose     bool
 
 	cvCount         int
+	cvFragFirst     int
+	cvFragOverlap   int
+	cvFragSize      int
 	cvHops          int
 	cvMulticastHops int
 	cvTC            int
 	cvPayloadLen    int
 	cvWait          int // allow to run "hidden flooding mode" when cvWait is a negative integer
 
+	cvApp        string
+	cvExtHeaders string
 	cvOutboundIf string
+	cvNAT64      string
 	cvSrc        string
+	cvSegments   string
+	cvTimestamp  string
 )
 
 func init() {
 	cmdCV.Flag.BoolVar(&cvIPv4only, "4", false, "Run IPv4 test only")
 	cmdCV.Flag.BoolVar(&cvIPv6only, "6", false, "Run IPv6 test only")
+	cmdCV.Flag.BoolVar(&cvCompare, "compare", false, "Compare IPv4 and IPv6 connectivity to a dual-stack destination in lock-step")
 	cmdCV.Flag.BoolVar(&cvNoRevLookup, "n", false, "Don't use DNS reverse lookup")
+	cmdCV.Flag.BoolVar(&cvPace, "pace", false, "Estimate ICMP rate limit of each destination and pace echoes below the limit")
 	cmdCV.Flag.BoolVar(&cvQuiet, "q", false, "Quiet output except summary")
+	cmdCV.Flag.BoolVar(&cvRecordRoute, "rr", false, "Use IPv4 record route option")
 	cmdCV.Flag.BoolVar(&cvXmitOnly, "x", false, "Run transmission only")
 	cmdCV.Flag.BoolVar(&cvVerbose, "v", false, "Show verbose information")
 
 	cmdCV.Flag.IntVar(&cvCount, "count", 0, "Iteration count, less than or equal to zero will run until interrupted")
+	cmdCV.Flag.IntVar(&cvFragFirst, "fragfirst", 0, "Length of first fragment when using -fragsize, e.g., 8 for tiny first fragment")
+	cmdCV.Flag.IntVar(&cvFragOverlap, "fragoverlap", 0, "Length of overlap between adjacent fragments when using -fragsize")
+	cmdCV.Flag.IntVar(&cvFragSize, "fragsize", 0, "Split ICMP echo requests into fragments of the given length, multiple of 8")
 	cmdCV.Flag.IntVar(&cvHops, "hops", 64, "IPv4 TTL or IPv6 hop-limit on outgoing unicast packets")
 	cmdCV.Flag.IntVar(&cvMulticastHops, "mchops", 5, "IPv4 TTL or IPv6 hop-limit on outgoing multicast packets")
 	cmdCV.Flag.IntVar(&cvTC, "tc", 0, "IPv4 TOS or IPv6 traffic-class on outgoing packets")
 	cmdCV.Flag.IntVar(&cvPayloadLen, "pldlen", 56, "ICMP echo payload length")
 	cmdCV.Flag.IntVar(&cvWait, "wait", 1, "Seconds between transmitting each echo")
 
+	cmdCV.Flag.StringVar(&cvApp, "app", "", "Use UDP packets with application payload to the well-known port instead of ICMP echo, either dns, ntp or snmp")
+	cmdCV.Flag.StringVar(&cvExtHeaders, "eh", "", "IPv6 extension headers on outgoing packets, comma-separated list of hbh, dst, rt and frag; frag enlarges packets to be fragmented at 1280 bytes")
 	cmdCV.Flag.StringVar(&cvOutboundIf, "if", "", "Outbound interface name")
+	cmdCV.Flag.StringVar(&cvNAT64, "nat64", "", "Probe IPv4 destinations over IPv6 through NAT64, either a NAT64 prefix or auto to discover it")
 	cmdCV.Flag.StringVar(&cvSrc, "src", "", "Source IP address")
+	cmdCV.Flag.StringVar(&cvSegments, "srh", "", "Use IPv6 segment routing header, comma-separated list of segments toward the destination")
+	cmdCV.Flag.StringVar(&cvTimestamp, "ts", "", "Use IPv4 timestamp option, either tsonly, tsandaddr or tsprespec=addr[,addr...]")
 }
 
 func cvMain(cmd *Command, args []string) {
@@ -93,9 +119,41 @@ func cvMain(cmd *Command, args []string) {
 	if err != nil {
 		cmd.fatal(err)
 	}
+	prefixes, err := parseNAT64Prefixes(cvNAT64)
+	if err != nil {
+		cmd.fatal(err)
+	}
+	if cvNAT64 != "" {
+		if c, err = synthesizeDsts(c, prefixes[0]); err != nil {
+			cmd.fatal(err)
+		}
+		cvIPv6only = true
+	}
 
 	cvPayload = bytes.Repeat(cvData, int(cvPayloadLen)/len(cvData)+1)
 	cvPayload = cvPayload[:cvPayloadLen]
+	if cvApp != "" {
+		if cvAppProto, err = ipoam.ParseAppProtocol(cvApp); err != nil {
+			cmd.fatal(err)
+		}
+		if cvCompare || cvPace {
+			cmd.fatal(fmt.Errorf("application payload doesn't support comparison and pacing"))
+		}
+	}
+	if cvFragSize > 0 {
+		if cvAppProto != 0 || cvCompare || cvPace {
+			cmd.fatal(fmt.Errorf("fragmented probe doesn't support application payload, comparison and pacing"))
+		}
+		if cvRecordRoute || cvTimestamp != "" || cvExtHeaders != "" || cvSegments != "" {
+			cmd.fatal(fmt.Errorf("fragmented probe doesn't support IPv4 options and IPv6 extension headers"))
+		}
+		if cvPayloadLen == 0 {
+			cmd.fatal(fmt.Errorf("fragmented probe requires payload"))
+		}
+		if cvFrags, err = ipoam.SplitFragments(8+len(cvPayload), cvFragSize, cvFragFirst, cvFragOverlap); err != nil {
+			cmd.fatal(err)
+		}
+	}
 	if cvWait == 0 {
 		cvWait = 1
 	}
@@ -116,9 +174,35 @@ func cvMain(cmd *Command, args []string) {
 		}
 	}
 
+	var cmp *cvComparison
+	if cvCompare {
+		if cvIPv4only || cvIPv6only {
+			cmd.fatal(fmt.Errorf("comparison requires both IPv4 and IPv6"))
+		}
+		if cmp, err = newCVComparison(c); err != nil {
+			cmd.fatal(err)
+		}
+		c = ipaddr.NewCursor([]ipaddr.Prefix{*newPrefix(cmp.dsts[famIPv4]), *newPrefix(cmp.dsts[famIPv6])})
+	}
+
+	opts, err := parseIPv4Options(cvRecordRoute, cvTimestamp)
+	if err != nil {
+		cmd.fatal(err)
+	}
+	ehs, err := parseIPv6ExtHeaders(cvExtHeaders)
+	if err != nil {
+		cmd.fatal(err)
+	}
+	cvPayload = fragPayload(cvPayload, cvData, ehs)
+	segs, err := parseSegments(cvSegments)
+	if err != nil {
+		cmd.fatal(err)
+	}
+
 	var ipts = [2]struct {
-		t *ipoam.Tester
-		r <-chan ipoam.Report
+		t   *ipoam.Tester
+		r   <-chan ipoam.Report
+		app <-chan appReply
 	}{}
 	for _, pos := range c.List() {
 		if !cvIPv6only && pos.IP.To4() != nil && ipts[0].t == nil {
@@ -126,11 +210,18 @@ func cvMain(cmd *Command, args []string) {
 			if src != nil {
 				address = src.String()
 			}
-			ipts[0].t, err = ipoam.NewTester("ip4:icmp", address)
+			network := "ip4:icmp"
+			if cvAppProto != 0 {
+				network, address = "udp4", net.JoinHostPort(address, "0")
+			}
+			ipts[0].t, err = ipoam.NewTester(network, address)
 			if err != nil {
 				cmd.fatal(err)
 			}
 			defer ipts[0].t.Close()
+			if cvAppProto != 0 {
+				ipts[0].app = readAppReplies(ipts[0].t, cvAppProto)
+			}
 			ipts[0].r = ipts[0].t.Report()
 			if cvXmitOnly {
 				ipts[0].t.StopReport()
@@ -152,11 +243,21 @@ func cvMain(cmd *Command, args []string) {
 			if src != nil {
 				address = src.String()
 			}
-			ipts[1].t, err = ipoam.NewTester("ip6:ipv6-icmp", address)
+			network := "ip6:ipv6-icmp"
+			if cvAppProto != 0 {
+				network, address = "udp6", net.JoinHostPort(address, "0")
+			}
+			ipts[1].t, err = ipoam.NewTester(network, address)
 			if err != nil {
 				cmd.fatal(err)
 			}
 			defer ipts[1].t.Close()
+			if cvAppProto != 0 {
+				ipts[1].app = readAppReplies(ipts[1].t, cvAppProto)
+			}
+			if err := ipts[1].t.SetNAT64Prefixes(prefixes...); err != nil {
+				cmd.fatal(err)
+			}
 			ipts[1].r = ipts[1].t.Report()
 			if cvXmitOnly {
 				ipts[1].t.StopReport()
@@ -178,35 +279,102 @@ func cvMain(cmd *Command, args []string) {
 		}
 	}
 
-	printCVBanner(bw, args[0], c)
+	printCVBanner(bw, args[0], c, prefixes)
 
 	stats := make(cvStats)
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 	var onlink ipoam.Report
-	cm := ipoam.ControlMessage{ID: os.Getpid() & 0xffff}
+	cm := ipoam.ControlMessage{ID: os.Getpid() & 0xffff, Port: cvAppProto.Port(), IPv4Options: opts, IPv6ExtHeaders: ehs}
+	pacers := make(map[string]*pacer)
+	if cvPace && !cvXmitOnly {
+		for pos := c.First(); pos != nil; pos = c.Next() {
+			var ipt *ipoam.Tester
+			if !cvIPv6only && pos.IP.To4() != nil {
+				ipt = ipts[0].t
+			}
+			if !cvIPv4only && pos.IP.To16() != nil && pos.IP.To4() == nil {
+				ipt = ipts[1].t
+				if cm.IPv6ExtHeaders, err = appendSRH(ehs, segs, pos.IP); err != nil {
+					cmd.fatal(err)
+				}
+			}
+			if ipt == nil || pos.IP.IsMulticast() {
+				continue
+			}
+			rl := measureRateLimit(ipt, &cm, cvPayload, pos.IP, ifi, time.Second, nil, sig)
+			pacers[pos.IP.String()] = newPacer(rl)
+			fmt.Fprintf(bw, "%s: ", literalOrName(pos.IP.String(), cvNoRevLookup))
+			printRateLimit(bw, rl)
+			fmt.Fprintf(bw, "\n")
+			bw.Flush()
+		}
+		c.Reset(nil)
+	}
 	for i := 1; ; i++ {
 		t := time.NewTimer(time.Duration(cvWait) * time.Second)
 		begin := time.Now()
 		cm.Seq = i
-		for pos := c.First(); pos != nil; pos = c.Next() {
-			if !cvIPv6only && pos.IP.To4() != nil {
-				onlink.Error = ipts[0].t.Probe(cvPayload, &cm, pos.IP, ifi)
-				stats.get(pos.IP.String()).onDeparture(&onlink)
+		b := cvPayload
+		if cvAppProto != 0 {
+			var err error
+			if b, err = ipoam.MarshalAppProbe(cvAppProto, i); err != nil {
+				cmd.fatal(err)
+			}
+		}
+		var ra *cvReassembly
+		if cvFrags != nil {
+			ra = newCVReassembly(cm.ID, i)
+		}
+		probe := func(ip net.IP) {
+			pacers[ip.String()].wait()
+			if cmp != nil {
+				cmp.onDeparture(ip)
+			}
+			if ra != nil {
+				ra.dsts = append(ra.dsts, ip.String())
+			}
+			if !cvIPv6only && ip.To4() != nil {
+				if cvFrags != nil {
+					onlink.Error = ipts[0].t.ProbeFragments(b, &cm, ip, ifi, cvFrags)
+				} else {
+					onlink.Error = ipts[0].t.Probe(b, &cm, ip, ifi)
+				}
+				stats.get(ip.String()).onDeparture(&onlink)
+				if onlink.Error == nil && cvFrags != nil {
+					onlink.Error = ipts[0].t.Probe(nil, &cm, ip, ifi)
+				}
 				if onlink.Error != nil {
 					printCVReport(bw, 0, &onlink)
-					continue
+					return
 				}
 			}
-			if !cvIPv4only && pos.IP.To16() != nil && pos.IP.To4() == nil {
-				onlink.Error = ipts[1].t.Probe(cvPayload, &cm, pos.IP, ifi)
-				stats.get(pos.IP.String()).onDeparture(&onlink)
+			if !cvIPv4only && ip.To16() != nil && ip.To4() == nil {
+				cm.IPv6ExtHeaders, onlink.Error = appendSRH(ehs, segs, ip)
+				if onlink.Error == nil && cvFrags != nil {
+					onlink.Error = ipts[1].t.ProbeFragments(b, &cm, ip, ifi, cvFrags)
+				} else if onlink.Error == nil {
+					onlink.Error = ipts[1].t.Probe(b, &cm, ip, ifi)
+				}
+				stats.get(ip.String()).onDeparture(&onlink)
+				if onlink.Error == nil && cvFrags != nil {
+					onlink.Error = ipts[1].t.Probe(nil, &cm, ip, ifi)
+				}
 				if onlink.Error != nil {
 					printCVReport(bw, 0, &onlink)
-					continue
+					return
 				}
 			}
 		}
+		if cmp != nil {
+			for _, ip := range cmp.begin(i) {
+				probe(ip)
+			}
+		} else {
+			for pos := c.First(); pos != nil; pos = c.Next() {
+				probe(pos.IP)
+			}
+		}
 		c.Reset(nil)
 
 	loop:
@@ -216,25 +384,41 @@ func cvMain(cmd *Command, args []string) {
 				if cvVerbose {
 					printCVSummary(bw, args[0], stats)
 				}
+				printCVComparison(bw, cmp)
 				os.Exit(0)
 			case <-t.C:
 				break loop
 			case r := <-ipts[0].r:
-				rtt := time.Since(begin)
+				if ra.onArrival(bw, &r) {
+					continue
+				}
+				rtt := cmp.rtt(&r, begin)
 				printCVReport(bw, rtt, &r)
 				stats.get(r.Src.String()).onArrival(rtt, &r)
+				cmp.onArrival(rtt, &r)
 			case r := <-ipts[1].r:
-				rtt := time.Since(begin)
+				if ra.onArrival(bw, &r) {
+					continue
+				}
+				rtt := cmp.rtt(&r, begin)
 				printCVReport(bw, rtt, &r)
 				stats.get(r.Src.String()).onArrival(rtt, &r)
+				cmp.onArrival(rtt, &r)
+			case r := <-ipts[0].app:
+				onCVAppReply(bw, stats, i, begin, &r)
+			case r := <-ipts[1].app:
+				onCVAppReply(bw, stats, i, begin, &r)
 			}
 		}
 		t.Stop()
+		cmp.end(bw)
+		ra.end(bw, stats)
 
 		if cvCount > 0 && i == cvCount {
 			if cvVerbose {
 				printCVSummary(bw, args[0], stats)
 			}
+			printCVComparison(bw, cmp)
 			os.Exit(0)
 		}
 	}
@@ -251,7 +435,21 @@ func (stats cvStats) get(s string) *cvStat {
 	return st
 }
 
+// responders returns the sorted responders to the group destination.
+func (stats cvStats) responders(group string) []string {
+	var resps []string
+	for ip, st := range stats {
+		if st.group == group {
+			resps = append(resps, ip)
+		}
+	}
+	sort.Strings(resps)
+	return resps
+}
+
 type cvStat struct {
+	group string // group destination when the stat is for a responder
+
 	received    uint64
 	transmitted uint64
 	opErrors    uint64
@@ -272,6 +470,15 @@ func (st *cvStat) onArrival(rtt time.Duration, r *ipoam.Report) {
 		st.icmpErrors++
 		return
 	}
+	if r.Group != nil {
+		st.group = r.Group.String()
+	}
+	st.onRTT(rtt)
+}
+
+// onRTT records the round-trip time, or one-way delay, of a received
+// packet.
+func (st *cvStat) onRTT(rtt time.Duration) {
 	st.received++
 	if rtt < st.minRTT {
 		st.minRTT = rtt
@@ -290,7 +497,7 @@ func (st *cvStat) onDeparture(r *ipoam.Report) {
 	}
 }
 
-func printCVBanner(bw *bufio.Writer, dsts string, c *ipaddr.Cursor) {
+func printCVBanner(bw *bufio.Writer, dsts string, c *ipaddr.Cursor, prefixes []*net.IPNet) {
 	fmt.Fprintf(bw, "Connectivity verification for %s", dsts)
 	if cvVerbose {
 		fmt.Fprintf(bw, " [")
@@ -309,7 +516,37 @@ func printCVBanner(bw *bufio.Writer, dsts string, c *ipaddr.Cursor) {
 		fmt.Fprintf(bw, "]")
 		c.Reset(nil)
 	}
-	fmt.Fprintf(bw, ": %d bytes payload\n", len(cvPayload))
+	if cvAppProto != 0 {
+		fmt.Fprintf(bw, ": %v payload to port %d\n", cvAppProto, cvAppProto.Port())
+	} else if cvFrags != nil {
+		fmt.Fprintf(bw, ": %d bytes payload in %d fragments\n", len(cvPayload), len(cvFrags))
+	} else {
+		fmt.Fprintf(bw, ": %d bytes payload\n", len(cvPayload))
+	}
+	if !cvIPv4only {
+		for pos := c.First(); pos != nil; pos = c.Next() {
+			printNAT64Dst(bw, pos.IP, prefixes)
+		}
+		c.Reset(nil)
+	}
+	bw.Flush()
+}
+
+// onCVAppReply handles the application-level reply r to the probe
+// packet of iteration i.
+// Late replies to the previous iterations are ignored.
+func onCVAppReply(bw *bufio.Writer, stats cvStats, i int, begin time.Time, r *appReply) {
+	if r.ID != i&0xffff {
+		return
+	}
+	rtt := r.time.Sub(begin)
+	stats.get(r.src.String()).onRTT(rtt)
+	if cvQuiet {
+		return
+	}
+	fmt.Fprintf(bw, "from=%s", literalOrName(r.src.String(), cvNoRevLookup))
+	printAppReply(bw, r.AppReply)
+	fmt.Fprintf(bw, " app.id=%d rtt=%v\n", r.ID, rtt)
 	bw.Flush()
 }
 
@@ -323,46 +560,198 @@ func printCVReport(bw *bufio.Writer, rtt time.Duration, r *ipoam.Report) {
 		return
 	}
 	if r.ICMP.Type != ipv4.ICMPTypeEchoReply && r.ICMP.Type != ipv6.ICMPTypeEchoReply {
-		fmt.Fprintf(bw, "from=%s icmp.type=%q icmp.code=%d rtt=%v\n", literalOrName(r.Src.String(), cvNoRevLookup), r.ICMP.Type, r.ICMP.Code, rtt)
+		fmt.Fprintf(bw, "from=%s", literalOrName(r.Src.String(), cvNoRevLookup))
+		printNAT64Src(bw, r)
+		fmt.Fprintf(bw, " icmp.type=%q icmp.code=%d", r.ICMP.Type, r.ICMP.Code)
+		if f := r.OrigFragment; f != nil {
+			fmt.Fprintf(bw, " frag.id=%#x frag.off=%d frag.more=%v", f.ID, f.Offset, f.More)
+		}
+		fmt.Fprintf(bw, " rtt=%v\n", rtt)
 		bw.Flush()
 		return
 	}
 	echo, _ := r.ICMP.Body.(*icmp.Echo)
 	fmt.Fprintf(bw, "%d bytes", len(echo.Data))
 	if !cvVerbose {
-		fmt.Fprintf(bw, " from=%s echo.seq=%d rtt=%v\n", literalOrName(r.Src.String(), cvNoRevLookup), echo.Seq, rtt)
+		fmt.Fprintf(bw, " from=%s", literalOrName(r.Src.String(), cvNoRevLookup))
+		printNAT64Src(bw, r)
+		if r.Group != nil {
+			fmt.Fprintf(bw, " group=%v", r.Group)
+		}
+		fmt.Fprintf(bw, " echo.seq=%d rtt=%v\n", echo.Seq, rtt)
 		bw.Flush()
 		return
 	}
-	if r.Dst == nil {
-		fmt.Fprintf(bw, " from=%s", literalOrName(r.Src.String(), cvNoRevLookup))
-	} else {
-		fmt.Fprintf(bw, " tc=%#x hops=%d from=%s to=%s", r.TC, r.Hops, literalOrName(r.Src.String(), cvNoRevLookup), literalOrName(r.Dst.String(), cvNoRevLookup))
+	if r.Dst != nil {
+		fmt.Fprintf(bw, " tc=%#x hops=%d rev=%d", r.TC, r.Hops, r.ReverseHops())
+	}
+	fmt.Fprintf(bw, " from=%s", literalOrName(r.Src.String(), cvNoRevLookup))
+	printNAT64Src(bw, r)
+	if r.Dst != nil {
+		fmt.Fprintf(bw, " to=%s", literalOrName(r.Dst.String(), cvNoRevLookup))
+	}
+	if r.Group != nil {
+		fmt.Fprintf(bw, " group=%v", r.Group)
 	}
 	if r.Interface != nil {
 		fmt.Fprintf(bw, " if=%s", r.Interface.Name)
 	}
-	fmt.Fprintf(bw, " echo.id=%d echo.seq=%d rtt=%v\n", echo.ID, echo.Seq, rtt)
+	fmt.Fprintf(bw, " echo.id=%d echo.seq=%d rtt=%v", echo.ID, echo.Seq, rtt)
+	printIPv4Options(bw, r)
+	fmt.Fprintf(bw, "\n")
+	bw.Flush()
+}
+
+// A cvReassembly represents the state of the fragmented echo
+// request and the unfragmented control echo request of an iteration.
+// Both share the echo identifier and sequence number, and the control
+// echo request carries no payload.
+type cvReassembly struct {
+	id, seq  int
+	dsts     []string        // probed destinations
+	replied  map[string]bool // destinations replied to the fragmented probe
+	control  map[string]bool // destinations replied to the control probe
+	timedOut map[string]bool // destinations failed to reassemble
+}
+
+func newCVReassembly(id, seq int) *cvReassembly {
+	return &cvReassembly{
+		id:       id & 0xffff,
+		seq:      seq & 0xffff,
+		replied:  make(map[string]bool),
+		control:  make(map[string]bool),
+		timedOut: make(map[string]bool),
+	}
+}
+
+// onArrival records r and reports whether r is a reply to the control
+// probe, which must not be shown or counted as a reply.
+// It prints the destination of an ICMP fragment reassembly time
+// exceeded message with reassembled=false, the message may belong to
+// an earlier iteration.
+func (ra *cvReassembly) onArrival(bw *bufio.Writer, r *ipoam.Report) bool {
+	if ra == nil || r.Error != nil {
+		return false
+	}
+	switch r.ICMP.Type {
+	case ipv4.ICMPTypeEchoReply, ipv6.ICMPTypeEchoReply:
+		echo, _ := r.ICMP.Body.(*icmp.Echo)
+		if echo == nil {
+			return false
+		}
+		if len(echo.Data) == 0 {
+			if echo.Seq == ra.seq {
+				ra.control[r.Src.String()] = true
+			}
+			return true
+		}
+		if echo.Seq == ra.seq {
+			ra.replied[r.Src.String()] = true
+		}
+	case ipv4.ICMPTypeTimeExceeded, ipv6.ICMPTypeTimeExceeded:
+		f := r.OrigFragment
+		if r.ICMP.Code != 1 || f == nil {
+			return false
+		}
+		var dst net.IP
+		var seq int
+		switch h := r.OrigHeader.(type) {
+		case *ipv4.Header:
+			swapped := int(bits.ReverseBytes16(uint16(ra.id)))
+			dst, seq = h.Dst, f.ID^swapped
+			// The identification 0xffff also stands for zero.
+			if f.ID == 0xffff && ra.seq == swapped {
+				seq = ra.seq
+			}
+		case *ipv6.Header:
+			if f.ID>>16 != ra.id {
+				return false
+			}
+			dst, seq = h.Dst, f.ID&0xffff
+		default:
+			return false
+		}
+		if seq == ra.seq {
+			ra.timedOut[dst.String()] = true
+		}
+		if !cvQuiet && !cvXmitOnly {
+			fmt.Fprintf(bw, "to=%s echo.seq=%d reassembled=false\n", literalOrName(dst.String(), cvNoRevLookup), seq)
+			bw.Flush()
+		}
+	}
+	return false
+}
+
+// end prints the unicast destinations that didn't reply to the
+// fragmented probe of the iteration.
+// A destination that replied to the control probe is shown with
+// reassembled=false, and a destination that replied to neither is
+// shown with no reply, because the probes or the replies may be lost.
+func (ra *cvReassembly) end(bw *bufio.Writer, stats cvStats) {
+	if ra == nil || cvQuiet || cvXmitOnly {
+		return
+	}
+	groups := make(map[string]bool)
+	for _, st := range stats {
+		if st.group != "" {
+			groups[st.group] = true
+		}
+	}
+	sort.Strings(ra.dsts)
+	for _, ip := range ra.dsts {
+		if net.ParseIP(ip).IsMulticast() || groups[ip] || ra.replied[ip] || ra.timedOut[ip] {
+			continue
+		}
+		fmt.Fprintf(bw, "to=%s echo.seq=%d", literalOrName(ip, cvNoRevLookup), ra.seq)
+		if ra.control[ip] {
+			fmt.Fprintf(bw, " reassembled=false\n")
+		} else {
+			fmt.Fprintf(bw, " no reply\n")
+		}
+	}
 	bw.Flush()
 }
 
 func printCVSummary(bw *bufio.Writer, dsts string, stats cvStats) {
 	fmt.Fprintf(bw, "\nStatistical information for %s:\n", dsts)
 	for ip, st := range stats {
-		var avg time.Duration
-		var stddev float64
-		if st.received > 0 {
-			avg = st.rttSum / time.Duration(st.received)
-			stddev = math.Sqrt(float64(st.rttSq)/float64(st.received) - float64(avg)*float64(avg))
-		} else {
-			st.minRTT = 0
+		if st.group != "" {
+			continue
 		}
-		fmt.Fprintf(bw, "%s:", literalOrName(ip, cvNoRevLookup))
-		if st.transmitted > 0 && st.received <= st.transmitted {
-			fmt.Fprintf(bw, " loss=%.1f%%", float64(st.transmitted-st.received)*100.0/float64(st.transmitted))
+		resps := stats.responders(ip)
+		if len(resps) == 0 {
+			printCVStat(bw, ip, st, st.transmitted)
+			continue
+		}
+		fmt.Fprintf(bw, "%s: sent=%d op.err=%d responders=%d\n", literalOrName(ip, cvNoRevLookup), st.transmitted, st.opErrors, len(resps))
+		for _, rip := range resps {
+			fmt.Fprintf(bw, "  ")
+			printCVStat(bw, rip, stats[rip], st.transmitted)
 		}
-		fmt.Fprintf(bw, " rcvd=%d sent=%d op.err=%d icmp.err=%d", st.received, st.transmitted, st.opErrors, st.icmpErrors)
-		fmt.Fprintf(bw, " min=%v avg=%v max=%v stddev=%v\n", st.minRTT, avg, st.maxRTT, time.Duration(stddev))
 	}
 	bw.Flush()
 }
+
+func printCVStat(bw *bufio.Writer, ip string, st *cvStat, transmitted uint64) {
+	fmt.Fprintf(bw, "%s:", literalOrName(ip, cvNoRevLookup))
+	if transmitted > 0 && st.received <= transmitted {
+		fmt.Fprintf(bw, " loss=%.1f%%", float64(transmitted-st.received)*100.0/float64(transmitted))
+	}
+	fmt.Fprintf(bw, " rcvd=%d sent=%d op.err=%d icmp.err=%d", st.received, transmitted, st.opErrors, st.icmpErrors)
+	printCVRTT(bw, st)
+	fmt.Fprintf(bw, "\n")
+}
+
+// printCVRTT prints the distribution of round-trip times, or one-way
+// delays, in st.
+func printCVRTT(bw *bufio.Writer, st *cvStat) {
+	var avg time.Duration
+	var stddev float64
+	if st.received > 0 {
+		avg = st.rttSum / time.Duration(st.received)
+		stddev = math.Sqrt(float64(st.rttSq)/float64(st.received) - float64(avg)*float64(avg))
+	} else {
+		st.minRTT = 0
+	}
+	fmt.Fprintf(bw, " min=%v avg=%v max=%v stddev=%v", st.minRTT, avg, st.maxRTT, time.Duration(stddev))
+}
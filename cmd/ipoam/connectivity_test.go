@@ -0,0 +1,60 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mikioh/ipoam"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestCVSummary(t *testing.T) {
+	noRevLookup := cvNoRevLookup
+	defer func() { cvNoRevLookup = noRevLookup }()
+	cvNoRevLookup = true
+
+	group := net.IPv4(192, 0, 2, 255)
+	reply := &icmp.Message{Type: ipv4.ICMPTypeEchoReply}
+	unreach := &icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable}
+	stats := make(cvStats)
+	for i := 0; i < 2; i++ {
+		stats.get(group.String()).onDeparture(&ipoam.Report{})
+		stats.get("192.0.2.1").onDeparture(&ipoam.Report{})
+	}
+	stats.get("192.0.2.3").onArrival(time.Millisecond, &ipoam.Report{Group: group, ICMP: reply})
+	stats.get("192.0.2.3").onArrival(3*time.Millisecond, &ipoam.Report{Group: group, ICMP: reply})
+	stats.get("192.0.2.2").onArrival(2*time.Millisecond, &ipoam.Report{Group: group, ICMP: reply})
+	stats.get("192.0.2.1").onArrival(time.Millisecond, &ipoam.Report{ICMP: reply})
+	stats.get("192.0.2.1").onArrival(0, &ipoam.Report{ICMP: unreach})
+
+	if resps, want := stats.responders(group.String()), []string{"192.0.2.2", "192.0.2.3"}; !reflect.DeepEqual(resps, want) {
+		t.Errorf("got %v; want %v", resps, want)
+	}
+	if resps := stats.responders("192.0.2.1"); len(resps) != 0 {
+		t.Errorf("got %v; want none", resps)
+	}
+	if st := stats["192.0.2.1"]; st.group != "" || st.received != 1 || st.icmpErrors != 1 {
+		t.Errorf("got %+v", st)
+	}
+
+	delete(stats, "192.0.2.1")
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	printCVSummary(bw, group.String(), stats)
+	want := "\nStatistical information for 192.0.2.255:\n" +
+		"192.0.2.255: sent=2 op.err=0 responders=2\n" +
+		"  192.0.2.2: loss=50.0% rcvd=1 sent=2 op.err=0 icmp.err=0 min=2ms avg=2ms max=2ms stddev=0s\n" +
+		"  192.0.2.3: loss=0.0% rcvd=2 sent=2 op.err=0 icmp.err=0 min=1ms avg=2ms max=3ms stddev=1ms\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
@@ -19,6 +19,8 @@ import (
 	"github.com/mikioh/ipaddr"
 	"github.com/mikioh/ipoam"
 	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 var rtUsageTmpl = `Usage:
@@ -41,6 +43,10 @@ var (
 
 	rtPayload []byte
 	rtData    = []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	rtPacers  = make(map[int]*pacer) // keyed by hop index
+
+	rtAppProto   ipoam.AppProtocol
+	rtAppReplies <-chan appReply
 
 	rtIPv4only    bool
 	rtIPv6only    bool
@@ -48,6 +54,11 @@ var (
 	rtUseICMP     bool
 	rtVerbose     bool
 
+	rtECN             bool
+	rtPace            bool
+	rtExtHeaderSurvey bool
+
+	rtAsymSlack        int
 	rtMaxHops          int
 	rtTC               int
 	rtPayloadLen       int
@@ -55,8 +66,12 @@ var (
 	rtPort             int
 	rtWait             int
 
+	rtApp        string
+	rtExtHeaders string
 	rtOutboundIf string
+	rtNAT64      string
 	rtSrc        string
+	rtSegments   string
 )
 
 func init() {
@@ -65,7 +80,11 @@ func init() {
 	cmdRT.Flag.BoolVar(&rtNoRevLookup, "n", false, "Don't use DNS reverse lookup")
 	cmdRT.Flag.BoolVar(&rtUseICMP, "m", false, "Use ICMP for probe packets instead of UDP")
 	cmdRT.Flag.BoolVar(&rtVerbose, "v", false, "Show verbose information")
+	cmdRT.Flag.BoolVar(&rtECN, "ecn", false, "Validate ECN along the path with ECT(0), ECT(1) and CE marked probe packets")
+	cmdRT.Flag.BoolVar(&rtPace, "pace", false, "Estimate ICMP rate limit of each hop and pace probes below the limit")
+	cmdRT.Flag.BoolVar(&rtExtHeaderSurvey, "ehsurvey", false, "Survey the hops where IPv6 packets with extension headers are dropped")
 
+	cmdRT.Flag.IntVar(&rtAsymSlack, "asym", 1, "Tolerance in hops for flagging hops with asymmetric reverse paths")
 	cmdRT.Flag.IntVar(&rtMaxHops, "hops", 30, "Maximum IPv4 TTL or IPv6 hop-limit")
 	cmdRT.Flag.IntVar(&rtTC, "tc", 0, "IPv4 TOS or IPv6 traffic-class on probe packets")
 	cmdRT.Flag.IntVar(&rtPayloadLen, "pldlen", 56, "Probe packet payload length")
@@ -73,8 +92,12 @@ func init() {
 	cmdRT.Flag.IntVar(&rtPort, "port", 33434, "Base destination port, range will be [port, port+hops)")
 	cmdRT.Flag.IntVar(&rtWait, "wait", 1, "Seconds between transmitting each probe")
 
+	cmdRT.Flag.StringVar(&rtApp, "app", "", "Use application payload on UDP probe packets to the well-known port, either dns, ntp or snmp")
+	cmdRT.Flag.StringVar(&rtExtHeaders, "eh", "", "IPv6 extension headers on probe packets, comma-separated list of hbh, dst, rt and frag; frag enlarges packets to be fragmented at 1280 bytes")
 	cmdRT.Flag.StringVar(&rtOutboundIf, "if", "", "Outbound interface name")
+	cmdRT.Flag.StringVar(&rtNAT64, "nat64", "", "Probe IPv4 destinations over IPv6 through NAT64, either a NAT64 prefix or auto to discover it")
 	cmdRT.Flag.StringVar(&rtSrc, "src", "", "Source IP address")
+	cmdRT.Flag.StringVar(&rtSegments, "srh", "", "Use IPv6 segment routing header, comma-separated list of segments toward the destination")
 }
 
 func rtMain(cmd *Command, args []string) {
@@ -88,7 +111,26 @@ func rtMain(cmd *Command, args []string) {
 	if err != nil {
 		cmd.fatal(err)
 	}
+	prefixes, err := parseNAT64Prefixes(rtNAT64)
+	if err != nil {
+		cmd.fatal(err)
+	}
+	if rtNAT64 != "" {
+		if c, err = synthesizeDsts(c, prefixes[0]); err != nil {
+			cmd.fatal(err)
+		}
+		rtIPv6only = true
+	}
 
+	if rtApp != "" {
+		if rtAppProto, err = ipoam.ParseAppProtocol(rtApp); err != nil {
+			cmd.fatal(err)
+		}
+		if rtUseICMP {
+			cmd.fatal(fmt.Errorf("application payload requires UDP probe packets"))
+		}
+		rtPort = rtAppProto.Port()
+	}
 	if rtMaxHops > 255 {
 		rtMaxHops = 255
 	}
@@ -103,6 +145,18 @@ func rtMain(cmd *Command, args []string) {
 			ifi = oif
 		}
 	}
+	ehs, err := parseIPv6ExtHeaders(rtExtHeaders)
+	if err != nil {
+		cmd.fatal(err)
+	}
+	rtPayload = fragPayload(rtPayload, rtData, ehs)
+	segs, err := parseSegments(rtSegments)
+	if err != nil {
+		cmd.fatal(err)
+	}
+	if rtExtHeaderSurvey || len(segs) > 0 {
+		rtIPv6only = true
+	}
 	var src net.IP
 	if rtSrc != "" {
 		src = net.ParseIP(rtSrc)
@@ -170,40 +224,97 @@ func rtMain(cmd *Command, args []string) {
 	if dst == nil {
 		cmd.fatal(fmt.Errorf("destination for %s not found", args[0]))
 	}
+	if err := ipt.SetNAT64Prefixes(prefixes...); err != nil {
+		cmd.fatal(err)
+	}
+	if rtAppProto != 0 {
+		rtAppReplies = readAppReplies(ipt, rtAppProto)
+	}
 
-	printRTBanner(bw, args[0], c, dst)
+	printRTBanner(bw, args[0], c, dst, prefixes)
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
-	cm := ipoam.ControlMessage{ID: os.Getpid() & 0xffff, Seq: 1, Port: rtPort}
-	hops := make([]rtHop, 0)
+	if ehs, err = appendSRH(ehs, segs, dst.IP); err != nil {
+		cmd.fatal(err)
+	}
+	cm := ipoam.ControlMessage{ID: os.Getpid() & 0xffff, Seq: 1, Port: rtPort, IPv6ExtHeaders: ehs}
+	if rtExtHeaderSurvey {
+		rtSurveyExtHeaders(cmd, bw, ipt, &cm, dst.IP, ifi, sig)
+		os.Exit(0)
+	}
+	if rtECN {
+		rtValidateECN(cmd, bw, ipt, &cm, dst.IP, ifi, sig)
+		os.Exit(0)
+	}
 	for i := 1; i <= rtMaxHops; i++ {
-		var reached bool
-		var r ipoam.Report
-		hops = hops[:0]
+		hops, reached := rtProbeHop(cmd, ipt, &cm, rtPayload, dst.IP, ifi, i, sig)
+		printRTReport(bw, i, hops)
+		if reached {
+			break
+		}
+	}
+	os.Exit(0)
+}
 
-		for j := 0; j < rtPerHopProbeCount; j++ {
-			t := time.NewTimer(time.Duration(rtWait) * time.Second)
-			begin := time.Now()
-			if p := ipt.IPv4PacketConn(); p != nil && !rtIPv6only && dst.IP.To4() != nil {
-				p.SetTTL(i)
-			}
-			if p := ipt.IPv6PacketConn(); p != nil && !rtIPv4only && dst.IP.To16() != nil && dst.IP.To4() == nil {
-				p.SetHopLimit(i)
+// rtProbeHop transmits rtPerHopProbeCount probes with the IPv4 TTL or
+// IPv6 hop limit i, and returns the per-probe results.
+// It reports whether any of the probes reached dst.
+// When rtAppProto is set, each probe carries an application-level
+// request instead of b, and an application-level reply from the
+// destination also means that the probe reached dst.
+// When rtPace is true, it estimates the ICMP rate limit of the hop on
+// the first call for the hop, and paces the probes below the limit.
+func rtProbeHop(cmd *Command, ipt *ipoam.Tester, cm *ipoam.ControlMessage, b []byte, dst net.IP, ifi *net.Interface, i int, sig <-chan os.Signal) ([]rtHop, bool) {
+	var reached bool
+	var hops []rtHop
+	if p := ipt.IPv4PacketConn(); p != nil && !rtIPv6only && dst.To4() != nil {
+		p.SetTTL(i)
+	}
+	if p := ipt.IPv6PacketConn(); p != nil && !rtIPv4only && dst.To16() != nil && dst.To4() == nil {
+		p.SetHopLimit(i)
+	}
+	pc, ok := rtPacers[i]
+	if rtPace && !ok {
+		pb := b
+		if rtAppProto != 0 {
+			var err error
+			if pb, err = ipoam.MarshalAppProbe(rtAppProto, cm.Seq); err != nil {
+				cmd.fatal(err)
 			}
-			if err := ipt.Probe(rtPayload, &cm, dst.IP, ifi); err != nil {
-				fmt.Fprintf(os.Stdout, "error=%q\n", err)
+		}
+		pc = newPacer(measureRateLimit(ipt, cm, pb, dst, ifi, time.Duration(rtWait)*time.Second, rtAppReplies, sig))
+		rtPacers[i] = pc
+	}
+	for j := 0; j < rtPerHopProbeCount; j++ {
+		var r ipoam.Report
+		pc.wait()
+		pb, id := b, cm.Seq
+		if rtAppProto != 0 {
+			var err error
+			if pb, err = ipoam.MarshalAppProbe(rtAppProto, id); err != nil {
+				cmd.fatal(err)
 			}
+		}
+		t := time.NewTimer(time.Duration(rtWait) * time.Second)
+		begin := time.Now()
+		if err := ipt.Probe(pb, cm, dst, ifi); err != nil {
+			fmt.Fprintf(os.Stdout, "error=%q\n", err)
+		}
 
-			cm.Seq++
-			if cm.Seq > 0xffff {
-				cm.Seq = 1
-			}
+		cm.Seq++
+		if cm.Seq > 0xffff {
+			cm.Seq = 1
+		}
+		if rtAppProto == 0 {
 			cm.Port++
 			if cm.Port > 0xffff {
 				cm.Port = rtPort
 			}
+		}
 
+	loop:
+		for {
 			select {
 			case <-sig:
 				os.Exit(0)
@@ -211,26 +322,276 @@ func rtMain(cmd *Command, args []string) {
 				hops = append(hops, rtHop{rtt: time.Since(begin), r: ipoam.Report{Src: net.IPv6unspecified}})
 			case r = <-ipt.Report():
 				hops = append(hops, rtHop{rtt: time.Since(begin), r: r})
+			case ar := <-rtAppReplies:
+				if ar.ID != id&0xffff {
+					continue
+				}
+				r = ipoam.Report{Time: ar.time, Src: ar.src}
+				hops = append(hops, rtHop{rtt: ar.time.Sub(begin), r: r, app: ar.AppReply})
+				reached = true
+			}
+			break loop
+		}
+		if !reached {
+			reached = hasReached(&r)
+		}
+		t.Stop()
+	}
+	return hops, reached
+}
+
+// rtExtHeaderSurveyCases holds the survey cases.
+// The frag case is compared with the large case that uses
+// unfragmented packets of the IPv6 minimum MTU, so that drops
+// caused by the packet size are told apart from drops caused by
+// fragmentation.
+var rtExtHeaderSurveyCases = []struct {
+	name string
+	typ  int
+	plen int // payload length, zero for rtPayload
+}{
+	{"none", -1, 0},
+	{"hbh", ipoam.IPv6HopByHop, 0},
+	{"dst", ipoam.IPv6DstOpts, 0},
+	{"rt", ipoam.IPv6Routing, 0},
+	{"large", -1, largePayloadLen},
+	{"frag", ipoam.IPv6Fragment, fragPayloadLen},
+}
+
+type rtSurveyResult struct {
+	name    string
+	hop     int    // last hop that responded
+	src     net.IP // last responder
+	reached bool
+	r       ipoam.Report // last report
+}
+
+// rtSurveyExtHeaders runs path discovery with and without each of the
+// IPv6 extension headers, and shows the last hop that responded to
+// probe packets with the extension header.
+// See RFC 7872.
+func rtSurveyExtHeaders(cmd *Command, bw *bufio.Writer, ipt *ipoam.Tester, cm *ipoam.ControlMessage, dst net.IP, ifi *net.Interface, sig <-chan os.Signal) {
+	fmt.Fprintf(bw, "IPv6 extension header survey for %v: %d hops max, %d per-hop probes\n", dst, rtMaxHops, rtPerHopProbeCount)
+	bw.Flush()
+	maxHops := rtMaxHops
+	var base, large rtSurveyResult
+	for i, sc := range rtExtHeaderSurveyCases {
+		res := rtSurveyResult{name: sc.name}
+		cm.IPv6ExtHeaders = nil
+		b := rtPayload
+		if sc.typ >= 0 {
+			cm.IPv6ExtHeaders = []ipoam.IPv6ExtHeader{{Type: sc.typ}}
+		}
+		if sc.plen > 0 {
+			b = bytes.Repeat(rtData, sc.plen/len(rtData)+1)[:sc.plen]
+		}
+		for h := 1; h <= maxHops; h++ {
+			hops, reached := rtProbeHop(cmd, ipt, cm, b, dst, ifi, h, sig)
+			for _, hop := range hops {
+				if hop.r.Error == nil && hop.r.ICMP != nil {
+					res.hop, res.src, res.r = h, hop.r.Src, hop.r
+				}
 			}
-			if !reached {
-				reached = hasReached(&r)
+			if reached {
+				res.reached = true
+				break
 			}
-			t.Stop()
 		}
+		ref := &base
+		switch {
+		case i == 0:
+			base, ref = res, nil
+			if base.hop > 0 {
+				maxHops = base.hop
+			}
+		case sc.typ == -1 && sc.plen > 0:
+			large = res
+		case sc.typ == ipoam.IPv6Fragment:
+			ref = &large
+		}
+		printRTSurveyResult(bw, &res, ref)
+	}
+}
 
-		printRTReport(bw, i, hops)
-		if reached {
+// printRTSurveyResult prints the survey result res compared with the
+// reference result ref.
+// The ref is nil when res is the baseline.
+func printRTSurveyResult(bw *bufio.Writer, res, ref *rtSurveyResult) {
+	fmt.Fprintf(bw, "%-5s  ", res.name)
+	switch {
+	case res.hop == 0:
+		fmt.Fprintf(bw, "no response")
+	case res.reached:
+		fmt.Fprintf(bw, "reached at hop %d: %s", res.hop, literalOrName(res.src.String(), rtNoRevLookup))
+	case ref == nil:
+		fmt.Fprintf(bw, "last response at hop %d: %s", res.hop, literalOrName(res.src.String(), rtNoRevLookup))
+	default:
+		fmt.Fprintf(bw, "disappeared after hop %d: %s", res.hop, literalOrName(res.src.String(), rtNoRevLookup))
+	}
+	if res.r.ICMP != nil && res.r.ICMP.Type == ipv6.ICMPTypeParameterProblem {
+		fmt.Fprintf(bw, " (parameter problem, code=%d)", res.r.ICMP.Code)
+	}
+	if ref != nil && !res.reached && ref.hop > 0 {
+		if ref.reached {
+			fmt.Fprintf(bw, ", %s reached at hop %d", ref.name, ref.hop)
+		} else {
+			fmt.Fprintf(bw, ", %s last response at hop %d", ref.name, ref.hop)
+		}
+	}
+	fmt.Fprintf(bw, "\n")
+	bw.Flush()
+}
+
+var rtECNCodepoints = []int{0x02, 0x01, 0x03} // ECT(0), ECT(1), CE
+
+// rtValidateECN runs path discovery with probe packets marked with
+// each of ECN-capable codepoints, and shows the ECN field observed by
+// each node along the path.
+// See RFC 3168.
+func rtValidateECN(cmd *Command, bw *bufio.Writer, ipt *ipoam.Tester, cm *ipoam.ControlMessage, dst net.IP, ifi *net.Interface, sig <-chan os.Signal) {
+	tc := rtTC
+	if tc < 0 {
+		tc = 0
+	}
+	for _, ecn := range rtECNCodepoints {
+		tc = tc&^0x03 | ecn
+		if p := ipt.IPv4PacketConn(); p != nil && dst.To4() != nil {
+			p.SetTOS(tc)
+		}
+		if p := ipt.IPv6PacketConn(); p != nil && dst.To4() == nil {
+			p.SetTrafficClass(tc)
+		}
+		fmt.Fprintf(bw, "ECN validation for %v with %s\n", dst, ecnName(ecn))
+		bw.Flush()
+		var path []ecnHop
+		for i := 1; i <= rtMaxHops; i++ {
+			hops, reached := rtProbeHop(cmd, ipt, cm, rtPayload, dst, ifi, i, sig)
+			sort.Sort(rtHops(hops))
+			fmt.Fprintf(bw, "% 3d  ", i)
+			var prev net.IP
+			for _, h := range hops {
+				v, ok := reportECN(&h.r)
+				if !ok || h.r.Src.Equal(prev) {
+					continue
+				}
+				if prev != nil {
+					fmt.Fprintf(bw, "\n     ")
+				}
+				prev = h.r.Src
+				path = append(path, ecnHop{hop: i, src: h.r.Src, ecn: v})
+				fmt.Fprintf(bw, "%s ecn=%s", literalOrName(h.r.Src.String(), rtNoRevLookup), ecnName(v))
+				if v != ecn {
+					fmt.Fprintf(bw, " (%s)", ecnChange(v))
+				}
+			}
+			if prev == nil {
+				fmt.Fprintf(bw, "*")
+			}
+			fmt.Fprintf(bw, "\n")
+			bw.Flush()
+			if reached {
+				break
+			}
+		}
+		v := classifyECN(ecn, path)
+		switch {
+		case v.changed == nil && v.last == nil:
+			fmt.Fprintf(bw, "%s: no response\n", ecnName(ecn))
+		case v.changed == nil:
+			fmt.Fprintf(bw, "%s: preserved up to hop %d: %s\n", ecnName(ecn), v.lastHop, literalOrName(v.last.String(), rtNoRevLookup))
+		case v.last == nil:
+			fmt.Fprintf(bw, "%s: %s before hop %d: %s\n", ecnName(ecn), v.change, v.changedHop, literalOrName(v.changed.String(), rtNoRevLookup))
+		default:
+			fmt.Fprintf(bw, "%s: %s between hop %d: %s and hop %d: %s\n", ecnName(ecn), v.change, v.lastHop, literalOrName(v.last.String(), rtNoRevLookup), v.changedHop, literalOrName(v.changed.String(), rtNoRevLookup))
+		}
+		fmt.Fprintf(bw, "\n")
+		bw.Flush()
+	}
+}
+
+// An ecnHop represents the ECN field of the probe packet observed by
+// a node along the path.
+type ecnHop struct {
+	hop int
+	src net.IP
+	ecn int
+}
+
+// An ecnVerdict represents the result of ECN validation along the
+// path.
+type ecnVerdict struct {
+	change     string // ecnChange of the first changed field, empty when preserved
+	lastHop    int    // last hop preserving the field before any change
+	last       net.IP // node at lastHop, nil if none
+	changedHop int    // first hop observing the changed field
+	changed    net.IP // node at changedHop, nil if none
+}
+
+// classifyECN returns the verdict on the ECN fields observed along
+// the path for probe packets marked with sent.
+func classifyECN(sent int, path []ecnHop) ecnVerdict {
+	var v ecnVerdict
+	for _, h := range path {
+		if h.ecn != sent {
+			v.change, v.changedHop, v.changed = ecnChange(h.ecn), h.hop, h.src
 			break
 		}
+		v.lastHop, v.last = h.hop, h.src
+	}
+	return v
+}
+
+// reportECN returns the ECN field of the probe packet observed by the
+// node that sent r.
+// It is taken from the original datagram of an ICMP error message,
+// or the traffic class of an echo reply.
+func reportECN(r *ipoam.Report) (int, bool) {
+	switch h := r.OrigHeader.(type) {
+	case *ipv4.Header:
+		return h.TOS & 0x03, true
+	case *ipv6.Header:
+		return h.TrafficClass & 0x03, true
+	}
+	if r.Error == nil && r.ICMP != nil && r.Dst != nil && (r.ICMP.Type == ipv4.ICMPTypeEchoReply || r.ICMP.Type == ipv6.ICMPTypeEchoReply) {
+		return r.TC & 0x03, true
+	}
+	return 0, false
+}
+
+func ecnName(ecn int) string {
+	switch ecn {
+	case 0x01:
+		return "ect1"
+	case 0x02:
+		return "ect0"
+	case 0x03:
+		return "ce"
+	default:
+		return "not-ect"
+	}
+}
+
+func ecnChange(observed int) string {
+	switch {
+	case observed == 0:
+		return "bleached"
+	case observed == 0x03:
+		return "ce-marked"
+	default:
+		return "remarked"
 	}
-	os.Exit(0)
 }
 
-func printRTBanner(bw *bufio.Writer, dsts string, c *ipaddr.Cursor, pos *ipaddr.Position) {
-	fmt.Fprintf(bw, "Path discovery for %s: %d hops max, %d per-hop probes, %d bytes payload\n", dsts, rtMaxHops, rtPerHopProbeCount, len(rtPayload))
+func printRTBanner(bw *bufio.Writer, dsts string, c *ipaddr.Cursor, pos *ipaddr.Position, prefixes []*net.IPNet) {
+	if rtAppProto != 0 {
+		fmt.Fprintf(bw, "Path discovery for %s: %d hops max, %d per-hop probes, %v payload to port %d\n", dsts, rtMaxHops, rtPerHopProbeCount, rtAppProto, rtPort)
+	} else {
+		fmt.Fprintf(bw, "Path discovery for %s: %d hops max, %d per-hop probes, %d bytes payload\n", dsts, rtMaxHops, rtPerHopProbeCount, len(rtPayload))
+	}
 	if len(c.List()) > 1 {
 		fmt.Fprintf(bw, "Warning: %s has multiple addresses, using %v\n", dsts, pos.IP)
 	}
+	printNAT64Dst(bw, pos.IP, prefixes)
 	bw.Flush()
 }
 
@@ -253,14 +614,34 @@ func printRTReport(bw *bufio.Writer, i int, hops []rtHop) {
 			fmt.Fprintf(bw, "*")
 		} else {
 			fmt.Fprintf(bw, "%s", literalOrName(h.r.Src.String(), rtNoRevLookup))
+			printNAT64Src(bw, &h.r)
+			if h.r.Asymmetric(i, rtAsymSlack) {
+				fmt.Fprintf(bw, " asym")
+			}
+			if h.app != nil {
+				printAppReply(bw, h.app)
+			}
 			if rtVerbose {
 				if h.r.Dst != nil {
-					fmt.Fprintf(bw, " tc=%#x hops=%d to=%v", h.r.TC, h.r.Hops, h.r.Dst)
+					fmt.Fprintf(bw, " tc=%#x hops=%d rev=%d to=%v", h.r.TC, h.r.Hops, h.r.ReverseHops(), h.r.Dst)
 				}
 				if h.r.Interface != nil {
 					fmt.Fprintf(bw, " if=%s", h.r.Interface.Name)
 				}
-				switch body := h.r.ICMP.Body.(type) {
+				if len(h.r.HeaderChanges) > 0 {
+					fmt.Fprintf(bw, " changed=%v", h.r.HeaderChanges)
+				}
+				if srh := h.r.OrigSRH; srh != nil {
+					fmt.Fprintf(bw, " srh.sl=%d", srh.SegmentsLeft)
+					if srh.SegmentsLeft < len(srh.Segments) {
+						fmt.Fprintf(bw, " srh.seg=%v", srh.Segments[srh.SegmentsLeft])
+					}
+				}
+				var body icmp.MessageBody
+				if h.r.ICMP != nil {
+					body = h.r.ICMP.Body
+				}
+				switch body := body.(type) {
 				case *icmp.DstUnreach:
 					printICMPExtensions(bw, body.Extensions)
 				case *icmp.ParamProb:
@@ -274,12 +655,18 @@ func printRTReport(bw *bufio.Writer, i int, hops []rtHop) {
 		prev = h.r.Src
 	}
 	fmt.Fprintf(bw, "\n")
+	if pc, ok := rtPacers[i]; ok {
+		fmt.Fprintf(bw, "     ")
+		printRateLimit(bw, pc.rateLimit())
+		fmt.Fprintf(bw, "\n")
+	}
 	bw.Flush()
 }
 
 type rtHop struct {
 	rtt time.Duration
 	r   ipoam.Report
+	app *ipoam.AppReply // application-level reply, nil if not received
 }
 
 type rtHops []rtHop
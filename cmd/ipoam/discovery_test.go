@@ -0,0 +1,71 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/mikioh/ipoam"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestClassifyECN(t *testing.T) {
+	hop1, hop2, hop3 := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), net.IPv4(192, 0, 2, 3)
+	for _, tt := range []struct {
+		sent int
+		ecns []int // observed by hop1, hop2 and hop3
+		want ecnVerdict
+	}{
+		{0x02, nil, ecnVerdict{}},
+		{0x02, []int{0x02, 0x02, 0x02}, ecnVerdict{lastHop: 3, last: hop3}},
+		{0x01, []int{0x01, 0x01, 0x01}, ecnVerdict{lastHop: 3, last: hop3}},
+		{0x03, []int{0x03, 0x03, 0x03}, ecnVerdict{lastHop: 3, last: hop3}},
+
+		{0x02, []int{0x02, 0x00, 0x00}, ecnVerdict{change: "bleached", lastHop: 1, last: hop1, changedHop: 2, changed: hop2}},
+		{0x01, []int{0x01, 0x01, 0x00}, ecnVerdict{change: "bleached", lastHop: 2, last: hop2, changedHop: 3, changed: hop3}},
+		{0x03, []int{0x00, 0x00, 0x00}, ecnVerdict{change: "bleached", changedHop: 1, changed: hop1}},
+
+		{0x02, []int{0x02, 0x03, 0x00}, ecnVerdict{change: "ce-marked", lastHop: 1, last: hop1, changedHop: 2, changed: hop2}},
+		{0x01, []int{0x03, 0x03, 0x03}, ecnVerdict{change: "ce-marked", changedHop: 1, changed: hop1}},
+
+		{0x02, []int{0x02, 0x01, 0x02}, ecnVerdict{change: "remarked", lastHop: 1, last: hop1, changedHop: 2, changed: hop2}},
+		{0x01, []int{0x01, 0x02, 0x01}, ecnVerdict{change: "remarked", lastHop: 1, last: hop1, changedHop: 2, changed: hop2}},
+		{0x03, []int{0x03, 0x03, 0x01}, ecnVerdict{change: "remarked", lastHop: 2, last: hop2, changedHop: 3, changed: hop3}},
+	} {
+		var path []ecnHop
+		for i, ecn := range tt.ecns {
+			path = append(path, ecnHop{hop: i + 1, src: []net.IP{hop1, hop2, hop3}[i], ecn: ecn})
+		}
+		if v := classifyECN(tt.sent, path); !reflect.DeepEqual(v, tt.want) {
+			t.Errorf("%s, %v: got %+v; want %+v", ecnName(tt.sent), tt.ecns, v, tt.want)
+		}
+	}
+}
+
+func TestReportECN(t *testing.T) {
+	for _, tt := range []struct {
+		r   ipoam.Report
+		ecn int
+		ok  bool
+	}{
+		{ipoam.Report{OrigHeader: &ipv4.Header{TOS: 0xb9}}, 0x01, true},
+		{ipoam.Report{OrigHeader: &ipv6.Header{TrafficClass: 0xba}}, 0x02, true},
+		{ipoam.Report{ICMP: &icmp.Message{Type: ipv4.ICMPTypeEchoReply}, Dst: net.IPv4(192, 0, 2, 1), TC: 0x03}, 0x03, true},
+		{ipoam.Report{ICMP: &icmp.Message{Type: ipv6.ICMPTypeEchoReply}, Dst: net.ParseIP("2001:db8::1"), TC: 0x00}, 0x00, true},
+
+		{ipoam.Report{ICMP: &icmp.Message{Type: ipv4.ICMPTypeEchoReply}, TC: 0x03}, 0, false},
+		{ipoam.Report{ICMP: &icmp.Message{Type: ipv4.ICMPTypeTimeExceeded}, Dst: net.IPv4(192, 0, 2, 1), TC: 0x03}, 0, false},
+		{ipoam.Report{Error: errors.New("timeout")}, 0, false},
+	} {
+		if ecn, ok := reportECN(&tt.r); ecn != tt.ecn || ok != tt.ok {
+			t.Errorf("%+v: got %#x, %v; want %#x, %v", tt.r, ecn, ok, tt.ecn, tt.ok)
+		}
+	}
+}
@@ -11,6 +11,22 @@ Usage:	ipoam command [flags] [arguments]
 The commands are:
 	cv|ping                 Verify IP-layer connectivity
 	rt|pathdisc|traceroute  Discover an IP-layer path
+	ndping                  Verify IPv6 neighbor reachability with neighbor discovery
+	arping                  Verify IPv4 neighbor reachability with ARP
+	listeners               Discover multicast listeners with IGMP and MLD queries
+	routers                 Discover IPv6 routers with router advertisements
+	lsp-ping                Verify MPLS LSP connectivity
+	lsp-trace               Trace an MPLS LSP
+	lsp-responder           Run an MPLS echo reply agent
+	bfd                     Run a BFD session
+	sbfd                    Verify reachability of remote discriminators with S-BFD
+	sbfd-reflector          Run an S-BFD reflector
+	stamp                   Measure one-way and round-trip delay and loss with STAMP
+	stamp-reflector         Run a STAMP session-reflector
+	twamp                   Measure two-way delay and loss with TWAMP-Light
+	twamp-reflector         Run a TWAMP-Light session-reflector
+	owping                  Measure one-way delay and loss with OWAMP
+	owampd                  Run an OWAMP server
 	sh|show|list            Show network facility information
 
 
@@ -18,8 +34,47 @@ Verify IP-layer connectivity
 
 CV (Connectivity Verification) uses both ICMP echo request and reply
 messages for verifying IP-layer connectivity. The destination can be
-unicast (including anycast), multicast or broadcast addresses.
+unicast (including anycast), multicast or IPv4 limited or directed
+broadcast addresses.
 Also it can be a single or multiple addresses.
+When the destination is a multicast or broadcast address, each reply
+shows the group address it answered, and the summary shows a list of
+responders with per-responder statistics.
+With -pace, it first transmits bursts of echo requests at rising rates
+to each unicast destination, estimates the token bucket that the
+destination uses to limit the rate of ICMP message generation, and
+paces echo requests below the estimated limit.
+Destinations that are IPv4-embedded IPv6 addresses, such as addresses
+synthesized by DNS64 with the well-known prefix 64:ff9b::/96, are
+shown with the embedded IPv4 addresses. With -nat64, IPv4
+destinations are probed over IPv6 through NAT64 using the
+IPv4-embedded IPv6 addresses with the given prefix, or the prefix
+discovered by ipv4only.arpa as described in RFC 7050 when the value
+is auto, and replies from them carry ipv4.
+With -compare, it probes the first IPv4 and IPv6 unicast addresses of
+a dual-stack destination in lock-step, alternating the transmission
+order every round. Each round shows the RTT of both address families,
+their difference and the address family that a Happy Eyeballs client
+would choose, assuming the Connection Attempt Delay of 250ms
+recommended in RFC 8305. The summary shows per-family loss and RTT
+distribution, the distribution of the difference, and the preferred
+address family.
+With -app, it transmits UDP packets carrying a DNS query, an NTP
+client request or an SNMP get request to the well-known port instead
+of ICMP echo requests, which is useful when packet filters on the
+path drop ICMP. An application-level reply counts as a reply, and an
+ICMP destination unreachable message as an ICMP error.
+With -fragsize, it splits each ICMP echo request into IPv4 fragments
+or IPv6 fragments with a fragment header, optionally with a tiny first
+fragment by -fragfirst or overlapping fragments by -fragoverlap, for
+verifying that the destination reassembles them. It also transmits
+an unfragmented ICMP echo request without payload as a control probe.
+A destination that doesn't reply to the fragmented echo request within
+the interval is shown with reassembled=false when it replies to the
+control probe, otherwise with no reply.
+ICMP fragment reassembly time exceeded messages are shown as ICMP
+errors with the fragmentation fields of the original datagram, and
+their destinations with reassembled=false.
 
 Usage:	ipoam cv|ping [flags] destination
 
@@ -31,8 +86,20 @@ Destination:
 Flags:
 	-4	Run IPv4 test only
 	-6	Run IPv6 test only
+	-app string
+		Use UDP packets with application payload to the well-known port instead of ICMP echo, either dns, ntp or snmp
+	-compare
+		Compare IPv4 and IPv6 connectivity to a dual-stack destination in lock-step
 	-count int
 		Iteration count, less than or equal to zero will run until interrupted
+	-eh string
+		IPv6 extension headers on outgoing packets, comma-separated list of hbh, dst, rt and frag; frag enlarges packets to be fragmented at 1280 bytes
+	-fragfirst int
+		Length of first fragment when using -fragsize, e.g., 8 for tiny first fragment
+	-fragoverlap int
+		Length of overlap between adjacent fragments when using -fragsize
+	-fragsize int
+		Split ICMP echo requests into fragments of the given length, multiple of 8
 	-hops int
 		IPv4 TTL or IPv6 hop-limit on outgoing unicast packets (default 64)
 	-if string
@@ -40,13 +107,22 @@ Flags:
 	-mchops int
 		IPv4 TTL or IPv6 hop-limit on outgoing multicast packets (default 5)
 	-n	Don't use DNS reverse lookup
+	-nat64 string
+		Probe IPv4 destinations over IPv6 through NAT64, either a NAT64 prefix or auto to discover it
+	-pace
+		Estimate ICMP rate limit of each destination and pace echoes below the limit
 	-pldlen int
 		ICMP echo payload length (default 56)
 	-q	Quiet output except summary
+	-rr	Use IPv4 record route option
 	-src string
 		Source IP address
+	-srh string
+		Use IPv6 segment routing header, comma-separated list of segments toward the destination
 	-tc int
 		IPv4 TOS or IPv6 traffic-class on outgoing packets
+	-ts string
+		Use IPv4 timestamp option, either tsonly, tsandaddr or tsprespec=addr[,addr...]
 	-v	Show verbose information
 	-wait int
 		Seconds between transmitting each echo (default 1)
@@ -74,6 +150,49 @@ RT (Route Tracing) transmits probe packets and discovers a route to
 the destination by determining received ICMP error messages from nodes
 along the route. The probe packets can be carried by either UDP or
 ICMP.
+With -v, it also compares the original datagram in each ICMP error
+message with the probe packet, and shows the header fields modified
+along the path, such as DSCP and ECN remarking, NAT port rewriting or
+IP option stripping, in the form of changed=[field=sent->quoted ...].
+With -pace, it estimates the ICMP rate limit of each hop by probe
+bursts at rising rates, shows it as icmp.ratelimit and icmp.burst, and
+paces probe packets below the limit so that reported losses are not
+caused by rate limiting.
+With -ecn, it runs path discovery with probe packets marked ECT(0),
+ECT(1) and CE in turn, shows the ECN field that each node observed,
+taken from the original datagram in ICMP error messages or the
+traffic class of echo replies, and reports where the field is
+bleached or remarked.
+With -ehsurvey, it runs path discovery with and without each of
+IPv6 hop-by-hop options, destination options, routing and fragment
+headers, and shows the hop after which packets with the extension
+header disappear, as described in RFC 7872. Fragment headers appear
+only on packets larger than the IPv6 minimum MTU, therefore the frag
+case uses packets fragmented at 1280 bytes, and is compared with the
+large case that uses unfragmented packets of 1280 bytes, instead of
+the baseline, to tell drops caused by the packet size from drops
+caused by fragmentation.
+With -srh, it traces along an explicit SRv6 path; the verbose output
+shows the Segments Left field and the active segment of the segment
+routing header in the original datagram of each ICMP error message.
+With -nat64, it traces the path to an IPv4 destination over IPv6
+through NAT64, the same as cv; hops on the IPv4 side of the
+translator are shown with ipv4, and ICMP error messages are matched
+by the destination address when the translator rewrites the UDP
+source port or ICMP echo identifier.
+With -app, UDP probe packets carry a DNS query, an NTP client request
+or an SNMP get request to the well-known port of the protocol instead
+of the port range starting at -port, which helps to get through
+packet filters that drop the probe packets of traceroute. An
+application-level reply from the destination means that the
+destination is reached, and the hop is shown with app and a summary
+of the reply.
+
+Each hop is flagged with asym when the reverse path length, estimated
+from the TTL or hop limit on the received packet assuming an initial
+value of 64, 128 or 255, differs from the hop index by more than the
+tolerance specified by -asym. The verbose output shows the estimate
+as rev.
 
 Usage:	ipoam rt|pathdisc|traceroute [flags] destination
 
@@ -83,20 +202,36 @@ Destination:
 Flags:
 	-4	Run IPv4 test only
 	-6	Run IPv6 test only
+	-app string
+		Use application payload on UDP probe packets to the well-known port, either dns, ntp or snmp
+	-asym int
+		Tolerance in hops for flagging hops with asymmetric reverse paths (default 1)
 	-count int
 		Per-hop probe count (default 3)
+	-ecn
+		Validate ECN along the path with ECT(0), ECT(1) and CE marked probe packets
+	-eh string
+		IPv6 extension headers on probe packets, comma-separated list of hbh, dst, rt and frag; frag enlarges packets to be fragmented at 1280 bytes
+	-ehsurvey
+		Survey the hops where IPv6 packets with extension headers are dropped
 	-hops int
 		Maximum IPv4 TTL or IPv6 hop-limit (default 30)
 	-if string
 		Outbound interface name
 	-m	Use ICMP for probe packets instead of UDP
 	-n	Don't use DNS reverse lookup
+	-nat64 string
+		Probe IPv4 destinations over IPv6 through NAT64, either a NAT64 prefix or auto to discover it
+	-pace
+		Estimate ICMP rate limit of each hop and pace probes below the limit
 	-pldlen int
 		Probe packet payload length (default 56)
 	-port int
 		Base destination port number, range will be [port, port+hops) (default 33434)
 	-src string
 		Source IP address
+	-srh string
+		Use IPv6 segment routing header, comma-separated list of segments toward the destination
 	-tc int
 		IPv4 TOS or IPv6 traffic-class on probe packets
 	-v	Show verbose information
@@ -129,6 +264,698 @@ A sample output:
 	 20  *  1.003906987s  1.001953641s  1.000027483s
 	 21  ti-in-f82.1e100.net. (74.125.204.82) tc=0x0 hops=42 to=192.168.86.21 if=en0  47.809163ms  66.017916ms  43.068939ms
 
+Verify IPv6 neighbor reachability with neighbor discovery
+
+NDPing transmits IPv6 neighbor solicitations out of the interface
+specified by -if and verifies the reachability of a neighbor by the
+neighbor advertisements described in RFC 4861. The solicitations are
+addressed to the solicited-node multicast address of the target, or
+the target itself with -unicast. Each advertisement shows the target
+link-layer address and the router (R), solicited (S) and override (O)
+flags. Advertisements received with a hop limit other than 255 are
+ignored.
+When more than one neighbor, distinguished by the source address and
+the target link-layer address, advertises the target in a round, the
+extra advertisements are flagged with duplicate, and the summary shows
+a list of responders. It is useful for detecting duplicate addresses
+and spoofed advertisements on the link.
+
+Usage:	ipoam ndping [flags] target
+
+Target:
+	An IPv6 address of neighbor on the link attached to the
+	interface specified by the -if flag.
+
+Flags:
+	-count int
+		Iteration count, less than or equal to zero will run until interrupted
+	-if string
+		Outbound interface name, required
+	-n	Don't use DNS reverse lookup
+	-q	Quiet output except summary
+	-unicast
+		Send solicitations to the target address instead of its solicited-node multicast address
+	-v	Show verbose information
+	-wait int
+		Seconds between transmitting each solicitation (default 1)
+
+A sample output:
+
+	% sudo ipoam ndping -n -count 2 -if eth0 fd01::2
+	Neighbor reachability verification for fd01::2 via eth0
+	from=fd01::2 lladdr=56:fb:1b:ca:55:ed flags=SO hlim=255 rtt=507.384µs
+	from=fd01::2 lladdr=7e:2e:80:16:b5:67 flags=SO hlim=255 rtt=600.674µs duplicate
+	from=fd01::2 lladdr=56:fb:1b:ca:55:ed flags=SO hlim=255 rtt=275.988µs
+	from=fd01::2 lladdr=7e:2e:80:16:b5:67 flags=SO hlim=255 rtt=624.597µs duplicate
+
+	Statistical information for fd01::2:
+	neighbor: loss=0.0% rcvd=2 sent=2 op.err=0 min=275.988µs avg=391.686µs max=507.384µs stddev=115.698µs
+	duplicate responders: dup=2 fd01::2(56:fb:1b:ca:55:ed) fd01::2(7e:2e:80:16:b5:67)
+
+Verify IPv4 neighbor reachability with ARP
+
+ARPing transmits ARP requests on a link-layer socket and verifies the
+reachability of an IPv4 neighbor by the replies described in RFC 826.
+Each reply shows the link-layer address of the neighbor. The interface
+is specified by -if, or chosen from the interfaces that have an IPv4
+address on the same subnet as the target. With -unicast, it refreshes
+the neighbor with requests addressed to its link-layer address once
+the address is known. With -gratuitous, it transmits gratuitous
+requests that carry the target as the sender address, and with -dad,
+ARP probes that carry the unspecified address as described in RFC
+5227; in both modes any response indicates another owner of the
+target. Gratuitous requests are allowed only for the addresses of
+the interface, because announcing another node's address poisons the
+neighbor caches on the link.
+When more than one link-layer address answers the target in a round,
+the extra replies are flagged with duplicate, and the summary shows a
+list of owners. It currently works on Linux only.
+
+Usage:	ipoam arping [flags] target
+
+Target:
+	A hostname, DNS reg-name or IPv4 address of neighbor.
+
+Flags:
+	-count int
+		Iteration count, less than or equal to zero will run until interrupted
+	-dad
+		Detect address conflict with ARP probes carrying the unspecified sender address
+	-gratuitous
+		Transmit gratuitous ARP requests carrying the target, one of the interface addresses, as the sender address
+	-if string
+		Outbound interface name
+	-n	Don't use DNS reverse lookup
+	-q	Quiet output except summary
+	-unicast
+		Refresh the neighbor with unicast requests once its link-layer address is known
+	-v	Show verbose information
+	-wait int
+		Seconds between transmitting each request (default 1)
+
+A sample output:
+
+	% sudo ipoam arping -n -count 2 -if eth0 192.0.3.2
+	Neighbor reachability verification for 192.0.3.2 via eth0
+	from=192.0.3.2 lladdr=56:fb:1b:ca:55:ed rtt=332.814µs
+	from=192.0.3.2 lladdr=7e:2e:80:16:b5:67 rtt=343.627µs duplicate
+	from=192.0.3.2 lladdr=56:fb:1b:ca:55:ed rtt=156.43µs
+	from=192.0.3.2 lladdr=7e:2e:80:16:b5:67 rtt=165.599µs duplicate
+
+	Statistical information for 192.0.3.2:
+	neighbor: loss=0.0% rcvd=2 sent=2 op.err=0 min=156.43µs avg=244.622µs max=332.814µs stddev=88.192µs
+	duplicate owners: dup=2 56:fb:1b:ca:55:ed 7e:2e:80:16:b5:67
+
+Discover multicast listeners with IGMP and MLD queries
+
+Listeners transmits IGMP and MLD queries on the interface specified by
+-if and collects the reports from the listeners on the link, while
+"sh int" shows only the groups that the node itself joins. General
+queries are transmitted by default; -group makes group-specific
+queries, and -src makes group-and-source-specific queries with IGMPv3
+or MLDv2. Each report shows the group records with the filter mode and
+source list; the reports and leave messages of IGMPv1, IGMPv2 and
+MLDv1 are shown as the equivalent IGMPv3 and MLDv2 records. The
+summary shows the listeners for each group and the queriers heard on
+the link. With -passive, it only listens for reports and queries,
+which is useful for finding the querier.
+Note that IGMPv2 and MLD queriers with a higher address than the node
+may stop acting as a querier for a while. It currently works on Linux
+only.
+
+Usage:	ipoam listeners [flags]
+
+Flags:
+	-4	Run IGMP test only
+	-6	Run MLD test only
+	-count int
+		Number of queries for each group (default 1)
+	-group string
+		Comma-separated list of groups for group-specific queries instead of general queries
+	-if string
+		Outbound interface name, required
+	-igmp int
+		IGMP version of queries (default 3)
+	-maxresp int
+		Maximum response delay in milliseconds (default 1000)
+	-mld int
+		MLD version of queries (default 2)
+	-n	Don't use DNS reverse lookup
+	-passive
+		Listen for reports and queries without transmitting queries
+	-q	Quiet output except summary
+	-src string
+		Comma-separated list of sources for group-and-source-specific queries
+	-v	Show verbose information
+	-wait int
+		Seconds to wait for reports after each query (default 2)
+
+A sample output:
+
+	% sudo ipoam listeners -n -if eth0
+	Multicast listener discovery on eth0: igmpv3 and mldv2 queries, 1s max response delay
+	from=fe80::54fb:1bff:feca:55ed mldv2 group=ff02::1:ff00:1234 mode=is-exclude
+	from=fe80::54fb:1bff:feca:55ed mldv2 group=ff3e::1234 mode=is-exclude
+	from=fe80::54fb:1bff:feca:55ed mldv2 group=ff02::1:ff00:2 mode=is-exclude
+	from=fe80::54fb:1bff:feca:55ed mldv2 group=ff02::1:ffca:55ed mode=is-exclude
+	from=192.0.3.2 igmpv3 group=239.1.1.1 mode=is-exclude
+	from=192.0.3.2 igmpv3 group=239.1.1.2 mode=is-exclude
+	from=fe80::7c2e:80ff:fe16:b567 mldv2 group=ff02::1:ff00:2 mode=is-exclude
+	from=fe80::7c2e:80ff:fe16:b567 mldv2 group=ff02::1:ff16:b567 mode=is-exclude
+
+	Multicast listeners:
+	239.1.1.1: 192.0.3.2
+	239.1.1.2: 192.0.3.2
+	ff02::1:ff00:2: fe80::54fb:1bff:feca:55ed fe80::7c2e:80ff:fe16:b567
+	ff02::1:ff00:1234: fe80::54fb:1bff:feca:55ed
+	ff02::1:ff16:b567: fe80::7c2e:80ff:fe16:b567
+	ff02::1:ffca:55ed: fe80::54fb:1bff:feca:55ed
+	ff3e::1234: fe80::54fb:1bff:feca:55ed
+	querier: none heard
+
+
+Discover IPv6 routers with router advertisements
+
+Routers transmits IPv6 router solicitations to the link-local
+all-routers multicast address on the interface specified by -if and
+shows the router advertisements received on the link, solicited or
+not. Each advertisement shows the router lifetime and preference, the
+managed and other configuration flags, the current hop limit, the link
+MTU, and the prefix information, route information, recursive DNS
+server and DNS search list options. Advertisements not received from
+a link-local address with the hop limit of 255 are ignored. With
+-passive, it only listens for advertisements, which is useful for
+finding routers that stay quiet for solicitations.
+It warns when multiple routers advertise on the link. With -allow, it
+instead warns about the routers whose address and link-layer address
+are not in the list, which is useful for detecting rogue routers.
+The summary shows the routers heard on the link.
+
+Usage:	ipoam routers [flags]
+
+Flags:
+	-allow string
+		Comma-separated list of expected router addresses or link-layer addresses
+	-count int
+		Iteration count, less than or equal to zero will run until interrupted (default 3)
+	-if string
+		Outbound interface name, required
+	-n	Don't use DNS reverse lookup
+	-passive
+		Listen for advertisements without transmitting solicitations
+	-q	Quiet output except summary and warnings
+	-v	Show verbose information
+	-wait int
+		Seconds between transmitting each solicitation, or of each iteration with -passive (default 4)
+
+A sample output:
+
+	% sudo ipoam routers -n -count 1 -allow fe80::7c2e:80ff:fe16:b567 -if eth0
+	Router discovery via eth0
+	from=fe80::7c2e:80ff:fe16:b567 lladdr=56:fb:1b:ca:55:ed lifetime=30m0s pref=high flags=O curhlim=64 mtu=1500 hlim=255 rtt=341.820644ms
+		prefix=fd01::/64 flags=LA valid=24h0m0s preferred=4h0m0s
+		route=fd02::/48 pref=high lifetime=infinity
+		rdnss=fd01::53 lifetime=1h0m0s
+		dnssl=example.org lifetime=1h0m0s
+	from=fe80::54fb:1bff:feca:55ed lladdr=7e:2e:80:16:b5:67 lifetime=0s pref=low flags=O curhlim=64 mtu=1500 hlim=255 unexpected
+		prefix=fd01::/64 flags=LA valid=24h0m0s preferred=4h0m0s
+		route=fd02::/48 pref=high lifetime=infinity
+		rdnss=fd01::53 lifetime=1h0m0s
+		dnssl=example.org lifetime=1h0m0s
+
+	Statistical information for eth0:
+	routers: loss=0.0% rcvd=2 sent=1 op.err=0 min=341.820644ms avg=341.820644ms max=341.820644ms stddev=0s
+	router: fe80::7c2e:80ff:fe16:b567 lladdr=56:fb:1b:ca:55:ed lifetime=30m0s pref=high rcvd=1
+	router: fe80::54fb:1bff:feca:55ed lladdr=7e:2e:80:16:b5:67 lifetime=0s pref=low rcvd=1 non-default
+	warning: unexpected router fe80::54fb:1bff:feca:55ed(7e:2e:80:16:b5:67)
+
+
+Verify MPLS LSP connectivity
+
+LSP Ping transmits MPLS echo requests carrying a Target FEC Stack TLV
+over UDP port 3503, as described in RFC 8029, and shows the return
+code and subcode of each echo reply. The FEC is either an LDP prefix
+FEC or, with -generic, a generic prefix FEC; -nil pushes a nil FEC
+on top of it. The echo requests carry the router alert option and are
+sent to 127.0.0.1 for IPv4 FEC, so that they are not forwarded as IP
+packets when the LSP is broken, or to the address specified by -to.
+IPv6 FEC requires -to, because kernels don't transmit IPv6 packets to
+::ffff:127.0.0.0/104 described in RFC 8029. They are expected to be
+labeled by the ingress LSR, such as a policy route with MPLS
+encapsulation on Linux.
+ICMP error messages are shown with the MPLS label stack described in
+RFC 4950.
+
+Usage:	ipoam lsp-ping [flags] fec
+
+Fec:
+	An IP address or IP address prefix of LDP or generic prefix FEC.
+
+Flags:
+	-count int
+		Iteration count, less than or equal to zero will run until interrupted
+	-generic
+		Use generic prefix FEC instead of LDP prefix FEC
+	-hops int
+		IPv4 TTL or IPv6 hop-limit on echo requests (default 255)
+	-if string
+		Outbound interface name
+	-n	Don't use DNS reverse lookup
+	-nil int
+		Push nil FEC with the label on top of the target FEC stack (default -1)
+	-port int
+		Destination port (default 3503)
+	-src string
+		Source IP address
+	-to string
+		Destination IP address of echo requests, 127.0.0.1 by default for IPv4 FEC and required for IPv6 FEC
+	-v	Show verbose information
+	-wait int
+		Seconds between transmitting each echo request (default 1)
+
+A sample output:
+
+	% ipoam lsp-ping -count=2 -v 127.0.0.1
+	LSP ping for [ldp:127.0.0.1/32] to 127.0.0.1
+	from=localhost (127.0.0.1) rc=3 rsc=1 seq=1 rtt=653.806µs fwd=431.974µs (replying router is an egress for the FEC at stack-depth)
+	from=localhost (127.0.0.1) rc=3 rsc=1 seq=2 rtt=871.267µs fwd=713.442µs (replying router is an egress for the FEC at stack-depth)
+
+	sent=2 rcvd=2 loss=0.0% min=653.806µs avg=762.536µs max=871.267µs
+	rc=3 (replying router is an egress for the FEC at stack-depth): 2
+
+
+Trace an MPLS LSP
+
+LSP Trace transmits MPLS echo requests with increasing IPv4 TTL or
+IPv6 hop limit, which the ingress LSR copies to the label stack
+entry, and shows the echo reply or ICMP error message from each hop
+until the egress for the FEC answers.
+
+Usage:	ipoam lsp-trace [flags] fec
+
+Fec:
+	An IP address or IP address prefix of LDP or generic prefix FEC.
+
+Flags:
+	-generic
+		Use generic prefix FEC instead of LDP prefix FEC
+	-hops int
+		Maximum IPv4 TTL or IPv6 hop-limit (default 30)
+	-if string
+		Outbound interface name
+	-n	Don't use DNS reverse lookup
+	-nil int
+		Push nil FEC with the label on top of the target FEC stack (default -1)
+	-port int
+		Destination port (default 3503)
+	-src string
+		Source IP address
+	-to string
+		Destination IP address of echo requests, 127.0.0.1 by default for IPv4 FEC and required for IPv6 FEC
+	-v	Show verbose information
+	-wait int
+		Seconds between transmitting each echo request (default 1)
+
+
+Run an MPLS echo reply agent
+
+LSP Responder receives MPLS echo requests and answers them as the
+egress of prefix FECs that cover one of the addresses of the node;
+other prefix FECs are answered with return code 4, no mapping for the
+FEC. Echo requests carrying mandatory TLVs that it doesn't understand
+are answered with return code 2 and an Errored TLVs TLV.
+
+Usage:	ipoam lsp-responder [flags]
+
+Flags:
+	-4	Receive IPv4 echo requests only
+	-6	Receive IPv6 echo requests only
+	-port int
+		Listening port (default 3503)
+
+
+Run a BFD session
+
+BFD runs a Bidirectional Forwarding Detection session in asynchronous
+mode with the peer, as described in RFC 5880, and shows the state
+changes of the session. Single-hop sessions use UDP port 3784 and
+accept control packets with the IPv4 TTL or IPv6 hop limit of 255 only,
+as described in RFC 5881; multihop sessions use UDP port 4784, as
+described in RFC 5883. The echo function transmits echo packets to
+UDP port 3785 of the peer that reflects them, and declares the session
+down when they are not returned.
+
+Usage:	ipoam bfd [flags] peer
+
+Peer:
+	A hostname, DNS reg-name or IP address of BFD peer.
+
+Flags:
+	-4	Run IPv4 session only
+	-6	Run IPv6 session only
+	-auth string
+		Authentication type, either simple, md5, meticulous-md5, sha1 or meticulous-sha1
+	-echo int
+		Milliseconds between transmitting each echo packet, zero disables echo function
+	-echorx int
+		Required minimum echo receive interval in milliseconds, zero disables reflecting echo packets
+	-key string
+		Authentication password or key
+	-keyid int
+		Authentication key ID (default 1)
+	-mult int
+		Detection time multiplier (default 3)
+	-multihop
+		Run multihop session
+	-n	Don't use DNS reverse lookup
+	-port int
+		Control packet port, 3784 for single-hop or 4784 for multihop session by default
+	-rx int
+		Required minimum receive interval in milliseconds (default 1000)
+	-src string
+		Source IP address
+	-tx int
+		Desired minimum transmit interval in milliseconds (default 1000)
+	-v	Show verbose information
+
+A sample output of two sessions on the loopback interface:
+
+	% ipoam bfd -tx=100 -rx=100 -src=127.0.0.2 127.0.0.1
+	BFD single-hop session with 127.0.0.1 on 127.0.0.2:3784: discriminator=1106572732
+	13:22:09.037 state=Init old=Down diag=0 remote.state=Down remote.diag=0
+	13:22:09.121 state=Up old=Init diag=0 remote.state=Up remote.diag=0
+
+	% ipoam bfd -tx=100 -rx=100 -src=127.0.0.1 127.0.0.2
+	BFD single-hop session with 127.0.0.2 on 127.0.0.1:3784: discriminator=544835929
+	13:22:09.037 state=Up old=Down diag=0 remote.state=Init remote.diag=0
+	13:22:12.034 state=Down old=Up diag=3 remote.state=AdminDown remote.diag=7 (neighbor signaled session down)
+
+
+Verify reachability of remote discriminators with S-BFD
+
+SBFD runs a Seamless Bidirectional Forwarding Detection initiator, as
+described in RFC 7880 and RFC 7881. It transmits control packets to
+the remote discriminator of each target periodically without session
+setup, and shows the state and round-trip time reported by the
+reflector. A target goes down when no response arrives within the
+detection time.
+
+Usage:	ipoam sbfd [flags] target [target...]
+
+Target:
+	A hostname, DNS reg-name or IP address of S-BFD reflector,
+	optionally prefixed with the remote discriminator and @, such as
+	192.0.2.1@router1 or 3221225985@2001:db8::1.
+
+Flags:
+	-4	Run IPv4 test only
+	-6	Run IPv6 test only
+	-count int
+		Iteration count, less than or equal to zero will run until interrupted
+	-disc string
+		Remote discriminator of targets without explicit discriminator, the IPv4 address of target by default
+	-if string
+		Outbound interface name
+	-local string
+		Local discriminator, random by default
+	-mult int
+		Detection time multiplier (default 3)
+	-n	Don't use DNS reverse lookup
+	-q	Quiet output except state changes and summary
+	-src string
+		Source IP address
+	-wait int
+		Milliseconds between transmitting each control packet (default 1000)
+
+A sample output:
+
+	% ipoam sbfd -n -count=2 127.0.0.1
+	S-BFD initiator with 1 targets: discriminator=594874263
+	from=127.0.0.1 disc=2130706433 state=Up rtt=544.461µs rx=1ms
+	target=127.0.0.1 disc=2130706433 state=Up old.state=Down
+	from=127.0.0.1 disc=2130706433 state=Up rtt=276.329µs rx=1ms
+
+	Statistical information:
+	127.0.0.1 disc=2130706433 state=Up: loss=0.0% rcvd=2 sent=2 op.err=0 icmp.err=0 min=276.329µs avg=410.395µs max=544.461µs stddev=134.066µs
+
+
+Run an S-BFD reflector
+
+SBFD Reflector responds to control packets addressed to one of the
+discriminators in its table, and discards the others.
+
+Usage:	ipoam sbfd-reflector [flags] discriminator [discriminator...]
+
+Discriminator:
+	A 32-bit unsigned integer or IPv4 address form of the discriminator
+	that the reflector responds to.
+
+Flags:
+	-4	Receive IPv4 control packets only
+	-6	Receive IPv6 control packets only
+	-admindown
+		Respond with AdminDown state
+	-port int
+		Listening port (default 7784)
+	-q	Quiet output
+	-rx int
+		Required minimum receive interval in milliseconds (default 1)
+
+
+Measure one-way and round-trip delay and loss with STAMP
+
+STAMP runs a Simple Two-way Active Measurement Protocol
+session-sender, as described in RFC 8762, and shows the round-trip
+delay, and the forward and backward one-way delays computed from the
+timestamps on the session-sender and session-reflector. The one-way
+delays are accurate only when the clocks of both hosts are
+synchronized. The forward and backward loss are shown when the
+session-reflector is stateful. TLVs described in RFC 8972 are carried
+with -tlv; pad for Extra Padding, ts for Timestamp Information, cos
+for Class of Service and dm for Direct Measurement.
+
+Usage:	ipoam stamp [flags] destination
+
+Destination:
+	A hostname, DNS reg-name or IP address of STAMP session-reflector.
+
+Flags:
+	-4	Run IPv4 test only
+	-6	Run IPv6 test only
+	-count int
+		Iteration count, less than or equal to zero will run until interrupted
+	-if string
+		Outbound interface name
+	-key string
+		Shared key for authenticated mode
+	-n	Don't use DNS reverse lookup
+	-port int
+		Destination port (default 862)
+	-ptp
+		Use truncated PTP timestamp format instead of NTP timestamp format
+	-q	Quiet output except summary
+	-src string
+		Source IP address
+	-ssid int
+		Session-sender identifier, the process ID by default
+	-tlv string
+		TLVs on test packets, comma-separated list of pad=length, ts, cos=dscp and dm
+	-v	Show verbose information
+	-wait int
+		Seconds between transmitting each test packet (default 1)
+
+A sample output:
+
+	% ipoam stamp -n -count=2 127.0.0.1
+	STAMP session 19553 to 127.0.0.1: unauthenticated mode
+	from=127.0.0.1 seq=0 rtt=559.035µs fwd=338.723µs bwd=220.312µs
+	from=127.0.0.1 seq=1 rtt=327.43µs fwd=243.198µs bwd=84.232µs
+
+	Statistical information for 127.0.0.1:
+	round-trip: loss=0.0% rcvd=2 sent=2 op.err=0 icmp.err=0 min=327.43µs avg=443.232µs max=559.035µs stddev=115.804µs
+	forward: loss=0.0% min=243.198µs avg=290.96µs max=338.723µs stddev=47.765µs (unsynchronized clocks)
+	backward: loss=0.0% min=84.232µs avg=152.272µs max=220.312µs stddev=68.04µs (unsynchronized clocks)
+
+
+Run a STAMP session-reflector
+
+STAMP Reflector reflects session-sender test packets. A stateful
+session-reflector numbers its test packets per session, and fills the
+counters of Direct Measurement TLV.
+
+Usage:	ipoam stamp-reflector [flags]
+
+Flags:
+	-4	Receive IPv4 test packets only
+	-6	Receive IPv6 test packets only
+	-key string
+		Shared key for authenticated mode
+	-port int
+		Listening port (default 862)
+	-ptp
+		Use truncated PTP timestamp format instead of NTP timestamp format
+	-q	Quiet output
+	-stateless
+		Run stateless session-reflector
+
+
+Measure two-way delay and loss with TWAMP-Light
+
+TWAMP-Light runs a session-sender of the light version of Two-Way
+Active Measurement Protocol, as described in RFC 5357, Appendix I,
+without TWAMP-Control, and shows the round-trip delay excluding the
+processing delay on the session-reflector, and the one-way delays
+computed from the timestamps on both hosts. The test packets are
+unauthenticated.
+
+Usage:	ipoam twamp [flags] destination
+
+Destination:
+	A hostname, DNS reg-name or IP address of TWAMP-Light session-reflector.
+
+Flags:
+	-4	Run IPv4 test only
+	-6	Run IPv6 test only
+	-count int
+		Iteration count, less than or equal to zero will run until interrupted
+	-dscp int
+		DSCP on test packets
+	-error string
+		Timestamp error in error estimate (default "1ms")
+	-if string
+		Outbound interface name
+	-n	Don't use DNS reverse lookup
+	-pad int
+		Packet padding length, 27 or more keeps test packets in both directions the same size (default 27)
+	-port int
+		Destination port (default 862)
+	-ptp
+		Use truncated PTP timestamp format instead of NTP timestamp format
+	-q	Quiet output except summary
+	-src string
+		Source IP address
+	-synced
+		Mark the clock as synchronized to UTC in error estimate
+	-v	Show verbose information
+	-wait int
+		Seconds between transmitting each test packet (default 1)
+
+A sample output:
+
+	% ipoam twamp -n -count=2 -v 127.0.0.1
+	TWAMP-Light session to 127.0.0.1: 27 bytes padding, dscp 0
+	from=127.0.0.1 ttl=64 refl.seq=0 seq=0 rtt=466.668µs fwd=404.815µs bwd=61.853µs refl.rcvd=13:28:20.915397 refl.sent=13:28:20.915402 refl.delay=5.16µs refl.err=1.00708ms
+	from=127.0.0.1 ttl=64 refl.seq=1 seq=1 rtt=449.604µs fwd=153.087µs bwd=296.517µs refl.rcvd=13:28:21.915271 refl.sent=13:28:21.915279 refl.delay=7.673µs refl.err=1.00708ms
+
+	Statistical information for 127.0.0.1:
+	round-trip: loss=0.0% rcvd=2 sent=2 op.err=0 icmp.err=0 min=449.604µs avg=458.136µs max=466.668µs stddev=8.532µs
+	forward: loss=0.0% min=153.087µs avg=278.951µs max=404.815µs stddev=125.864µs (unsynchronized clocks)
+	backward: loss=0.0% min=61.853µs avg=179.185µs max=296.517µs stddev=117.332µs (unsynchronized clocks)
+
+
+Run a TWAMP-Light session-reflector
+
+TWAMP Reflector reflects session-sender test packets with its own
+sequence numbers per session-sender. It truncates the padding to keep
+the test packets in both directions the same size, and transmits IPv6
+test packets with the received DSCP.
+
+Usage:	ipoam twamp-reflector [flags]
+
+Flags:
+	-4	Receive IPv4 test packets only
+	-6	Receive IPv6 test packets only
+	-error string
+		Timestamp error in error estimate (default "1ms")
+	-port int
+		Listening port (default 862)
+	-ptp
+		Use truncated PTP timestamp format instead of NTP timestamp format
+	-q	Quiet output
+	-synced
+		Mark the clock as synchronized to UTC in error estimate
+
+
+Measure one-way delay and loss with OWAMP
+
+OWPing runs One-Way Active Measurement Protocol sessions, as described
+in RFC 4656, with an OWAMP server. It negotiates a session to the
+server and a session from the server over OWAMP-Control, transmits or
+receives test packets on a Poisson or periodic schedule, and shows the
+one-way delay and loss from the arrival records of each session. The
+records of the session to the server are fetched from the server. Both
+OWAMP-Control and OWAMP-Test are unauthenticated. The Poisson schedule
+doesn't use the pseudo-random generator of RFC 4656, and so a server
+of another implementation expects different departure times.
+
+Usage:	ipoam owping [flags] server
+
+Server:
+	A hostname, DNS reg-name or IP address of OWAMP server.
+
+Flags:
+	-4	Run IPv4 test only
+	-6	Run IPv6 test only
+	-count int
+		Number of test packets in each session (default 100)
+	-dscp int
+		DSCP on test packets
+	-error string
+		Timestamp error in error estimate (default "1ms")
+	-f	Run the session from the server only
+	-fixed
+		Transmit test packets at fixed intervals instead of exponentially distributed intervals
+	-interval string
+		Mean interval between test packets (default "100ms")
+	-n	Don't use DNS reverse lookup
+	-pad int
+		Packet padding length
+	-port int
+		Destination port (default 861)
+	-q	Quiet output except summary
+	-synced
+		Mark the clock as synchronized to UTC in error estimate
+	-t	Run the session to the server only
+	-timeout int
+		Seconds to wait for test packets after the last transmission (default 2)
+
+A sample output:
+
+	% ipoam owping -n -count=3 -interval=20ms -timeout=1 127.0.0.1
+	OWAMP sessions with 127.0.0.1: 3 test packets, 20ms mean interval, 0 bytes padding, dscp 0
+
+	--- to 127.0.0.1 -> 127.0.0.1 sid=7f000001ee7f51458fefb40fa22c812d ---
+	seq=0 ttl=255 delay=30.959µs err=2.01416ms
+	seq=1 ttl=255 delay=108.407µs err=2.01416ms
+	seq=2 ttl=255 delay=150.808µs err=2.01416ms
+	one-way: loss=0.0% rcvd=3 sent=3 min=30.959µs avg=96.724µs max=150.808µs stddev=49.621µs (unsynchronized clocks)
+
+	--- from 127.0.0.1 -> 127.0.0.1 sid=7f000001ee7f51458ff64e7fa6b84bae ---
+	seq=0 ttl=255 delay=158.623µs err=2.01416ms
+	seq=1 ttl=255 delay=127.78µs err=2.01416ms
+	seq=2 ttl=255 delay=68.735µs err=2.01416ms
+	one-way: loss=0.0% rcvd=3 sent=3 min=68.735µs avg=118.379µs max=158.623µs stddev=37.294µs (unsynchronized clocks)
+
+
+Run an OWAMP server
+
+OWAMPd accepts OWAMP-Control connections in unauthenticated mode,
+receives test packets and stores their arrival records for fetching,
+and transmits test packets to the client on the requested schedule.
+
+Usage:	ipoam owampd [flags]
+
+Flags:
+	-4	Accept IPv4 connections only
+	-6	Accept IPv6 connections only
+	-error string
+		Timestamp error in error estimate (default "1ms")
+	-port int
+		Listening port (default 861)
+	-q	Quiet output
+	-synced
+		Mark the clock as synchronized to UTC in error estimate
+
 
 Show network facility information
 
@@ -5,7 +5,10 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strings"
 	"time"
@@ -116,6 +119,229 @@ func literalOrName(s string, noRevLookup bool) string {
 	}
 }
 
+func parseIPv4Options(rr bool, ts string) ([]byte, error) {
+	var opts []byte
+	rrSlots, tsSlots, tsaSlots := 9, 9, 4
+	if rr && ts != "" { // share 40 bytes of option space
+		rrSlots, tsSlots, tsaSlots = 4, 4, 2
+	}
+	if rr {
+		b, err := (&ipoam.RecordRoute{Slots: rrSlots}).Marshal()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, b...)
+	}
+	if ts == "" {
+		return opts, nil
+	}
+	var o ipoam.Timestamp
+	switch {
+	case ts == "tsonly":
+		o.Flag, o.Slots = ipoam.TimestampOnly, tsSlots
+	case ts == "tsandaddr":
+		o.Flag, o.Slots = ipoam.TimestampAndAddr, tsaSlots
+	case strings.HasPrefix(ts, "tsprespec="):
+		o.Flag = ipoam.TimestampPrespecified
+		for _, s := range strings.Split(strings.TrimPrefix(ts, "tsprespec="), ",") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, &net.AddrError{Err: "invalid prespecified address", Addr: s}
+			}
+			o.Entries = append(o.Entries, ipoam.TimestampEntry{Addr: ip})
+		}
+	default:
+		return nil, fmt.Errorf("unknown timestamp option: %s", ts)
+	}
+	b, err := o.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, b...)
+	if len(opts) > 40 {
+		return nil, fmt.Errorf("IPv4 options too long: %d", len(opts))
+	}
+	return opts, nil
+}
+
+const (
+	// fragPayloadLen is the payload length of probe packets with
+	// a fragment header, that makes the packets larger than the
+	// IPv6 minimum MTU.
+	fragPayloadLen = 1280
+
+	// largePayloadLen is the payload length of the largest probe
+	// packets that fit in the IPv6 minimum MTU without
+	// fragmentation.
+	largePayloadLen = 1280 - 40 - 8
+)
+
+// fragPayload returns b extended to fragPayloadLen bytes with data
+// when hs contains a fragment header.
+// A fragment header appears only on probe packets that are larger
+// than the IPv6 minimum MTU and therefore fragmented.
+func fragPayload(b, data []byte, hs []ipoam.IPv6ExtHeader) []byte {
+	for _, h := range hs {
+		if h.Type == ipoam.IPv6Fragment && len(b) < fragPayloadLen {
+			return bytes.Repeat(data, fragPayloadLen/len(data)+1)[:fragPayloadLen]
+		}
+	}
+	return b
+}
+
+func parseIPv6ExtHeaders(s string) ([]ipoam.IPv6ExtHeader, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var hs []ipoam.IPv6ExtHeader
+	for _, name := range strings.Split(s, ",") {
+		switch name {
+		case "hbh":
+			hs = append(hs, ipoam.IPv6ExtHeader{Type: ipoam.IPv6HopByHop})
+		case "dst":
+			hs = append(hs, ipoam.IPv6ExtHeader{Type: ipoam.IPv6DstOpts})
+		case "rt":
+			hs = append(hs, ipoam.IPv6ExtHeader{Type: ipoam.IPv6Routing})
+		case "frag":
+			hs = append(hs, ipoam.IPv6ExtHeader{Type: ipoam.IPv6Fragment})
+		default:
+			return nil, fmt.Errorf("unknown IPv6 extension header: %s", name)
+		}
+	}
+	return hs, nil
+}
+
+func parseSegments(s string) ([]net.IP, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var segs []net.IP
+	for _, s := range strings.Split(s, ",") {
+		ip := net.ParseIP(s)
+		if ip == nil || ip.To4() != nil {
+			return nil, &net.AddrError{Err: "invalid segment", Addr: s}
+		}
+		segs = append(segs, ip)
+	}
+	return segs, nil
+}
+
+// appendSRH returns hs with a segment routing header that steers
+// packets through segs toward dst.
+// It returns hs when segs is empty.
+func appendSRH(hs []ipoam.IPv6ExtHeader, segs []net.IP, dst net.IP) ([]ipoam.IPv6ExtHeader, error) {
+	if len(segs) == 0 {
+		return hs, nil
+	}
+	for _, h := range hs {
+		if h.Type == ipoam.IPv6Routing {
+			return nil, errors.New("multiple routing headers")
+		}
+	}
+	b, err := ipoam.NewSegmentRoutingHeader(segs, dst).Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return append(hs[:len(hs):len(hs)], ipoam.IPv6ExtHeader{Type: ipoam.IPv6Routing, Data: b}), nil
+}
+
+// parseNAT64Prefixes returns the NAT64 prefixes specified by s,
+// either "auto" for the discovery using ipv4only.arpa, or a
+// comma-separated list of IPv6 prefixes.
+// It returns nil when s is empty.
+func parseNAT64Prefixes(s string) ([]*net.IPNet, error) {
+	switch s {
+	case "":
+		return nil, nil
+	case "auto":
+		return ipoam.DiscoverNAT64Prefixes()
+	}
+	var prefixes []*net.IPNet
+	for _, s := range strings.Split(s, ",") {
+		_, prefix, err := net.ParseCIDR(s)
+		if err != nil || prefix.IP.To4() != nil {
+			return nil, &net.AddrError{Err: "invalid NAT64 prefix", Addr: s}
+		}
+		if _, err := ipoam.NAT64Synthesize(prefix, net.IPv4zero); err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// synthesizeDsts returns a cursor that holds the IPv4-embedded IPv6
+// addresses of the IPv4 destinations in c with prefix, and the IPv6
+// destinations in c as they are.
+// It returns c when c holds no IPv4 destination.
+func synthesizeDsts(c *ipaddr.Cursor, prefix *net.IPNet) (*ipaddr.Cursor, error) {
+	var ps []ipaddr.Prefix
+	var synthesized bool
+	for _, p := range c.List() {
+		if p.IP.To4() == nil {
+			ps = append(ps, p)
+			continue
+		}
+		c4 := ipaddr.NewCursor([]ipaddr.Prefix{p})
+		for pos := c4.First(); pos != nil; pos = c4.Next() {
+			ip, err := ipoam.NAT64Synthesize(prefix, pos.IP)
+			if err != nil {
+				return nil, err
+			}
+			ps = append(ps, *newPrefix(ip))
+		}
+		synthesized = true
+	}
+	c.Reset(nil)
+	if !synthesized {
+		return c, nil
+	}
+	return ipaddr.NewCursor(ps), nil
+}
+
+// printNAT64Dst prints the IPv4 address embedded in dst when dst is
+// an IPv4-embedded IPv6 address with one of prefixes, or with the
+// well-known prefix when prefixes is empty.
+func printNAT64Dst(w io.Writer, dst net.IP, prefixes []*net.IPNet) {
+	if len(prefixes) == 0 {
+		prefixes = []*net.IPNet{ipoam.WellKnownNAT64Prefix}
+	}
+	for _, prefix := range prefixes {
+		if ip := ipoam.NAT64Extract(prefix, dst); ip != nil {
+			fmt.Fprintf(w, "NAT64: %v is synthesized from %v with %v\n", dst, ip, prefix)
+			return
+		}
+	}
+}
+
+func printNAT64Src(w io.Writer, r *ipoam.Report) {
+	if r.SrcIPv4 != nil {
+		fmt.Fprintf(w, " ipv4=%v", r.SrcIPv4)
+	}
+}
+
+func printIPv4Options(w io.Writer, r *ipoam.Report) {
+	if r.RecordRoute != nil {
+		fmt.Fprintf(w, " rr=%v", r.RecordRoute.Route)
+	}
+	if r.Timestamp != nil {
+		fmt.Fprintf(w, " ts=[")
+		for i, e := range r.Timestamp.Entries {
+			if i > 0 {
+				fmt.Fprintf(w, " ")
+			}
+			if e.Addr != nil {
+				fmt.Fprintf(w, "%v@", e.Addr)
+			}
+			fmt.Fprintf(w, "%dms", e.Time)
+		}
+		fmt.Fprintf(w, "]")
+		if r.Timestamp.Overflow > 0 {
+			fmt.Fprintf(w, " ts.oflw=%d", r.Timestamp.Overflow)
+		}
+	}
+}
+
 func hasReached(r *ipoam.Report) bool {
 	if r.Error != nil || r.ICMP == nil {
 		return false
@@ -128,3 +354,53 @@ func hasReached(r *ipoam.Report) bool {
 	}
 	return false
 }
+
+// An appReply represents an application-level reply to a UDP probe
+// packet.
+type appReply struct {
+	time time.Time
+	src  net.IP
+	*ipoam.AppReply
+}
+
+// readAppReplies reads the application-level replies of p to the
+// probe packets transmitted by ipt until ipt is closed.
+func readAppReplies(ipt *ipoam.Tester, p ipoam.AppProtocol) <-chan appReply {
+	ch := make(chan appReply, 1)
+	go func() {
+		b := make([]byte, 1<<16-1)
+		for {
+			n, peer, err := ipt.ReadFrom(b)
+			if err != nil {
+				if err, ok := err.(net.Error); ok && err.Timeout() {
+					continue
+				}
+				return
+			}
+			now := time.Now()
+			src, ok := peer.(*net.UDPAddr)
+			if !ok || src.Port != p.Port() {
+				continue
+			}
+			r, err := ipoam.ParseAppReply(p, b[:n])
+			if err != nil {
+				continue
+			}
+			ch <- appReply{time: now, src: src.IP, AppReply: r}
+		}
+	}()
+	return ch
+}
+
+// printAppReply writes the application-level reply r to w.
+func printAppReply(w io.Writer, r *ipoam.AppReply) {
+	fmt.Fprintf(w, " app=%v", r.Protocol)
+	switch r.Protocol {
+	case ipoam.AppDNS:
+		fmt.Fprintf(w, " dns.rcode=%d", r.RCode)
+	case ipoam.AppNTP:
+		fmt.Fprintf(w, " ntp.stratum=%d", r.Stratum)
+	case ipoam.AppSNMP:
+		fmt.Fprintf(w, " snmp.err=%d", r.ErrorStatus)
+	}
+}
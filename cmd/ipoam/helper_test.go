@@ -0,0 +1,36 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/mikioh/ipaddr"
+	"github.com/mikioh/ipoam"
+)
+
+func TestSynthesizeDsts(t *testing.T) {
+	c, _, err := parseDsts("192.0.2.1,2001:db8::1", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err = synthesizeDsts(c, ipoam.WellKnownNAT64Prefix); err != nil {
+		t.Fatal(err)
+	}
+	var ips []string
+	for pos := c.First(); pos != nil; pos = c.Next() {
+		ips = append(ips, pos.IP.String())
+	}
+	if want := []string{"64:ff9b::c000:201", "2001:db8::1"}; !reflect.DeepEqual(ips, want) {
+		t.Errorf("got %v; want %v", ips, want)
+	}
+
+	c = ipaddr.NewCursor([]ipaddr.Prefix{*newPrefix(net.ParseIP("2001:db8::1"))})
+	if got, err := synthesizeDsts(c, ipoam.WellKnownNAT64Prefix); err != nil || got != c {
+		t.Errorf("got %v, %v; want the same cursor", got, err)
+	}
+}
@@ -0,0 +1,365 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mikioh/ipoam"
+)
+
+var listenersUsageTmpl = `Usage:
+	ipoam {{.Name}} [flags]
+
+`
+
+var (
+	cmdListeners = &Command{
+		Func:      listenersMain,
+		Usage:     cmdUsage,
+		UsageTmpl: listenersUsageTmpl,
+		CanonName: "listeners",
+		Descr:     "Discover multicast listeners with IGMP and MLD queries",
+	}
+
+	lsnIPv4only    bool
+	lsnIPv6only    bool
+	lsnNoRevLookup bool
+	lsnPassive     bool
+	lsnQuiet       bool
+	lsnVerbose     bool
+
+	lsnCount       int
+	lsnIGMPVersion int
+	lsnMaxResp     int
+	lsnMLDVersion  int
+	lsnWait        int
+
+	lsnGroups     string
+	lsnOutboundIf string
+	lsnSources    string
+)
+
+func init() {
+	cmdListeners.Flag.BoolVar(&lsnIPv4only, "4", false, "Run IGMP test only")
+	cmdListeners.Flag.BoolVar(&lsnIPv6only, "6", false, "Run MLD test only")
+	cmdListeners.Flag.BoolVar(&lsnNoRevLookup, "n", false, "Don't use DNS reverse lookup")
+	cmdListeners.Flag.BoolVar(&lsnPassive, "passive", false, "Listen for reports and queries without transmitting queries")
+	cmdListeners.Flag.BoolVar(&lsnQuiet, "q", false, "Quiet output except summary")
+	cmdListeners.Flag.BoolVar(&lsnVerbose, "v", false, "Show verbose information")
+
+	cmdListeners.Flag.IntVar(&lsnCount, "count", 1, "Number of queries for each group")
+	cmdListeners.Flag.IntVar(&lsnIGMPVersion, "igmp", 3, "IGMP version of queries")
+	cmdListeners.Flag.IntVar(&lsnMaxResp, "maxresp", 1000, "Maximum response delay in milliseconds")
+	cmdListeners.Flag.IntVar(&lsnMLDVersion, "mld", 2, "MLD version of queries")
+	cmdListeners.Flag.IntVar(&lsnWait, "wait", 2, "Seconds to wait for reports after each query")
+
+	cmdListeners.Flag.StringVar(&lsnGroups, "group", "", "Comma-separated list of groups for group-specific queries instead of general queries")
+	cmdListeners.Flag.StringVar(&lsnOutboundIf, "if", "", "Outbound interface name, required")
+	cmdListeners.Flag.StringVar(&lsnSources, "src", "", "Comma-separated list of sources for group-and-source-specific queries")
+}
+
+// A listenerState represents the filter state of a listener for a
+// group.
+type listenerState struct {
+	mode    ipoam.MulticastRecordType
+	sources []net.IP
+}
+
+type listenerTable map[string]map[string]*listenerState // group, listener
+
+func (tbl listenerTable) update(src net.IP, rec *ipoam.MulticastRecord) {
+	g, h := rec.Group.String(), src.String()
+	if tbl[g] == nil {
+		tbl[g] = make(map[string]*listenerState)
+	}
+	ls := tbl[g][h]
+	switch {
+	case rec.Type == ipoam.MulticastBlockOldSources && ls != nil:
+		var srcs []net.IP
+		for _, s := range ls.sources {
+			if !containsIP(rec.Sources, s) {
+				srcs = append(srcs, s)
+			}
+		}
+		ls.sources = srcs
+	case rec.Type == ipoam.MulticastAllowNewSources && ls != nil:
+		for _, s := range rec.Sources {
+			if !containsIP(ls.sources, s) {
+				ls.sources = append(ls.sources, s)
+			}
+		}
+	case rec.Listening():
+		mode := ipoam.MulticastModeIsExclude
+		if rec.Type == ipoam.MulticastModeIsInclude || rec.Type == ipoam.MulticastAllowNewSources {
+			mode = ipoam.MulticastModeIsInclude
+		}
+		tbl[g][h] = &listenerState{mode: mode, sources: rec.Sources}
+	default:
+		delete(tbl[g], h)
+	}
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, x := range ips {
+		if x.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func listenersMain(cmd *Command, args []string) {
+	if lsnOutboundIf == "" {
+		cmd.Flag.Usage()
+	}
+	ifi, err := net.InterfaceByName(lsnOutboundIf)
+	if err != nil {
+		cmd.fatal(err)
+	}
+	groups, err := parseIPList(lsnGroups)
+	if err != nil {
+		cmd.fatal(err)
+	}
+	srcs, err := parseIPList(lsnSources)
+	if err != nil {
+		cmd.fatal(err)
+	}
+	if len(srcs) > 0 && len(groups) == 0 {
+		cmd.fatal(fmt.Errorf("source-specific query requires groups"))
+	}
+	wait := time.Duration(lsnWait) * time.Second
+	if wait <= 0 {
+		wait = time.Second
+	}
+	// IGMPv1 hosts respond within 10 seconds regardless of the max
+	// response delay.
+	if !lsnIPv6only && lsnIGMPVersion == 1 && wait < 10*time.Second {
+		wait = 10 * time.Second
+	}
+	if maxResp := time.Duration(lsnMaxResp) * time.Millisecond; wait < maxResp {
+		wait = maxResp
+	}
+
+	var ipts [2]struct {
+		t       *ipoam.ListenerTester
+		r       <-chan ipoam.ListenerReport
+		queries []*ipoam.MulticastQuery
+	}
+	for i, network := range []string{"ip4", "ip6"} {
+		if i == 0 && lsnIPv6only || i == 1 && lsnIPv4only {
+			continue
+		}
+		version := lsnIGMPVersion
+		if i == 1 {
+			version = lsnMLDVersion
+		}
+		var queries []*ipoam.MulticastQuery
+		for _, g := range groups {
+			if (g.To4() != nil) != (i == 0) {
+				continue
+			}
+			q := ipoam.MulticastQuery{Version: version, Group: g, MaxResponse: time.Duration(lsnMaxResp) * time.Millisecond, Robustness: 2, Interval: 125 * time.Second}
+			for _, s := range srcs {
+				if (s.To4() != nil) == (i == 0) {
+					q.Sources = append(q.Sources, s)
+				}
+			}
+			queries = append(queries, &q)
+		}
+		if len(groups) == 0 {
+			queries = append(queries, &ipoam.MulticastQuery{Version: version, MaxResponse: time.Duration(lsnMaxResp) * time.Millisecond, Robustness: 2, Interval: 125 * time.Second})
+		}
+		if len(queries) == 0 {
+			continue
+		}
+		t, err := ipoam.NewListenerTester(network, ifi)
+		if err != nil {
+			// Run the test for the other address family when
+			// the interface has no address for this one.
+			if !lsnIPv4only && !lsnIPv6only {
+				continue
+			}
+			cmd.fatal(err)
+		}
+		defer t.Close()
+		ipts[i].t, ipts[i].r, ipts[i].queries = t, t.Report(), queries
+	}
+	if ipts[0].t == nil && ipts[1].t == nil {
+		cmd.fatal(fmt.Errorf("no IGMP or MLD test on %s", ifi.Name))
+	}
+
+	bw := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(bw, "Multicast listener discovery on %s", ifi.Name)
+	if !lsnPassive {
+		var protos []string
+		if ipts[0].t != nil {
+			protos = append(protos, fmt.Sprintf("igmpv%d", lsnIGMPVersion))
+		}
+		if ipts[1].t != nil {
+			protos = append(protos, fmt.Sprintf("mldv%d", lsnMLDVersion))
+		}
+		fmt.Fprintf(bw, ": %s queries, %v max response delay", strings.Join(protos, " and "), time.Duration(lsnMaxResp)*time.Millisecond)
+	}
+	fmt.Fprintf(bw, "\n")
+	bw.Flush()
+
+	tbl := make(listenerTable)
+	queriers := make(map[string]string)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	for i := 0; i < lsnCount; i++ {
+		if !lsnPassive {
+			for _, ipt := range ipts {
+				for _, q := range ipt.queries {
+					if err := ipt.t.Query(q); err != nil {
+						cmd.fatal(err)
+					}
+				}
+			}
+		}
+		t := time.NewTimer(wait)
+	loop:
+		for {
+			var r ipoam.ListenerReport
+			select {
+			case <-sig:
+				printListeners(bw, tbl, queriers)
+				os.Exit(0)
+			case <-t.C:
+				break loop
+			case r = <-ipts[0].r:
+			case r = <-ipts[1].r:
+			}
+			if r.Error != nil {
+				cmd.fatal(r.Error)
+			}
+			proto := "igmp"
+			if r.Src.To4() == nil {
+				proto = "mld"
+			}
+			if r.Query != nil {
+				queriers[r.Src.String()] = fmt.Sprintf("%sv%d", proto, r.Version)
+			} else {
+				for i := range r.Records {
+					tbl.update(r.Src, &r.Records[i])
+				}
+			}
+			if !lsnQuiet {
+				printListenerReport(bw, proto, &r)
+			}
+		}
+		t.Stop()
+	}
+	printListeners(bw, tbl, queriers)
+	os.Exit(0)
+}
+
+func parseIPList(s string) ([]net.IP, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ips []net.IP
+	for _, s := range strings.Split(s, ",") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address: %s", s)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func printListenerReport(bw *bufio.Writer, proto string, r *ipoam.ListenerReport) {
+	prefix := fmt.Sprintf("from=%s", literalOrName(r.Src.String(), lsnNoRevLookup))
+	if lsnVerbose {
+		prefix += fmt.Sprintf(" lladdr=%v", r.LinkAddr)
+	}
+	prefix += fmt.Sprintf(" %sv%d", proto, r.Version)
+	if q := r.Query; q != nil {
+		fmt.Fprintf(bw, "%s query", prefix)
+		if q.Group != nil && !q.Group.IsUnspecified() {
+			fmt.Fprintf(bw, " group=%v", q.Group)
+		}
+		if len(q.Sources) > 0 {
+			fmt.Fprintf(bw, " sources=%s", joinIPs(q.Sources))
+		}
+		fmt.Fprintf(bw, " maxresp=%v", q.MaxResponse)
+		if lsnVerbose && (proto == "igmp" && r.Version == 3 || proto == "mld" && r.Version == 2) {
+			fmt.Fprintf(bw, " qrv=%d qqi=%v s=%v", q.Robustness, q.Interval, q.SuppressRouterSide)
+		}
+		fmt.Fprintf(bw, "\n")
+	}
+	for _, rec := range r.Records {
+		fmt.Fprintf(bw, "%s group=%v mode=%v", prefix, rec.Group, rec.Type)
+		if len(rec.Sources) > 0 {
+			fmt.Fprintf(bw, " sources=%s", joinIPs(rec.Sources))
+		}
+		fmt.Fprintf(bw, "\n")
+	}
+	bw.Flush()
+}
+
+func joinIPs(ips []net.IP) string {
+	var ss []string
+	for _, ip := range ips {
+		ss = append(ss, ip.String())
+	}
+	return strings.Join(ss, ",")
+}
+
+func printListeners(bw *bufio.Writer, tbl listenerTable, queriers map[string]string) {
+	fmt.Fprintf(bw, "\nMulticast listeners:\n")
+	var groups []net.IP
+	for g, ls := range tbl {
+		if len(ls) > 0 {
+			groups = append(groups, net.ParseIP(g))
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return bytes.Compare(groups[i].To16(), groups[j].To16()) < 0 })
+	for _, g := range groups {
+		ls := tbl[g.String()]
+		var hosts []string
+		for h := range ls {
+			hosts = append(hosts, h)
+		}
+		sort.Strings(hosts)
+		fmt.Fprintf(bw, "%v:", g)
+		for _, h := range hosts {
+			st := ls[h]
+			fmt.Fprintf(bw, " %s", literalOrName(h, lsnNoRevLookup))
+			switch {
+			case st.mode == ipoam.MulticastModeIsInclude:
+				fmt.Fprintf(bw, "(include=%s)", joinIPs(st.sources))
+			case len(st.sources) > 0:
+				fmt.Fprintf(bw, "(exclude=%s)", joinIPs(st.sources))
+			}
+		}
+		fmt.Fprintf(bw, "\n")
+	}
+	if len(groups) == 0 {
+		fmt.Fprintf(bw, "none\n")
+	}
+	var qs []string
+	for q, proto := range queriers {
+		qs = append(qs, fmt.Sprintf("%s(%s)", literalOrName(q, lsnNoRevLookup), proto))
+	}
+	sort.Strings(qs)
+	if len(qs) == 0 {
+		fmt.Fprintf(bw, "querier: none heard\n")
+	} else {
+		fmt.Fprintf(bw, "querier: %s\n", strings.Join(qs, " "))
+	}
+	bw.Flush()
+}
@@ -0,0 +1,475 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mikioh/ipoam"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var lspUsageTmpl = `Usage:
+	ipoam {{.Name}} [flags] fec
+
+fec
+	An IP address or IP address prefix of LDP or generic prefix FEC.
+
+`
+
+var lspResponderUsageTmpl = `Usage:
+	ipoam {{.Name}} [flags]
+
+`
+
+var (
+	cmdLSPPing = &Command{
+		Func:      lspPingMain,
+		Usage:     cmdUsage,
+		UsageTmpl: lspUsageTmpl,
+		CanonName: "lsp-ping",
+		Descr:     "Verify MPLS LSP connectivity",
+	}
+	cmdLSPTrace = &Command{
+		Func:      lspTraceMain,
+		Usage:     cmdUsage,
+		UsageTmpl: lspUsageTmpl,
+		CanonName: "lsp-trace",
+		Descr:     "Trace an MPLS LSP",
+	}
+	cmdLSPResponder = &Command{
+		Func:      lspResponderMain,
+		Usage:     cmdUsage,
+		UsageTmpl: lspResponderUsageTmpl,
+		CanonName: "lsp-responder",
+		Descr:     "Run an MPLS echo reply agent",
+	}
+
+	lspNoRevLookup bool
+	lspGeneric     bool
+	lspVerbose     bool
+
+	lspCount    int
+	lspHops     int
+	lspNilLabel int
+	lspPort     int
+	lspWait     int
+
+	lspOutboundIf string
+	lspSrc        string
+	lspTo         string
+
+	lspIPv4only bool
+	lspIPv6only bool
+)
+
+func init() {
+	for _, cmd := range []*Command{cmdLSPPing, cmdLSPTrace} {
+		cmd.Flag.BoolVar(&lspNoRevLookup, "n", false, "Don't use DNS reverse lookup")
+		cmd.Flag.BoolVar(&lspGeneric, "generic", false, "Use generic prefix FEC instead of LDP prefix FEC")
+		cmd.Flag.BoolVar(&lspVerbose, "v", false, "Show verbose information")
+
+		cmd.Flag.IntVar(&lspNilLabel, "nil", -1, "Push nil FEC with the label on top of the target FEC stack")
+		cmd.Flag.IntVar(&lspPort, "port", ipoam.LSPPort, "Destination port")
+		cmd.Flag.IntVar(&lspWait, "wait", 1, "Seconds between transmitting each echo request")
+
+		cmd.Flag.StringVar(&lspOutboundIf, "if", "", "Outbound interface name")
+		cmd.Flag.StringVar(&lspSrc, "src", "", "Source IP address")
+		cmd.Flag.StringVar(&lspTo, "to", "", "Destination IP address of echo requests, 127.0.0.1 by default for IPv4 FEC and required for IPv6 FEC")
+	}
+	cmdLSPPing.Flag.IntVar(&lspCount, "count", 0, "Iteration count, less than or equal to zero will run until interrupted")
+	cmdLSPPing.Flag.IntVar(&lspHops, "hops", 255, "IPv4 TTL or IPv6 hop-limit on echo requests")
+	cmdLSPTrace.Flag.IntVar(&lspHops, "hops", 30, "Maximum IPv4 TTL or IPv6 hop-limit")
+
+	cmdLSPResponder.Flag.BoolVar(&lspIPv4only, "4", false, "Receive IPv4 echo requests only")
+	cmdLSPResponder.Flag.BoolVar(&lspIPv6only, "6", false, "Receive IPv6 echo requests only")
+	cmdLSPResponder.Flag.IntVar(&lspPort, "port", ipoam.LSPPort, "Listening port")
+}
+
+// lspSetup parses the FEC and flags, and returns the tester, the
+// target FEC stack, the destination and the outbound interface.
+func lspSetup(cmd *Command, args []string) (*ipoam.Tester, []ipoam.LSPFEC, net.IP, *net.Interface) {
+	if len(args) == 0 {
+		cmd.Flag.Usage()
+	}
+	prefix, err := parseLSPPrefix(args[0])
+	if err != nil {
+		cmd.fatal(err)
+	}
+	var fecs []ipoam.LSPFEC
+	if lspNilLabel >= 0 {
+		fecs = append(fecs, ipoam.LSPFEC{Type: ipoam.LSPFECNil, Label: lspNilLabel})
+	}
+	fecs = append(fecs, ipoam.NewLSPFEC(prefix, lspGeneric))
+	dst, err := lspDestination(prefix, lspTo)
+	if err != nil {
+		cmd.fatal(err)
+	}
+	ipv6 := dst.To4() == nil
+	var ifi *net.Interface
+	if lspOutboundIf != "" {
+		if ifi, err = net.InterfaceByName(lspOutboundIf); err != nil {
+			cmd.fatal(err)
+		}
+	}
+	if lspWait <= 0 {
+		lspWait = 1
+	}
+
+	network, address := "udp4", "0.0.0.0:0"
+	if ipv6 {
+		network, address = "udp6", "[::]:0"
+	}
+	if lspSrc != "" {
+		address = net.JoinHostPort(lspSrc, "0")
+	}
+	ipt, err := ipoam.NewTester(network, address)
+	if err != nil {
+		cmd.fatal(err)
+	}
+	if p := ipt.IPv4PacketConn(); p != nil {
+		p.SetTTL(lspHops)
+	}
+	if p := ipt.IPv6PacketConn(); p != nil {
+		p.SetHopLimit(lspHops)
+	}
+	return ipt, fecs, dst, ifi
+}
+
+// lspDestination returns the destination of echo requests for the
+// FEC prefix, which is to when it is not empty.
+// The default destination for IPv4 FEC is 127.0.0.1. There's no
+// default for IPv6 FEC, because the destinations in ::ffff:127.0.0.0/104
+// described in RFC 8029 are IPv4-mapped addresses and kernels transmit
+// IPv4 packets to them, or nothing at all.
+func lspDestination(prefix *net.IPNet, to string) (net.IP, error) {
+	if to != "" {
+		dst := net.ParseIP(to)
+		if dst == nil {
+			return nil, &net.AddrError{Err: "invalid destination", Addr: to}
+		}
+		return dst, nil
+	}
+	if prefix.IP.To4() == nil {
+		return nil, &net.AddrError{Err: "IPv6 FEC requires destination specified by -to", Addr: prefix.String()}
+	}
+	return net.IPv4(127, 0, 0, 1), nil
+}
+
+// lspControlMessage returns the control message for echo requests to
+// dst, which carry the IPv4 router alert option or the IPv6 MPLS OAM
+// router alert option as described in RFC 8029.
+func lspControlMessage(dst net.IP) *ipoam.ControlMessage {
+	cm := ipoam.ControlMessage{Port: lspPort}
+	if dst.To4() != nil {
+		cm.IPv4Options = []byte{0x94, 0x04, 0x00, 0x00}
+	} else {
+		cm.IPv6ExtHeaders = []ipoam.IPv6ExtHeader{{Type: ipoam.IPv6HopByHop, Data: []byte{0, 0, 0x05, 0x02, 0x00, 0x45, 0x01, 0x00}}} // MPLS OAM router alert and PadN
+	}
+	return &cm
+}
+
+// parseLSPPrefix parses s as an IP address or IP address prefix.
+func parseLSPPrefix(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		ip, prefix, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		prefix.IP = ip
+		return prefix, nil
+	}
+	ips, err := net.LookupIP(s)
+	if err != nil {
+		return nil, err
+	}
+	ip := ips[0]
+	if ip.To4() != nil {
+		return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+type lspReply struct {
+	m    *ipoam.LSPEcho
+	peer net.Addr
+	rtt  time.Duration
+}
+
+// lspReplies returns the echo replies to echo requests that carry
+// handle.
+func lspReplies(ipt *ipoam.Tester, handle uint32) <-chan lspReply {
+	ch := make(chan lspReply)
+	go func() {
+		b := make([]byte, 1<<16)
+		for {
+			n, peer, err := ipt.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			m, err := ipoam.ParseLSPEcho(b[:n])
+			if err != nil || m.Type != ipoam.LSPEchoReply || m.Handle != handle {
+				continue
+			}
+			ch <- lspReply{m: m, peer: peer, rtt: time.Since(m.Sent)}
+		}
+	}()
+	return ch
+}
+
+func lspPingMain(cmd *Command, args []string) {
+	ipt, fecs, dst, ifi := lspSetup(cmd, args)
+	defer ipt.Close()
+
+	bw := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(bw, "LSP ping for %v to %v\n", fecs, dst)
+	bw.Flush()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	handle := uint32(os.Getpid())
+	replies := lspReplies(ipt, handle)
+	cm := lspControlMessage(dst)
+	var st lspStat
+	for i := 1; ; i++ {
+		t := time.NewTimer(time.Duration(lspWait) * time.Second)
+		req := ipoam.LSPEcho{Type: ipoam.LSPEchoRequest, ReplyMode: ipoam.LSPReplyUDP, Handle: handle, Seq: uint32(i), Sent: time.Now(), FECStack: fecs}
+		b, err := req.Marshal()
+		if err != nil {
+			cmd.fatal(err)
+		}
+		st.sent++
+		if err := ipt.Probe(b, cm, dst, ifi); err != nil {
+			fmt.Fprintf(bw, "error=%q\n", err)
+			bw.Flush()
+		}
+	loop:
+		for {
+			select {
+			case <-sig:
+				printLSPStat(bw, &st)
+				os.Exit(0)
+			case <-t.C:
+				break loop
+			case rep := <-replies:
+				st.onReply(&rep)
+				printLSPReply(bw, &rep)
+			case r := <-ipt.Report():
+				if r.Error != nil {
+					fmt.Fprintf(bw, "error=%q\n", r.Error)
+				} else {
+					fmt.Fprintf(bw, "from=%s icmp.type=%q icmp.code=%d", literalOrName(r.Src.String(), lspNoRevLookup), r.ICMP.Type, r.ICMP.Code)
+					printLSPICMPExtensions(bw, &r)
+					fmt.Fprintf(bw, "\n")
+				}
+				bw.Flush()
+			}
+		}
+		t.Stop()
+		if lspCount > 0 && i == lspCount {
+			printLSPStat(bw, &st)
+			os.Exit(0)
+		}
+	}
+}
+
+func lspTraceMain(cmd *Command, args []string) {
+	ipt, fecs, dst, ifi := lspSetup(cmd, args)
+	defer ipt.Close()
+	if lspHops > 255 {
+		lspHops = 255
+	}
+
+	bw := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(bw, "LSP trace for %v to %v: %d hops max\n", fecs, dst, lspHops)
+	bw.Flush()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	handle := uint32(os.Getpid())
+	replies := lspReplies(ipt, handle)
+	cm := lspControlMessage(dst)
+	for i := 1; i <= lspHops; i++ {
+		if p := ipt.IPv4PacketConn(); p != nil {
+			p.SetTTL(i)
+		}
+		if p := ipt.IPv6PacketConn(); p != nil {
+			p.SetHopLimit(i)
+		}
+		req := ipoam.LSPEcho{Type: ipoam.LSPEchoRequest, ReplyMode: ipoam.LSPReplyUDP, Handle: handle, Seq: uint32(i), Sent: time.Now(), FECStack: fecs}
+		b, err := req.Marshal()
+		if err != nil {
+			cmd.fatal(err)
+		}
+		fmt.Fprintf(bw, "% 3d  ", i)
+		if err := ipt.Probe(b, cm, dst, ifi); err != nil {
+			fmt.Fprintf(bw, "error=%q\n", err)
+			bw.Flush()
+			continue
+		}
+		t := time.NewTimer(time.Duration(lspWait) * time.Second)
+		done := false
+	loop:
+		for {
+			select {
+			case <-sig:
+				os.Exit(0)
+			case <-t.C:
+				fmt.Fprintf(bw, "*\n")
+				break loop
+			case rep := <-replies:
+				if rep.m.Seq != req.Seq {
+					continue
+				}
+				fmt.Fprintf(bw, "%s rc=%d rsc=%d", lspPeerName(rep.peer), rep.m.ReturnCode, rep.m.ReturnSubcode)
+				if lspVerbose {
+					fmt.Fprintf(bw, " (%v)", rep.m.ReturnCode)
+				}
+				fmt.Fprintf(bw, "  %v\n", rep.rtt)
+				done = rep.m.ReturnCode == ipoam.LSPEgress
+				break loop
+			case r := <-ipt.Report():
+				if r.Error != nil {
+					continue
+				}
+				fmt.Fprintf(bw, "%s icmp.type=%q icmp.code=%d", literalOrName(r.Src.String(), lspNoRevLookup), r.ICMP.Type, r.ICMP.Code)
+				printLSPICMPExtensions(bw, &r)
+				fmt.Fprintf(bw, "  %v\n", time.Since(req.Sent))
+				done = r.ICMP.Type == ipv4.ICMPTypeDestinationUnreachable || r.ICMP.Type == ipv6.ICMPTypeDestinationUnreachable
+				break loop
+			}
+		}
+		t.Stop()
+		bw.Flush()
+		if done {
+			break
+		}
+	}
+	os.Exit(0)
+}
+
+func lspPeerName(peer net.Addr) string {
+	if a, ok := peer.(*net.UDPAddr); ok {
+		return literalOrName(a.IP.String(), lspNoRevLookup)
+	}
+	return peer.String()
+}
+
+func printLSPReply(bw *bufio.Writer, rep *lspReply) {
+	fmt.Fprintf(bw, "from=%s rc=%d rsc=%d seq=%d rtt=%v", lspPeerName(rep.peer), rep.m.ReturnCode, rep.m.ReturnSubcode, rep.m.Seq, rep.rtt)
+	if lspVerbose {
+		fmt.Fprintf(bw, " fwd=%v (%v)", rep.m.Received.Sub(rep.m.Sent), rep.m.ReturnCode)
+	}
+	fmt.Fprintf(bw, "\n")
+	bw.Flush()
+}
+
+// printLSPICMPExtensions prints the ICMP extensions of r, such as the
+// MPLS label stack of the time exceeded message from an LSR.
+func printLSPICMPExtensions(bw *bufio.Writer, r *ipoam.Report) {
+	switch body := r.ICMP.Body.(type) {
+	case *icmp.DstUnreach:
+		printICMPExtensions(bw, body.Extensions)
+	case *icmp.TimeExceeded:
+		printICMPExtensions(bw, body.Extensions)
+	}
+}
+
+type lspStat struct {
+	sent, rcvd             int
+	minRTT, maxRTT, rttSum time.Duration
+	codes                  map[ipoam.LSPReturnCode]int
+}
+
+func (st *lspStat) onReply(rep *lspReply) {
+	if st.codes == nil {
+		st.codes = make(map[ipoam.LSPReturnCode]int)
+		st.minRTT = math.MaxInt64
+	}
+	st.rcvd++
+	st.codes[rep.m.ReturnCode]++
+	if rep.rtt < st.minRTT {
+		st.minRTT = rep.rtt
+	}
+	if rep.rtt > st.maxRTT {
+		st.maxRTT = rep.rtt
+	}
+	st.rttSum += rep.rtt
+}
+
+func printLSPStat(bw *bufio.Writer, st *lspStat) {
+	fmt.Fprintf(bw, "\nsent=%d rcvd=%d", st.sent, st.rcvd)
+	if st.sent > 0 && st.rcvd <= st.sent {
+		fmt.Fprintf(bw, " loss=%.1f%%", float64(st.sent-st.rcvd)*100.0/float64(st.sent))
+	}
+	if st.rcvd > 0 {
+		fmt.Fprintf(bw, " min=%v avg=%v max=%v", st.minRTT, st.rttSum/time.Duration(st.rcvd), st.maxRTT)
+	}
+	fmt.Fprintf(bw, "\n")
+	var rcs []int
+	for rc := range st.codes {
+		rcs = append(rcs, int(rc))
+	}
+	sort.Ints(rcs)
+	for _, rc := range rcs {
+		fmt.Fprintf(bw, "rc=%d (%v): %d\n", rc, ipoam.LSPReturnCode(rc), st.codes[ipoam.LSPReturnCode(rc)])
+	}
+	bw.Flush()
+}
+
+func lspResponderMain(cmd *Command, args []string) {
+	network, address := "udp", fmt.Sprintf(":%d", lspPort)
+	if lspIPv4only {
+		network = "udp4"
+	}
+	if lspIPv6only {
+		network = "udp6"
+	}
+	r, err := ipoam.NewLSPResponder(network, address)
+	if err != nil {
+		cmd.fatal(err)
+	}
+	defer r.Close()
+
+	bw := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(bw, "MPLS echo reply agent on %v\n", r.Addr())
+	bw.Flush()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		<-sig
+		close(done)
+		r.Close()
+	}()
+	err = r.Serve(func(req, rep *ipoam.LSPEcho, peer net.Addr) {
+		fmt.Fprintf(bw, "from=%v seq=%d fec=%v", peer, req.Seq, req.FECStack)
+		if rep != nil {
+			fmt.Fprintf(bw, " rc=%d rsc=%d", rep.ReturnCode, rep.ReturnSubcode)
+		} else {
+			fmt.Fprintf(bw, " no reply")
+		}
+		fmt.Fprintf(bw, "\n")
+		bw.Flush()
+	})
+	select {
+	case <-done:
+	default:
+		cmd.fatal(err)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,50 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mikioh/ipoam"
+)
+
+func TestLSPDestination(t *testing.T) {
+	for _, tt := range []struct {
+		prefix, to string
+		dst        net.IP // nil if an error is expected
+		ipv4       bool   // true if the IPv4 router alert option is expected
+	}{
+		{"192.0.2.1/32", "", net.IPv4(127, 0, 0, 1), true},
+		{"192.0.2.1/32", "127.0.0.2", net.IPv4(127, 0, 0, 2), true},
+		{"2001:db8::1/128", "", nil, false},
+		{"2001:db8::1/128", "::1", net.IPv6loopback, false},
+		{"2001:db8::1/128", "::ffff:127.0.0.1", net.IPv4(127, 0, 0, 1), true},
+		{"192.0.2.1/32", "localhost", nil, false},
+	} {
+		_, prefix, err := net.ParseCIDR(tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst, err := lspDestination(prefix, tt.to)
+		if tt.dst == nil {
+			if err == nil {
+				t.Errorf("%s to %q: got %v; want error", tt.prefix, tt.to, dst)
+			}
+			continue
+		}
+		if err != nil || !dst.Equal(tt.dst) {
+			t.Errorf("%s to %q: got %v, %v; want %v", tt.prefix, tt.to, dst, err, tt.dst)
+			continue
+		}
+		cm := lspControlMessage(dst)
+		if tt.ipv4 && (len(cm.IPv4Options) == 0 || cm.IPv6ExtHeaders != nil) {
+			t.Errorf("%v: got %+v; want IPv4 router alert option only", dst, cm)
+		}
+		if !tt.ipv4 && (cm.IPv4Options != nil || len(cm.IPv6ExtHeaders) != 1 || cm.IPv6ExtHeaders[0].Type != ipoam.IPv6HopByHop) {
+			t.Errorf("%v: got %+v; want IPv6 hop-by-hop options header only", dst, cm)
+		}
+	}
+}
@@ -22,6 +22,22 @@ The commands are:{{range .}}
 var commands = []*Command{
 	cmdCV,
 	cmdRT,
+	cmdNDPing,
+	cmdARPing,
+	cmdListeners,
+	cmdRouters,
+	cmdLSPPing,
+	cmdLSPTrace,
+	cmdLSPResponder,
+	cmdBFD,
+	cmdSBFD,
+	cmdSBFDReflector,
+	cmdSTAMP,
+	cmdSTAMPReflector,
+	cmdTWAMP,
+	cmdTWAMPReflector,
+	cmdOWPing,
+	cmdOWAMPd,
 	cmdFacility,
 }
 
@@ -39,6 +39,7 @@ func TestMain(t *testing.T) {
 			{"ipoam", "cv", "-v", "-count=1", "ipv4.google.com"},
 			{"ipoam", "cv", "-v", "-count=1", "ipv6.google.com"},
 			{"ipoam", "cv", "-v", "-count=1", "www.google.com,golang.org"},
+			{"ipoam", "cv", "-compare", "-count=2", "www.google.com"},
 
 			{"ipoam", "cv", "-v", "-count=1", "8.8.8.8"},
 			{"ipoam", "cv", "-v", "-count=1", "8.8.8.8,8.8.4.4"},
@@ -0,0 +1,234 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mikioh/ipoam"
+)
+
+var ndpingUsageTmpl = `Usage:
+	ipoam {{.Name}} [flags] target
+
+target
+	An IPv6 address of neighbor on the link attached to the
+	interface specified by the -if flag.
+
+`
+
+var (
+	cmdNDPing = &Command{
+		Func:      ndpingMain,
+		Usage:     cmdUsage,
+		UsageTmpl: ndpingUsageTmpl,
+		CanonName: "ndping",
+		Descr:     "Verify IPv6 neighbor reachability with neighbor discovery",
+	}
+
+	ndNoRevLookup bool
+	ndQuiet       bool
+	ndUnicast     bool
+	ndVerbose     bool
+
+	ndCount int
+	ndWait  int
+
+	ndOutboundIf string
+)
+
+func init() {
+	cmdNDPing.Flag.BoolVar(&ndNoRevLookup, "n", false, "Don't use DNS reverse lookup")
+	cmdNDPing.Flag.BoolVar(&ndQuiet, "q", false, "Quiet output except summary")
+	cmdNDPing.Flag.BoolVar(&ndUnicast, "unicast", false, "Send solicitations to the target address instead of its solicited-node multicast address")
+	cmdNDPing.Flag.BoolVar(&ndVerbose, "v", false, "Show verbose information")
+
+	cmdNDPing.Flag.IntVar(&ndCount, "count", 0, "Iteration count, less than or equal to zero will run until interrupted")
+	cmdNDPing.Flag.IntVar(&ndWait, "wait", 1, "Seconds between transmitting each solicitation")
+
+	cmdNDPing.Flag.StringVar(&ndOutboundIf, "if", "", "Outbound interface name, required")
+}
+
+// An ndResponder represents a neighbor that advertises the target.
+type ndResponder struct {
+	src    string
+	lladdr string
+}
+
+func ndpingMain(cmd *Command, args []string) {
+	if len(args) == 0 || ndOutboundIf == "" {
+		cmd.Flag.Usage()
+	}
+	target := net.ParseIP(args[0])
+	if target == nil || target.To4() != nil || target.IsMulticast() {
+		cmd.fatal(fmt.Errorf("invalid target: %s", args[0]))
+	}
+	ifi, err := net.InterfaceByName(ndOutboundIf)
+	if err != nil {
+		cmd.fatal(err)
+	}
+	if ndWait <= 0 {
+		ndWait = 1
+	}
+
+	ipt, err := ipoam.NewTester("ip6:ipv6-icmp", "::")
+	if err != nil {
+		cmd.fatal(err)
+	}
+	defer ipt.Close()
+
+	bw := bufio.NewWriter(os.Stdout)
+	dst := ipoam.SolicitedNodeMulticast(target)
+	if ndUnicast {
+		dst = target
+	}
+	fmt.Fprintf(bw, "Neighbor reachability verification for %v via %s", target, ifi.Name)
+	if ndVerbose {
+		fmt.Fprintf(bw, " [%v from %v]", dst, ifi.HardwareAddr)
+	}
+	fmt.Fprintf(bw, "\n")
+	bw.Flush()
+
+	st := cvStat{minRTT: math.MaxInt64}
+	var responders []ndResponder
+	var dups uint64
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	for i := 1; ; i++ {
+		t := time.NewTimer(time.Duration(ndWait) * time.Second)
+		begin := time.Now()
+		st.transmitted++
+		if err := ipt.ProbeNeighbor(target, ndUnicast, ifi); err != nil {
+			st.opErrors++
+			fmt.Fprintf(bw, "error=%q\n", err)
+			bw.Flush()
+		}
+
+		// Each round expects a single advertisement; the others
+		// come from duplicate responders.
+		var round []ndResponder
+	loop:
+		for {
+			select {
+			case <-sig:
+				printNDSummary(bw, target, &st, responders, dups)
+				os.Exit(0)
+			case <-t.C:
+				break loop
+			case r := <-ipt.Report():
+				if r.Error != nil {
+					st.opErrors++
+					if !ndQuiet {
+						fmt.Fprintf(bw, "error=%q\n", r.Error)
+						bw.Flush()
+					}
+					continue
+				}
+				na := r.NeighborAdvert
+				if na == nil || !na.Target.Equal(target) {
+					continue
+				}
+				rtt := r.Time.Sub(begin)
+				rsp := ndResponder{src: r.Src.String(), lladdr: na.LinkAddr.String()}
+				if !containsNDResponder(responders, rsp) {
+					responders = append(responders, rsp)
+				}
+				dup := false
+				if len(round) > 0 && !containsNDResponder(round, rsp) {
+					dup = true
+				}
+				round = append(round, rsp)
+				if dup {
+					dups++
+				}
+				if len(round) == 1 {
+					st.onRTT(rtt)
+				}
+				if !ndQuiet || dup {
+					printNDReport(bw, rtt, &r, dup)
+				}
+			}
+		}
+		t.Stop()
+
+		if ndCount > 0 && i == ndCount {
+			printNDSummary(bw, target, &st, responders, dups)
+			os.Exit(0)
+		}
+	}
+}
+
+// containsNDResponder reports whether rsps contains rsp.
+// An advertisement without the target link-layer address, which is
+// usual for unicast solicitations, matches any responder with the
+// same source address.
+func containsNDResponder(rsps []ndResponder, rsp ndResponder) bool {
+	for _, r := range rsps {
+		if r.src == rsp.src && (r.lladdr == rsp.lladdr || r.lladdr == "" || rsp.lladdr == "") {
+			return true
+		}
+	}
+	return false
+}
+
+func printNDReport(bw *bufio.Writer, rtt time.Duration, r *ipoam.Report, dup bool) {
+	na := r.NeighborAdvert
+	fmt.Fprintf(bw, "from=%s", literalOrName(r.Src.String(), ndNoRevLookup))
+	if len(na.LinkAddr) > 0 {
+		fmt.Fprintf(bw, " lladdr=%v", na.LinkAddr)
+	}
+	var flags []byte
+	for _, f := range []struct {
+		set bool
+		c   byte
+	}{{na.Router, 'R'}, {na.Solicited, 'S'}, {na.Override, 'O'}} {
+		if f.set {
+			flags = append(flags, f.c)
+		}
+	}
+	if len(flags) > 0 {
+		fmt.Fprintf(bw, " flags=%s", flags)
+	}
+	if ndVerbose {
+		if r.Dst != nil {
+			fmt.Fprintf(bw, " dst=%v", r.Dst)
+		}
+		if r.Interface != nil {
+			fmt.Fprintf(bw, " if=%s", r.Interface.Name)
+		}
+	}
+	fmt.Fprintf(bw, " hlim=%d rtt=%v", r.Hops, rtt)
+	if dup {
+		fmt.Fprintf(bw, " duplicate")
+	}
+	fmt.Fprintf(bw, "\n")
+	bw.Flush()
+}
+
+func printNDSummary(bw *bufio.Writer, target net.IP, st *cvStat, responders []ndResponder, dups uint64) {
+	fmt.Fprintf(bw, "\nStatistical information for %v:\n", target)
+	fmt.Fprintf(bw, "neighbor:")
+	if st.transmitted > 0 {
+		fmt.Fprintf(bw, " loss=%.1f%%", float64(st.transmitted-st.received)*100.0/float64(st.transmitted))
+	}
+	fmt.Fprintf(bw, " rcvd=%d sent=%d op.err=%d", st.received, st.transmitted, st.opErrors)
+	printCVRTT(bw, st)
+	fmt.Fprintf(bw, "\n")
+	if len(responders) > 1 || dups > 0 {
+		fmt.Fprintf(bw, "duplicate responders: dup=%d", dups)
+		for _, rsp := range responders {
+			fmt.Fprintf(bw, " %s(%s)", rsp.src, rsp.lladdr)
+		}
+		fmt.Fprintf(bw, "\n")
+	}
+	bw.Flush()
+}
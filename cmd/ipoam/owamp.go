@@ -0,0 +1,285 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mikioh/ipoam"
+)
+
+var owpingUsageTmpl = `Usage:
+	ipoam {{.Name}} [flags] server
+
+server
+	A hostname, DNS reg-name or IP address of OWAMP server.
+
+`
+
+var owampdUsageTmpl = `Usage:
+	ipoam {{.Name}} [flags]
+
+`
+
+var (
+	cmdOWPing = &Command{
+		Func:      owpingMain,
+		Usage:     cmdUsage,
+		UsageTmpl: owpingUsageTmpl,
+		CanonName: "owping",
+		Descr:     "Measure one-way delay and loss with OWAMP",
+	}
+	cmdOWAMPd = &Command{
+		Func:      owampdMain,
+		Usage:     cmdUsage,
+		UsageTmpl: owampdUsageTmpl,
+		CanonName: "owampd",
+		Descr:     "Run an OWAMP server",
+	}
+
+	owampIPv4only    bool
+	owampIPv6only    bool
+	owampFixed       bool
+	owampFrom        bool
+	owampNoRevLookup bool
+	owampQuiet       bool
+	owampSynced      bool
+	owampTo          bool
+
+	owampCount   int
+	owampDSCP    int
+	owampPadding int
+	owampPort    int
+	owampTimeout int
+
+	owampError    string
+	owampInterval string
+)
+
+func init() {
+	cmdOWPing.Flag.BoolVar(&owampIPv4only, "4", false, "Run IPv4 test only")
+	cmdOWPing.Flag.BoolVar(&owampIPv6only, "6", false, "Run IPv6 test only")
+	cmdOWPing.Flag.BoolVar(&owampFixed, "fixed", false, "Transmit test packets at fixed intervals instead of exponentially distributed intervals")
+	cmdOWPing.Flag.BoolVar(&owampFrom, "f", false, "Run the session from the server only")
+	cmdOWPing.Flag.BoolVar(&owampNoRevLookup, "n", false, "Don't use DNS reverse lookup")
+	cmdOWPing.Flag.BoolVar(&owampQuiet, "q", false, "Quiet output except summary")
+	cmdOWPing.Flag.BoolVar(&owampTo, "t", false, "Run the session to the server only")
+
+	cmdOWPing.Flag.IntVar(&owampCount, "count", 100, "Number of test packets in each session")
+	cmdOWPing.Flag.IntVar(&owampDSCP, "dscp", 0, "DSCP on test packets")
+	cmdOWPing.Flag.IntVar(&owampPadding, "pad", 0, "Packet padding length")
+	cmdOWPing.Flag.IntVar(&owampPort, "port", ipoam.OWAMPPort, "Destination port")
+	cmdOWPing.Flag.IntVar(&owampTimeout, "timeout", 2, "Seconds to wait for test packets after the last transmission")
+
+	cmdOWPing.Flag.StringVar(&owampInterval, "interval", "100ms", "Mean interval between test packets")
+
+	cmdOWAMPd.Flag.BoolVar(&owampIPv4only, "4", false, "Accept IPv4 connections only")
+	cmdOWAMPd.Flag.BoolVar(&owampIPv6only, "6", false, "Accept IPv6 connections only")
+	cmdOWAMPd.Flag.BoolVar(&owampQuiet, "q", false, "Quiet output")
+	cmdOWAMPd.Flag.IntVar(&owampPort, "port", ipoam.OWAMPPort, "Listening port")
+
+	for _, cmd := range []*Command{cmdOWPing, cmdOWAMPd} {
+		cmd.Flag.BoolVar(&owampSynced, "synced", false, "Mark the clock as synchronized to UTC in error estimate")
+		cmd.Flag.StringVar(&owampError, "error", "1ms", "Timestamp error in error estimate")
+	}
+}
+
+func owampErrorEstimate() (ipoam.STAMPErrorEstimate, error) {
+	d, err := time.ParseDuration(owampError)
+	if err != nil {
+		return 0, err
+	}
+	return ipoam.NewSTAMPErrorEstimate(owampSynced, false, d), nil
+}
+
+func owpingMain(cmd *Command, args []string) {
+	if len(args) == 0 {
+		cmd.Flag.Usage()
+	}
+	stampIPv4only, stampIPv6only = owampIPv4only, owampIPv6only
+	ip, err := stampResolve(args[0])
+	if err != nil {
+		cmd.fatal(err)
+	}
+	ee, err := owampErrorEstimate()
+	if err != nil {
+		cmd.fatal(err)
+	}
+	interval, err := time.ParseDuration(owampInterval)
+	if err != nil || interval < 0 {
+		cmd.fatal(fmt.Errorf("invalid interval: %s", owampInterval))
+	}
+	if owampDSCP < 0 || owampDSCP > 63 {
+		cmd.fatal(fmt.Errorf("invalid dscp: %d", owampDSCP))
+	}
+	if owampCount <= 0 {
+		cmd.fatal(fmt.Errorf("invalid count: %d", owampCount))
+	}
+	if !owampTo && !owampFrom {
+		owampTo, owampFrom = true, true
+	}
+
+	network := "tcp4"
+	if ip.To4() == nil {
+		network = "tcp6"
+	}
+	c, err := ipoam.DialOWAMP(network, net.JoinHostPort(ip.String(), strconv.Itoa(owampPort)))
+	if err != nil {
+		cmd.fatal(err)
+	}
+	defer c.Close()
+	c.SetErrorEstimate(ee)
+
+	var sesss []*ipoam.OWAMPSession
+	for _, fromServer := range []bool{false, true} {
+		if fromServer && !owampFrom || !fromServer && !owampTo {
+			continue
+		}
+		sess := ipoam.OWAMPSession{
+			FromServer: fromServer,
+			Count:      owampCount,
+			Padding:    owampPadding,
+			Timeout:    time.Duration(owampTimeout) * time.Second,
+			DSCP:       owampDSCP,
+			Schedule:   []ipoam.OWAMPSlot{{Exponential: !owampFixed, Interval: interval}},
+		}
+		if err := c.RequestSession(&sess); err != nil {
+			cmd.fatal(err)
+		}
+		sesss = append(sesss, &sess)
+	}
+
+	bw := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(bw, "OWAMP sessions with %v: %d test packets, %v mean interval, %d bytes padding, dscp %d\n", ip, owampCount, interval, owampPadding, owampDSCP)
+	bw.Flush()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	errc := make(chan error, 1)
+	go func() {
+		if err := c.StartSessions(); err != nil {
+			errc <- err
+			return
+		}
+		errc <- c.StopSessions()
+	}()
+	select {
+	case <-sig:
+		os.Exit(0)
+	case err := <-errc:
+		if err != nil {
+			cmd.fatal(err)
+		}
+	}
+
+	for _, sess := range sesss {
+		recs, err := c.Records(sess)
+		if err != nil {
+			cmd.fatal(err)
+		}
+		printOWAMPSession(bw, sess, recs)
+	}
+	c.Close()
+	os.Exit(0)
+}
+
+func printOWAMPSession(bw *bufio.Writer, sess *ipoam.OWAMPSession, recs []ipoam.OWAMPRecord) {
+	dir := "to"
+	if sess.FromServer {
+		dir = "from"
+	}
+	fmt.Fprintf(bw, "\n--- %s %s -> %s sid=%v ---\n", dir, literalOrName(sess.Sender.IP.String(), owampNoRevLookup), literalOrName(sess.Receiver.IP.String(), owampNoRevLookup), sess.SID)
+	st := cvStat{minRTT: math.MaxInt64, transmitted: uint64(len(recs))}
+	synced := true
+	for _, r := range recs {
+		if r.Lost() {
+			if !owampQuiet {
+				fmt.Fprintf(bw, "seq=%d lost\n", r.Seq)
+			}
+			continue
+		}
+		st.onRTT(r.Delay())
+		synced = synced && r.SentError.Synced() && r.ReceivedError.Synced()
+		if !owampQuiet {
+			fmt.Fprintf(bw, "seq=%d ttl=%d delay=%v err=%v\n", r.Seq, r.TTL, r.Delay(), r.SentError.Duration()+r.ReceivedError.Duration())
+		}
+	}
+	fmt.Fprintf(bw, "one-way:")
+	if st.transmitted > 0 {
+		fmt.Fprintf(bw, " loss=%.1f%%", float64(st.transmitted-st.received)*100.0/float64(st.transmitted))
+	}
+	fmt.Fprintf(bw, " rcvd=%d sent=%d", st.received, st.transmitted)
+	printCVRTT(bw, &st)
+	if !synced {
+		fmt.Fprintf(bw, " (unsynchronized clocks)")
+	}
+	fmt.Fprintf(bw, "\n")
+	bw.Flush()
+}
+
+func owampdMain(cmd *Command, args []string) {
+	ee, err := owampErrorEstimate()
+	if err != nil {
+		cmd.fatal(err)
+	}
+	network := "tcp"
+	if owampIPv4only {
+		network = "tcp4"
+	}
+	if owampIPv6only {
+		network = "tcp6"
+	}
+	s, err := ipoam.NewOWAMPServer(network, fmt.Sprintf(":%d", owampPort))
+	if err != nil {
+		cmd.fatal(err)
+	}
+	defer s.Close()
+	s.SetErrorEstimate(ee)
+
+	bw := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(bw, "OWAMP server on %v\n", s.Addr())
+	bw.Flush()
+	var mu sync.Mutex
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Serve(func(peer net.Addr, sess *ipoam.OWAMPSession, recs []ipoam.OWAMPRecord) {
+			if owampQuiet {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			fmt.Fprintf(bw, "from=%v sid=%v sender=%v receiver=%v count=%d", peer, sess.SID, sess.Sender, sess.Receiver, sess.Count)
+			if !sess.FromServer {
+				var rcvd int
+				for _, r := range recs {
+					if !r.Lost() {
+						rcvd++
+					}
+				}
+				fmt.Fprintf(bw, " rcvd=%d sent=%d", rcvd, len(recs))
+			}
+			fmt.Fprintf(bw, "\n")
+			bw.Flush()
+		})
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-sig:
+	case err := <-errc:
+		cmd.fatal(err)
+	}
+	os.Exit(0)
+}
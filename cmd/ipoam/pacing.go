@@ -0,0 +1,144 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"time"
+
+	"github.com/mikioh/ipoam"
+)
+
+// rateLimitRates holds the probe packet rates in packets per second
+// for estimating ICMP rate limits.
+var rateLimitRates = []float64{10, 20, 50, 100, 200, 500, 1000}
+
+const (
+	rateLimitBurstLen = 16  // number of probe packets in a burst
+	pacingMargin      = 0.8 // fraction of the estimated rate limit used for pacing
+)
+
+// measureRateLimit transmits probe bursts to dst at rising rates and
+// estimates the ICMP rate limit of the node that answers the probe
+// packets.
+// The caller must set the IPv4 TTL or IPv6 hop limit on the probe
+// packets beforehand.
+// Each application-level reply on app that carries the identifier
+// cm.Seq counts as an answer, because the destination of a probe
+// packet carrying an application-level payload answers with it
+// instead of an ICMP message.
+// It returns nil when the node doesn't answer, or doesn't limit the
+// rate within the tested rates.
+func measureRateLimit(ipt *ipoam.Tester, cm *ipoam.ControlMessage, b []byte, dst net.IP, ifi *net.Interface, wait time.Duration, app <-chan appReply, sig <-chan os.Signal) *ipoam.RateLimit {
+	var samples []ipoam.RateSample
+	var lossy int
+	for _, rate := range rateLimitRates {
+		s := ipoam.RateSample{Rate: rate}
+		sent := make(chan int, 1)
+		go func() {
+			interval := time.Duration(float64(time.Second) / rate)
+			if app == nil {
+				n, _ := ipt.ProbeBurst(b, cm, dst, ifi, rateLimitBurstLen, interval)
+				sent <- n
+				return
+			}
+			// The destination port must be kept for the
+			// application-level payload.
+			var n int
+			for next := time.Now(); n < rateLimitBurstLen; n++ {
+				time.Sleep(time.Until(next))
+				if err := ipt.Probe(b, cm, dst, ifi); err != nil {
+					break
+				}
+				next = next.Add(interval)
+			}
+			sent <- n
+		}()
+		var timeout <-chan time.Time
+	loop:
+		for {
+			select {
+			case <-sig:
+				os.Exit(0)
+			case s.Sent = <-sent:
+				timeout = time.After(wait)
+			case r := <-ipt.Report():
+				if r.Error == nil && r.ICMP != nil {
+					s.Received++
+				}
+			case ar := <-app:
+				if ar.ID == cm.Seq&0xffff {
+					s.Received++
+				}
+			case <-timeout:
+				break loop
+			}
+		}
+		if s.Received == 0 && len(samples) == 0 {
+			return nil
+		}
+		samples = append(samples, s)
+		if s.Received < s.Sent {
+			if lossy++; lossy == 2 {
+				break
+			}
+		}
+	}
+	return ipoam.EstimateRateLimit(samples)
+}
+
+// A pacer paces probe packets to stay below an ICMP rate limit.
+type pacer struct {
+	rl     *ipoam.RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newPacer(rl *ipoam.RateLimit) *pacer {
+	if rl == nil {
+		return nil
+	}
+	return &pacer{rl: rl}
+}
+
+func (p *pacer) rateLimit() *ipoam.RateLimit {
+	if p == nil {
+		return nil
+	}
+	return p.rl
+}
+
+// wait blocks until the next probe packet can be transmitted without
+// exhausting the bucket of the rate limit.
+func (p *pacer) wait() {
+	if p == nil {
+		return
+	}
+	rate := p.rl.Rate * pacingMargin
+	now := time.Now()
+	if !p.last.IsZero() {
+		p.tokens = math.Min(float64(p.rl.Burst), p.tokens+now.Sub(p.last).Seconds()*rate)
+	}
+	p.last = now
+	if p.tokens < 1 {
+		d := time.Duration((1 - p.tokens) / rate * float64(time.Second))
+		time.Sleep(d)
+		p.last = now.Add(d)
+		p.tokens = 1
+	}
+	p.tokens--
+}
+
+func printRateLimit(w io.Writer, rl *ipoam.RateLimit) {
+	if rl == nil {
+		fmt.Fprintf(w, "icmp.ratelimit=none")
+		return
+	}
+	fmt.Fprintf(w, "icmp.ratelimit=%.1f/s icmp.burst=%d", rl.Rate, rl.Burst)
+}
@@ -0,0 +1,359 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mikioh/ipoam"
+)
+
+var routersUsageTmpl = `Usage:
+	ipoam {{.Name}} [flags]
+
+`
+
+var (
+	cmdRouters = &Command{
+		Func:      routersMain,
+		Usage:     cmdUsage,
+		UsageTmpl: routersUsageTmpl,
+		CanonName: "routers",
+		Descr:     "Discover IPv6 routers with router advertisements",
+	}
+
+	rtrNoRevLookup bool
+	rtrPassive     bool
+	rtrQuiet       bool
+	rtrVerbose     bool
+
+	rtrCount int
+	rtrWait  int
+
+	rtrAllow      string
+	rtrOutboundIf string
+)
+
+func init() {
+	cmdRouters.Flag.BoolVar(&rtrNoRevLookup, "n", false, "Don't use DNS reverse lookup")
+	cmdRouters.Flag.BoolVar(&rtrPassive, "passive", false, "Listen for advertisements without transmitting solicitations")
+	cmdRouters.Flag.BoolVar(&rtrQuiet, "q", false, "Quiet output except summary and warnings")
+	cmdRouters.Flag.BoolVar(&rtrVerbose, "v", false, "Show verbose information")
+
+	cmdRouters.Flag.IntVar(&rtrCount, "count", 3, "Iteration count, less than or equal to zero will run until interrupted")
+	cmdRouters.Flag.IntVar(&rtrWait, "wait", 4, "Seconds between transmitting each solicitation, or of each iteration with -passive")
+
+	cmdRouters.Flag.StringVar(&rtrAllow, "allow", "", "Comma-separated list of expected router addresses or link-layer addresses")
+	cmdRouters.Flag.StringVar(&rtrOutboundIf, "if", "", "Outbound interface name, required")
+}
+
+// A rtrRouter represents a router that advertises itself on the
+// link.
+type rtrRouter struct {
+	src      string
+	lladdr   string
+	lifetime time.Duration
+	pref     ipoam.RouterPreference
+	received int
+	allowed  bool
+}
+
+// A rtrAllowList represents the expected routers.
+type rtrAllowList struct {
+	ips     []net.IP
+	lladdrs []net.HardwareAddr
+}
+
+func parseRouterAllowList(s string) (*rtrAllowList, error) {
+	var al rtrAllowList
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if ip := net.ParseIP(f); ip != nil {
+			al.ips = append(al.ips, ip)
+			continue
+		}
+		lladdr, err := net.ParseMAC(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed router: %s", f)
+		}
+		al.lladdrs = append(al.lladdrs, lladdr)
+	}
+	return &al, nil
+}
+
+// allows reports whether the router with src and lladdr is expected.
+func (al *rtrAllowList) allows(src net.IP, lladdr net.HardwareAddr) bool {
+	for _, ip := range al.ips {
+		if ip.Equal(src) {
+			return true
+		}
+	}
+	for _, a := range al.lladdrs {
+		if a.String() == lladdr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func routersMain(cmd *Command, args []string) {
+	if rtrOutboundIf == "" {
+		cmd.Flag.Usage()
+	}
+	ifi, err := net.InterfaceByName(rtrOutboundIf)
+	if err != nil {
+		cmd.fatal(err)
+	}
+	var al *rtrAllowList
+	if rtrAllow != "" {
+		if al, err = parseRouterAllowList(rtrAllow); err != nil {
+			cmd.fatal(err)
+		}
+	}
+	if rtrWait <= 0 {
+		rtrWait = 4
+	}
+
+	ipt, err := ipoam.NewTester("ip6:ipv6-icmp", "::")
+	if err != nil {
+		cmd.fatal(err)
+	}
+	defer ipt.Close()
+
+	bw := bufio.NewWriter(os.Stdout)
+	if rtrPassive {
+		if err := ipt.ListenRouters(); err != nil {
+			cmd.fatal(err)
+		}
+		fmt.Fprintf(bw, "Router advertisement monitoring on %s", ifi.Name)
+	} else {
+		fmt.Fprintf(bw, "Router discovery via %s", ifi.Name)
+		if rtrVerbose {
+			fmt.Fprintf(bw, " [%v from %v]", net.IPv6linklocalallrouters, ifi.HardwareAddr)
+		}
+	}
+	fmt.Fprintf(bw, "\n")
+	bw.Flush()
+
+	st := cvStat{minRTT: math.MaxInt64}
+	var routers []*rtrRouter
+	var ras uint64
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	for i := 1; ; i++ {
+		t := time.NewTimer(time.Duration(rtrWait) * time.Second)
+		begin := time.Now()
+		if !rtrPassive {
+			st.transmitted++
+			if err := ipt.ProbeRouter(ifi); err != nil {
+				st.opErrors++
+				fmt.Fprintf(bw, "error=%q\n", err)
+				bw.Flush()
+			}
+		}
+
+		solicited := !rtrPassive
+	loop:
+		for {
+			select {
+			case <-sig:
+				printRouters(bw, ifi, &st, routers, ras, al)
+				os.Exit(0)
+			case <-t.C:
+				break loop
+			case r := <-ipt.Report():
+				if r.Error != nil {
+					st.opErrors++
+					if !rtrQuiet {
+						fmt.Fprintf(bw, "error=%q\n", r.Error)
+						bw.Flush()
+					}
+					continue
+				}
+				ra := r.RouterAdvert
+				if ra == nil || r.Interface != nil && r.Interface.Index != ifi.Index {
+					continue
+				}
+				ras++
+				var rtt time.Duration
+				if solicited {
+					rtt = r.Time.Sub(begin)
+					st.onRTT(rtt)
+					solicited = false
+				}
+				rtr, seen := lookupRouter(routers, r.Src)
+				if !seen {
+					rtr = &rtrRouter{src: r.Src.String(), allowed: al == nil || al.allows(r.Src, ra.LinkAddr)}
+					routers = append(routers, rtr)
+				}
+				if len(ra.LinkAddr) > 0 {
+					rtr.lladdr = ra.LinkAddr.String()
+					if al != nil && !rtr.allowed {
+						rtr.allowed = al.allows(r.Src, ra.LinkAddr)
+					}
+				}
+				rtr.lifetime, rtr.pref = ra.Lifetime, ra.Preference
+				rtr.received++
+				var warning string
+				switch {
+				case !rtr.allowed:
+					warning = "unexpected"
+				case al == nil && !seen && len(routers) > 1:
+					warning = "multiple"
+				}
+				if !rtrQuiet || warning != "" {
+					printRouterAdvert(bw, rtt, &r, warning)
+				}
+			}
+		}
+		t.Stop()
+
+		if rtrCount > 0 && i == rtrCount {
+			printRouters(bw, ifi, &st, routers, ras, al)
+			os.Exit(0)
+		}
+	}
+}
+
+func lookupRouter(routers []*rtrRouter, src net.IP) (*rtrRouter, bool) {
+	for _, rtr := range routers {
+		if rtr.src == src.String() {
+			return rtr, true
+		}
+	}
+	return nil, false
+}
+
+func raLifetime(d time.Duration) string {
+	if d == ipoam.RAInfiniteLifetime {
+		return "infinity"
+	}
+	return d.String()
+}
+
+func printRouterAdvert(bw *bufio.Writer, rtt time.Duration, r *ipoam.Report, warning string) {
+	ra := r.RouterAdvert
+	fmt.Fprintf(bw, "from=%s", literalOrName(r.Src.String(), rtrNoRevLookup))
+	if len(ra.LinkAddr) > 0 {
+		fmt.Fprintf(bw, " lladdr=%v", ra.LinkAddr)
+	}
+	fmt.Fprintf(bw, " lifetime=%v pref=%v", ra.Lifetime, ra.Preference)
+	var flags []byte
+	for _, f := range []struct {
+		set bool
+		c   byte
+	}{{ra.Managed, 'M'}, {ra.Other, 'O'}} {
+		if f.set {
+			flags = append(flags, f.c)
+		}
+	}
+	if len(flags) > 0 {
+		fmt.Fprintf(bw, " flags=%s", flags)
+	}
+	if ra.HopLimit > 0 {
+		fmt.Fprintf(bw, " curhlim=%d", ra.HopLimit)
+	}
+	if ra.MTU > 0 {
+		fmt.Fprintf(bw, " mtu=%d", ra.MTU)
+	}
+	if rtrVerbose {
+		if ra.ReachableTime > 0 {
+			fmt.Fprintf(bw, " reachable=%v", ra.ReachableTime)
+		}
+		if ra.RetransTimer > 0 {
+			fmt.Fprintf(bw, " retrans=%v", ra.RetransTimer)
+		}
+		if r.Dst != nil {
+			fmt.Fprintf(bw, " dst=%v", r.Dst)
+		}
+	}
+	fmt.Fprintf(bw, " hlim=%d", r.Hops)
+	if rtt > 0 {
+		fmt.Fprintf(bw, " rtt=%v", rtt)
+	}
+	if warning != "" {
+		fmt.Fprintf(bw, " %s", warning)
+	}
+	fmt.Fprintf(bw, "\n")
+	for _, p := range ra.Prefixes {
+		var flags []byte
+		if p.OnLink {
+			flags = append(flags, 'L')
+		}
+		if p.Autonomous {
+			flags = append(flags, 'A')
+		}
+		fmt.Fprintf(bw, "\tprefix=%v", p.Prefix)
+		if len(flags) > 0 {
+			fmt.Fprintf(bw, " flags=%s", flags)
+		}
+		fmt.Fprintf(bw, " valid=%s preferred=%s\n", raLifetime(p.ValidLifetime), raLifetime(p.PreferredLifetime))
+	}
+	for _, rt := range ra.Routes {
+		fmt.Fprintf(bw, "\troute=%v pref=%v lifetime=%s\n", rt.Prefix, rt.Preference, raLifetime(rt.Lifetime))
+	}
+	for _, rdnss := range ra.RDNSS {
+		fmt.Fprintf(bw, "\trdnss=%s lifetime=%s\n", joinIPs(rdnss.Servers), raLifetime(rdnss.Lifetime))
+	}
+	for _, dnssl := range ra.DNSSL {
+		fmt.Fprintf(bw, "\tdnssl=%s lifetime=%s\n", strings.Join(dnssl.Domains, ","), raLifetime(dnssl.Lifetime))
+	}
+	bw.Flush()
+}
+
+func printRouters(bw *bufio.Writer, ifi *net.Interface, st *cvStat, routers []*rtrRouter, ras uint64, al *rtrAllowList) {
+	fmt.Fprintf(bw, "\nStatistical information for %s:\n", ifi.Name)
+	fmt.Fprintf(bw, "routers:")
+	if st.transmitted > 0 {
+		fmt.Fprintf(bw, " loss=%.1f%%", float64(st.transmitted-st.received)*100.0/float64(st.transmitted))
+	}
+	fmt.Fprintf(bw, " rcvd=%d", ras)
+	if !rtrPassive {
+		fmt.Fprintf(bw, " sent=%d", st.transmitted)
+	}
+	fmt.Fprintf(bw, " op.err=%d", st.opErrors)
+	if !rtrPassive {
+		printCVRTT(bw, st)
+	}
+	fmt.Fprintf(bw, "\n")
+	if len(routers) == 0 {
+		fmt.Fprintf(bw, "router: none heard\n")
+	}
+	for _, rtr := range routers {
+		fmt.Fprintf(bw, "router: %s", literalOrName(rtr.src, rtrNoRevLookup))
+		if rtr.lladdr != "" {
+			fmt.Fprintf(bw, " lladdr=%s", rtr.lladdr)
+		}
+		fmt.Fprintf(bw, " lifetime=%v pref=%v rcvd=%d", rtr.lifetime, rtr.pref, rtr.received)
+		if rtr.lifetime == 0 {
+			fmt.Fprintf(bw, " non-default")
+		}
+		fmt.Fprintf(bw, "\n")
+	}
+	if al == nil && len(routers) > 1 {
+		fmt.Fprintf(bw, "warning: multiple routers on link\n")
+	}
+	for _, rtr := range routers {
+		if !rtr.allowed {
+			fmt.Fprintf(bw, "warning: unexpected router %s", rtr.src)
+			if rtr.lladdr != "" {
+				fmt.Fprintf(bw, "(%s)", rtr.lladdr)
+			}
+			fmt.Fprintf(bw, "\n")
+		}
+	}
+	bw.Flush()
+}
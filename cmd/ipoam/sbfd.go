@@ -0,0 +1,368 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mikioh/ipoam"
+)
+
+var sbfdUsageTmpl = `Usage:
+	ipoam {{.Name}} [flags] target [target...]
+
+target
+	A hostname, DNS reg-name or IP address of S-BFD reflector,
+	optionally prefixed with the remote discriminator and @, such as
+	192.0.2.1@router1 or 3221225985@2001:db8::1.
+
+`
+
+var sbfdReflectorUsageTmpl = `Usage:
+	ipoam {{.Name}} [flags] discriminator [discriminator...]
+
+discriminator
+	A 32-bit unsigned integer or IPv4 address form of the discriminator
+	that the reflector responds to.
+
+`
+
+var (
+	cmdSBFD = &Command{
+		Func:      sbfdMain,
+		Usage:     cmdUsage,
+		UsageTmpl: sbfdUsageTmpl,
+		CanonName: "sbfd",
+		Descr:     "Verify reachability of remote discriminators with S-BFD",
+	}
+	cmdSBFDReflector = &Command{
+		Func:      sbfdReflectorMain,
+		Usage:     cmdUsage,
+		UsageTmpl: sbfdReflectorUsageTmpl,
+		CanonName: "sbfd-reflector",
+		Descr:     "Run an S-BFD reflector",
+	}
+
+	sbfdAdminDown   bool
+	sbfdIPv4only    bool
+	sbfdIPv6only    bool
+	sbfdNoRevLookup bool
+	sbfdQuiet       bool
+
+	sbfdCount      int
+	sbfdDetectMult int
+	sbfdPort       int
+	sbfdRx         int
+	sbfdWait       int
+
+	sbfdDisc       string
+	sbfdLocalDisc  string
+	sbfdOutboundIf string
+	sbfdSrc        string
+)
+
+func init() {
+	cmdSBFD.Flag.BoolVar(&sbfdIPv4only, "4", false, "Run IPv4 test only")
+	cmdSBFD.Flag.BoolVar(&sbfdIPv6only, "6", false, "Run IPv6 test only")
+	cmdSBFD.Flag.BoolVar(&sbfdNoRevLookup, "n", false, "Don't use DNS reverse lookup")
+	cmdSBFD.Flag.BoolVar(&sbfdQuiet, "q", false, "Quiet output except state changes and summary")
+
+	cmdSBFD.Flag.IntVar(&sbfdCount, "count", 0, "Iteration count, less than or equal to zero will run until interrupted")
+	cmdSBFD.Flag.IntVar(&sbfdDetectMult, "mult", 3, "Detection time multiplier")
+	cmdSBFD.Flag.IntVar(&sbfdWait, "wait", 1000, "Milliseconds between transmitting each control packet")
+
+	cmdSBFD.Flag.StringVar(&sbfdDisc, "disc", "", "Remote discriminator of targets without explicit discriminator, the IPv4 address of target by default")
+	cmdSBFD.Flag.StringVar(&sbfdLocalDisc, "local", "", "Local discriminator, random by default")
+	cmdSBFD.Flag.StringVar(&sbfdOutboundIf, "if", "", "Outbound interface name")
+	cmdSBFD.Flag.StringVar(&sbfdSrc, "src", "", "Source IP address")
+
+	cmdSBFDReflector.Flag.BoolVar(&sbfdAdminDown, "admindown", false, "Respond with AdminDown state")
+	cmdSBFDReflector.Flag.BoolVar(&sbfdIPv4only, "4", false, "Receive IPv4 control packets only")
+	cmdSBFDReflector.Flag.BoolVar(&sbfdIPv6only, "6", false, "Receive IPv6 control packets only")
+	cmdSBFDReflector.Flag.BoolVar(&sbfdQuiet, "q", false, "Quiet output")
+	cmdSBFDReflector.Flag.IntVar(&sbfdPort, "port", ipoam.SBFDPort, "Listening port")
+	cmdSBFDReflector.Flag.IntVar(&sbfdRx, "rx", 1, "Required minimum receive interval in milliseconds")
+}
+
+// parseSBFDDiscriminator parses s as a discriminator in either
+// integer or IPv4 address form.
+func parseSBFDDiscriminator(s string) (uint32, error) {
+	if ip := net.ParseIP(s).To4(); ip != nil {
+		return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3]), nil
+	}
+	n, err := strconv.ParseUint(s, 0, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid discriminator: %s", s)
+	}
+	return uint32(n), nil
+}
+
+type sbfdTarget struct {
+	name  string
+	ip    net.IP
+	disc  uint32
+	in    *ipoam.SBFDInitiator
+	state ipoam.BFDState
+	last  time.Time // time of the latest reply
+	st    *cvStat
+}
+
+func sbfdMain(cmd *Command, args []string) {
+	if len(args) == 0 {
+		cmd.Flag.Usage()
+	}
+	var disc, local uint32
+	var err error
+	if sbfdDisc != "" {
+		if disc, err = parseSBFDDiscriminator(sbfdDisc); err != nil {
+			cmd.fatal(err)
+		}
+	}
+	if sbfdLocalDisc != "" {
+		if local, err = parseSBFDDiscriminator(sbfdLocalDisc); err != nil {
+			cmd.fatal(err)
+		}
+	}
+	var ifi *net.Interface
+	if sbfdOutboundIf != "" {
+		if ifi, err = net.InterfaceByName(sbfdOutboundIf); err != nil {
+			cmd.fatal(err)
+		}
+	}
+	if sbfdWait <= 0 {
+		sbfdWait = 1000
+	}
+	if sbfdDetectMult <= 0 {
+		sbfdDetectMult = 3
+	}
+
+	stampIPv4only, stampIPv6only = sbfdIPv4only, sbfdIPv6only
+	var targets []*sbfdTarget
+	ins := make(map[string]*ipoam.SBFDInitiator)
+	for _, arg := range args {
+		t := sbfdTarget{name: arg, state: ipoam.BFDDown, st: &cvStat{minRTT: math.MaxInt64}}
+		if i := strings.IndexByte(arg, '@'); i >= 0 {
+			if t.disc, err = parseSBFDDiscriminator(arg[:i]); err != nil {
+				cmd.fatal(err)
+			}
+			t.name = arg[i+1:]
+		}
+		if t.ip, err = stampResolve(t.name); err != nil {
+			cmd.fatal(err)
+		}
+		if t.disc == 0 {
+			t.disc = disc
+		}
+		if t.disc == 0 {
+			if t.disc, err = parseSBFDDiscriminator(t.ip.String()); err != nil {
+				cmd.fatal(fmt.Errorf("no discriminator for %s", arg))
+			}
+		}
+		network, address := "udp4", "0.0.0.0"
+		if t.ip.To4() == nil {
+			network, address = "udp6", "::"
+		}
+		if sbfdSrc != "" {
+			address = sbfdSrc
+		}
+		if t.in = ins[network]; t.in == nil {
+			if t.in, err = ipoam.NewSBFDInitiator(network, address, local); err != nil {
+				cmd.fatal(err)
+			}
+			defer t.in.Close()
+			ins[network] = t.in
+			local = t.in.LocalDiscriminator()
+		}
+		targets = append(targets, &t)
+	}
+
+	bw := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(bw, "S-BFD initiator with %d targets: discriminator=%d\n", len(targets), local)
+	bw.Flush()
+
+	reports := make(chan ipoam.SBFDReport)
+	for _, in := range ins {
+		go func(in *ipoam.SBFDInitiator) {
+			for r := range in.Report() {
+				reports <- r
+			}
+		}(in)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	detect := time.Duration(sbfdWait*sbfdDetectMult) * time.Millisecond
+	for i := 0; ; i++ {
+		t := time.NewTimer(time.Duration(sbfdWait) * time.Millisecond)
+		now := time.Now()
+		for _, tgt := range targets {
+			if tgt.state != ipoam.BFDDown && now.Sub(tgt.last) > detect {
+				printSBFDState(bw, tgt, ipoam.BFDDown)
+			}
+			tgt.st.transmitted++
+			if err := tgt.in.Probe(tgt.ip, tgt.disc, ifi); err != nil {
+				tgt.st.opErrors++
+				if !sbfdQuiet {
+					fmt.Fprintf(bw, "error=%q\n", err)
+					bw.Flush()
+				}
+			}
+		}
+	loop:
+		for {
+			select {
+			case <-sig:
+				printSBFDStat(bw, targets)
+				os.Exit(0)
+			case <-t.C:
+				break loop
+			case r := <-reports:
+				if r.Error != nil {
+					if !sbfdQuiet {
+						fmt.Fprintf(bw, "error=%q\n", r.Error)
+						bw.Flush()
+					}
+					continue
+				}
+				if r.ICMP != nil {
+					// ICMP error messages may come from
+					// routers on the path.
+					if tgt := sbfdLookup(targets, nil, r.RemoteDiscriminator); tgt != nil && r.RemoteDiscriminator != 0 {
+						tgt.st.icmpErrors++
+					}
+					if !sbfdQuiet {
+						fmt.Fprintf(bw, "from=%s icmp.type=%q icmp.code=%d\n", literalOrName(r.Src.String(), sbfdNoRevLookup), r.ICMP.Type, r.ICMP.Code)
+						bw.Flush()
+					}
+					continue
+				}
+				tgt := sbfdLookup(targets, r.Src, r.RemoteDiscriminator)
+				if tgt == nil {
+					continue
+				}
+				tgt.st.onRTT(r.RTT)
+				tgt.last = r.Time
+				if !sbfdQuiet {
+					fmt.Fprintf(bw, "from=%s disc=%d state=%v rtt=%v rx=%v\n", literalOrName(r.Src.String(), sbfdNoRevLookup), r.RemoteDiscriminator, r.State, r.RTT, r.RequiredMinRx)
+					bw.Flush()
+				}
+				if r.State != tgt.state {
+					printSBFDState(bw, tgt, r.State)
+				}
+			}
+		}
+		t.Stop()
+		if sbfdCount > 0 && i+1 == sbfdCount {
+			printSBFDStat(bw, targets)
+			os.Exit(0)
+		}
+	}
+}
+
+// sbfdLookup returns the target that has the IP address ip and the
+// remote discriminator disc.
+// The IP address is ignored when it's nil, and the discriminator is
+// ignored when it's zero.
+func sbfdLookup(targets []*sbfdTarget, ip net.IP, disc uint32) *sbfdTarget {
+	for _, t := range targets {
+		if (ip == nil || t.ip.Equal(ip)) && (disc == 0 || t.disc == disc) {
+			return t
+		}
+	}
+	return nil
+}
+
+func printSBFDState(bw *bufio.Writer, t *sbfdTarget, state ipoam.BFDState) {
+	fmt.Fprintf(bw, "target=%s disc=%d state=%v old.state=%v\n", literalOrName(t.ip.String(), sbfdNoRevLookup), t.disc, state, t.state)
+	bw.Flush()
+	t.state = state
+}
+
+func printSBFDStat(bw *bufio.Writer, targets []*sbfdTarget) {
+	fmt.Fprintf(bw, "\nStatistical information:\n")
+	for _, t := range targets {
+		st := t.st
+		fmt.Fprintf(bw, "%s disc=%d state=%v:", literalOrName(t.ip.String(), sbfdNoRevLookup), t.disc, t.state)
+		if st.transmitted > 0 && st.received <= st.transmitted {
+			fmt.Fprintf(bw, " loss=%.1f%%", float64(st.transmitted-st.received)*100.0/float64(st.transmitted))
+		}
+		fmt.Fprintf(bw, " rcvd=%d sent=%d op.err=%d icmp.err=%d", st.received, st.transmitted, st.opErrors, st.icmpErrors)
+		printCVRTT(bw, st)
+		fmt.Fprintf(bw, "\n")
+	}
+	bw.Flush()
+}
+
+func sbfdReflectorMain(cmd *Command, args []string) {
+	if len(args) == 0 {
+		cmd.Flag.Usage()
+	}
+	var discs []uint32
+	for _, arg := range args {
+		disc, err := parseSBFDDiscriminator(arg)
+		if err != nil {
+			cmd.fatal(err)
+		}
+		discs = append(discs, disc)
+	}
+	var networks []string
+	if !sbfdIPv6only {
+		networks = append(networks, "udp4")
+	}
+	if !sbfdIPv4only {
+		networks = append(networks, "udp6")
+	}
+
+	bw := bufio.NewWriter(os.Stdout)
+	var mu sync.Mutex
+	errc := make(chan error, len(networks))
+	var rs []*ipoam.SBFDReflector
+	for _, network := range networks {
+		r, err := ipoam.NewSBFDReflector(network, fmt.Sprintf(":%d", sbfdPort))
+		if err != nil {
+			cmd.fatal(err)
+		}
+		defer r.Close()
+		for _, disc := range discs {
+			r.AddDiscriminator(disc)
+		}
+		r.SetAdminDown(sbfdAdminDown)
+		r.SetRequiredMinRx(time.Duration(sbfdRx) * time.Millisecond)
+		rs = append(rs, r)
+		fmt.Fprintf(bw, "S-BFD reflector on %v: discriminators=%v\n", r.Addr(), r.Discriminators())
+	}
+	bw.Flush()
+	for _, r := range rs {
+		go func(r *ipoam.SBFDReflector) {
+			errc <- r.Serve(func(req, rep *ipoam.BFDControl, peer net.Addr) {
+				if sbfdQuiet {
+					return
+				}
+				mu.Lock()
+				fmt.Fprintf(bw, "from=%v disc=%d remote.disc=%d state=%v\n", peer, rep.MyDiscriminator, req.MyDiscriminator, rep.State)
+				bw.Flush()
+				mu.Unlock()
+			})
+		}(r)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-sig:
+	case err := <-errc:
+		cmd.fatal(err)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,482 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mikioh/ipoam"
+)
+
+var stampUsageTmpl = `Usage:
+	ipoam {{.Name}} [flags] destination
+
+destination
+	A hostname, DNS reg-name or IP address of STAMP session-reflector.
+
+`
+
+var stampReflectorUsageTmpl = `Usage:
+	ipoam {{.Name}} [flags]
+
+`
+
+var (
+	cmdSTAMP = &Command{
+		Func:      stampMain,
+		Usage:     cmdUsage,
+		UsageTmpl: stampUsageTmpl,
+		CanonName: "stamp",
+		Descr:     "Measure one-way and round-trip delay and loss with STAMP",
+	}
+	cmdSTAMPReflector = &Command{
+		Func:      stampReflectorMain,
+		Usage:     cmdUsage,
+		UsageTmpl: stampReflectorUsageTmpl,
+		CanonName: "stamp-reflector",
+		Descr:     "Run a STAMP session-reflector",
+	}
+
+	stampIPv4only    bool
+	stampIPv6only    bool
+	stampNoRevLookup bool
+	stampPTP         bool
+	stampQuiet       bool
+	stampStateless   bool
+	stampVerbose     bool
+
+	stampCount int
+	stampPort  int
+	stampSSID  int
+	stampWait  int
+
+	stampKey        string
+	stampOutboundIf string
+	stampSrc        string
+	stampTLVs       string
+)
+
+func init() {
+	cmdSTAMP.Flag.BoolVar(&stampIPv4only, "4", false, "Run IPv4 test only")
+	cmdSTAMP.Flag.BoolVar(&stampIPv6only, "6", false, "Run IPv6 test only")
+	cmdSTAMP.Flag.BoolVar(&stampNoRevLookup, "n", false, "Don't use DNS reverse lookup")
+	cmdSTAMP.Flag.BoolVar(&stampPTP, "ptp", false, "Use truncated PTP timestamp format instead of NTP timestamp format")
+	cmdSTAMP.Flag.BoolVar(&stampQuiet, "q", false, "Quiet output except summary")
+	cmdSTAMP.Flag.BoolVar(&stampVerbose, "v", false, "Show verbose information")
+
+	cmdSTAMP.Flag.IntVar(&stampCount, "count", 0, "Iteration count, less than or equal to zero will run until interrupted")
+	cmdSTAMP.Flag.IntVar(&stampPort, "port", ipoam.STAMPPort, "Destination port")
+	cmdSTAMP.Flag.IntVar(&stampSSID, "ssid", 0, "Session-sender identifier, the process ID by default")
+	cmdSTAMP.Flag.IntVar(&stampWait, "wait", 1, "Seconds between transmitting each test packet")
+
+	cmdSTAMP.Flag.StringVar(&stampKey, "key", "", "Shared key for authenticated mode")
+	cmdSTAMP.Flag.StringVar(&stampOutboundIf, "if", "", "Outbound interface name")
+	cmdSTAMP.Flag.StringVar(&stampSrc, "src", "", "Source IP address")
+	cmdSTAMP.Flag.StringVar(&stampTLVs, "tlv", "", "TLVs on test packets, comma-separated list of pad=length, ts, cos=dscp and dm")
+
+	cmdSTAMPReflector.Flag.BoolVar(&stampIPv4only, "4", false, "Receive IPv4 test packets only")
+	cmdSTAMPReflector.Flag.BoolVar(&stampIPv6only, "6", false, "Receive IPv6 test packets only")
+	cmdSTAMPReflector.Flag.BoolVar(&stampPTP, "ptp", false, "Use truncated PTP timestamp format instead of NTP timestamp format")
+	cmdSTAMPReflector.Flag.BoolVar(&stampQuiet, "q", false, "Quiet output")
+	cmdSTAMPReflector.Flag.BoolVar(&stampStateless, "stateless", false, "Run stateless session-reflector")
+	cmdSTAMPReflector.Flag.IntVar(&stampPort, "port", ipoam.STAMPPort, "Listening port")
+	cmdSTAMPReflector.Flag.StringVar(&stampKey, "key", "", "Shared key for authenticated mode")
+}
+
+func stampMain(cmd *Command, args []string) {
+	if len(args) == 0 {
+		cmd.Flag.Usage()
+	}
+	dst, err := stampResolve(args[0])
+	if err != nil {
+		cmd.fatal(err)
+	}
+	tlvs, err := parseSTAMPTLVs(stampTLVs)
+	if err != nil {
+		cmd.fatal(err)
+	}
+	var key []byte
+	if stampKey != "" {
+		key = []byte(stampKey)
+	}
+	var ifi *net.Interface
+	if stampOutboundIf != "" {
+		if ifi, err = net.InterfaceByName(stampOutboundIf); err != nil {
+			cmd.fatal(err)
+		}
+	}
+	if stampSSID == 0 {
+		stampSSID = os.Getpid() & 0xffff
+	}
+	if stampWait <= 0 {
+		stampWait = 1
+	}
+
+	network, address := "udp4", "0.0.0.0:0"
+	if dst.To4() == nil {
+		network, address = "udp6", "[::]:0"
+	}
+	if stampSrc != "" {
+		address = net.JoinHostPort(stampSrc, "0")
+	}
+	ipt, err := ipoam.NewTester(network, address)
+	if err != nil {
+		cmd.fatal(err)
+	}
+	defer ipt.Close()
+
+	bw := bufio.NewWriter(os.Stdout)
+	mode := "unauthenticated"
+	if key != nil {
+		mode = "authenticated"
+	}
+	fmt.Fprintf(bw, "STAMP session %d to %v: %s mode\n", stampSSID, dst, mode)
+	bw.Flush()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	replies := stampReplies(ipt, key)
+	cm := ipoam.ControlMessage{Port: stampPort}
+	ee := ipoam.NewSTAMPErrorEstimate(false, stampPTP, time.Millisecond)
+	st := newSTAMPStat()
+	for seq := uint32(0); ; seq++ {
+		t := time.NewTimer(time.Duration(stampWait) * time.Second)
+		for _, tlv := range tlvs {
+			if tlv.Type == ipoam.STAMPTLVDirectMeasurement {
+				binary.BigEndian.PutUint32(tlv.Value[0:4], seq+1)
+			}
+		}
+		req := ipoam.STAMPPacket{Seq: seq, Timestamp: time.Now(), ErrorEstimate: ee, SSID: stampSSID, TLVs: tlvs}
+		b, err := req.Marshal(key)
+		if err != nil {
+			cmd.fatal(err)
+		}
+		st.rtt.transmitted++
+		if err := ipt.Probe(b, &cm, dst, ifi); err != nil {
+			st.rtt.opErrors++
+			if !stampQuiet {
+				fmt.Fprintf(bw, "error=%q\n", err)
+				bw.Flush()
+			}
+		}
+	loop:
+		for {
+			select {
+			case <-sig:
+				printSTAMPStat(bw, args[0], st)
+				os.Exit(0)
+			case <-t.C:
+				break loop
+			case rep := <-replies:
+				if rep.p.SSID != stampSSID {
+					continue
+				}
+				st.onReply(&rep)
+				printSTAMPReply(bw, &rep)
+			case r := <-ipt.Report():
+				if r.Error != nil {
+					st.rtt.opErrors++
+				} else {
+					st.rtt.icmpErrors++
+				}
+				if stampQuiet {
+					continue
+				}
+				if r.Error != nil {
+					fmt.Fprintf(bw, "error=%q\n", r.Error)
+				} else {
+					fmt.Fprintf(bw, "from=%s icmp.type=%q icmp.code=%d\n", literalOrName(r.Src.String(), stampNoRevLookup), r.ICMP.Type, r.ICMP.Code)
+				}
+				bw.Flush()
+			}
+		}
+		t.Stop()
+		if stampCount > 0 && int(seq)+1 == stampCount {
+			printSTAMPStat(bw, args[0], st)
+			os.Exit(0)
+		}
+	}
+}
+
+func stampResolve(s string) (net.IP, error) {
+	ips, err := net.LookupIP(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil && !stampIPv6only || ip.To4() == nil && !stampIPv4only {
+			return ip, nil
+		}
+	}
+	return nil, &net.AddrError{Err: "no suitable address", Addr: s}
+}
+
+// parseSTAMPTLVs parses s as a comma-separated list of TLVs.
+func parseSTAMPTLVs(s string) ([]ipoam.STAMPTLV, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var tlvs []ipoam.STAMPTLV
+	for _, f := range strings.Split(s, ",") {
+		name, arg := f, ""
+		if i := strings.IndexByte(f, '='); i >= 0 {
+			name, arg = f[:i], f[i+1:]
+		}
+		switch name {
+		case "pad":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 0 || n > 0xffff {
+				return nil, fmt.Errorf("invalid padding length: %s", arg)
+			}
+			tlvs = append(tlvs, ipoam.STAMPTLV{Type: ipoam.STAMPTLVExtraPadding, Value: make([]byte, n)})
+		case "ts":
+			tlvs = append(tlvs, ipoam.STAMPTLV{Type: ipoam.STAMPTLVTimestampInfo, Value: []byte{ipoam.STAMPSyncFreeRun, ipoam.STAMPStampSWLocal, 0, 0}})
+		case "cos":
+			dscp, err := strconv.Atoi(arg)
+			if err != nil || dscp < 0 || dscp > 63 {
+				return nil, fmt.Errorf("invalid dscp: %s", arg)
+			}
+			tlvs = append(tlvs, ipoam.STAMPTLV{Type: ipoam.STAMPTLVClassOfService, Value: []byte{byte(dscp) << 2, 0, 0, 0}})
+		case "dm":
+			tlvs = append(tlvs, ipoam.STAMPTLV{Type: ipoam.STAMPTLVDirectMeasurement, Value: make([]byte, 12)})
+		default:
+			return nil, fmt.Errorf("unknown TLV: %s", f)
+		}
+	}
+	return tlvs, nil
+}
+
+type stampReply struct {
+	p    *ipoam.STAMPPacket
+	peer net.Addr
+	rcvd time.Time
+}
+
+// stampReplies returns the session-reflector test packets received
+// on ipt.
+func stampReplies(ipt *ipoam.Tester, key []byte) <-chan stampReply {
+	ch := make(chan stampReply)
+	go func() {
+		b := make([]byte, 1<<16)
+		for {
+			n, peer, err := ipt.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			rcvd := time.Now()
+			p, err := ipoam.ParseSTAMPPacket(b[:n], true, key)
+			if err != nil {
+				continue
+			}
+			ch <- stampReply{p: p, peer: peer, rcvd: rcvd}
+		}
+	}()
+	return ch
+}
+
+// A stampStat represents the statistics of STAMP or TWAMP-Light
+// session.
+// The forward and backward statistics hold one-way delays, which are
+// accurate only when the clocks of both hosts are synchronized.
+type stampStat struct {
+	rtt, fwd, bwd *cvStat
+
+	stateful      bool   // true if the session-reflector is known to be stateful
+	lastSenderSeq uint32 // session-sender sequence number of the latest reply
+	lastReflSeq   uint32 // session-reflector sequence number of the latest reply
+	synced        bool
+}
+
+func newSTAMPStat() *stampStat {
+	stats := make(cvStats)
+	return &stampStat{rtt: stats.get("rtt"), fwd: stats.get("fwd"), bwd: stats.get("bwd")}
+}
+
+// A stampSample represents the delays and sequence numbers of a
+// session-reflector test packet.
+type stampSample struct {
+	rtt, fwd, bwd      time.Duration
+	senderSeq, reflSeq uint32
+	synced             bool // true if the clocks of both hosts are synchronized
+}
+
+func (st *stampStat) onSample(s *stampSample) {
+	st.rtt.onRTT(s.rtt)
+	st.fwd.onRTT(s.fwd)
+	st.bwd.onRTT(s.bwd)
+	if s.reflSeq != s.senderSeq {
+		st.stateful = true
+	}
+	if s.senderSeq >= st.lastSenderSeq {
+		st.lastSenderSeq, st.lastReflSeq = s.senderSeq, s.reflSeq
+	}
+	st.synced = s.synced
+}
+
+func (st *stampStat) onReply(rep *stampReply) {
+	s := stampSample{senderSeq: rep.p.SenderSeq, reflSeq: rep.p.Seq, synced: rep.p.SenderErrorEstimate.Synced() && rep.p.ErrorEstimate.Synced()}
+	s.rtt, s.fwd, s.bwd = rep.p.Delays(rep.rcvd)
+	st.onSample(&s)
+}
+
+func printSTAMPReply(bw *bufio.Writer, rep *stampReply) {
+	if stampQuiet {
+		return
+	}
+	rtt, fwd, bwd := rep.p.Delays(rep.rcvd)
+	fmt.Fprintf(bw, "from=%s", literalOrName(rep.peer.(*net.UDPAddr).IP.String(), stampNoRevLookup))
+	if stampVerbose {
+		fmt.Fprintf(bw, " ttl=%d refl.seq=%d", rep.p.SenderTTL, rep.p.Seq)
+	}
+	fmt.Fprintf(bw, " seq=%d rtt=%v fwd=%v bwd=%v", rep.p.SenderSeq, rtt, fwd, bwd)
+	if stampVerbose {
+		fmt.Fprintf(bw, " refl.err=%v", rep.p.ErrorEstimate.Duration())
+		printSTAMPTLVs(bw, rep.p.TLVs)
+	}
+	fmt.Fprintf(bw, "\n")
+	bw.Flush()
+}
+
+// stampTLVLens holds the value lengths of the STAMP TLVs printed by
+// printSTAMPTLVs, as described in RFC 8972.
+var stampTLVLens = map[int]int{
+	ipoam.STAMPTLVTimestampInfo:     4,
+	ipoam.STAMPTLVClassOfService:    4,
+	ipoam.STAMPTLVDirectMeasurement: 12,
+}
+
+func printSTAMPTLVs(bw *bufio.Writer, tlvs []ipoam.STAMPTLV) {
+	for _, tlv := range tlvs {
+		if tlv.Flags&(ipoam.STAMPTLVUnrecognized|ipoam.STAMPTLVMalformed|ipoam.STAMPTLVIntegrity) != 0 {
+			fmt.Fprintf(bw, " tlv.%d.flags=%#x", tlv.Type, tlv.Flags)
+			continue
+		}
+		if n, ok := stampTLVLens[tlv.Type]; ok && len(tlv.Value) != n {
+			fmt.Fprintf(bw, " tlv.%d.len=%d", tlv.Type, len(tlv.Value))
+			continue
+		}
+		switch tlv.Type {
+		case ipoam.STAMPTLVTimestampInfo:
+			fmt.Fprintf(bw, " ts.sync=%d ts.method=%d", tlv.Value[2], tlv.Value[3])
+		case ipoam.STAMPTLVClassOfService:
+			fmt.Fprintf(bw, " cos.dscp=%d cos.ecn=%d", tlv.Value[0]&0x03<<4|tlv.Value[1]>>4, tlv.Value[1]>>2&0x03)
+		case ipoam.STAMPTLVDirectMeasurement:
+			fmt.Fprintf(bw, " dm.s.tx=%d dm.r.rx=%d dm.r.tx=%d", binary.BigEndian.Uint32(tlv.Value[0:4]), binary.BigEndian.Uint32(tlv.Value[4:8]), binary.BigEndian.Uint32(tlv.Value[8:12]))
+		}
+	}
+}
+
+func printSTAMPStat(bw *bufio.Writer, dst string, st *stampStat) {
+	fmt.Fprintf(bw, "\nStatistical information for %s:\n", dst)
+	fmt.Fprintf(bw, "round-trip:")
+	if st.rtt.transmitted > 0 && st.rtt.received <= st.rtt.transmitted {
+		fmt.Fprintf(bw, " loss=%.1f%%", float64(st.rtt.transmitted-st.rtt.received)*100.0/float64(st.rtt.transmitted))
+	}
+	fmt.Fprintf(bw, " rcvd=%d sent=%d op.err=%d icmp.err=%d", st.rtt.received, st.rtt.transmitted, st.rtt.opErrors, st.rtt.icmpErrors)
+	printCVRTT(bw, st.rtt)
+	fmt.Fprintf(bw, "\n")
+
+	// A stateful session-reflector numbers the test packets it
+	// receives, which tells forward loss from backward loss.
+	fwdLoss, bwdLoss := math.NaN(), math.NaN()
+	if st.rtt.received > 0 && (st.stateful || st.rtt.received == st.rtt.transmitted) {
+		sent, reflected := float64(st.lastSenderSeq)+1, float64(st.lastReflSeq)+1
+		fwdLoss = (sent - reflected) * 100.0 / sent
+		bwdLoss = (reflected - float64(st.rtt.received)) * 100.0 / reflected
+		if bwdLoss < 0 {
+			bwdLoss = 0
+		}
+	}
+	for _, dir := range []struct {
+		name   string
+		loss   float64
+		st     *cvStat
+		synced bool
+	}{
+		{"forward", fwdLoss, st.fwd, st.synced},
+		{"backward", bwdLoss, st.bwd, st.synced},
+	} {
+		fmt.Fprintf(bw, "%s:", dir.name)
+		if !math.IsNaN(dir.loss) {
+			fmt.Fprintf(bw, " loss=%.1f%%", dir.loss)
+		}
+		printCVRTT(bw, dir.st)
+		if !dir.synced {
+			fmt.Fprintf(bw, " (unsynchronized clocks)")
+		}
+		fmt.Fprintf(bw, "\n")
+	}
+	bw.Flush()
+}
+
+func stampReflectorMain(cmd *Command, args []string) {
+	// IPv4 and IPv6 session-reflectors run on separate
+	// connections to learn the IPv4 TTL or IPv6 hop limit of
+	// session-sender test packets.
+	var networks []string
+	if !stampIPv6only {
+		networks = append(networks, "udp4")
+	}
+	if !stampIPv4only {
+		networks = append(networks, "udp6")
+	}
+	var key []byte
+	if stampKey != "" {
+		key = []byte(stampKey)
+	}
+	mode := "stateful"
+	if stampStateless {
+		mode = "stateless"
+	}
+
+	bw := bufio.NewWriter(os.Stdout)
+	var mu sync.Mutex
+	errc := make(chan error, len(networks))
+	var rs []*ipoam.STAMPReflector
+	for _, network := range networks {
+		r, err := ipoam.NewSTAMPReflector(network, fmt.Sprintf(":%d", stampPort), !stampStateless, key)
+		if err != nil {
+			cmd.fatal(err)
+		}
+		defer r.Close()
+		r.SetPTP(stampPTP)
+		rs = append(rs, r)
+		fmt.Fprintf(bw, "STAMP %s session-reflector on %v\n", mode, r.Addr())
+	}
+	bw.Flush()
+	for _, r := range rs {
+		go func(r *ipoam.STAMPReflector) {
+			errc <- r.Serve(func(req, rep *ipoam.STAMPPacket, peer net.Addr) {
+				if stampQuiet {
+					return
+				}
+				mu.Lock()
+				fmt.Fprintf(bw, "from=%v ssid=%d seq=%d refl.seq=%d ttl=%d\n", peer, req.SSID, req.Seq, rep.Seq, rep.SenderTTL)
+				bw.Flush()
+				mu.Unlock()
+			})
+		}(r)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-sig:
+	case err := <-errc:
+		cmd.fatal(err)
+	}
+	os.Exit(0)
+}
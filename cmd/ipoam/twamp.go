@@ -0,0 +1,308 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mikioh/ipoam"
+)
+
+var twampUsageTmpl = `Usage:
+	ipoam {{.Name}} [flags] destination
+
+destination
+	A hostname, DNS reg-name or IP address of TWAMP-Light session-reflector.
+
+`
+
+var twampReflectorUsageTmpl = `Usage:
+	ipoam {{.Name}} [flags]
+
+`
+
+var (
+	cmdTWAMP = &Command{
+		Func:      twampMain,
+		Usage:     cmdUsage,
+		UsageTmpl: twampUsageTmpl,
+		CanonName: "twamp",
+		Descr:     "Measure two-way delay and loss with TWAMP-Light",
+	}
+	cmdTWAMPReflector = &Command{
+		Func:      twampReflectorMain,
+		Usage:     cmdUsage,
+		UsageTmpl: twampReflectorUsageTmpl,
+		CanonName: "twamp-reflector",
+		Descr:     "Run a TWAMP-Light session-reflector",
+	}
+
+	twampIPv4only    bool
+	twampIPv6only    bool
+	twampNoRevLookup bool
+	twampPTP         bool
+	twampQuiet       bool
+	twampSynced      bool
+	twampVerbose     bool
+
+	twampCount   int
+	twampDSCP    int
+	twampPadding int
+	twampPort    int
+	twampWait    int
+
+	twampError      string
+	twampOutboundIf string
+	twampSrc        string
+)
+
+func init() {
+	cmdTWAMP.Flag.BoolVar(&twampIPv4only, "4", false, "Run IPv4 test only")
+	cmdTWAMP.Flag.BoolVar(&twampIPv6only, "6", false, "Run IPv6 test only")
+	cmdTWAMP.Flag.BoolVar(&twampNoRevLookup, "n", false, "Don't use DNS reverse lookup")
+	cmdTWAMP.Flag.BoolVar(&twampQuiet, "q", false, "Quiet output except summary")
+	cmdTWAMP.Flag.BoolVar(&twampVerbose, "v", false, "Show verbose information")
+
+	cmdTWAMP.Flag.IntVar(&twampCount, "count", 0, "Iteration count, less than or equal to zero will run until interrupted")
+	cmdTWAMP.Flag.IntVar(&twampDSCP, "dscp", 0, "DSCP on test packets")
+	cmdTWAMP.Flag.IntVar(&twampPadding, "pad", 27, "Packet padding length, 27 or more keeps test packets in both directions the same size")
+	cmdTWAMP.Flag.IntVar(&twampPort, "port", ipoam.TWAMPPort, "Destination port")
+	cmdTWAMP.Flag.IntVar(&twampWait, "wait", 1, "Seconds between transmitting each test packet")
+
+	cmdTWAMP.Flag.StringVar(&twampOutboundIf, "if", "", "Outbound interface name")
+	cmdTWAMP.Flag.StringVar(&twampSrc, "src", "", "Source IP address")
+
+	cmdTWAMPReflector.Flag.BoolVar(&twampIPv4only, "4", false, "Receive IPv4 test packets only")
+	cmdTWAMPReflector.Flag.BoolVar(&twampIPv6only, "6", false, "Receive IPv6 test packets only")
+	cmdTWAMPReflector.Flag.BoolVar(&twampQuiet, "q", false, "Quiet output")
+	cmdTWAMPReflector.Flag.IntVar(&twampPort, "port", ipoam.TWAMPPort, "Listening port")
+
+	for _, cmd := range []*Command{cmdTWAMP, cmdTWAMPReflector} {
+		cmd.Flag.BoolVar(&twampPTP, "ptp", false, "Use truncated PTP timestamp format instead of NTP timestamp format")
+		cmd.Flag.BoolVar(&twampSynced, "synced", false, "Mark the clock as synchronized to UTC in error estimate")
+		cmd.Flag.StringVar(&twampError, "error", "1ms", "Timestamp error in error estimate")
+	}
+}
+
+func twampErrorEstimate() (ipoam.STAMPErrorEstimate, error) {
+	d, err := time.ParseDuration(twampError)
+	if err != nil {
+		return 0, err
+	}
+	return ipoam.NewSTAMPErrorEstimate(twampSynced, twampPTP, d), nil
+}
+
+func twampMain(cmd *Command, args []string) {
+	if len(args) == 0 {
+		cmd.Flag.Usage()
+	}
+	stampIPv4only, stampIPv6only = twampIPv4only, twampIPv6only
+	dst, err := stampResolve(args[0])
+	if err != nil {
+		cmd.fatal(err)
+	}
+	ee, err := twampErrorEstimate()
+	if err != nil {
+		cmd.fatal(err)
+	}
+	if twampDSCP < 0 || twampDSCP > 63 {
+		cmd.fatal(fmt.Errorf("invalid dscp: %d", twampDSCP))
+	}
+	var ifi *net.Interface
+	if twampOutboundIf != "" {
+		if ifi, err = net.InterfaceByName(twampOutboundIf); err != nil {
+			cmd.fatal(err)
+		}
+	}
+	if twampWait <= 0 {
+		twampWait = 1
+	}
+
+	network, address := "udp4", "0.0.0.0:0"
+	if dst.To4() == nil {
+		network, address = "udp6", "[::]:0"
+	}
+	if twampSrc != "" {
+		address = net.JoinHostPort(twampSrc, "0")
+	}
+	ipt, err := ipoam.NewTester(network, address)
+	if err != nil {
+		cmd.fatal(err)
+	}
+	defer ipt.Close()
+	if p := ipt.IPv4PacketConn(); p != nil {
+		p.SetTOS(twampDSCP << 2)
+	}
+	if p := ipt.IPv6PacketConn(); p != nil {
+		p.SetTrafficClass(twampDSCP << 2)
+	}
+
+	bw := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(bw, "TWAMP-Light session to %v: %d bytes padding, dscp %d\n", dst, twampPadding, twampDSCP)
+	bw.Flush()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	replies := twampReplies(ipt)
+	cm := ipoam.ControlMessage{Port: twampPort}
+	st := newSTAMPStat()
+	for seq := uint32(0); ; seq++ {
+		t := time.NewTimer(time.Duration(twampWait) * time.Second)
+		req := ipoam.TWAMPPacket{Seq: seq, Timestamp: time.Now(), ErrorEstimate: ee, Padding: twampPadding}
+		b, err := req.Marshal()
+		if err != nil {
+			cmd.fatal(err)
+		}
+		st.rtt.transmitted++
+		if err := ipt.Probe(b, &cm, dst, ifi); err != nil {
+			st.rtt.opErrors++
+			if !twampQuiet {
+				fmt.Fprintf(bw, "error=%q\n", err)
+				bw.Flush()
+			}
+		}
+	loop:
+		for {
+			select {
+			case <-sig:
+				printSTAMPStat(bw, args[0], st)
+				os.Exit(0)
+			case <-t.C:
+				break loop
+			case rep := <-replies:
+				s := stampSample{senderSeq: rep.p.SenderSeq, reflSeq: rep.p.Seq, synced: rep.p.SenderErrorEstimate.Synced() && rep.p.ErrorEstimate.Synced()}
+				s.rtt, s.fwd, s.bwd = rep.p.Delays(rep.rcvd)
+				st.onSample(&s)
+				printTWAMPReply(bw, &rep, &s)
+			case r := <-ipt.Report():
+				if r.Error != nil {
+					st.rtt.opErrors++
+				} else {
+					st.rtt.icmpErrors++
+				}
+				if twampQuiet {
+					continue
+				}
+				if r.Error != nil {
+					fmt.Fprintf(bw, "error=%q\n", r.Error)
+				} else {
+					fmt.Fprintf(bw, "from=%s icmp.type=%q icmp.code=%d\n", literalOrName(r.Src.String(), twampNoRevLookup), r.ICMP.Type, r.ICMP.Code)
+				}
+				bw.Flush()
+			}
+		}
+		t.Stop()
+		if twampCount > 0 && int(seq)+1 == twampCount {
+			printSTAMPStat(bw, args[0], st)
+			os.Exit(0)
+		}
+	}
+}
+
+type twampReply struct {
+	p    *ipoam.TWAMPPacket
+	peer net.Addr
+	rcvd time.Time
+}
+
+// twampReplies returns the session-reflector test packets received
+// on ipt.
+func twampReplies(ipt *ipoam.Tester) <-chan twampReply {
+	ch := make(chan twampReply)
+	go func() {
+		b := make([]byte, 1<<16)
+		for {
+			n, peer, err := ipt.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			rcvd := time.Now()
+			p, err := ipoam.ParseTWAMPPacket(b[:n], true)
+			if err != nil {
+				continue
+			}
+			ch <- twampReply{p: p, peer: peer, rcvd: rcvd}
+		}
+	}()
+	return ch
+}
+
+func printTWAMPReply(bw *bufio.Writer, rep *twampReply, s *stampSample) {
+	if twampQuiet {
+		return
+	}
+	fmt.Fprintf(bw, "from=%s", literalOrName(rep.peer.(*net.UDPAddr).IP.String(), twampNoRevLookup))
+	if twampVerbose {
+		fmt.Fprintf(bw, " ttl=%d refl.seq=%d", rep.p.SenderTTL, rep.p.Seq)
+	}
+	fmt.Fprintf(bw, " seq=%d rtt=%v fwd=%v bwd=%v", rep.p.SenderSeq, s.rtt, s.fwd, s.bwd)
+	if twampVerbose {
+		fmt.Fprintf(bw, " refl.rcvd=%s refl.sent=%s refl.delay=%v refl.err=%v", rep.p.Received.Format("15:04:05.000000"), rep.p.Timestamp.Format("15:04:05.000000"), rep.p.Timestamp.Sub(rep.p.Received), rep.p.ErrorEstimate.Duration())
+	}
+	fmt.Fprintf(bw, "\n")
+	bw.Flush()
+}
+
+func twampReflectorMain(cmd *Command, args []string) {
+	ee, err := twampErrorEstimate()
+	if err != nil {
+		cmd.fatal(err)
+	}
+	// IPv4 and IPv6 session-reflectors run on separate
+	// connections to learn the IPv4 TTL or IPv6 hop limit of
+	// session-sender test packets.
+	var networks []string
+	if !twampIPv6only {
+		networks = append(networks, "udp4")
+	}
+	if !twampIPv4only {
+		networks = append(networks, "udp6")
+	}
+
+	bw := bufio.NewWriter(os.Stdout)
+	var mu sync.Mutex
+	errc := make(chan error, len(networks))
+	var rs []*ipoam.TWAMPReflector
+	for _, network := range networks {
+		r, err := ipoam.NewTWAMPReflector(network, fmt.Sprintf(":%d", twampPort))
+		if err != nil {
+			cmd.fatal(err)
+		}
+		defer r.Close()
+		r.SetErrorEstimate(ee)
+		rs = append(rs, r)
+		fmt.Fprintf(bw, "TWAMP-Light session-reflector on %v\n", r.Addr())
+	}
+	bw.Flush()
+	for _, r := range rs {
+		go func(r *ipoam.TWAMPReflector) {
+			errc <- r.Serve(func(req, rep *ipoam.TWAMPPacket, peer net.Addr) {
+				if twampQuiet {
+					return
+				}
+				mu.Lock()
+				fmt.Fprintf(bw, "from=%v seq=%d refl.seq=%d ttl=%d pad=%d\n", peer, req.Seq, rep.Seq, rep.SenderTTL, req.Padding)
+				bw.Flush()
+				mu.Unlock()
+			})
+		}(r)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-sig:
+	case err := <-errc:
+		cmd.fatal(err)
+	}
+	os.Exit(0)
+}
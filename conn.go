@@ -5,10 +5,17 @@
 package ipoam
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"runtime"
+	"sync"
 	"syscall"
+	"time"
 
+	"golang.org/x/net/bpf"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
@@ -18,11 +25,18 @@ const (
 	// See golang.org/x/net/internal/iana.
 	ianaProtocolIP       = 0
 	ianaProtocolICMP     = 1
+	ianaProtocolIGMP     = 2
 	ianaProtocolUDP      = 17
 	ianaProtocolIPv6     = 41
 	ianaProtocolIPv6ICMP = 58
 )
 
+// maxBatchSize is the maximum number of packets transferred in a
+// single batch I/O operation.
+const maxBatchSize = 16
+
+var errHeaderTooShort = errors.New("header too short")
+
 // A conn represents a connection endpoint.
 type conn struct {
 	protocol  int            // protocol number
@@ -33,6 +47,159 @@ type conn struct {
 	r4        *ipv4.RawConn
 	p4        *ipv4.PacketConn
 	p6        *ipv6.PacketConn
+
+	fmu    sync.Mutex
+	filter []bpf.RawInstruction // receive packet filter on c
+
+	bmu       sync.Mutex
+	broadcast bool          // true if c is allowed to transmit broadcast packets
+	opts      []byte        // IPv4 options on outgoing packets
+	ext       *ipv6ExtState // IPv6 extension headers on outgoing packets
+	socks     [2]*sockState // cached socket options for IPv4 and IPv6, nil if not cached
+}
+
+var bcastCache = struct {
+	sync.Mutex
+	expire time.Time
+	ips    []net.IP
+	addrs  func() ([]net.Addr, error) // source of interface addresses
+}{addrs: net.InterfaceAddrs}
+
+// isBroadcast reports whether ip is the IPv4 limited broadcast address
+// or a directed broadcast address of a subnet attached to the node.
+func isBroadcast(ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	if ip4.Equal(net.IPv4bcast) {
+		return true
+	}
+	bcastCache.Lock()
+	defer bcastCache.Unlock()
+	if now := time.Now(); now.After(bcastCache.expire) {
+		bcastCache.expire = now.Add(5 * time.Second)
+		bcastCache.ips = bcastCache.ips[:0]
+		ifat, _ := bcastCache.addrs()
+		for _, ifa := range ifat {
+			ipn, ok := ifa.(*net.IPNet)
+			if !ok || ipn.IP.To4() == nil {
+				continue
+			}
+			ones, bits := ipn.Mask.Size()
+			if bits-ones < 2 {
+				continue
+			}
+			b := make(net.IP, net.IPv4len)
+			for i := range b {
+				b[i] = ipn.IP.To4()[i] | ^ipn.Mask[len(ipn.Mask)-net.IPv4len+i]
+			}
+			bcastCache.ips = append(bcastCache.ips, b)
+		}
+	}
+	for _, b := range bcastCache.ips {
+		if ip4.Equal(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// setBroadcast allows c to transmit broadcast packets.
+func (c *conn) setBroadcast() error {
+	c.bmu.Lock()
+	defer c.bmu.Unlock()
+	if c.broadcast {
+		return nil
+	}
+	if err := c.control(setsockoptBroadcast); err != nil {
+		return err
+	}
+	c.broadcast = true
+	return nil
+}
+
+// setIPv4Options sets the IPv4 options on outgoing packets.
+// It does nothing when the options are unchanged.
+func (c *conn) setIPv4Options(b []byte) error {
+	if len(b) > maxIPv4OptionsLen {
+		return fmt.Errorf("IPv4 options too long: %d", len(b))
+	}
+	c.bmu.Lock()
+	defer c.bmu.Unlock()
+	if bytes.Equal(b, c.opts) {
+		return nil
+	}
+	opts := b
+	for len(opts)%4 != 0 {
+		opts = append(opts[:len(opts):len(opts)], ipv4OptEOL)
+	}
+	if err := c.control(func(s uintptr) error { return setsockoptIPv4Options(s, opts) }); err != nil {
+		return err
+	}
+	c.opts = append(c.opts[:0], b...)
+	return nil
+}
+
+// setIPv6ExtHeaders sets the IPv6 extension headers on outgoing
+// packets to dst.
+// It does nothing when the extension headers are unchanged.
+func (c *conn) setIPv6ExtHeaders(hs []IPv6ExtHeader, dst net.IP) error {
+	st, err := newIPv6ExtState(hs, dst)
+	if err != nil {
+		return err
+	}
+	c.bmu.Lock()
+	defer c.bmu.Unlock()
+	old := c.ext
+	if old == nil {
+		old = &ipv6ExtState{}
+	}
+	for _, h := range []struct {
+		typ      int
+		new, old []byte
+	}{
+		{IPv6HopByHop, st.hbh, old.hbh},
+		{IPv6Routing, st.rthdr, old.rthdr},
+		{IPv6DstOpts, st.dstopts, old.dstopts},
+	} {
+		if bytes.Equal(h.new, h.old) {
+			continue
+		}
+		if err := c.control(func(s uintptr) error { return setsockoptIPv6ExtHeader(s, h.typ, h.new) }); err != nil {
+			return err
+		}
+	}
+	if st.frag != old.frag {
+		mtu := 0
+		if st.frag {
+			mtu = minIPv6MTU
+		}
+		if err := c.control(func(s uintptr) error { return setsockoptIPv6MTU(s, mtu) }); err != nil {
+			return err
+		}
+	}
+	c.ext = st
+	return nil
+}
+
+func (c *conn) control(fn func(uintptr) error) error {
+	sc, ok := c.c.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("socket option not supported on %s", c.c.LocalAddr().Network())
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(s uintptr) { serr = fn(s) }); err != nil {
+		return err
+	}
+	if serr != nil {
+		return os.NewSyscallError("setsockopt", serr)
+	}
+	return nil
 }
 
 func (c *conn) close() error {
@@ -59,6 +226,22 @@ func (c *conn) readFrom(b []byte) ([]byte, interface{}, interface{}, net.Addr, e
 			}
 			return p, h, cm, &net.IPAddr{IP: cm.Src}, nil
 		}
+		// The ipv4.PacketConn strips the IPv4 header that
+		// carries the IPv4 options.
+		// A packet that fails to parse is skipped.
+		if ipc, ok := c.c.(*net.IPConn); ok {
+			oob := c.newControlMessage()
+			for {
+				n, oobn, _, peer, err := ipc.ReadMsgIP(b, oob)
+				if err != nil {
+					return nil, nil, nil, nil, err
+				}
+				p, err := c.parseMessage(&ipv4.Message{Buffers: [][]byte{b}, OOB: oob, Addr: peer, N: n, NN: oobn})
+				if err == nil {
+					return p.b, p.h, p.cm, p.peer, nil
+				}
+			}
+		}
 		n, cm, peer, err := c.p4.ReadFrom(b)
 		return b[:n], nil, cm, peer, err
 	case ianaProtocolIPv6ICMP:
@@ -72,6 +255,93 @@ func (c *conn) readFrom(b []byte) ([]byte, interface{}, interface{}, net.Addr, e
 	}
 }
 
+// A packet represents a received packet.
+type packet struct {
+	b    []byte      // ICMP message
+	h    interface{} // IP header, either nil or ipv4.Header
+	cm   interface{} // control message, either ipv4.ControlMessage or ipv6.ControlMessage
+	peer net.Addr
+	err  error // per-packet parse error, the other fields are unset if not nil
+}
+
+func (c *conn) newControlMessage() []byte {
+	switch {
+	case c.r4 != nil, c.p4 != nil:
+		return ipv4.NewControlMessage(ipv4.FlagTTL | ipv4.FlagSrc | ipv4.FlagDst | ipv4.FlagInterface)
+	case c.p6 != nil:
+		return ipv6.NewControlMessage(ipv6.FlagTrafficClass | ipv6.FlagHopLimit | ipv6.FlagSrc | ipv6.FlagDst | ipv6.FlagInterface)
+	}
+	return nil
+}
+
+// readBatch reads a batch of packets into ps using ms as receive
+// buffers.
+// It returns the number of packets received.
+// A packet that fails to parse doesn't fail the batch; its err field
+// is set instead.
+func (c *conn) readBatch(ms []ipv4.Message, ps []packet) (int, error) {
+	var n int
+	var err error
+	switch {
+	case c.r4 != nil:
+		n, err = c.r4.ReadBatch(ms, 0)
+	case c.p4 != nil:
+		n, err = c.p4.ReadBatch(ms, 0)
+	case c.p6 != nil:
+		n, err = c.p6.ReadBatch(ms, 0)
+	default:
+		return 0, fmt.Errorf("unknown protocol: %d", c.protocol)
+	}
+	if err != nil {
+		return 0, err
+	}
+	for i := range ms[:n] {
+		p, err := c.parseMessage(&ms[i])
+		if err != nil {
+			p = packet{err: err}
+		}
+		ps[i] = p
+	}
+	return n, nil
+}
+
+// parseMessage parses the received message m.
+func (c *conn) parseMessage(m *ipv4.Message) (packet, error) {
+	b := m.Buffers[0][:m.N]
+	p := packet{peer: m.Addr}
+	switch {
+	case c.r4 != nil, c.p4 != nil && c.rawSocket:
+		// ReadBatch doesn't strip the IPv4 header from the
+		// received datagram on raw sockets.
+		h, err := ipv4.ParseHeader(b)
+		if err != nil {
+			return p, err
+		}
+		if h.Len > len(b) {
+			return p, errHeaderTooShort
+		}
+		p.b, p.h = b[h.Len:], h
+	default:
+		p.b = b
+	}
+	if m.NN > 0 {
+		if c.p6 != nil {
+			cm := new(ipv6.ControlMessage)
+			if err := cm.Parse(m.OOB[:m.NN]); err != nil {
+				return p, err
+			}
+			p.cm = cm
+		} else {
+			cm := new(ipv4.ControlMessage)
+			if err := cm.Parse(m.OOB[:m.NN]); err != nil {
+				return p, err
+			}
+			p.cm = cm
+		}
+	}
+	return p, nil
+}
+
 func (c *conn) setup(maint bool) {
 	switch la := c.c.LocalAddr().(type) {
 	case *net.UDPAddr:
@@ -147,6 +417,159 @@ func (c *conn) writeTo(b []byte, dst net.Addr, ifi *net.Interface) (int, error)
 	}
 }
 
+// writeBatch writes each bs[i] to dsts[i] via ifi in as few system
+// calls as possible.
+// It returns the number of packets written.
+func (c *conn) writeBatch(bs [][]byte, dsts []net.Addr, ifi *net.Interface) (int, error) {
+	var oob []byte
+	if ifi != nil {
+		switch {
+		case c.p4 != nil:
+			oob = (&ipv4.ControlMessage{IfIndex: ifi.Index}).Marshal()
+		case c.p6 != nil:
+			oob = (&ipv6.ControlMessage{IfIndex: ifi.Index}).Marshal()
+		}
+	}
+	batch := runtime.GOOS == "linux" && (c.p4 != nil || c.p6 != nil)
+	ms := make([]ipv4.Message, len(bs))
+	for i := range ms {
+		ms[i].Buffers = [][]byte{bs[i]}
+		ms[i].OOB = oob
+		ms[i].Addr = dsts[i]
+		if c.p6 != nil && !c.rawSocket && dsts[i].(*net.UDPAddr).IP.To4() != nil {
+			// A dual stack socket requires IPv4-mapped IPv6
+			// addresses that cannot be carried by Message.
+			batch = false
+		}
+	}
+	if !batch {
+		for i := range bs {
+			if _, err := c.writeTo(bs[i], dsts[i], ifi); err != nil {
+				return i, err
+			}
+		}
+		return len(bs), nil
+	}
+	var n int
+	for n < len(ms) {
+		var nn int
+		var err error
+		if c.p4 != nil {
+			nn, err = c.p4.WriteBatch(ms[n:], 0)
+		} else {
+			nn, err = c.p6.WriteBatch(ms[n:], 0)
+		}
+		n += nn
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// setProbeFilter installs a receive packet filter that passes only
+// packets related to the outstanding probes identified by cs.
+// It does nothing when the filter is unchanged.
+func (c *conn) setProbeFilter(cs []cookie, dsts []net.IP) error {
+	return c.setFilter(probeFilter(c.protocol, cs, dsts))
+}
+
+// setFilter installs the receive packet filter insts on c.
+func (c *conn) setFilter(insts []bpf.Instruction) error {
+	if runtime.GOOS != "linux" || !c.rawSocket {
+		return nil
+	}
+	prog, err := bpf.Assemble(insts)
+	if err != nil {
+		return err
+	}
+	c.fmu.Lock()
+	defer c.fmu.Unlock()
+	if len(prog) == len(c.filter) {
+		same := true
+		for i := range prog {
+			if prog[i] != c.filter[i] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return nil
+		}
+	}
+	switch {
+	case c.r4 != nil:
+		err = c.r4.SetBPF(prog)
+	case c.p4 != nil:
+		err = c.p4.SetBPF(prog)
+	case c.p6 != nil:
+		err = c.p6.SetBPF(prog)
+	}
+	if err != nil {
+		return err
+	}
+	c.filter = prog
+	return nil
+}
+
+// setMaintOptions configures c to receive ICMP messages related to
+// probe packets along with the control messages.
+func (c *conn) setMaintOptions() {
+	if c.ip.To4() != nil {
+		if runtime.GOOS == "linux" {
+			var f ipv4.ICMPFilter
+			f.SetAll(true)
+			f.Accept(ipv4.ICMPTypeEchoReply)
+			f.Accept(ipv4.ICMPTypeDestinationUnreachable)
+			f.Accept(ipv4.ICMPTypeTimeExceeded)
+			f.Accept(ipv4.ICMPTypeParameterProblem)
+			if c.r4 != nil {
+				c.r4.SetICMPFilter(&f)
+			} else {
+				c.p4.SetICMPFilter(&f)
+			}
+		}
+		f := ipv4.FlagSrc | ipv4.FlagDst | ipv4.FlagInterface
+		if runtime.GOOS != "solaris" {
+			// It looks like IP_RECVTTL doesn't work well
+			// on Solaris.
+			f |= ipv4.FlagTTL
+		}
+		if c.r4 != nil {
+			c.r4.SetControlMessage(f, true)
+		} else {
+			c.p4.SetControlMessage(f, true)
+		}
+	}
+	if c.ip.To16() != nil && c.ip.To4() == nil {
+		var f ipv6.ICMPFilter
+		f.SetAll(true)
+		f.Accept(ipv6.ICMPTypeEchoReply)
+		f.Accept(ipv6.ICMPTypeDestinationUnreachable)
+		f.Accept(ipv6.ICMPTypePacketTooBig)
+		f.Accept(ipv6.ICMPTypeTimeExceeded)
+		f.Accept(ipv6.ICMPTypeParameterProblem)
+		f.Accept(ipv6.ICMPTypeNeighborAdvertisement)
+		f.Accept(ipv6.ICMPTypeRouterAdvertisement)
+		c.p6.SetICMPFilter(&f)
+		c.p6.SetControlMessage(ipv6.FlagTrafficClass|ipv6.FlagHopLimit|ipv6.FlagSrc|ipv6.FlagDst|ipv6.FlagInterface, true)
+	}
+}
+
+// blockICMP makes c discard all incoming ICMP messages.
+func (c *conn) blockICMP() {
+	switch {
+	case c.p4 != nil && runtime.GOOS == "linux":
+		var f ipv4.ICMPFilter
+		f.SetAll(true)
+		c.p4.SetICMPFilter(&f)
+	case c.p6 != nil:
+		var f ipv6.ICMPFilter
+		f.SetAll(true)
+		c.p6.SetICMPFilter(&f)
+	}
+}
+
 func newProbeConn(network, address string) (*conn, error) {
 	var err error
 	var c *conn
@@ -0,0 +1,134 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestConnParseMessage(t *testing.T) {
+	c := &conn{protocol: ianaProtocolICMP, rawSocket: true, p4: &ipv4.PacketConn{}}
+	h := ipv4.Header{Version: ipv4.Version, Len: ipv4.HeaderLen, TotalLen: ipv4.HeaderLen + 8, TTL: 1, Protocol: ianaProtocolICMP, Src: net.IPv4(192, 0, 2, 1), Dst: net.IPv4(192, 0, 2, 2)}
+	hb, err := h.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := append(hb, 0, 0, 0, 0, 0, 0, 0, 0)
+	bad := append([]byte{}, good...)
+	bad[0] = 0x4f // header length exceeds the packet
+
+	var ms []ipv4.Message
+	for _, b := range [][]byte{good, bad[:12], bad, good} {
+		ms = append(ms, ipv4.Message{Buffers: [][]byte{b}, N: len(b)})
+	}
+	for i := range ms {
+		p, err := c.parseMessage(&ms[i])
+		if (i == 1 || i == 2) != (err != nil) {
+			t.Errorf("#%d: got %v", i, err)
+		}
+		if err == nil && (p.h == nil || len(p.b) != 8) {
+			t.Errorf("#%d: got %+v", i, p)
+		}
+	}
+}
+
+func TestConnReadFromIPv4Options(t *testing.T) {
+	c, err := newProbeConn("ip4:icmp", "127.0.0.1")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer c.close()
+	if err := c.p4.SetControlMessage(ipv4.FlagTTL|ipv4.FlagDst|ipv4.FlagInterface, true); err != nil {
+		t.Skip(err)
+	}
+	rr, err := (&RecordRoute{Slots: 2}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.setIPv4Options(rr); err != nil {
+		t.Skip(err)
+	}
+	wb, err := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: 1, Seq: 1}}).Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.c.WriteTo(wb, &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	c.c.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 1500)
+	rb, h, cm, _, err := c.readFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, ok := h.(*ipv4.Header); !ok || len(h.Options) == 0 {
+		t.Fatalf("got %+v; want IPv4 header with options", h)
+	}
+	if _, ok := cm.(*ipv4.ControlMessage); !ok {
+		t.Errorf("got %T; want *ipv4.ControlMessage", cm)
+	}
+	if m, err := icmp.ParseMessage(ianaProtocolICMP, rb); err != nil || m.Type != ipv4.ICMPTypeEcho && m.Type != ipv4.ICMPTypeEchoReply {
+		t.Errorf("got %v, %v; want ICMP echo", m, err)
+	}
+}
+
+func TestIsBroadcast(t *testing.T) {
+	addrs := bcastCache.addrs
+	defer func() {
+		bcastCache.Lock()
+		bcastCache.addrs, bcastCache.expire = addrs, time.Time{}
+		bcastCache.Unlock()
+	}()
+	bcastCache.Lock()
+	bcastCache.addrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.IPv4(192, 0, 2, 1).To4(), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.IPv4(198, 51, 100, 1), Mask: net.CIDRMask(120, 128)}, // IPv4 address with 16-byte mask
+			&net.IPNet{IP: net.IPv4(203, 0, 113, 1).To4(), Mask: net.CIDRMask(31, 32)},
+			&net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(64, 128)},
+			&net.IPAddr{IP: net.IPv4(192, 0, 2, 2)},
+		}, nil
+	}
+	bcastCache.expire = time.Time{}
+	bcastCache.Unlock()
+
+	for _, tt := range []struct {
+		ip   net.IP
+		want bool
+	}{
+		{net.IPv4bcast, true},
+		{net.IPv4(192, 0, 2, 255), true},
+		{net.IPv4(198, 51, 100, 255), true},
+		{net.IPv4(192, 0, 2, 1), false},
+		{net.IPv4(192, 0, 3, 255), false},
+		{net.IPv4(203, 0, 113, 1), false},
+		{net.IPv4(224, 0, 0, 1), false},
+		{net.ParseIP("2001:db8::ffff:ffff:ffff:ffff"), false},
+		{nil, false},
+	} {
+		if got := isBroadcast(tt.ip); got != tt.want {
+			t.Errorf("%v: got %v; want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	// The broadcast addresses are cached for a while.
+	bcastCache.Lock()
+	bcastCache.addrs = func() ([]net.Addr, error) { return nil, nil }
+	bcastCache.Unlock()
+	if !isBroadcast(net.IPv4(192, 0, 2, 255)) {
+		t.Error("got false before the cache expires; want true")
+	}
+	bcastCache.Lock()
+	bcastCache.expire = time.Now().Add(-time.Second)
+	bcastCache.Unlock()
+	if isBroadcast(net.IPv4(192, 0, 2, 255)) {
+		t.Error("got true after the cache expires; want false")
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"net"
+	"sync"
+)
+
+// sharedReportLen is the length of the report channel of each tester
+// sharing a maintenance endpoint.
+const sharedReportLen = 64
+
+var (
+	demuxMu sync.Mutex
+	demuxes = make(map[string]*demux) // keyed by maintenance network and address
+)
+
+// A demux represents a maintenance endpoint shared by multiple
+// testers in the process.
+type demux struct {
+	key  string
+	refs int // protected by demuxMu
+	c    *conn
+
+	mu     sync.RWMutex
+	maints map[*maint]bool // registered maintenance endpoints
+
+	fmu sync.Mutex // serializes receive packet filter updates
+}
+
+// acquireDemux returns the shared maintenance endpoint for network
+// and address, and registers t with it.
+// It opens a new maintenance network connection when there's no
+// shared endpoint yet.
+func acquireDemux(network, address string, t *maint) (*demux, error) {
+	key := network + "," + address
+	demuxMu.Lock()
+	defer demuxMu.Unlock()
+	d := demuxes[key]
+	if d == nil {
+		c, err := newMaintConn(network, address)
+		if err != nil {
+			return nil, err
+		}
+		c.setMaintOptions()
+		d = &demux{key: key, c: c, maints: make(map[*maint]bool)}
+		demuxes[key] = d
+		go monitor(d.c, d)
+	}
+	d.refs++
+	d.mu.Lock()
+	d.maints[t] = true
+	d.mu.Unlock()
+	return d, nil
+}
+
+// release unregisters t from d.
+// It closes the shared maintenance network connection when t is the
+// last tester using d.
+func (d *demux) release(t *maint) error {
+	d.mu.Lock()
+	delete(d.maints, t)
+	d.mu.Unlock()
+	demuxMu.Lock()
+	defer demuxMu.Unlock()
+	d.refs--
+	if d.refs > 0 {
+		return nil
+	}
+	delete(demuxes, d.key)
+	return d.c.close()
+}
+
+// setProbeFilter installs a receive packet filter that passes only
+// packets related to the outstanding probes of all the registered
+// testers.
+func (d *demux) setProbeFilter() error {
+	d.fmu.Lock()
+	defer d.fmu.Unlock()
+	var cs []cookie
+	var dsts []net.IP
+	d.mu.RLock()
+	for t := range d.maints {
+		cs = append(cs, t.cookieList()...)
+		dsts = append(dsts, t.nat64DstList()...)
+	}
+	d.mu.RUnlock()
+	return d.c.setProbeFilter(cs, dsts)
+}
+
+func (d *demux) receive(c *conn, b []byte, h, cm interface{}, peer net.Addr) {
+	r, cookie, wildcard := parseReport(c, b, h, cm, peer)
+	var ts []*maint
+	d.mu.RLock()
+	for t := range d.maints {
+		ts = append(ts, t)
+	}
+	d.mu.RUnlock()
+	for _, t := range ts {
+		r := r // each tester annotates its own copy
+		if p, ok := t.match(cookie, &r); ok || wildcard {
+			p.annotate(&r)
+			t.tryWriteReport(&r)
+		}
+	}
+}
+
+func (d *demux) writeReport(r *Report) {
+	var ts []*maint
+	d.mu.RLock()
+	for t := range d.maints {
+		ts = append(ts, t)
+	}
+	d.mu.RUnlock()
+	for _, t := range ts {
+		t.tryWriteReport(r)
+	}
+}
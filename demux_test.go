@@ -0,0 +1,49 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestDemuxReceive(t *testing.T) {
+	c := &conn{protocol: ianaProtocolICMP, rawSocket: true}
+	d := &demux{maints: make(map[*maint]bool)}
+	var ts [2]*maint
+	for i := range ts {
+		ts[i] = &maint{emitReport: 1, report: make(chan Report, sharedReportLen), done: make(chan struct{})}
+		ts[i].setProbes(probe{cookie: icmpCookie(ianaProtocolICMP, i+1, 1), group: net.IPv4(224, 0, 0, byte(i+1))})
+		d.maints[ts[i]] = true
+	}
+
+	// The first tester never drains its report channel.
+	for i := 0; i < sharedReportLen+3; i++ {
+		for id := 1; id <= len(ts); id++ {
+			b, err := (&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: id, Seq: 1}}).Marshal(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.receive(c, b, nil, nil, &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)})
+		}
+		select {
+		case r := <-ts[1].report:
+			if !r.Group.Equal(net.IPv4(224, 0, 0, 2)) {
+				t.Fatalf("got %v; want 224.0.0.2", r.Group)
+			}
+		default:
+			t.Fatalf("#%d: no report", i)
+		}
+	}
+	if n := ts[0].DroppedReports(); n != 3 {
+		t.Errorf("got %d; want 3", n)
+	}
+	if n := ts[1].DroppedReports(); n != 0 {
+		t.Errorf("got %d; want 0", n)
+	}
+}
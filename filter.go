@@ -0,0 +1,167 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+
+	"golang.org/x/net/bpf"
+)
+
+const (
+	bpfDrop   = 0
+	bpfAccept = 0xffffffff
+
+	// maxFilterKeys is the maximum number of probe identifiers
+	// held by a single receive packet filter.
+	maxFilterKeys = 64
+
+	// maxFilterDsts is the maximum number of IPv4-embedded IPv6
+	// destinations held by a single receive packet filter.
+	maxFilterDsts = 8
+)
+
+// probeFilter returns a classic BPF program that passes only ICMP
+// echo replies, ICMP error messages and IPv6 neighbor advertisements
+// related to the outstanding probes identified by cs, and IPv6 router
+// advertisements when cs contains routerCookie.
+// For ianaProtocolIPv6ICMP, it also passes ICMP error messages whose
+// original datagram is addressed to one of the IPv4-embedded IPv6
+// destinations dsts, because a NAT64 translator may rewrite the
+// probe identifiers.
+// The protocol must be ianaProtocolICMP or ianaProtocolIPv6ICMP.
+// For ianaProtocolICMP, the program assumes that a received packet
+// starts with an IPv4 header.
+func probeFilter(protocol int, cs []cookie, dsts []net.IP) []bpf.Instruction {
+	var ids, udps, nds []uint32
+	routers := uint32(bpfDrop)
+	for _, c := range cs {
+		switch {
+		case c.protocol() == ianaProtocolUDP:
+			udps = appendUnique(udps, uint32(c.udpSport())<<16|uint32(c.udpDport()))
+		case c.router():
+			routers = bpfAccept
+		case c.neighbor():
+			nds = appendUnique(nds, uint32(c.ndTarget()))
+		default:
+			ids = appendUnique(ids, uint32(c.icmpID()))
+		}
+	}
+	if len(ids) > maxFilterKeys || len(udps) > maxFilterKeys || len(nds) > maxFilterKeys || len(dsts) > maxFilterDsts {
+		return []bpf.Instruction{bpf.RetConstant{Val: bpfAccept}}
+	}
+
+	var prog []bpf.Instruction
+	switch protocol {
+	case ianaProtocolICMP:
+		// The index register holds the length of the IPv4
+		// header, and the ICMP error message body starts at
+		// X+8.
+		quoted := bpfSwitch(bpf.LoadScratch{Dst: bpf.RegA, N: 0},
+			[]uint32{ianaProtocolICMP, ianaProtocolUDP},
+			[]int{0, 1},
+			[]bpf.Instruction{bpf.RetConstant{Val: bpfAccept}},
+			bpfMatch(bpf.LoadIndirect{Off: 8 + 4, Size: 2}, ids),
+			bpfMatch(bpf.LoadIndirect{Off: 8, Size: 4}, udps))
+		icmpErrs := append([]bpf.Instruction{
+			bpf.LoadIndirect{Off: 8 + 9, Size: 1},
+			bpf.StoreScratch{Src: bpf.RegA, N: 0},
+			bpf.LoadIndirect{Off: 8, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x0f},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 2},
+			bpf.ALUOpX{Op: bpf.ALUOpAdd},
+			bpf.TAX{},
+		}, quoted...)
+		prog = bpfSwitch(bpf.LoadIndirect{Off: 0, Size: 1},
+			[]uint32{0, 3, 11, 12}, // echo reply, destination unreachable, time exceeded, parameter problem
+			[]int{0, 1, 1, 1},
+			[]bpf.Instruction{bpf.RetConstant{Val: bpfDrop}},
+			bpfMatch(bpf.LoadIndirect{Off: 4, Size: 2}, ids),
+			icmpErrs)
+		prog = append([]bpf.Instruction{bpf.LoadMemShift{Off: 0}}, prog...)
+	case ianaProtocolIPv6ICMP:
+		quoted := bpfSwitch(bpf.LoadAbsolute{Off: 8 + 6, Size: 1},
+			[]uint32{ianaProtocolIPv6ICMP, ianaProtocolUDP},
+			[]int{0, 1},
+			[]bpf.Instruction{bpf.RetConstant{Val: bpfAccept}},
+			bpfMatch(bpf.LoadAbsolute{Off: 8 + 40 + 4, Size: 2}, ids),
+			bpfMatch(bpf.LoadAbsolute{Off: 8 + 40, Size: 4}, udps))
+		quoted = append(bpfMatchIPv6(8+24, dsts), quoted...)
+		prog = bpfSwitch(bpf.LoadAbsolute{Off: 0, Size: 1},
+			[]uint32{129, 1, 2, 3, 4, 136, 134}, // echo reply, destination unreachable, packet too big, time exceeded, parameter problem, neighbor advertisement, router advertisement
+			[]int{0, 1, 1, 1, 1, 2, 3},
+			[]bpf.Instruction{bpf.RetConstant{Val: bpfDrop}},
+			bpfMatch(bpf.LoadAbsolute{Off: 4, Size: 2}, ids),
+			quoted,
+			bpfMatch(bpf.LoadAbsolute{Off: 8 + 12, Size: 4}, nds),
+			[]bpf.Instruction{bpf.RetConstant{Val: routers}})
+	}
+	// A conditional jump can't skip more than 255 instructions.
+	if len(prog) == 0 || len(prog) > 256 {
+		return []bpf.Instruction{bpf.RetConstant{Val: bpfAccept}}
+	}
+	return prog
+}
+
+// bpfMatch returns a sequence of instructions that loads a value by
+// load and passes the packet when the value is one of vals.
+func bpfMatch(load bpf.Instruction, vals []uint32) []bpf.Instruction {
+	insts := []bpf.Instruction{load}
+	for i, v := range vals {
+		insts = append(insts, bpf.JumpIf{Cond: bpf.JumpEqual, Val: v, SkipTrue: uint8(len(vals) - i)})
+	}
+	return append(insts, bpf.RetConstant{Val: bpfDrop}, bpf.RetConstant{Val: bpfAccept})
+}
+
+// bpfMatchIPv6 returns a sequence of instructions that passes the
+// packet when the IPv6 address at off is one of ips, otherwise it
+// falls through to the following instructions.
+func bpfMatchIPv6(off uint32, ips []net.IP) []bpf.Instruction {
+	var insts []bpf.Instruction
+	for _, ip := range ips {
+		ip = ip.To16()
+		for i := 0; i < net.IPv6len; i += 4 {
+			insts = append(insts,
+				bpf.LoadAbsolute{Off: off + uint32(i), Size: 4},
+				bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: binary.BigEndian.Uint32(ip[i : i+4]), SkipTrue: uint8(7 - i/2)})
+		}
+		insts = append(insts, bpf.RetConstant{Val: bpfAccept})
+	}
+	return insts
+}
+
+// bpfSwitch returns a sequence of instructions that loads a value by
+// load and jumps to blocks[targets[i]] when the value is equal to
+// vals[i], otherwise it runs def.
+// Each of def and blocks must end with a return instruction.
+func bpfSwitch(load bpf.Instruction, vals []uint32, targets []int, def []bpf.Instruction, blocks ...[]bpf.Instruction) []bpf.Instruction {
+	offs := make([]int, len(blocks))
+	for i := 1; i < len(blocks); i++ {
+		offs[i] = offs[i-1] + len(blocks[i-1])
+	}
+	insts := []bpf.Instruction{load}
+	for i, v := range vals {
+		skip := len(vals) - 1 - i + len(def) + offs[targets[i]]
+		insts = append(insts, bpf.JumpIf{Cond: bpf.JumpEqual, Val: v, SkipTrue: uint8(skip)})
+	}
+	insts = append(insts, def...)
+	for _, b := range blocks {
+		insts = append(insts, b...)
+	}
+	return insts
+}
+
+func appendUnique(vals []uint32, v uint32) []uint32 {
+	i := sort.Search(len(vals), func(i int) bool { return vals[i] >= v })
+	if i < len(vals) && vals[i] == v {
+		return vals
+	}
+	vals = append(vals, 0)
+	copy(vals[i+1:], vals[i:])
+	vals[i] = v
+	return vals
+}
@@ -0,0 +1,138 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestProbeFilter(t *testing.T) {
+	echoReply := func(typ icmp.Type, id int) []byte {
+		b, err := (&icmp.Message{Type: typ, Body: &icmp.Echo{ID: id, Seq: 1}}).Marshal(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	ipv4Header := func(protocol int, payload []byte) []byte {
+		h := ipv4.Header{Version: ipv4.Version, Len: ipv4.HeaderLen, TotalLen: ipv4.HeaderLen + len(payload), TTL: 1, Protocol: protocol, Src: net.IPv4(192, 0, 2, 1), Dst: net.IPv4(192, 0, 2, 2)}
+		b, err := h.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(b, payload...)
+	}
+	ipv6Header := func(nxt int, payload []byte) []byte {
+		b := make([]byte, ipv6.HeaderLen)
+		b[0] = ipv6.Version << 4
+		b[6] = byte(nxt)
+		b[7] = 1
+		return append(b, payload...)
+	}
+	timeExceeded := func(typ icmp.Type, orig []byte) []byte {
+		b, err := (&icmp.Message{Type: typ, Body: &icmp.TimeExceeded{Data: orig}}).Marshal(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	udp := []byte{0xc0, 0x00, 0x82, 0x9a, 0x00, 0x08, 0x00, 0x00} // 49152 -> 33434
+	neighborAdvert := func(target net.IP) []byte {
+		b := make([]byte, ndNeighborMsgLen)
+		b[0], b[4] = ianaICMPv6NeighborAdvert, 0x60
+		copy(b[8:], target)
+		return b
+	}
+	routerAdvert := []byte{ianaICMPv6RouterAdvert, 0, 0, 0, 64, 0, 0x07, 0x08, 0, 0, 0, 0, 0, 0, 0, 0}
+
+	for _, tt := range []struct {
+		protocol int
+		cs       []cookie
+		b        []byte
+		ok       bool
+	}{
+		{ianaProtocolICMP, []cookie{icmpCookie(ianaProtocolICMP, 1, 1)}, ipv4Header(ianaProtocolICMP, echoReply(ipv4.ICMPTypeEchoReply, 1)), true},
+		{ianaProtocolICMP, []cookie{icmpCookie(ianaProtocolICMP, 1, 1)}, ipv4Header(ianaProtocolICMP, echoReply(ipv4.ICMPTypeEchoReply, 2)), false},
+		{ianaProtocolICMP, []cookie{icmpCookie(ianaProtocolICMP, 1, 1)}, ipv4Header(ianaProtocolICMP, echoReply(ipv4.ICMPTypeEcho, 1)), false},
+		{ianaProtocolICMP, []cookie{icmpCookie(ianaProtocolICMP, 1, 1)}, ipv4Header(ianaProtocolICMP, timeExceeded(ipv4.ICMPTypeTimeExceeded, ipv4Header(ianaProtocolICMP, echoReply(ipv4.ICMPTypeEcho, 1)))), true},
+		{ianaProtocolICMP, []cookie{icmpCookie(ianaProtocolICMP, 1, 1)}, ipv4Header(ianaProtocolICMP, timeExceeded(ipv4.ICMPTypeTimeExceeded, ipv4Header(ianaProtocolICMP, echoReply(ipv4.ICMPTypeEcho, 2)))), false},
+		{ianaProtocolICMP, []cookie{udpCookie(ianaProtocolUDP, 49152, 33434)}, ipv4Header(ianaProtocolICMP, timeExceeded(ipv4.ICMPTypeTimeExceeded, ipv4Header(ianaProtocolUDP, udp))), true},
+		{ianaProtocolICMP, []cookie{udpCookie(ianaProtocolUDP, 49152, 33435)}, ipv4Header(ianaProtocolICMP, timeExceeded(ipv4.ICMPTypeTimeExceeded, ipv4Header(ianaProtocolUDP, udp))), false},
+
+		{ianaProtocolIPv6ICMP, []cookie{icmpCookie(ianaProtocolIPv6ICMP, 1, 1)}, echoReply(ipv6.ICMPTypeEchoReply, 1), true},
+		{ianaProtocolIPv6ICMP, []cookie{icmpCookie(ianaProtocolIPv6ICMP, 1, 1), icmpCookie(ianaProtocolIPv6ICMP, 2, 1)}, echoReply(ipv6.ICMPTypeEchoReply, 2), true},
+		{ianaProtocolIPv6ICMP, []cookie{icmpCookie(ianaProtocolIPv6ICMP, 1, 1)}, echoReply(ipv6.ICMPTypeEchoReply, 2), false},
+		{ianaProtocolIPv6ICMP, []cookie{icmpCookie(ianaProtocolIPv6ICMP, 1, 1)}, timeExceeded(ipv6.ICMPTypeTimeExceeded, ipv6Header(ianaProtocolIPv6ICMP, echoReply(ipv6.ICMPTypeEchoRequest, 1))), true},
+		{ianaProtocolIPv6ICMP, []cookie{udpCookie(ianaProtocolUDP, 49152, 33434)}, timeExceeded(ipv6.ICMPTypeTimeExceeded, ipv6Header(ianaProtocolUDP, udp)), true},
+		{ianaProtocolIPv6ICMP, []cookie{udpCookie(ianaProtocolUDP, 49153, 33434)}, timeExceeded(ipv6.ICMPTypeTimeExceeded, ipv6Header(ianaProtocolUDP, udp)), false},
+		{ianaProtocolIPv6ICMP, []cookie{ndCookie(net.ParseIP("2001:db8::1"))}, neighborAdvert(net.ParseIP("2001:db8::1")), true},
+		{ianaProtocolIPv6ICMP, []cookie{ndCookie(net.ParseIP("2001:db8::1"))}, neighborAdvert(net.ParseIP("2001:db8::2")), false},
+		{ianaProtocolIPv6ICMP, []cookie{icmpCookie(ianaProtocolIPv6ICMP, 1, 1)}, neighborAdvert(net.ParseIP("2001:db8::1")), false},
+		{ianaProtocolIPv6ICMP, []cookie{routerCookie}, routerAdvert, true},
+		{ianaProtocolIPv6ICMP, []cookie{routerCookie}, neighborAdvert(net.ParseIP("2001:db8::1")), false},
+		{ianaProtocolIPv6ICMP, []cookie{ndCookie(net.ParseIP("2001:db8::1"))}, routerAdvert, false},
+	} {
+		vm, err := bpf.NewVM(probeFilter(tt.protocol, tt.cs, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := vm.Run(tt.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok := n > 0; ok != tt.ok {
+			t.Errorf("%v: got %v; want %v", tt.cs, ok, tt.ok)
+		}
+	}
+	// A large set of probes must not overflow conditional jumps.
+	var cs []cookie
+	for i := 0; i < maxFilterKeys; i++ {
+		target := net.ParseIP("2001:db8::")
+		target[15] = byte(i)
+		cs = append(cs, icmpCookie(ianaProtocolIPv6ICMP, i+1, 1), udpCookie(ianaProtocolUDP, 49152+i, 33434), ndCookie(target))
+	}
+	cs = append(cs, routerCookie)
+	vm, err := bpf.NewVM(probeFilter(ianaProtocolIPv6ICMP, cs, []net.IP{net.ParseIP("64:ff9b::192.0.2.33")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := vm.Run(routerAdvert); err != nil || n == 0 {
+		t.Errorf("got %d, %v; want router advertisement to pass", n, err)
+	}
+
+	// ICMP error messages quoting probe packets to IPv4-embedded
+	// IPv6 addresses with a rewritten UDP source port.
+	nat64Dst := net.ParseIP("64:ff9b::192.0.2.33")
+	for _, tt := range []struct {
+		dsts []net.IP
+		dst  net.IP
+		ok   bool
+	}{
+		{nil, nat64Dst, false},
+		{[]net.IP{net.ParseIP("64:ff9b::192.0.2.34"), nat64Dst}, nat64Dst, true},
+		{[]net.IP{nat64Dst}, net.ParseIP("64:ff9b::192.0.2.34"), false},
+		{[]net.IP{nat64Dst}, net.ParseIP("64:ff9b::c000:221:0:0"), false},
+	} {
+		orig := ipv6Header(ianaProtocolUDP, udp)
+		copy(orig[24:40], tt.dst.To16())
+		vm, err := bpf.NewVM(probeFilter(ianaProtocolIPv6ICMP, []cookie{udpCookie(ianaProtocolUDP, 49153, 33434)}, tt.dsts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := vm.Run(timeExceeded(ipv6.ICMPTypeTimeExceeded, orig))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok := n > 0; ok != tt.ok {
+			t.Errorf("%v, %v: got %v; want %v", tt.dsts, tt.dst, ok, tt.ok)
+		}
+	}
+}
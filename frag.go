@@ -0,0 +1,319 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// An IPFragment represents the fragmentation fields of an IPv4 header
+// or IPv6 fragment header.
+type IPFragment struct {
+	ID     int  // identification
+	Offset int  // fragment offset in bytes
+	More   bool // more fragments flag
+}
+
+// A FragmentRange represents a fragment of probe packet that carries
+// the range [Offset, Offset+Len) of the IP payload.
+type FragmentRange struct {
+	Offset int // must be a multiple of 8
+	Len    int
+}
+
+// SplitFragments returns the fragment ranges that split an IP payload
+// of n bytes into fragments of size bytes.
+// When first is greater than zero, the first fragment is of first
+// bytes, such as a tiny first fragment that carries only the ICMP
+// header.
+// When overlap is greater than zero, each fragment but the first
+// starts overlap bytes before the end of the previous fragment.
+// The size, first and overlap must be multiples of 8, and overlap
+// must be less than size and first.
+func SplitFragments(n, size, first, overlap int) ([]FragmentRange, error) {
+	if size <= 0 || size%8 != 0 {
+		return nil, fmt.Errorf("invalid fragment size: %d", size)
+	}
+	if first < 0 || first%8 != 0 {
+		return nil, fmt.Errorf("invalid first fragment length: %d", first)
+	}
+	if overlap < 0 || overlap%8 != 0 || overlap >= size || first > 0 && overlap >= first {
+		return nil, fmt.Errorf("invalid fragment overlap: %d", overlap)
+	}
+	if first == 0 {
+		first = size
+	}
+	frs := []FragmentRange{{Offset: 0, Len: minInt(first, n)}}
+	for off := first; off < n; {
+		fr := FragmentRange{Offset: off - overlap}
+		fr.Len = minInt(size, n-fr.Offset)
+		frs = append(frs, fr)
+		off = fr.Offset + fr.Len
+	}
+	return frs, nil
+}
+
+// fragmentID returns the fragment identification of the fragmented
+// probe packet that carries the ICMP echo identifier and sequence
+// number in cm.
+// The 16-bit IPv4 identification is the sequence number XORed with
+// the byte-swapped identifier, so that testers with adjacent
+// identifiers don't use the same identification for a while.
+// It is never zero because the kernel replaces a zero identification
+// of a packet with the IP header included; 0xffff is used instead.
+func fragmentID(protocol int, cm *ControlMessage) int {
+	if protocol == ianaProtocolICMP {
+		id := bits.ReverseBytes16(uint16(cm.ID)) ^ uint16(cm.Seq)
+		if id == 0 {
+			id = 0xffff
+		}
+		return int(id)
+	}
+	return cm.ID&0xffff<<16 | cm.Seq&0xffff
+}
+
+// fragments returns the fragments of the IP payload b by frs, and the
+// fragmentation fields of each fragment.
+func fragments(b []byte, id int, frs []FragmentRange) ([][]byte, []IPFragment, error) {
+	var bs [][]byte
+	var fs []IPFragment
+	for _, fr := range frs {
+		if fr.Offset < 0 || fr.Offset%8 != 0 || fr.Len <= 0 || fr.Offset+fr.Len > len(b) {
+			return nil, nil, errors.New("invalid fragment range")
+		}
+		bs = append(bs, b[fr.Offset:fr.Offset+fr.Len])
+		fs = append(fs, IPFragment{ID: id, Offset: fr.Offset, More: fr.Offset+fr.Len < len(b)})
+	}
+	return bs, fs, nil
+}
+
+// marshalIPv6Fragment returns the binary encoding of IPv6 fragment
+// header f followed by fragment b of the upper-layer protocol nh.
+func marshalIPv6Fragment(nh int, f *IPFragment, b []byte) []byte {
+	h := make([]byte, 8, 8+len(b))
+	h[0] = byte(nh)
+	binary.BigEndian.PutUint16(h[2:4], uint16(f.Offset))
+	if f.More {
+		h[3] |= 0x01
+	}
+	binary.BigEndian.PutUint32(h[4:8], uint32(f.ID))
+	return append(h, b...)
+}
+
+// parseOrigFragment returns the fragmentation fields of the original
+// datagram in an ICMP error message.
+// It returns nil when the original datagram is not a fragment.
+func parseOrigFragment(iph interface{}, b []byte) *IPFragment {
+	switch h := iph.(type) {
+	case *ipv4.Header:
+		if h.Flags&ipv4.MoreFragments == 0 && h.FragOff == 0 {
+			return nil
+		}
+		return &IPFragment{ID: h.ID, Offset: h.FragOff * 8, More: h.Flags&ipv4.MoreFragments != 0}
+	case *ipv6.Header:
+		nh := h.NextHeader
+		for nh != IPv6Fragment {
+			var ok bool
+			if nh, b, ok = nextExtHeader(nh, b); !ok {
+				return nil
+			}
+		}
+		if len(b) < 8 {
+			return nil
+		}
+		off := binary.BigEndian.Uint16(b[2:4])
+		return &IPFragment{ID: int(binary.BigEndian.Uint32(b[4:8])), Offset: int(off &^ 0x07), More: off&0x01 != 0}
+	}
+	return nil
+}
+
+// isReassemblyTimeExceeded reports whether m is an ICMP fragment
+// reassembly time exceeded message.
+func isReassemblyTimeExceeded(m *icmp.Message) bool {
+	return (m.Type == ipv4.ICMPTypeTimeExceeded || m.Type == ipv6.ICMPTypeTimeExceeded) && m.Code == 1
+}
+
+// ProbeFragments transmits a single ICMP echo request to ip via ifi,
+// split into the fragments specified by frs.
+// The fragments are transmitted in the order of frs, and the ranges
+// may overlap or leave a gap.
+// The fragment identification is derived from the ICMP echo
+// identifier and sequence number in cm; it is the identifier in the
+// upper 16 bits and the sequence number in the lower 16 bits for
+// IPv6, and the sequence number XORed with the byte-swapped
+// identifier for IPv4, where 0xffff stands for a zero result.
+// Each reply to the reassembled echo request is reported as usual,
+// and each ICMP fragment reassembly time exceeded message, which may
+// arrive long after the probe, is reported regardless of the
+// outstanding probes.
+// It returns an error when t is not created as a tester using a raw
+// ICMP socket.
+func (t *Tester) ProbeFragments(b []byte, cm *ControlMessage, ip net.IP, ifi *net.Interface, frs []FragmentRange) error {
+	t.initOnce.Do(t.init)
+
+	if !t.pconn.rawSocket || t.pconn.protocol != ianaProtocolICMP && t.pconn.protocol != ianaProtocolIPv6ICMP {
+		return net.UnknownNetworkError(t.pconn.c.LocalAddr().Network())
+	}
+	if cm == nil {
+		return errors.New("no control message for fragmented probe")
+	}
+	echo := icmp.Echo{ID: cm.ID, Seq: cm.Seq, Data: b}
+	m := icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &echo}
+	if t.pconn.protocol == ianaProtocolIPv6ICMP {
+		m.Type = ipv6.ICMPTypeEchoRequest
+	}
+	wb, err := m.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	p := probe{cookie: icmpCookie(t.pconn.protocol, cm.ID, cm.Seq)}
+	if ip.IsMulticast() {
+		p.group = ip
+	}
+	if err := t.setProbes(p); err != nil {
+		return err
+	}
+
+	var zone string
+	if ifi != nil {
+		zone = ifi.Name
+	}
+	fc, err := t.fragConn()
+	if err != nil {
+		return err
+	}
+	switch t.pconn.protocol {
+	case ianaProtocolICMP:
+		bs, fs, err := fragments(wb, fragmentID(t.pconn.protocol, cm), frs)
+		if err != nil {
+			return err
+		}
+		var rcm *ipv4.ControlMessage
+		if ifi != nil {
+			rcm = &ipv4.ControlMessage{IfIndex: ifi.Index}
+		}
+		ttl, tos := 64, 0
+		if ip.IsMulticast() {
+			ttl = 1
+		}
+		if t.pconn.p4 != nil {
+			if ip.IsMulticast() {
+				ttl, _ = t.pconn.p4.MulticastTTL()
+			} else {
+				ttl, _ = t.pconn.p4.TTL()
+			}
+			tos, _ = t.pconn.p4.TOS()
+		}
+		for i, f := range fs {
+			h := ipv4.Header{
+				Version:  ipv4.Version,
+				Len:      ipv4.HeaderLen,
+				TOS:      tos,
+				TotalLen: ipv4.HeaderLen + len(bs[i]),
+				ID:       f.ID,
+				FragOff:  f.Offset / 8,
+				TTL:      ttl,
+				Protocol: ianaProtocolICMP,
+				Src:      t.pconn.ip,
+				Dst:      ip,
+			}
+			if f.More {
+				h.Flags = ipv4.MoreFragments
+			}
+			if err := fc.r4.WriteTo(&h, bs[i], rcm); err != nil {
+				return err
+			}
+		}
+	case ianaProtocolIPv6ICMP:
+		// The kernel doesn't fill in the checksum of ICMPv6
+		// message split into fragments, therefore the source
+		// address is determined by a route lookup beforehand.
+		src := t.pconn.ip
+		if src.IsUnspecified() {
+			if src, err = sourceAddr(ip, zone); err != nil {
+				return err
+			}
+		}
+		s := pseudoHeaderSum(src, ip, ianaProtocolIPv6ICMP, len(wb))
+		binary.BigEndian.PutUint16(wb[2:4], foldChecksum(onesSum(s, wb)))
+		bs, fs, err := fragments(wb, fragmentID(t.pconn.protocol, cm), frs)
+		if err != nil {
+			return err
+		}
+		rcm := ipv6.ControlMessage{Src: src, HopLimit: 64}
+		if ifi != nil {
+			rcm.IfIndex = ifi.Index
+		}
+		if t.pconn.p6 != nil {
+			if ip.IsMulticast() {
+				rcm.HopLimit, _ = t.pconn.p6.MulticastHopLimit()
+			} else {
+				rcm.HopLimit, _ = t.pconn.p6.HopLimit()
+			}
+		}
+		for i, f := range fs {
+			if _, err := fc.p6.WriteTo(marshalIPv6Fragment(ianaProtocolIPv6ICMP, &f, bs[i]), &rcm, &net.IPAddr{IP: ip, Zone: zone}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// A fragConn represents a network connection for transmitting
+// fragments.
+type fragConn struct {
+	c  net.PacketConn
+	r4 *ipv4.RawConn    // IPv4 raw socket with IP_HDRINCL
+	p6 *ipv6.PacketConn // IPv6 raw socket for fragment header
+}
+
+// fragConn returns the network connection for transmitting fragments,
+// which is opened on the first call.
+func (t *Tester) fragConn() (*fragConn, error) {
+	t.fmu.Lock()
+	defer t.fmu.Unlock()
+	if t.fconn != nil {
+		return t.fconn, nil
+	}
+	var fc fragConn
+	var err error
+	switch t.pconn.protocol {
+	case ianaProtocolICMP:
+		if fc.c, err = net.ListenPacket("ip4:255", t.pconn.ip.String()); err != nil { // IPPROTO_RAW
+			return nil, err
+		}
+		if fc.r4, err = ipv4.NewRawConn(fc.c); err != nil {
+			fc.c.Close()
+			return nil, err
+		}
+	case ianaProtocolIPv6ICMP:
+		if fc.c, err = net.ListenPacket("ip6:44", t.pconn.ip.String()); err != nil { // IPv6 fragment header
+			return nil, err
+		}
+		fc.p6 = ipv6.NewPacketConn(fc.c)
+	}
+	t.fconn = &fc
+	return t.fconn, nil
+}
+
+// sourceAddr returns the source address that the kernel selects for
+// the destination ip.
+func sourceAddr(ip net.IP, zone string) (net.IP, error) {
+	c, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: 9, Zone: zone})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestSplitFragments(t *testing.T) {
+	for _, tt := range []struct {
+		n, size, first, overlap int
+		frs                     []FragmentRange
+	}{
+		{64, 64, 0, 0, []FragmentRange{{0, 64}}},
+		{100, 32, 0, 0, []FragmentRange{{0, 32}, {32, 32}, {64, 32}, {96, 4}}},
+		{100, 64, 8, 0, []FragmentRange{{0, 8}, {8, 64}, {72, 28}}},
+		{100, 48, 0, 16, []FragmentRange{{0, 48}, {32, 48}, {64, 36}}},
+		{16, 64, 8, 0, []FragmentRange{{0, 8}, {8, 8}}},
+	} {
+		frs, err := SplitFragments(tt.n, tt.size, tt.first, tt.overlap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(frs, tt.frs) {
+			t.Errorf("%d, %d, %d, %d: got %v; want %v", tt.n, tt.size, tt.first, tt.overlap, frs, tt.frs)
+		}
+	}
+	for _, tt := range []struct {
+		args [4]int
+		arg  string
+	}{
+		{[4]int{64, 0, 0, 0}, "size"},
+		{[4]int{64, 12, 0, 0}, "size"},
+		{[4]int{64, 32, 4, 0}, "first"},
+		{[4]int{64, 32, -8, 0}, "first"},
+		{[4]int{64, 32, 0, 32}, "overlap"},
+		{[4]int{64, 32, 8, 8}, "overlap"},
+		{[4]int{64, 32, 0, 4}, "overlap"},
+	} {
+		_, err := SplitFragments(tt.args[0], tt.args[1], tt.args[2], tt.args[3])
+		if err == nil || !strings.Contains(err.Error(), tt.arg) {
+			t.Errorf("%v: got %v; want error on %s", tt.args, err, tt.arg)
+		}
+	}
+}
+
+func TestFragmentID(t *testing.T) {
+	cm := ControlMessage{ID: 0x1234, Seq: 1}
+	if id := fragmentID(ianaProtocolIPv6ICMP, &cm); id != 0x12340001 {
+		t.Errorf("got %#x; want 0x12340001", id)
+	}
+	if id := fragmentID(ianaProtocolICMP, &cm); id != 0x3413 {
+		t.Errorf("got %#x; want 0x3413", id)
+	}
+	if fragmentID(ianaProtocolICMP, &cm) == fragmentID(ianaProtocolICMP, &ControlMessage{ID: 0x1235, Seq: 0}) {
+		t.Error("got the same identification for adjacent identifiers")
+	}
+	if id := fragmentID(ianaProtocolICMP, &ControlMessage{ID: 0x0100, Seq: 1}); id != 0xffff {
+		t.Errorf("got %#x; want 0xffff", id)
+	}
+}
+
+func TestParseOrigFragment(t *testing.T) {
+	b := make([]byte, 40)
+	bs, fs, err := fragments(b, 0x12345678, []FragmentRange{{0, 16}, {16, 24}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs) != 2 || len(bs[0]) != 16 || len(bs[1]) != 24 || !fs[0].More || fs[1].More || fs[1].Offset != 16 {
+		t.Fatalf("got %v, %+v", bs, fs)
+	}
+	if _, _, err := fragments(b, 0, []FragmentRange{{4, 8}}); err == nil {
+		t.Error("got nil for misaligned fragment; want error")
+	}
+
+	for i, f := range fs {
+		h := ipv6.Header{NextHeader: IPv6Fragment}
+		fb := marshalIPv6Fragment(ianaProtocolIPv6ICMP, &f, bs[i])
+		if got := parseOrigFragment(&h, fb); got == nil || *got != f {
+			t.Errorf("got %+v; want %+v", got, f)
+		}
+		nh, rest, ok := nextExtHeader(IPv6Fragment, fb)
+		if ok != (f.Offset == 0) || ok && (nh != ianaProtocolIPv6ICMP || len(rest) != len(bs[i])) {
+			t.Errorf("got %d, %d, %v for %+v", nh, len(rest), ok, f)
+		}
+	}
+	if f := parseOrigFragment(&ipv6.Header{NextHeader: ianaProtocolIPv6ICMP}, b); f != nil {
+		t.Errorf("got %+v; want nil", f)
+	}
+	if f := parseOrigFragment(&ipv4.Header{ID: 0x1234, FragOff: 2}, b); f == nil || *f != (IPFragment{ID: 0x1234, Offset: 16}) {
+		t.Errorf("got %+v", f)
+	}
+	if f := parseOrigFragment(&ipv4.Header{ID: 0x1234, Flags: ipv4.DontFragment}, b); f != nil {
+		t.Errorf("got %+v; want nil", f)
+	}
+}
+
+func TestParseReassemblyTimeExceeded(t *testing.T) {
+	echo, err := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: 1, Seq: 2, Data: make([]byte, 8)}}).Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		off, code int
+		wildcard  bool
+	}{
+		{0, 0, false},
+		{0, 1, true},
+		{1, 1, true},
+	} {
+		h := ipv4.Header{Version: ipv4.Version, Len: ipv4.HeaderLen, TotalLen: ipv4.HeaderLen + len(echo), ID: 2, Flags: ipv4.MoreFragments, FragOff: tt.off, TTL: 1, Protocol: ianaProtocolICMP, Src: net.IPv4(192, 0, 2, 1), Dst: net.IPv4(192, 0, 2, 2)}
+		hb, err := h.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := (&icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Code: tt.code, Body: &icmp.TimeExceeded{Data: append(hb, echo...)}}).Marshal(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, ck, wildcard := parseReport(&conn{protocol: ianaProtocolICMP, rawSocket: true}, b, nil, nil, &net.IPAddr{IP: net.IPv4(192, 0, 2, 2)})
+		if r.Error != nil {
+			t.Fatal(r.Error)
+		}
+		if wildcard != tt.wildcard || r.OrigFragment == nil || r.OrigFragment.ID != 2 || r.OrigFragment.Offset != tt.off*8 {
+			t.Errorf("%d, %d: got %v, %+v", tt.off, tt.code, wildcard, r.OrigFragment)
+		}
+		if tt.off == 0 && ck != icmpCookie(ianaProtocolICMP, 1, 2) {
+			t.Errorf("%d, %d: got %#x", tt.off, tt.code, ck)
+		}
+	}
+}
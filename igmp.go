@@ -0,0 +1,186 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	igmpTypeQuery    = 0x11
+	igmpTypeV1Report = 0x12
+	igmpTypeV2Report = 0x16
+	igmpTypeLeave    = 0x17
+	igmpTypeV3Report = 0x22
+
+	igmpMsgLen        = 8  // length of IGMPv1 or IGMPv2 message
+	igmpV3QueryLen    = 12 // length of IGMPv3 query without sources
+	igmpV3ReportLen   = 8  // length of IGMPv3 report without records
+	igmpV3RecordLen   = 8  // length of IGMPv3 group record without sources
+	igmpResponseUnits = 100 * time.Millisecond
+)
+
+var errInvalidIGMPMessage = errors.New("invalid IGMP message")
+
+// marshalIGMPQuery returns the binary encoding of IGMP query q.
+// See RFC 1112, RFC 2236 and RFC 3376.
+func marshalIGMPQuery(q *MulticastQuery) ([]byte, error) {
+	group := q.Group.To4()
+	if group == nil {
+		group = net.IPv4zero.To4()
+	}
+	var b []byte
+	switch q.Version {
+	case 1:
+		if !group.Equal(net.IPv4zero) || len(q.Sources) > 0 {
+			return nil, errors.New("IGMPv1 supports general query only")
+		}
+		b = make([]byte, igmpMsgLen)
+	case 2:
+		if len(q.Sources) > 0 {
+			return nil, errors.New("IGMPv2 doesn't support source-specific query")
+		}
+		b = make([]byte, igmpMsgLen)
+		b[1] = byte(minInt(int(q.MaxResponse/igmpResponseUnits), 0xff))
+	case 3:
+		b = make([]byte, igmpV3QueryLen, igmpV3QueryLen+4*len(q.Sources))
+		b[1] = byte(encodeFloatCode(uint(q.MaxResponse/igmpResponseUnits), 4))
+		if q.SuppressRouterSide {
+			b[8] |= 0x08
+		}
+		b[8] |= byte(minInt(q.Robustness, 7))
+		b[9] = byte(encodeFloatCode(uint(q.Interval/time.Second), 4))
+		binary.BigEndian.PutUint16(b[10:12], uint16(len(q.Sources)))
+		for _, src := range q.Sources {
+			src = src.To4()
+			if src == nil {
+				return nil, errors.New("non-IPv4 source")
+			}
+			b = append(b, src...)
+		}
+	default:
+		return nil, errors.New("unknown IGMP version")
+	}
+	b[0] = igmpTypeQuery
+	copy(b[4:8], group)
+	binary.BigEndian.PutUint16(b[2:4], foldChecksum(onesSum(0, b)))
+	return b, nil
+}
+
+// parseIGMP parses the IGMP message b, and returns the version and
+// either the query or the group records.
+// The reports and leave messages of IGMPv1 and IGMPv2 are
+// represented as the equivalent IGMPv3 group records.
+func parseIGMP(b []byte) (int, *MulticastQuery, []MulticastRecord, error) {
+	if len(b) < igmpMsgLen || foldChecksum(onesSum(0, b)) != 0 {
+		return 0, nil, nil, errInvalidIGMPMessage
+	}
+	group := net.IPv4(b[4], b[5], b[6], b[7])
+	switch b[0] {
+	case igmpTypeQuery:
+		if len(b) == igmpMsgLen {
+			q := MulticastQuery{Version: 2, Group: group, MaxResponse: time.Duration(b[1]) * igmpResponseUnits}
+			if b[1] == 0 {
+				q.Version, q.MaxResponse = 1, 10*time.Second
+			}
+			return q.Version, &q, nil, nil
+		}
+		if len(b) < igmpV3QueryLen {
+			return 0, nil, nil, errInvalidIGMPMessage
+		}
+		q := MulticastQuery{
+			Version:            3,
+			Group:              group,
+			MaxResponse:        time.Duration(decodeFloatCode(uint(b[1]), 4)) * igmpResponseUnits,
+			SuppressRouterSide: b[8]&0x08 != 0,
+			Robustness:         int(b[8] & 0x07),
+			Interval:           time.Duration(decodeFloatCode(uint(b[9]), 4)) * time.Second,
+		}
+		var err error
+		if q.Sources, err = parseIPv4s(b[igmpV3QueryLen:], int(binary.BigEndian.Uint16(b[10:12]))); err != nil {
+			return 0, nil, nil, errInvalidIGMPMessage
+		}
+		return 3, &q, nil, nil
+	case igmpTypeV1Report:
+		return 1, nil, []MulticastRecord{{Type: MulticastModeIsExclude, Group: group}}, nil
+	case igmpTypeV2Report:
+		return 2, nil, []MulticastRecord{{Type: MulticastModeIsExclude, Group: group}}, nil
+	case igmpTypeLeave:
+		return 2, nil, []MulticastRecord{{Type: MulticastChangeToInclude, Group: group}}, nil
+	case igmpTypeV3Report:
+		n := int(binary.BigEndian.Uint16(b[6:8]))
+		var recs []MulticastRecord
+		for b = b[igmpV3ReportLen:]; n > 0; n-- {
+			if len(b) < igmpV3RecordLen {
+				return 0, nil, nil, errInvalidIGMPMessage
+			}
+			rec := MulticastRecord{Type: MulticastRecordType(b[0]), Group: net.IPv4(b[4], b[5], b[6], b[7])}
+			nsrcs, auxLen := int(binary.BigEndian.Uint16(b[2:4])), int(b[1])*4
+			var err error
+			if rec.Sources, err = parseIPv4s(b[igmpV3RecordLen:], nsrcs); err != nil {
+				return 0, nil, nil, errInvalidIGMPMessage
+			}
+			l := igmpV3RecordLen + 4*nsrcs + auxLen
+			if len(b) < l {
+				return 0, nil, nil, errInvalidIGMPMessage
+			}
+			recs = append(recs, rec)
+			b = b[l:]
+		}
+		return 3, nil, recs, nil
+	default:
+		return 0, nil, nil, errInvalidIGMPMessage
+	}
+}
+
+func parseIPv4s(b []byte, n int) ([]net.IP, error) {
+	if len(b) < 4*n {
+		return nil, errInvalidIGMPMessage
+	}
+	var ips []net.IP
+	for i := 0; i < n; i++ {
+		ips = append(ips, net.IPv4(b[4*i], b[4*i+1], b[4*i+2], b[4*i+3]))
+	}
+	return ips, nil
+}
+
+// encodeFloatCode returns the code for the value v in the
+// floating-point representation that has a mant-bit mantissa and a
+// 3-bit exponent.
+// See RFC 3376 and RFC 3810.
+func encodeFloatCode(v, mant uint) uint {
+	limit := uint(1) << (mant + 3)
+	if v < limit {
+		return v
+	}
+	for exp := uint(0); exp < 8; exp++ {
+		if m := v >> (exp + 3); m < 1<<(mant+1) {
+			return limit | exp<<mant | m&(1<<mant-1)
+		}
+	}
+	return limit<<1 - 1
+}
+
+// decodeFloatCode returns the value of the code c in the
+// floating-point representation that has a mant-bit mantissa and a
+// 3-bit exponent.
+func decodeFloatCode(c, mant uint) uint {
+	limit := uint(1) << (mant + 3)
+	if c < limit {
+		return c
+	}
+	exp, m := c>>mant&0x7, c&(1<<mant-1)
+	return (m | 1<<mant) << (exp + 3)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
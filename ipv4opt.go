@@ -0,0 +1,151 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	ipv4OptEOL       = 0
+	ipv4OptNOP       = 1
+	ipv4OptRR        = 7
+	ipv4OptTimestamp = 68
+
+	maxIPv4OptionsLen = 40
+)
+
+var errInvalidIPv4Option = errors.New("invalid IPv4 option")
+
+// A RecordRoute represents an IPv4 Record Route option.
+// See RFC 791.
+type RecordRoute struct {
+	Slots int      // number of route data slots, up to 9
+	Route []net.IP // recorded route
+}
+
+// Marshal returns the binary encoding of the record route option
+// with rr.Slots empty route data slots.
+func (rr *RecordRoute) Marshal() ([]byte, error) {
+	if rr.Slots < 1 || rr.Slots > 9 {
+		return nil, fmt.Errorf("invalid number of record route slots: %d", rr.Slots)
+	}
+	b := make([]byte, 3+4*rr.Slots)
+	b[0], b[1], b[2] = ipv4OptRR, byte(len(b)), 4
+	return b, nil
+}
+
+// A TimestampFlag represents a flag of IPv4 Timestamp option.
+type TimestampFlag int
+
+const (
+	TimestampOnly         TimestampFlag = 0 // record timestamps only
+	TimestampAndAddr      TimestampFlag = 1 // record addresses and timestamps
+	TimestampPrespecified TimestampFlag = 3 // record timestamps at prespecified addresses
+)
+
+// A TimestampEntry represents an entry of IPv4 Timestamp option.
+type TimestampEntry struct {
+	Addr net.IP // recording node, nil if the flag is TimestampOnly
+	Time uint32 // milliseconds since midnight UT, high-order bit is set when the value is non-standard
+}
+
+// A Timestamp represents an IPv4 Timestamp option.
+// See RFC 791.
+type Timestamp struct {
+	Flag     TimestampFlag
+	Slots    int              // number of slots when Flag is TimestampOnly or TimestampAndAddr
+	Overflow int              // number of nodes that cannot record timestamps
+	Entries  []TimestampEntry // recorded entries, or prespecified addresses when Flag is TimestampPrespecified
+}
+
+// Marshal returns the binary encoding of the timestamp option.
+func (ts *Timestamp) Marshal() ([]byte, error) {
+	var b []byte
+	switch ts.Flag {
+	case TimestampOnly:
+		if ts.Slots < 1 || ts.Slots > 9 {
+			return nil, fmt.Errorf("invalid number of timestamp slots: %d", ts.Slots)
+		}
+		b = make([]byte, 4+4*ts.Slots)
+	case TimestampAndAddr:
+		if ts.Slots < 1 || ts.Slots > 4 {
+			return nil, fmt.Errorf("invalid number of timestamp slots: %d", ts.Slots)
+		}
+		b = make([]byte, 4+8*ts.Slots)
+	case TimestampPrespecified:
+		if len(ts.Entries) < 1 || len(ts.Entries) > 4 {
+			return nil, fmt.Errorf("invalid number of prespecified addresses: %d", len(ts.Entries))
+		}
+		b = make([]byte, 4+8*len(ts.Entries))
+		for i, e := range ts.Entries {
+			ip := e.Addr.To4()
+			if ip == nil {
+				return nil, fmt.Errorf("invalid prespecified address: %v", e.Addr)
+			}
+			copy(b[4+8*i:], ip)
+		}
+	default:
+		return nil, fmt.Errorf("unknown timestamp flag: %d", ts.Flag)
+	}
+	b[0], b[1], b[2], b[3] = ipv4OptTimestamp, byte(len(b)), 5, byte(ts.Flag)
+	return b, nil
+}
+
+// parseIPv4Options parses the record route and timestamp options in
+// b.
+func parseIPv4Options(b []byte) (*RecordRoute, *Timestamp, error) {
+	var rr *RecordRoute
+	var ts *Timestamp
+	for len(b) > 0 {
+		switch b[0] {
+		case ipv4OptEOL:
+			return rr, ts, nil
+		case ipv4OptNOP:
+			b = b[1:]
+			continue
+		}
+		if len(b) < 2 || int(b[1]) < 2 || int(b[1]) > len(b) {
+			return nil, nil, errInvalidIPv4Option
+		}
+		opt := b[:b[1]]
+		switch opt[0] {
+		case ipv4OptRR:
+			if len(opt) < 3 || opt[2] < 4 {
+				return nil, nil, errInvalidIPv4Option
+			}
+			rr = &RecordRoute{Slots: (len(opt) - 3) / 4}
+			for i := 3; i+4 <= len(opt) && i+4 <= int(opt[2]); i += 4 {
+				rr.Route = append(rr.Route, net.IPv4(opt[i], opt[i+1], opt[i+2], opt[i+3]))
+			}
+		case ipv4OptTimestamp:
+			if len(opt) < 4 || opt[2] < 5 {
+				return nil, nil, errInvalidIPv4Option
+			}
+			ts = &Timestamp{Flag: TimestampFlag(opt[3] & 0x0f), Overflow: int(opt[3] >> 4)}
+			end := int(opt[2]) - 1
+			if end > len(opt) {
+				end = len(opt)
+			}
+			switch ts.Flag {
+			case TimestampOnly:
+				ts.Slots = (len(opt) - 4) / 4
+				for i := 4; i+4 <= end; i += 4 {
+					ts.Entries = append(ts.Entries, TimestampEntry{Time: binary.BigEndian.Uint32(opt[i : i+4])})
+				}
+			default:
+				ts.Slots = (len(opt) - 4) / 8
+				for i := 4; i+8 <= end; i += 8 {
+					ts.Entries = append(ts.Entries, TimestampEntry{Addr: net.IPv4(opt[i], opt[i+1], opt[i+2], opt[i+3]), Time: binary.BigEndian.Uint32(opt[i+4 : i+8])})
+				}
+			}
+		}
+		b = b[len(opt):]
+	}
+	return rr, ts, nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseIPv4Options(t *testing.T) {
+	rr, err := (&RecordRoute{Slots: 3}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(rr[3:], net.IPv4(192, 0, 2, 1).To4())
+	rr[2] = 8
+	ts, err := (&Timestamp{Flag: TimestampPrespecified, Entries: []TimestampEntry{{Addr: net.IPv4(192, 0, 2, 1)}, {Addr: net.IPv4(192, 0, 2, 2)}}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts[4+7] = 0xff
+	ts[2] = 13
+	ts[3] |= 1 << 4
+
+	grr, gts, err := parseIPv4Options(append(append(rr, ts...), ipv4OptEOL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&RecordRoute{Slots: 3, Route: []net.IP{net.IPv4(192, 0, 2, 1)}}); !reflect.DeepEqual(grr, want) {
+		t.Errorf("got %+v; want %+v", grr, want)
+	}
+	if want := (&Timestamp{Flag: TimestampPrespecified, Slots: 2, Overflow: 1, Entries: []TimestampEntry{{Addr: net.IPv4(192, 0, 2, 1), Time: 0xff}}}); !reflect.DeepEqual(gts, want) {
+		t.Errorf("got %+v; want %+v", gts, want)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// IPv6 extension header types.
+const (
+	IPv6HopByHop = 0  // hop-by-hop options header
+	IPv6Routing  = 43 // routing header
+	IPv6Fragment = 44 // fragment header
+	IPv6DstOpts  = 60 // destination options header
+)
+
+var errInvalidSRH = errors.New("invalid segment routing header")
+
+// minIPv6MTU is the minimum link MTU for IPv6.
+// Probe packets carrying a fragment header are fragmented to fit in
+// this MTU.
+const minIPv6MTU = 1280
+
+// An IPv6ExtHeader represents an IPv6 extension header on probe
+// packets.
+type IPv6ExtHeader struct {
+	// Type specifies the extension header type.
+	// It must be IPv6HopByHop, IPv6Routing, IPv6Fragment or
+	// IPv6DstOpts.
+	Type int
+
+	// Data specifies the extension header, including the Next
+	// Header and Hdr Ext Len fields, such as the binary encoding
+	// of SegmentRoutingHeader.
+	// When Data is nil, a header that must be ignored or
+	// processed transparently by nodes along the path is used;
+	// an options header with a PadN option, or a segment routing
+	// header whose Segments Left field is zero.
+	// Data is ignored when Type is IPv6Fragment; a probe packet
+	// is fragmented when it is larger than 1280 bytes, the IPv6
+	// minimum MTU, and carries no fragment header otherwise.
+	// Callers need to use probe packets larger than 1280 bytes
+	// to have fragment headers on the wire.
+	Data []byte
+}
+
+// An ipv6ExtState represents a set of extension headers on outgoing
+// packets.
+type ipv6ExtState struct {
+	hbh     []byte
+	rthdr   []byte
+	dstopts []byte
+	frag    bool
+}
+
+func newIPv6ExtState(hs []IPv6ExtHeader, dst net.IP) (*ipv6ExtState, error) {
+	var st ipv6ExtState
+	for _, h := range hs {
+		switch h.Type {
+		case IPv6HopByHop:
+			st.hbh = h.Data
+			if st.hbh == nil {
+				st.hbh = padOptionsHeader()
+			}
+		case IPv6Routing:
+			st.rthdr = h.Data
+			if st.rthdr == nil {
+				var err error
+				st.rthdr, err = (&SegmentRoutingHeader{Segments: []net.IP{dst}}).Marshal()
+				if err != nil {
+					return nil, err
+				}
+			}
+		case IPv6Fragment:
+			st.frag = true
+		case IPv6DstOpts:
+			st.dstopts = h.Data
+			if st.dstopts == nil {
+				st.dstopts = padOptionsHeader()
+			}
+		default:
+			return nil, fmt.Errorf("unknown IPv6 extension header: %d", h.Type)
+		}
+	}
+	return &st, nil
+}
+
+// padOptionsHeader returns an 8-byte options header with a PadN
+// option.
+func padOptionsHeader() []byte {
+	return []byte{0, 0, 1, 4, 0, 0, 0, 0}
+}
+
+const srhRoutingType = 4
+
+// maxSRHSegments is the maximum number of segments in a segment
+// routing header.
+const maxSRHSegments = (256*8 - 8) / 16
+
+// A SegmentRoutingHeader represents an IPv6 segment routing header.
+// See RFC 8754.
+//
+// Segments holds the segment list in the reverse order of the path;
+// Segments[0] is the last segment, and Segments[SegmentsLeft] is the
+// active segment.
+// When the header is used on probe packets, Segments[0] must be the
+// destination address of the probe packets and Segments[SegmentsLeft]
+// must be the first segment of the path.
+type SegmentRoutingHeader struct {
+	SegmentsLeft int      // index of the active segment
+	Flags        int      // flags
+	Tag          int      // tag
+	Segments     []net.IP // segment list
+}
+
+// NewSegmentRoutingHeader returns a segment routing header that
+// steers a packet through segs toward dst.
+func NewSegmentRoutingHeader(segs []net.IP, dst net.IP) *SegmentRoutingHeader {
+	srh := SegmentRoutingHeader{SegmentsLeft: len(segs), Segments: []net.IP{dst}}
+	for i := len(segs) - 1; i >= 0; i-- {
+		srh.Segments = append(srh.Segments, segs[i])
+	}
+	return &srh
+}
+
+// Marshal returns the binary encoding of the segment routing header.
+func (srh *SegmentRoutingHeader) Marshal() ([]byte, error) {
+	if len(srh.Segments) < 1 || len(srh.Segments) > maxSRHSegments {
+		return nil, fmt.Errorf("invalid number of segments: %d", len(srh.Segments))
+	}
+	if srh.SegmentsLeft < 0 || srh.SegmentsLeft >= len(srh.Segments) {
+		return nil, fmt.Errorf("invalid segments left: %d", srh.SegmentsLeft)
+	}
+	b := make([]byte, 8+16*len(srh.Segments))
+	b[1] = byte(len(b)/8 - 1)
+	b[2] = srhRoutingType
+	b[3] = byte(srh.SegmentsLeft)
+	b[4] = byte(len(srh.Segments) - 1)
+	b[5] = byte(srh.Flags)
+	binary.BigEndian.PutUint16(b[6:8], uint16(srh.Tag))
+	for i, seg := range srh.Segments {
+		ip := seg.To16()
+		if ip == nil || seg.To4() != nil {
+			return nil, fmt.Errorf("invalid segment: %v", seg)
+		}
+		copy(b[8+16*i:], ip)
+	}
+	return b, nil
+}
+
+// parseSRH parses b as a segment routing header.
+// It allows the segment list to be truncated.
+func parseSRH(b []byte) (*SegmentRoutingHeader, error) {
+	if len(b) < 8 || b[2] != srhRoutingType {
+		return nil, errInvalidSRH
+	}
+	srh := SegmentRoutingHeader{SegmentsLeft: int(b[3]), Flags: int(b[5]), Tag: int(binary.BigEndian.Uint16(b[6:8]))}
+	n := int(b[4]) + 1
+	if l := (int(b[1]) + 1) * 8; l < 8+16*n {
+		return nil, errInvalidSRH
+	} else if l < len(b) {
+		b = b[:l]
+	}
+	for i := 8; i+16 <= len(b) && len(srh.Segments) < n; i += 16 {
+		srh.Segments = append(srh.Segments, net.IP(append([]byte(nil), b[i:i+16]...)))
+	}
+	return &srh, nil
+}
+
+func equalIPv6ExtHeaders(a, b []IPv6ExtHeader) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Type != b[i].Type || !bytes.Equal(a[i].Data, b[i].Data) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasIPv6ExtHeader(hs []IPv6ExtHeader, typ int) bool {
+	for _, h := range hs {
+		if h.Type == typ {
+			return true
+		}
+	}
+	return false
+}
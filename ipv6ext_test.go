@@ -0,0 +1,148 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestSegmentRoutingHeader(t *testing.T) {
+	dst := net.ParseIP("2001:db8::1")
+	segs := []net.IP{net.ParseIP("2001:db8:1::1"), net.ParseIP("2001:db8:2::1")}
+	srh := NewSegmentRoutingHeader(segs, dst)
+	if srh.SegmentsLeft != 2 || !srh.Segments[0].Equal(dst) || !srh.Segments[2].Equal(segs[0]) {
+		t.Fatalf("got %+v", srh)
+	}
+	b, err := srh.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 8+16*3 || b[1] != 6 || b[2] != 4 || b[3] != 2 || b[4] != 2 {
+		t.Fatalf("got %#v", b[:8])
+	}
+
+	// An original datagram with a hop-by-hop options header, a
+	// segment routing header and a UDP header.
+	udp := []byte{0xc0, 0x00, 0x82, 0x9a, 0x00, 0x08, 0x00, 0x00}
+	hbh := []byte{IPv6Routing, 0, 1, 4, 0, 0, 0, 0}
+	b[0] = ianaProtocolUDP
+	orig := append(append(hbh, b...), udp...)
+	got := parseOrigSRH(IPv6HopByHop, orig)
+	if !reflect.DeepEqual(got, srh) {
+		t.Errorf("got %+v; want %+v", got, srh)
+	}
+	if got := parseOrigSRH(IPv6HopByHop, orig[:len(hbh)+8+16]); got == nil || len(got.Segments) != 1 {
+		t.Errorf("got %+v for truncated header", got)
+	}
+	if got := parseOrigSRH(ianaProtocolUDP, udp); got != nil {
+		t.Errorf("got %+v; want nil", got)
+	}
+
+	if _, err := (&SegmentRoutingHeader{SegmentsLeft: 1, Segments: []net.IP{dst}}).Marshal(); err == nil {
+		t.Error("got nil; want error")
+	}
+	if _, err := (&SegmentRoutingHeader{Segments: []net.IP{net.IPv4(192, 0, 2, 1)}}).Marshal(); err == nil {
+		t.Error("got nil; want error")
+	}
+}
+
+func TestNewIPv6ExtState(t *testing.T) {
+	dst := net.ParseIP("2001:db8::1")
+	srh, err := (&SegmentRoutingHeader{Segments: []net.IP{dst}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hbh := []byte{0, 0, 5, 2, 0, 0, 1, 0}
+	for i, tt := range []struct {
+		hs   []IPv6ExtHeader
+		want *ipv6ExtState // nil if an error is expected
+	}{
+		{nil, &ipv6ExtState{}},
+		{[]IPv6ExtHeader{{Type: IPv6HopByHop}}, &ipv6ExtState{hbh: padOptionsHeader()}},
+		{[]IPv6ExtHeader{{Type: IPv6HopByHop, Data: hbh}}, &ipv6ExtState{hbh: hbh}},
+		{[]IPv6ExtHeader{{Type: IPv6Routing}}, &ipv6ExtState{rthdr: srh}},
+		{[]IPv6ExtHeader{{Type: IPv6Fragment, Data: hbh}}, &ipv6ExtState{frag: true}},
+		{[]IPv6ExtHeader{{Type: IPv6DstOpts}, {Type: IPv6HopByHop}}, &ipv6ExtState{hbh: padOptionsHeader(), dstopts: padOptionsHeader()}},
+		{[]IPv6ExtHeader{{Type: ianaProtocolUDP}}, nil},
+	} {
+		st, err := newIPv6ExtState(tt.hs, dst)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("#%d: got %+v; want error", i, st)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(st, tt.want) {
+			t.Errorf("#%d: got %+v, %v; want %+v", i, st, err, tt.want)
+		}
+	}
+}
+
+func TestPadOptionsHeader(t *testing.T) {
+	b := append(padOptionsHeader(), ianaProtocolUDP)
+	b[0] = ianaProtocolUDP
+	nh, rest, ok := nextExtHeader(IPv6HopByHop, b)
+	if !ok || nh != ianaProtocolUDP || len(rest) != 1 {
+		t.Fatalf("got %d, %v, %v", nh, rest, ok)
+	}
+	// The PadN option covers the rest of the header.
+	if b[2] != 1 || 2+2+int(b[3]) != 8 {
+		t.Errorf("got %#v", b[:8])
+	}
+}
+
+func TestNextExtHeader(t *testing.T) {
+	payload := []byte{0xde, 0xad}
+	for i, tt := range []struct {
+		nh   int
+		b    []byte
+		next int
+		rest []byte
+		ok   bool
+	}{
+		{IPv6HopByHop, append([]byte{ianaProtocolUDP, 0, 1, 4, 0, 0, 0, 0}, payload...), ianaProtocolUDP, payload, true},
+		{IPv6DstOpts, append([]byte{ianaProtocolIPv6ICMP, 1, 1, 12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, payload...), ianaProtocolIPv6ICMP, payload, true},
+		{IPv6Routing, []byte{ianaProtocolUDP, 1, 4, 0, 0, 0, 0, 0}, IPv6Routing, nil, false},
+		{IPv6HopByHop, []byte{ianaProtocolUDP}, IPv6HopByHop, nil, false},
+		{IPv6Fragment, append([]byte{ianaProtocolUDP, 0, 0x00, 0x01, 0, 0, 0, 1}, payload...), ianaProtocolUDP, payload, true},
+		{IPv6Fragment, append([]byte{ianaProtocolUDP, 0, 0x00, 0x08, 0, 0, 0, 1}, payload...), IPv6Fragment, nil, false},
+		{ianaProtocolUDP, payload, ianaProtocolUDP, nil, false},
+	} {
+		next, rest, ok := nextExtHeader(tt.nh, tt.b)
+		if ok != tt.ok || next != tt.next || ok && !reflect.DeepEqual(rest, tt.rest) {
+			t.Errorf("#%d: got %d, %v, %v; want %d, %v, %v", i, next, rest, ok, tt.next, tt.rest, tt.ok)
+		}
+	}
+}
+
+func TestParseOrigIP(t *testing.T) {
+	payload := []byte{0x80, 0, 0, 0, 0, 1, 0, 1}
+	hbh := []byte{IPv6DstOpts, 0, 1, 4, 0, 0, 0, 0}
+	dstopts := []byte{ianaProtocolIPv6ICMP, 0, 1, 4, 0, 0, 0, 0}
+	frag := []byte{ianaProtocolIPv6ICMP, 0, 0x00, 0x10, 0, 0, 0, 1}
+	for i, tt := range []struct {
+		iph      interface{}
+		b        []byte
+		protocol int
+		payload  []byte
+	}{
+		{&ipv4.Header{Protocol: ianaProtocolUDP}, payload, ianaProtocolUDP, payload},
+		{&ipv6.Header{NextHeader: ianaProtocolIPv6ICMP}, payload, ianaProtocolIPv6ICMP, payload},
+		{&ipv6.Header{NextHeader: IPv6HopByHop}, append(append(append([]byte{}, hbh...), dstopts...), payload...), ianaProtocolIPv6ICMP, payload},
+		{&ipv6.Header{NextHeader: IPv6HopByHop}, hbh[:4], IPv6HopByHop, hbh[:4]},
+		{&ipv6.Header{NextHeader: IPv6Fragment}, append(append([]byte{}, frag...), payload...), IPv6Fragment, append(append([]byte{}, frag...), payload...)},
+		{nil, payload, -1, nil},
+	} {
+		protocol, b := parseOrigIP(tt.iph, tt.b)
+		if protocol != tt.protocol || !reflect.DeepEqual(b, tt.payload) {
+			t.Errorf("#%d: got %d, %v; want %d, %v", i, protocol, b, tt.protocol, tt.payload)
+		}
+	}
+}
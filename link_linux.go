@@ -0,0 +1,134 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	etherTypeIPv4 = syscall.ETH_P_IP
+	etherTypeARP  = syscall.ETH_P_ARP
+	etherTypeIPv6 = syscall.ETH_P_IPV6
+)
+
+// A linkConn represents a link-layer socket that transmits and
+// receives network-layer packets without link-layer headers.
+type linkConn struct {
+	ifi   *net.Interface
+	proto uint16
+	f     *os.File
+}
+
+// nativeEndian is the byte order of the host.
+var nativeEndian binary.ByteOrder
+
+func init() {
+	i := uint16(1)
+	if (*[2]byte)(unsafe.Pointer(&i))[0] == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+func htons(i uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], i)
+	return nativeEndian.Uint16(b[:])
+}
+
+// listenLink returns a link-layer socket on ifi for the EtherType
+// proto.
+func listenLink(ifi *net.Interface, proto uint16) (*linkConn, error) {
+	s, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, int(htons(proto)))
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	sa := syscall.SockaddrLinklayer{Protocol: htons(proto), Ifindex: ifi.Index}
+	if err := syscall.Bind(s, &sa); err != nil {
+		syscall.Close(s)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	// The file is registered with the runtime network poller
+	// because the socket is non-blocking, and so closing it
+	// unblocks pending reads.
+	return &linkConn{ifi: ifi, proto: proto, f: os.NewFile(uintptr(s), "link")}, nil
+}
+
+// setAllMulticast makes the interface receive all multicast frames
+// while c is open.
+func (c *linkConn) setAllMulticast() error {
+	// struct packet_mreq in host byte order.
+	var mreq [16]byte
+	nativeEndian.PutUint32(mreq[0:4], uint32(c.ifi.Index))
+	nativeEndian.PutUint16(mreq[4:6], syscall.PACKET_MR_ALLMULTI)
+	rc, err := c.f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(s uintptr) {
+		serr = syscall.SetsockoptString(int(s), syscall.SOL_PACKET, syscall.PACKET_ADD_MEMBERSHIP, string(mreq[:]))
+	}); err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", serr)
+}
+
+// readFrom reads a packet that is received by the interface, and
+// returns the number of bytes read and the source link-layer
+// address.
+// Packets transmitted by the node itself are skipped.
+func (c *linkConn) readFrom(b []byte) (int, net.HardwareAddr, error) {
+	rc, err := c.f.SyscallConn()
+	if err != nil {
+		return 0, nil, err
+	}
+	for {
+		var n int
+		var from syscall.Sockaddr
+		var serr error
+		if err := rc.Read(func(s uintptr) bool {
+			n, from, serr = syscall.Recvfrom(int(s), b, 0)
+			return serr != syscall.EAGAIN
+		}); err != nil {
+			return 0, nil, err
+		}
+		if serr != nil {
+			return 0, nil, os.NewSyscallError("recvfrom", serr)
+		}
+		sa, ok := from.(*syscall.SockaddrLinklayer)
+		if !ok || sa.Pkttype == syscall.PACKET_OUTGOING {
+			continue
+		}
+		return n, net.HardwareAddr(append([]byte(nil), sa.Addr[:sa.Halen]...)), nil
+	}
+}
+
+func (c *linkConn) writeTo(b []byte, dst net.HardwareAddr) error {
+	sa := syscall.SockaddrLinklayer{Protocol: htons(c.proto), Ifindex: c.ifi.Index, Halen: uint8(len(dst))}
+	copy(sa.Addr[:], dst)
+	rc, err := c.f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Write(func(s uintptr) bool {
+		serr = syscall.Sendto(int(s), b, 0, &sa)
+		return serr != syscall.EAGAIN
+	}); err != nil {
+		return err
+	}
+	return os.NewSyscallError("sendto", serr)
+}
+
+func (c *linkConn) close() error {
+	return c.f.Close()
+}
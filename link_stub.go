@@ -0,0 +1,41 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package ipoam
+
+import (
+	"errors"
+	"net"
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+	etherTypeIPv6 = 0x86dd
+)
+
+type linkConn struct{}
+
+func listenLink(ifi *net.Interface, proto uint16) (*linkConn, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *linkConn) setAllMulticast() error {
+	return errors.New("not implemented")
+}
+
+func (c *linkConn) readFrom(b []byte) (int, net.HardwareAddr, error) {
+	return 0, nil, errors.New("not implemented")
+}
+
+func (c *linkConn) writeTo(b []byte, dst net.HardwareAddr) error {
+	return errors.New("not implemented")
+}
+
+func (c *linkConn) close() error {
+	return errors.New("not implemented")
+}
@@ -0,0 +1,346 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A MulticastRecordType represents a type of IGMPv3 group record or
+// MLDv2 multicast address record.
+type MulticastRecordType int
+
+const (
+	MulticastModeIsInclude   MulticastRecordType = 1 // current state is include mode
+	MulticastModeIsExclude   MulticastRecordType = 2 // current state is exclude mode
+	MulticastChangeToInclude MulticastRecordType = 3 // filter mode changed to include
+	MulticastChangeToExclude MulticastRecordType = 4 // filter mode changed to exclude
+	MulticastAllowNewSources MulticastRecordType = 5 // sources allowed
+	MulticastBlockOldSources MulticastRecordType = 6 // sources blocked
+)
+
+var multicastRecordTypes = map[MulticastRecordType]string{
+	MulticastModeIsInclude:   "is-include",
+	MulticastModeIsExclude:   "is-exclude",
+	MulticastChangeToInclude: "to-include",
+	MulticastChangeToExclude: "to-exclude",
+	MulticastAllowNewSources: "allow",
+	MulticastBlockOldSources: "block",
+}
+
+func (typ MulticastRecordType) String() string {
+	s, ok := multicastRecordTypes[typ]
+	if !ok {
+		return "<nil>"
+	}
+	return s
+}
+
+// A MulticastRecord represents a group record in IGMP report or a
+// multicast address record in MLD report.
+type MulticastRecord struct {
+	Type    MulticastRecordType
+	Group   net.IP   // group address
+	Sources []net.IP // source addresses
+}
+
+// Listening reports whether the record shows that the sender is
+// listening to the group.
+// A record in exclude mode without sources, which is also the
+// meaning of IGMPv1, IGMPv2 and MLDv1 reports, shows that the sender
+// is listening to all the sources.
+func (rec *MulticastRecord) Listening() bool {
+	switch rec.Type {
+	case MulticastModeIsExclude, MulticastChangeToExclude:
+		return true
+	case MulticastModeIsInclude, MulticastAllowNewSources:
+		return len(rec.Sources) > 0
+	default:
+		return false
+	}
+}
+
+// A MulticastQuery represents an IGMP or MLD query.
+type MulticastQuery struct {
+	Version     int           // IGMP version 1 through 3, or MLD version 1 or 2
+	Group       net.IP        // group address, nil or unspecified for general query
+	Sources     []net.IP      // source addresses for group-and-source-specific query
+	MaxResponse time.Duration // maximum response delay
+
+	// These fields are used only by IGMPv3 and MLDv2.
+	SuppressRouterSide bool          // suppress router-side processing
+	Robustness         int           // querier's robustness variable
+	Interval           time.Duration // querier's query interval
+}
+
+// A ListenerReport represents a test report of listener tester.
+type ListenerReport struct {
+	Error    error            // on-link operation error
+	Time     time.Time        // time packet received
+	Src      net.IP           // source address on received packet
+	LinkAddr net.HardwareAddr // source link-layer address on received packet
+	Version  int              // IGMP or MLD version of received message
+
+	// Query is set only when the received message is a query
+	// transmitted by another querier on the link.
+	Query *MulticastQuery
+
+	// Records holds the records of received report.
+	// The reports and leave messages of IGMPv1, IGMPv2 and MLDv1
+	// are represented as the equivalent records; a report is a
+	// record in exclude mode without sources, and a leave or done
+	// message is a change to include mode without sources.
+	Records []MulticastRecord
+}
+
+// A ListenerTester represents a tester for multicast listener
+// discovery using IGMP or MLD.
+// It currently works on Linux only.
+type ListenerTester struct {
+	ifi    *net.Interface
+	src    net.IP
+	c      *linkConn
+	report chan ListenerReport
+	done   chan struct{}
+
+	closeOnce sync.Once
+}
+
+// NewListenerTester makes a tester that transmits IGMP or MLD
+// queries and receives reports via ifi.
+// The network must be "ip4" for IGMP or "ip6" for MLD.
+// It requires the privilege to open link-layer sockets.
+// Queries are transmitted from one of the IPv4 addresses of ifi for
+// IGMP, and the IPv6 link-local address of ifi for MLD.
+func NewListenerTester(network string, ifi *net.Interface) (*ListenerTester, error) {
+	if ifi == nil {
+		return nil, errors.New("no interface for listener discovery")
+	}
+	var proto uint16
+	switch network {
+	case "ip4":
+		proto = etherTypeIPv4
+	case "ip6":
+		proto = etherTypeIPv6
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	src, err := listenerSource(ifi, proto == etherTypeIPv6)
+	if err != nil {
+		return nil, err
+	}
+	c, err := listenLink(ifi, proto)
+	if err != nil {
+		return nil, err
+	}
+	// Reports are addressed to the groups, or the all IGMPv3 or
+	// MLDv2 routers, that the node doesn't join.
+	if err := c.setAllMulticast(); err != nil {
+		c.close()
+		return nil, err
+	}
+	t := ListenerTester{ifi: ifi, src: src, c: c, report: make(chan ListenerReport, 1), done: make(chan struct{})}
+	go t.monitor()
+	return &t, nil
+}
+
+func listenerSource(ifi *net.Interface, ipv6 bool) (net.IP, error) {
+	ifat, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, ifa := range ifat {
+		ipn, ok := ifa.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if !ipv6 && ipn.IP.To4() != nil {
+			return ipn.IP.To4(), nil
+		}
+		if ipv6 && ipn.IP.To4() == nil && ipn.IP.IsLinkLocalUnicast() {
+			return ipn.IP, nil
+		}
+	}
+	if ipv6 {
+		return nil, errors.New("no IPv6 link-local address on " + ifi.Name)
+	}
+	return nil, errors.New("no IPv4 address on " + ifi.Name)
+}
+
+// Report returns the buffered test report channel.
+func (t *ListenerTester) Report() <-chan ListenerReport {
+	return t.report
+}
+
+// Close closes the underlying link-layer socket.
+func (t *ListenerTester) Close() error {
+	err := error(syscall.EINVAL)
+	t.closeOnce.Do(func() {
+		close(t.done)
+		err = t.c.close()
+	})
+	return err
+}
+
+// Query transmits the query q.
+// A general query is addressed to the all-nodes group, and a
+// group-specific or group-and-source-specific query to the group.
+// Note that IGMPv2 and MLD routers with a higher address than the
+// tester may stop acting as a querier for a while.
+func (t *ListenerTester) Query(q *MulticastQuery) error {
+	var b []byte
+	var dst net.IP
+	var err error
+	if t.src.To4() != nil {
+		if b, err = marshalIGMPQuery(q); err != nil {
+			return err
+		}
+		dst = net.IPv4allsys
+		if q.Group != nil && !q.Group.IsUnspecified() {
+			if q.Group.To4() == nil {
+				return errors.New("non-IPv4 group")
+			}
+			dst = q.Group
+		}
+		b = marshalIGMPPacket(t.src, dst, b)
+	} else {
+		if b, err = marshalMLDQuery(q); err != nil {
+			return err
+		}
+		dst = net.IPv6linklocalallnodes
+		if q.Group != nil && !q.Group.IsUnspecified() {
+			if q.Group.To16() == nil || q.Group.To4() != nil {
+				return errors.New("non-IPv6 group")
+			}
+			dst = q.Group
+		}
+		b = marshalMLDPacket(t.src, dst, b)
+	}
+	if !dst.IsMulticast() {
+		return errors.New("non-multicast group")
+	}
+	return t.c.writeTo(b, multicastLinkAddr(dst))
+}
+
+// multicastLinkAddr returns the Ethernet multicast address for the
+// IP multicast address ip.
+// See RFC 1112 and RFC 2464.
+func multicastLinkAddr(ip net.IP) net.HardwareAddr {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.HardwareAddr{0x01, 0x00, 0x5e, ip4[1] & 0x7f, ip4[2], ip4[3]}
+	}
+	ip = ip.To16()
+	return net.HardwareAddr{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}
+}
+
+// marshalIGMPPacket returns an IPv4 packet that carries the IGMP
+// message b with the router alert option.
+func marshalIGMPPacket(src, dst net.IP, b []byte) []byte {
+	h := make([]byte, 24, 24+len(b))
+	h[0], h[1] = 4<<4|6, 0xc0 // version, header length and internetwork control
+	binary.BigEndian.PutUint16(h[2:4], uint16(len(h)+len(b)))
+	h[8], h[9] = 1, ianaProtocolIGMP
+	copy(h[12:16], src.To4())
+	copy(h[16:20], dst.To4())
+	copy(h[20:24], []byte{0x94, 0x04, 0x00, 0x00}) // router alert
+	binary.BigEndian.PutUint16(h[10:12], foldChecksum(onesSum(0, h)))
+	return append(h, b...)
+}
+
+// marshalMLDPacket returns an IPv6 packet that carries the MLD
+// message b in a hop-by-hop options header with the router alert
+// option.
+// It fills the checksum of b.
+func marshalMLDPacket(src, dst net.IP, b []byte) []byte {
+	binary.BigEndian.PutUint16(b[2:4], foldChecksum(onesSum(pseudoHeaderSum(src, dst, ianaProtocolIPv6ICMP, len(b)), b)))
+	h := make([]byte, 48, 48+len(b))
+	h[0] = 6 << 4
+	binary.BigEndian.PutUint16(h[4:6], uint16(8+len(b)))
+	h[6], h[7] = IPv6HopByHop, 1
+	copy(h[8:24], src.To16())
+	copy(h[24:40], dst.To16())
+	copy(h[40:48], []byte{ianaProtocolIPv6ICMP, 0, 0x05, 0x02, 0x00, 0x00, 0x01, 0x00}) // router alert for mld and padn
+	return append(h, b...)
+}
+
+func (t *ListenerTester) emit(r *ListenerReport) {
+	select {
+	case t.report <- *r:
+	case <-t.done:
+	}
+}
+
+func (t *ListenerTester) monitor() {
+	b := make([]byte, 1<<16)
+	for {
+		n, lladdr, err := t.c.readFrom(b)
+		if err != nil {
+			select {
+			case <-t.done:
+			default:
+				t.emit(&ListenerReport{Error: err, Time: time.Now()})
+			}
+			return
+		}
+		r := ListenerReport{Time: time.Now(), LinkAddr: lladdr}
+		if r.Src, r.Version, r.Query, r.Records, err = parseListenerPacket(b[:n]); err != nil {
+			continue
+		}
+		t.emit(&r)
+	}
+}
+
+// parseListenerPacket parses the IPv4 or IPv6 packet b that carries
+// an IGMP or MLD message.
+func parseListenerPacket(b []byte) (net.IP, int, *MulticastQuery, []MulticastRecord, error) {
+	if len(b) < 1 {
+		return nil, 0, nil, nil, errHeaderTooShort
+	}
+	switch b[0] >> 4 {
+	case 4:
+		hl := int(b[0]&0x0f) << 2
+		if len(b) < 20 || hl < 20 || len(b) < hl || b[9] != ianaProtocolIGMP {
+			return nil, 0, nil, nil, errHeaderTooShort
+		}
+		tl := int(binary.BigEndian.Uint16(b[2:4]))
+		if tl < hl || tl > len(b) {
+			return nil, 0, nil, nil, errHeaderTooShort
+		}
+		v, q, recs, err := parseIGMP(b[hl:tl])
+		return net.IPv4(b[12], b[13], b[14], b[15]), v, q, recs, err
+	case 6:
+		if len(b) < 40 {
+			return nil, 0, nil, nil, errHeaderTooShort
+		}
+		end := 40 + int(binary.BigEndian.Uint16(b[4:6]))
+		if end > len(b) {
+			return nil, 0, nil, nil, errHeaderTooShort
+		}
+		src, dst := net.IP(append([]byte(nil), b[8:24]...)), net.IP(b[24:40])
+		nxt, off := int(b[6]), 40
+		for nxt == IPv6HopByHop || nxt == IPv6DstOpts {
+			if off+2 > end {
+				return nil, 0, nil, nil, errHeaderTooShort
+			}
+			nxt, off = int(b[off]), off+(int(b[off+1])+1)*8
+		}
+		if nxt != ianaProtocolIPv6ICMP || off > end {
+			return nil, 0, nil, nil, errHeaderTooShort
+		}
+		m := b[off:end]
+		if foldChecksum(onesSum(pseudoHeaderSum(src, dst, ianaProtocolIPv6ICMP, len(m)), m)) != 0 {
+			return nil, 0, nil, nil, errInvalidMLDMessage
+		}
+		v, q, recs, err := parseMLD(m)
+		return src, v, q, recs, err
+	default:
+		return nil, 0, nil, nil, errHeaderTooShort
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFloatCode(t *testing.T) {
+	for _, tt := range []struct {
+		v, mant, code uint
+	}{
+		{127, 4, 127},
+		{128, 4, 0x80},
+		{31744, 4, 0xff},
+		{40000, 4, 0xff},
+		{32767, 12, 32767},
+		{32768, 12, 0x8000},
+	} {
+		if code := encodeFloatCode(tt.v, tt.mant); code != tt.code {
+			t.Errorf("%d: got %#x; want %#x", tt.v, code, tt.code)
+		}
+	}
+	for _, v := range []uint{1, 100, 125, 1000, 3000, 31744} {
+		if got := decodeFloatCode(encodeFloatCode(v, 4), 4); got > v || got < v-v/16 {
+			t.Errorf("%d: got %d", v, got)
+		}
+	}
+}
+
+func TestParseListenerPacket(t *testing.T) {
+	src4, dst4 := net.IPv4(192, 0, 2, 1), net.IPv4(224, 0, 0, 22)
+	src6, dst6 := net.ParseIP("fe80::1"), net.ParseIP("ff02::16")
+
+	for _, q := range []*MulticastQuery{
+		{Version: 1, Group: net.IPv4zero, MaxResponse: 10 * time.Second},
+		{Version: 2, Group: net.IPv4(239, 1, 1, 1), MaxResponse: time.Second},
+		{Version: 3, Group: net.IPv4(232, 1, 1, 1), Sources: []net.IP{net.IPv4(192, 0, 2, 9)}, MaxResponse: 20 * time.Second, Robustness: 2, Interval: 125 * time.Second},
+		{Version: 1, Group: net.IPv6unspecified, MaxResponse: 10 * time.Second},
+		{Version: 2, Group: net.ParseIP("ff3e::1"), Sources: []net.IP{net.ParseIP("2001:db8::9")}, SuppressRouterSide: true, MaxResponse: 40 * time.Second, Robustness: 2, Interval: 125 * time.Second},
+	} {
+		var b []byte
+		var err error
+		if q.Group.To4() != nil {
+			if b, err = marshalIGMPQuery(q); err == nil {
+				b = marshalIGMPPacket(src4, net.IPv4allsys, b)
+			}
+		} else {
+			if b, err = marshalMLDQuery(q); err == nil {
+				b = marshalMLDPacket(src6, net.IPv6linklocalallnodes, b)
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, v, qq, _, err := parseListenerPacket(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != q.Version || !reflect.DeepEqual(qq, q) {
+			t.Errorf("got %d, %+v; want %+v", v, qq, q)
+		}
+	}
+
+	igmpv3Report := []byte{
+		0x22, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+		0x02, 0x00, 0x00, 0x00, 239, 1, 1, 1,
+		0x01, 0x01, 0x00, 0x02, 232, 1, 1, 1, 192, 0, 2, 8, 192, 0, 2, 9, 0, 0, 0, 0,
+	}
+	binary.BigEndian.PutUint16(igmpv3Report[2:4], foldChecksum(onesSum(0, igmpv3Report)))
+	mldv2Report := append([]byte{0x8f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x06, 0x00, 0x00, 0x01}, net.ParseIP("ff3e::1")...)
+	mldv2Report = append(mldv2Report, net.ParseIP("2001:db8::9")...)
+	mldv1Done := append([]byte{0x84, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, net.ParseIP("ff0e::1")...)
+
+	for _, tt := range []struct {
+		b       []byte
+		src     net.IP
+		version int
+		recs    []MulticastRecord
+	}{
+		{
+			marshalIGMPPacket(src4, dst4, igmpv3Report), src4, 3,
+			[]MulticastRecord{
+				{Type: MulticastModeIsExclude, Group: net.IPv4(239, 1, 1, 1)},
+				{Type: MulticastModeIsInclude, Group: net.IPv4(232, 1, 1, 1), Sources: []net.IP{net.IPv4(192, 0, 2, 8), net.IPv4(192, 0, 2, 9)}},
+			},
+		},
+		{
+			marshalMLDPacket(src6, dst6, mldv2Report), src6, 2,
+			[]MulticastRecord{
+				{Type: MulticastBlockOldSources, Group: net.ParseIP("ff3e::1"), Sources: []net.IP{net.ParseIP("2001:db8::9")}},
+			},
+		},
+		{
+			marshalMLDPacket(src6, net.ParseIP("ff02::2"), mldv1Done), src6, 1,
+			[]MulticastRecord{
+				{Type: MulticastChangeToInclude, Group: net.ParseIP("ff0e::1")},
+			},
+		},
+	} {
+		src, v, q, recs, err := parseListenerPacket(tt.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !src.Equal(tt.src) || v != tt.version || q != nil || !reflect.DeepEqual(recs, tt.recs) {
+			t.Errorf("got %v, %d, %+v, %+v; want %v, %d, %+v", src, v, q, recs, tt.src, tt.version, tt.recs)
+		}
+	}
+
+	b := marshalMLDPacket(src6, dst6, mldv2Report)
+	b[len(b)-1] ^= 0xff
+	if _, _, _, _, err := parseListenerPacket(b); err == nil {
+		t.Error("got nil for corrupted checksum; want error")
+	}
+}
@@ -0,0 +1,486 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// LSPPort is the UDP port number for MPLS LSP ping.
+const LSPPort = 3503
+
+// MPLS echo message types.
+const (
+	LSPEchoRequest = 1 // echo request
+	LSPEchoReply   = 2 // echo reply
+)
+
+// MPLS echo reply modes.
+const (
+	LSPReplyNone           = 1 // do not reply
+	LSPReplyUDP            = 2 // reply via an IPv4 or IPv6 UDP packet
+	LSPReplyUDPRouterAlert = 3 // reply via an IPv4 or IPv6 UDP packet with router alert
+	LSPReplyControlChannel = 4 // reply via application level control channel
+)
+
+// An LSPReturnCode represents a return code of MPLS echo reply.
+type LSPReturnCode int
+
+const (
+	LSPNoReturnCode       LSPReturnCode = 0  // no return code
+	LSPMalformedRequest   LSPReturnCode = 1  // malformed echo request received
+	LSPTLVNotUnderstood   LSPReturnCode = 2  // one or more of the TLVs was not understood
+	LSPEgress             LSPReturnCode = 3  // replying router is an egress for the FEC at stack-depth
+	LSPNoMapping          LSPReturnCode = 4  // replying router has no mapping for the FEC at stack-depth
+	LSPDownstreamMismatch LSPReturnCode = 5  // downstream mapping mismatch
+	LSPUpstreamIfUnknown  LSPReturnCode = 6  // upstream interface index unknown
+	LSPLabelSwitched      LSPReturnCode = 8  // label switched at stack-depth
+	LSPNoMPLSForwarding   LSPReturnCode = 9  // label switched but no MPLS forwarding at stack-depth
+	LSPLabelMismatch      LSPReturnCode = 10 // mapping for this FEC is not the given label at stack-depth
+	LSPNoLabelEntry       LSPReturnCode = 11 // no label entry at stack-depth
+	LSPProtocolMismatch   LSPReturnCode = 12 // protocol not associated with interface at FEC stack-depth
+	LSPPrematureTerm      LSPReturnCode = 13 // premature termination of ping due to label stack shrinking to a single label
+	LSPSeeDDMAP           LSPReturnCode = 14 // see DDMAP TLV for meaning of return code and return subcode
+	LSPLabelSwitchedFEC   LSPReturnCode = 15 // label switched with FEC change
+)
+
+var lspReturnCodes = map[LSPReturnCode]string{
+	LSPNoReturnCode:       "no return code",
+	LSPMalformedRequest:   "malformed echo request received",
+	LSPTLVNotUnderstood:   "one or more of the TLVs was not understood",
+	LSPEgress:             "replying router is an egress for the FEC at stack-depth",
+	LSPNoMapping:          "replying router has no mapping for the FEC at stack-depth",
+	LSPDownstreamMismatch: "downstream mapping mismatch",
+	LSPUpstreamIfUnknown:  "upstream interface index unknown",
+	LSPLabelSwitched:      "label switched at stack-depth",
+	LSPNoMPLSForwarding:   "label switched but no MPLS forwarding at stack-depth",
+	LSPLabelMismatch:      "mapping for this FEC is not the given label at stack-depth",
+	LSPNoLabelEntry:       "no label entry at stack-depth",
+	LSPProtocolMismatch:   "protocol not associated with interface at FEC stack-depth",
+	LSPPrematureTerm:      "premature termination of ping due to label stack shrinking to a single label",
+	LSPSeeDDMAP:           "see DDMAP TLV for meaning of return code and return subcode",
+	LSPLabelSwitchedFEC:   "label switched with FEC change",
+}
+
+func (rc LSPReturnCode) String() string {
+	if s, ok := lspReturnCodes[rc]; ok {
+		return s
+	}
+	return fmt.Sprintf("return code %d", int(rc))
+}
+
+// MPLS echo TLV types.
+const (
+	lspTLVTargetFECStack = 1
+	lspTLVPad            = 3
+	lspTLVErroredTLVs    = 9
+
+	lspOptionalTLVs = 0x8000 // TLV types greater than or equal to this may be ignored
+)
+
+// Target FEC stack sub-TLV types.
+const (
+	LSPFECLDPIPv4     = 1  // LDP IPv4 prefix
+	LSPFECLDPIPv6     = 2  // LDP IPv6 prefix
+	LSPFECGenericIPv4 = 14 // generic IPv4 prefix
+	LSPFECGenericIPv6 = 15 // generic IPv6 prefix
+	LSPFECNil         = 16 // nil FEC
+)
+
+const lspHeaderLen = 32
+
+var (
+	errInvalidLSPEcho     = errors.New("invalid MPLS echo message")
+	errUnknownLSPVersion  = errors.New("unknown MPLS echo version")
+	errInvalidLSPFECStack = errors.New("invalid target FEC stack")
+)
+
+// An LSPFEC represents a sub-TLV of Target FEC Stack TLV.
+type LSPFEC struct {
+	// Type specifies the sub-TLV type.
+	Type int
+
+	// Prefix specifies the prefix of LSPFECLDPIPv4,
+	// LSPFECLDPIPv6, LSPFECGenericIPv4 and LSPFECGenericIPv6.
+	Prefix *net.IPNet
+
+	// Label specifies the label of LSPFECNil.
+	Label int
+
+	// Data holds the value of other types.
+	Data []byte
+}
+
+// NewLSPFEC returns an LDP prefix FEC for prefix, or a generic prefix
+// FEC when generic is true.
+func NewLSPFEC(prefix *net.IPNet, generic bool) LSPFEC {
+	fec := LSPFEC{Type: LSPFECLDPIPv6, Prefix: prefix}
+	if prefix.IP.To4() != nil {
+		fec.Type = LSPFECLDPIPv4
+	}
+	if generic {
+		fec.Type += LSPFECGenericIPv4 - LSPFECLDPIPv4
+	}
+	return fec
+}
+
+func (fec LSPFEC) String() string {
+	switch fec.Type {
+	case LSPFECLDPIPv4, LSPFECLDPIPv6:
+		return fmt.Sprintf("ldp:%v", fec.Prefix)
+	case LSPFECGenericIPv4, LSPFECGenericIPv6:
+		return fmt.Sprintf("generic:%v", fec.Prefix)
+	case LSPFECNil:
+		return fmt.Sprintf("nil:%d", fec.Label)
+	default:
+		return fmt.Sprintf("fec%d", fec.Type)
+	}
+}
+
+func (fec *LSPFEC) marshal() ([]byte, error) {
+	switch fec.Type {
+	case LSPFECLDPIPv4, LSPFECGenericIPv4, LSPFECLDPIPv6, LSPFECGenericIPv6:
+		l := net.IPv4len
+		if fec.Type == LSPFECLDPIPv6 || fec.Type == LSPFECGenericIPv6 {
+			l = net.IPv6len
+		}
+		if fec.Prefix == nil {
+			return nil, fmt.Errorf("missing prefix for %v", fec)
+		}
+		ip := fec.Prefix.IP.To16()
+		if l == net.IPv4len {
+			ip = fec.Prefix.IP.To4()
+		}
+		ones, bits := fec.Prefix.Mask.Size()
+		if ip == nil || bits != 8*l {
+			return nil, fmt.Errorf("invalid prefix for %v", fec)
+		}
+		return append(append([]byte(nil), ip...), byte(ones)), nil
+	case LSPFECNil:
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(fec.Label)<<12)
+		return b[:], nil
+	default:
+		return fec.Data, nil
+	}
+}
+
+func parseLSPFEC(typ int, b []byte) (LSPFEC, error) {
+	fec := LSPFEC{Type: typ}
+	switch typ {
+	case LSPFECLDPIPv4, LSPFECGenericIPv4, LSPFECLDPIPv6, LSPFECGenericIPv6:
+		l := net.IPv4len
+		if typ == LSPFECLDPIPv6 || typ == LSPFECGenericIPv6 {
+			l = net.IPv6len
+		}
+		if len(b) < l+1 || int(b[l]) > 8*l {
+			return fec, errInvalidLSPFECStack
+		}
+		ip := net.IP(append([]byte(nil), b[:l]...))
+		fec.Prefix = &net.IPNet{IP: ip, Mask: net.CIDRMask(int(b[l]), 8*l)}
+	case LSPFECNil:
+		if len(b) < 4 {
+			return fec, errInvalidLSPFECStack
+		}
+		fec.Label = int(binary.BigEndian.Uint32(b) >> 12)
+	default:
+		fec.Data = append([]byte(nil), b...)
+	}
+	return fec, nil
+}
+
+// An LSPTLV represents a TLV of MPLS echo message other than Target
+// FEC Stack TLV.
+type LSPTLV struct {
+	Type int    // TLV type
+	Data []byte // value without padding
+}
+
+// An LSPEcho represents an MPLS echo request or reply message.
+// See RFC 8029.
+type LSPEcho struct {
+	Type          int           // LSPEchoRequest or LSPEchoReply
+	GlobalFlags   int           // global flags
+	ReplyMode     int           // reply mode
+	ReturnCode    LSPReturnCode // return code
+	ReturnSubcode int           // return subcode, stack-depth for most return codes
+	Handle        uint32        // sender's handle
+	Seq           uint32        // sequence number
+	Sent          time.Time     // time the echo request was sent
+	Received      time.Time     // time the echo request was received, zero for echo request
+	FECStack      []LSPFEC      // target FEC stack, top of the stack first
+	TLVs          []LSPTLV      // other TLVs
+}
+
+// Marshal returns the binary encoding of the MPLS echo message.
+func (m *LSPEcho) Marshal() ([]byte, error) {
+	b := make([]byte, lspHeaderLen)
+	binary.BigEndian.PutUint16(b[0:2], 1)
+	binary.BigEndian.PutUint16(b[2:4], uint16(m.GlobalFlags))
+	b[4], b[5], b[6], b[7] = byte(m.Type), byte(m.ReplyMode), byte(m.ReturnCode), byte(m.ReturnSubcode)
+	binary.BigEndian.PutUint32(b[8:12], m.Handle)
+	binary.BigEndian.PutUint32(b[12:16], m.Seq)
+	putNTPTime(b[16:24], m.Sent)
+	putNTPTime(b[24:32], m.Received)
+	if len(m.FECStack) > 0 {
+		var v []byte
+		for i := range m.FECStack {
+			sub, err := m.FECStack[i].marshal()
+			if err != nil {
+				return nil, err
+			}
+			v = appendLSPTLV(v, m.FECStack[i].Type, sub)
+		}
+		b = appendLSPTLV(b, lspTLVTargetFECStack, v)
+	}
+	for _, tlv := range m.TLVs {
+		b = appendLSPTLV(b, tlv.Type, tlv.Data)
+	}
+	return b, nil
+}
+
+// appendLSPTLV appends a TLV to b.
+// The value is padded to a 4-octet boundary.
+func appendLSPTLV(b []byte, typ int, v []byte) []byte {
+	var h [4]byte
+	binary.BigEndian.PutUint16(h[0:2], uint16(typ))
+	binary.BigEndian.PutUint16(h[2:4], uint16(len(v)))
+	b = append(append(b, h[:]...), v...)
+	return append(b, make([]byte, (4-len(v)%4)%4)...)
+}
+
+// nextLSPTLV returns the type, value and the rest of b following the
+// first TLV in b.
+func nextLSPTLV(b []byte) (int, []byte, []byte, bool) {
+	if len(b) < 4 {
+		return 0, nil, nil, false
+	}
+	typ, l := int(binary.BigEndian.Uint16(b[0:2])), int(binary.BigEndian.Uint16(b[2:4]))
+	if 4+l > len(b) {
+		return 0, nil, nil, false
+	}
+	v := b[4 : 4+l]
+	if n := 4 + (l+3)&^3; n < len(b) {
+		return typ, v, b[n:], true
+	}
+	return typ, v, nil, true
+}
+
+// ParseLSPEcho parses b as an MPLS echo message.
+func ParseLSPEcho(b []byte) (*LSPEcho, error) {
+	m, err := parseLSPHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	for b = b[lspHeaderLen:]; len(b) > 0; {
+		typ, v, rest, ok := nextLSPTLV(b)
+		if !ok {
+			return nil, errInvalidLSPEcho
+		}
+		if typ == lspTLVTargetFECStack {
+			for len(v) > 0 {
+				styp, sv, srest, ok := nextLSPTLV(v)
+				if !ok {
+					return nil, errInvalidLSPFECStack
+				}
+				fec, err := parseLSPFEC(styp, sv)
+				if err != nil {
+					return nil, err
+				}
+				m.FECStack = append(m.FECStack, fec)
+				v = srest
+			}
+		} else {
+			m.TLVs = append(m.TLVs, LSPTLV{Type: typ, Data: append([]byte(nil), v...)})
+		}
+		b = rest
+	}
+	return m, nil
+}
+
+func parseLSPHeader(b []byte) (*LSPEcho, error) {
+	if len(b) < lspHeaderLen {
+		return nil, errInvalidLSPEcho
+	}
+	if binary.BigEndian.Uint16(b[0:2]) != 1 {
+		return nil, errUnknownLSPVersion
+	}
+	return &LSPEcho{
+		Type:          int(b[4]),
+		GlobalFlags:   int(binary.BigEndian.Uint16(b[2:4])),
+		ReplyMode:     int(b[5]),
+		ReturnCode:    LSPReturnCode(b[6]),
+		ReturnSubcode: int(b[7]),
+		Handle:        binary.BigEndian.Uint32(b[8:12]),
+		Seq:           binary.BigEndian.Uint32(b[12:16]),
+		Sent:          parseNTPTime(b[16:24]),
+		Received:      parseNTPTime(b[24:32]),
+	}, nil
+}
+
+// An LSPResponder represents an MPLS echo reply agent.
+// It replies to echo requests as the egress of prefix FECs that cover
+// one of the addresses of the node.
+type LSPResponder struct {
+	c  net.PacketConn
+	p4 *ipv4.PacketConn
+	p6 *ipv6.PacketConn
+}
+
+// NewLSPResponder makes a network connection for receiving MPLS echo
+// requests.
+// The network must be "udp", "udp4" or "udp6".
+// The address usually specifies LSPPort.
+//
+// Examples:
+//
+//	NewLSPResponder("udp", ":3503")
+//	NewLSPResponder("udp6", "[::1]:3503")
+func NewLSPResponder(network, address string) (*LSPResponder, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	c, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	r := LSPResponder{c: c}
+	// Echo replies should be sent with the IPv4 TTL or IPv6 hop
+	// limit of 255.
+	if ip := c.LocalAddr().(*net.UDPAddr).IP; ip.To4() != nil {
+		r.p4 = ipv4.NewPacketConn(c)
+		r.p4.SetTTL(255)
+	} else {
+		r.p6 = ipv6.NewPacketConn(c)
+		r.p6.SetHopLimit(255)
+		if network == "udp" {
+			ipv4.NewPacketConn(c).SetTTL(255)
+		}
+	}
+	return &r, nil
+}
+
+// Addr returns the local network address of r.
+func (r *LSPResponder) Addr() net.Addr {
+	return r.c.LocalAddr()
+}
+
+// Close closes the network connection of r.
+func (r *LSPResponder) Close() error {
+	return r.c.Close()
+}
+
+// Serve receives MPLS echo requests and transmits echo replies until
+// r is closed.
+// The fn is called for each echo request and reply when it is not
+// nil; the reply is nil when r doesn't reply.
+func (r *LSPResponder) Serve(fn func(req, rep *LSPEcho, peer net.Addr)) error {
+	b := make([]byte, 1<<16)
+	for {
+		n, peer, err := r.c.ReadFrom(b)
+		if err != nil {
+			return err
+		}
+		req, rep := lspReply(b[:n], time.Now())
+		if rep != nil {
+			wb, err := rep.Marshal()
+			if err == nil {
+				_, err = r.c.WriteTo(wb, peer)
+			}
+			if err != nil {
+				rep = nil
+			}
+		}
+		if fn != nil && req != nil {
+			fn(req, rep, peer)
+		}
+	}
+}
+
+// lspReply returns the echo request in b and the echo reply to it.
+// The returned reply is nil when the request must not be answered.
+func lspReply(b []byte, now time.Time) (*LSPEcho, *LSPEcho) {
+	req, err := ParseLSPEcho(b)
+	if err != nil {
+		h, herr := parseLSPHeader(b)
+		if herr != nil || h.Type != LSPEchoRequest {
+			return nil, nil
+		}
+		req = h
+	}
+	if req.Type != LSPEchoRequest || req.ReplyMode == LSPReplyNone {
+		return req, nil
+	}
+	rep := LSPEcho{
+		Type:        LSPEchoReply,
+		GlobalFlags: req.GlobalFlags,
+		ReplyMode:   req.ReplyMode,
+		Handle:      req.Handle,
+		Seq:         req.Seq,
+		Sent:        req.Sent,
+		Received:    now,
+	}
+	if err != nil || len(req.FECStack) == 0 {
+		rep.ReturnCode = LSPMalformedRequest
+		return req, &rep
+	}
+	var errored []byte
+	for _, tlv := range req.TLVs {
+		if tlv.Type < lspOptionalTLVs && tlv.Type != lspTLVPad {
+			errored = appendLSPTLV(errored, tlv.Type, tlv.Data)
+		}
+	}
+	if errored != nil {
+		rep.ReturnCode = LSPTLVNotUnderstood
+		rep.TLVs = []LSPTLV{{Type: lspTLVErroredTLVs, Data: errored}}
+		return req, &rep
+	}
+	rep.ReturnCode, rep.ReturnSubcode = lspValidateFECStack(req.FECStack)
+	return req, &rep
+}
+
+// lspValidateFECStack validates the FEC stack on the node that has no
+// MPLS forwarding state, and returns the return code and subcode.
+func lspValidateFECStack(fecs []LSPFEC) (LSPReturnCode, int) {
+	for i, fec := range fecs {
+		depth := i + 1
+		switch fec.Type {
+		case LSPFECNil:
+			continue
+		case LSPFECLDPIPv4, LSPFECLDPIPv6, LSPFECGenericIPv4, LSPFECGenericIPv6:
+			if isLocalPrefix(fec.Prefix) {
+				return LSPEgress, depth
+			}
+			return LSPNoMapping, depth
+		default:
+			return LSPTLVNotUnderstood, depth
+		}
+	}
+	return LSPNoMapping, len(fecs)
+}
+
+// isLocalPrefix reports whether prefix covers one of the addresses of
+// the node.
+func isLocalPrefix(prefix *net.IPNet) bool {
+	ifat, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, ifa := range ifat {
+		if ipn, ok := ifa.(*net.IPNet); ok && prefix.Contains(ipn.IP) {
+			return true
+		}
+	}
+	return false
+}
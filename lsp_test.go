@@ -0,0 +1,102 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mikioh/ipoam"
+)
+
+func TestLSPEcho(t *testing.T) {
+	_, v4, _ := net.ParseCIDR("192.0.2.0/24")
+	_, v6, _ := net.ParseCIDR("2001:db8::/32")
+	m := ipoam.LSPEcho{
+		Type:      ipoam.LSPEchoRequest,
+		ReplyMode: ipoam.LSPReplyUDP,
+		Handle:    1,
+		Seq:       2,
+		Sent:      time.Unix(1500000000, 500000000),
+		FECStack:  []ipoam.LSPFEC{ipoam.NewLSPFEC(v4, false), ipoam.NewLSPFEC(v6, true), {Type: ipoam.LSPFECNil, Label: 3}},
+		TLVs:      []ipoam.LSPTLV{{Type: 0x8001, Data: []byte{1, 2, 3}}},
+	}
+	b, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b)%4 != 0 {
+		t.Fatalf("got %d bytes; want 4-octet aligned", len(b))
+	}
+	got, err := ipoam.ParseLSPEcho(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Seq != m.Seq || got.Handle != m.Handle || !got.Received.IsZero() || got.Sent.Sub(m.Sent) > time.Microsecond || got.Sent.Sub(m.Sent) < -time.Microsecond {
+		t.Errorf("got %+v; want %+v", got, m)
+	}
+	if !reflect.DeepEqual(got.TLVs, m.TLVs) {
+		t.Errorf("got %v; want %v", got.TLVs, m.TLVs)
+	}
+	if len(got.FECStack) != 3 || got.FECStack[0].Type != ipoam.LSPFECLDPIPv4 || got.FECStack[1].Type != ipoam.LSPFECGenericIPv6 || got.FECStack[1].Prefix.String() != v6.String() || got.FECStack[2].Label != 3 {
+		t.Errorf("got %v", got.FECStack)
+	}
+	if _, err := ipoam.ParseLSPEcho(b[:len(b)-2]); err == nil {
+		t.Error("got nil; want error")
+	}
+}
+
+func TestLSPResponder(t *testing.T) {
+	r, err := ipoam.NewLSPResponder("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go r.Serve(nil)
+
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	local := &net.IPNet{IP: net.IPv4(127, 0, 0, 1), Mask: net.CIDRMask(32, 32)}
+	_, remote, _ := net.ParseCIDR("203.0.113.0/24")
+	for i, tt := range []struct {
+		fecs []ipoam.LSPFEC
+		tlvs []ipoam.LSPTLV
+		rc   ipoam.LSPReturnCode
+		rsc  int
+	}{
+		{[]ipoam.LSPFEC{ipoam.NewLSPFEC(local, false)}, nil, ipoam.LSPEgress, 1},
+		{[]ipoam.LSPFEC{{Type: ipoam.LSPFECNil}, ipoam.NewLSPFEC(local, true)}, nil, ipoam.LSPEgress, 2},
+		{[]ipoam.LSPFEC{ipoam.NewLSPFEC(remote, false)}, nil, ipoam.LSPNoMapping, 1},
+		{[]ipoam.LSPFEC{ipoam.NewLSPFEC(local, false)}, []ipoam.LSPTLV{{Type: 100}}, ipoam.LSPTLVNotUnderstood, 0},
+		{nil, nil, ipoam.LSPMalformedRequest, 0},
+	} {
+		req := ipoam.LSPEcho{Type: ipoam.LSPEchoRequest, ReplyMode: ipoam.LSPReplyUDP, Handle: 1, Seq: uint32(i), Sent: time.Now(), FECStack: tt.fecs, TLVs: tt.tlvs}
+		b, err := req.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.WriteTo(b, r.Addr()); err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, _, err := c.ReadFrom(b[:cap(b)])
+		if err != nil {
+			t.Fatal(err)
+		}
+		rep, err := ipoam.ParseLSPEcho(b[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Type != ipoam.LSPEchoReply || rep.Seq != req.Seq || rep.ReturnCode != tt.rc || rep.ReturnSubcode != tt.rsc || rep.Received.IsZero() {
+			t.Errorf("#%d: got %+v; want return code %d, subcode %d", i, rep, tt.rc, tt.rsc)
+		}
+	}
+}
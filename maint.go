@@ -5,8 +5,11 @@
 package ipoam
 
 import (
+	"encoding/binary"
+	"hash/fnv"
 	"net"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -22,6 +25,13 @@ func (c cookie) icmpSeq() int  { return int(c << 16 >> 48) }
 func (c cookie) udpSport() int { return int(c >> 48) }
 func (c cookie) udpDport() int { return int(c << 16 >> 48) }
 func (c cookie) protocol() int { return int(c & 0xff) }
+func (c cookie) ndTarget() int { return int(c >> 32) }
+
+// neighbor reports whether c identifies a neighbor solicitation.
+func (c cookie) neighbor() bool { return c>>8&0xff == ianaICMPv6NeighborAdvert }
+
+// router reports whether c identifies a router solicitation.
+func (c cookie) router() bool { return c>>8&0xff == ianaICMPv6RouterAdvert }
 
 func icmpCookie(protocol, id, seq int) cookie {
 	return cookie(id)&0xffff<<48 | cookie(seq)&0xffff<<32 | cookie(protocol)&0xff
@@ -31,129 +41,352 @@ func udpCookie(protocol, sport, dport int) cookie {
 	return cookie(sport)&0xffff<<48 | cookie(dport)&0xffff<<32 | cookie(protocol)&0xff
 }
 
+// ianaICMPv6NeighborAdvert is the ICMPv6 type of neighbor
+// advertisement.
+const ianaICMPv6NeighborAdvert = 136
+
+// ianaICMPv6RouterAdvert is the ICMPv6 type of router advertisement.
+const ianaICMPv6RouterAdvert = 134
+
+// routerCookie is the cookie of router solicitation.
+// Router advertisements carry nothing that relates to the
+// solicitation, and the unsolicited ones are of interest as well.
+const routerCookie = cookie(ianaICMPv6RouterAdvert<<8 | ianaProtocolIPv6ICMP)
+
+// ndCookie returns the cookie of neighbor solicitation for target.
+// It holds the last 32 bits of target, which the receive packet
+// filter matches, and a 16-bit hash of the whole target, which tells
+// apart the targets that share the last 32 bits.
+func ndCookie(target net.IP) cookie {
+	ip := target.To16()
+	h := fnv.New32a()
+	h.Write(ip)
+	sum := h.Sum32()
+	return cookie(binary.BigEndian.Uint32(ip[12:16]))<<32 | cookie(sum>>16^sum&0xffff)<<16 | ianaICMPv6NeighborAdvert<<8 | ianaProtocolIPv6ICMP
+}
+
+// A probe represents an outstanding probe packet.
+type probe struct {
+	cookie cookie
+	group  net.IP     // multicast or broadcast destination, nil for unicast
+	sent   *sentProbe // header fields of probe packet, nil if unknown
+	nat64  bool       // true if the destination is an IPv4-embedded IPv6 address
+}
+
+// annotate sets the fields of r that relate to p.
+func (p *probe) annotate(r *Report) {
+	r.Group = p.group
+	r.HeaderChanges = nil
+	if p.sent != nil && r.OrigHeader != nil {
+		r.HeaderChanges = p.sent.compare(r)
+	}
+}
+
 // A maint represents a maintenance endpoint.
 type maint struct {
-	cookie     uint64
+	dropped    uint64 // number of reports dropped by tryWriteReport, must be 64-bit aligned
+	mu         sync.RWMutex
+	cookies    map[cookie]probe // outstanding probes
+	nat64Dsts  map[string]probe // outstanding probes to IPv4-embedded IPv6 addresses
+	nat64      []*net.IPNet     // NAT64 prefixes
 	emitReport int32
-	report     chan Report // buffered report channel
+	report     chan Report   // buffered report channel
+	done       chan struct{} // closed when t is no longer used
+}
+
+func (t *maint) setProbes(ps ...probe) {
+	t.mu.Lock()
+	if t.cookies == nil {
+		t.cookies = make(map[cookie]probe)
+	}
+	for c := range t.cookies {
+		delete(t.cookies, c)
+	}
+	t.nat64Dsts = nil
+	for _, p := range ps {
+		t.cookies[p.cookie] = p
+		if p.nat64 && p.sent != nil {
+			if t.nat64Dsts == nil {
+				t.nat64Dsts = make(map[string]probe)
+			}
+			t.nat64Dsts[string(p.sent.dst.To16())] = p
+		}
+	}
+	t.mu.Unlock()
+}
+
+func (t *maint) setNAT64Prefixes(prefixes []*net.IPNet) {
+	t.mu.Lock()
+	t.nat64 = prefixes
+	t.mu.Unlock()
+}
+
+// isNAT64 reports whether ip is an IPv4-embedded IPv6 address with
+// one of the NAT64 prefixes.
+func (t *maint) isNAT64(ip net.IP) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return nat64Extract(t.nat64, ip) != nil
+}
+
+// nat64DstList returns the IPv4-embedded IPv6 destinations of the
+// outstanding probes.
+func (t *maint) nat64DstList() []net.IP {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	dsts := make([]net.IP, 0, len(t.nat64Dsts))
+	for dst := range t.nat64Dsts {
+		dsts = append(dsts, net.IP(dst))
+	}
+	return dsts
+}
+
+// match returns the outstanding probe that r relates to.
+// When no probe matches c, it falls back to matching the destination
+// address of the original datagram in r with the probes to
+// IPv4-embedded IPv6 addresses, because a stateful NAT64 translator
+// may rewrite the ICMP echo identifier or UDP source port on the
+// IPv4 side without restoring them in ICMP error messages.
+// It also sets r.SrcIPv4.
+func (t *maint) match(c cookie, r *Report) (probe, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	r.SrcIPv4 = nat64Extract(t.nat64, r.Src)
+	if p, ok := t.cookies[c]; ok {
+		return p, true
+	}
+	if h, ok := r.OrigHeader.(*ipv6.Header); ok && len(t.nat64Dsts) > 0 {
+		p, ok := t.nat64Dsts[string(h.Dst.To16())]
+		return p, ok
+	}
+	return probe{}, false
+}
+
+func (t *maint) cookieList() []cookie {
+	t.mu.RLock()
+	cs := make([]cookie, 0, len(t.cookies))
+	for c := range t.cookies {
+		cs = append(cs, c)
+	}
+	t.mu.RUnlock()
+	return cs
 }
 
-func (t *maint) setICMPCookie(protocol, id, seq int) {
-	atomic.StoreUint64(&t.cookie, uint64(icmpCookie(protocol, id, seq)))
+func (t *maint) receive(c *conn, b []byte, h, cm interface{}, peer net.Addr) {
+	r, cookie, wildcard := parseReport(c, b, h, cm, peer)
+	if p, ok := t.match(cookie, &r); ok || wildcard {
+		p.annotate(&r)
+		t.writeReport(&r)
+	}
 }
 
-func (t *maint) setUDPCookie(protocol, sport, dport int) {
-	atomic.StoreUint64(&t.cookie, uint64(udpCookie(protocol, sport, dport)))
+// A receiver receives packets from a maintenance network connection.
+type receiver interface {
+	receive(c *conn, b []byte, h, cm interface{}, peer net.Addr)
+	writeReport(r *Report)
 }
 
-func (t *maint) monitor(c *conn) {
-	var r Report
+func monitor(c *conn, rcvr receiver) {
+	if runtime.GOOS == "linux" {
+		monitorBatch(c, rcvr)
+		return
+	}
 	b := make([]byte, 1<<16-1)
 
 	for {
 		rb, h, cm, peer, err := c.readFrom(b)
 		if err != nil {
-			r.Error = err
-			t.writeReport(&r)
+			rcvr.writeReport(&Report{Error: err})
 			if err, ok := err.(net.Error); ok && (err.Timeout() || err.Temporary()) {
 				continue
 			}
 			return
 		}
+		rcvr.receive(c, rb, h, cm, peer)
+	}
+}
 
-		r.Time = time.Now()
+func monitorBatch(c *conn, rcvr receiver) {
+	ps := make([]packet, maxBatchSize)
+	ms := make([]ipv4.Message, maxBatchSize)
+	for i := range ms {
+		ms[i].Buffers = [][]byte{make([]byte, 1<<16-1)}
+		ms[i].OOB = c.newControlMessage()
+	}
 
-		if !c.rawSocket {
-			r.Src = peer.(*net.UDPAddr).IP
-		} else {
-			r.Src = peer.(*net.IPAddr).IP
-		}
-		switch h := h.(type) {
-		case *ipv4.Header:
-			r.TC = h.TOS
-			if runtime.GOOS == "solaris" {
-				r.Hops = h.TTL
+	for {
+		n, err := c.readBatch(ms, ps)
+		if err != nil {
+			rcvr.writeReport(&Report{Error: err})
+			if err, ok := err.(net.Error); ok && (err.Timeout() || err.Temporary()) {
+				continue
 			}
+			return
 		}
-		switch cm := cm.(type) {
-		case *ipv4.ControlMessage:
-			if cm != nil {
-				if runtime.GOOS != "solaris" {
-					r.Hops = cm.TTL
-				}
-				r.Dst = cm.Dst
-				ifi, _ := net.InterfaceByIndex(cm.IfIndex)
-				r.Interface = ifi
+		for _, p := range ps[:n] {
+			if p.err != nil {
+				rcvr.writeReport(&Report{Error: p.err})
+				continue
 			}
-		case *ipv6.ControlMessage:
-			if cm != nil {
-				r.TC = cm.TrafficClass
-				r.Hops = cm.HopLimit
-				r.Dst = cm.Dst
-				ifi, _ := net.InterfaceByIndex(cm.IfIndex)
-				r.Interface = ifi
+			rcvr.receive(c, p.b, p.h, p.cm, p.peer)
+		}
+	}
+}
+
+// parseReport parses a packet received on c.
+// It returns the report and the cookie of the probe packet that the
+// report relates to.
+// The returned wildcard is true when the report must be delivered
+// regardless of the cookie.
+func parseReport(c *conn, b []byte, h, cm interface{}, peer net.Addr) (r Report, ck cookie, wildcard bool) {
+	r.Time = time.Now()
+
+	switch peer := peer.(type) {
+	case *net.UDPAddr:
+		r.Src = peer.IP
+	case *net.IPAddr:
+		r.Src = peer.IP
+	}
+	switch h := h.(type) {
+	case *ipv4.Header:
+		r.TC = h.TOS
+		if runtime.GOOS == "solaris" {
+			r.Hops = h.TTL
+		}
+		if len(h.Options) > 0 {
+			r.RecordRoute, r.Timestamp, _ = parseIPv4Options(h.Options)
+		}
+	}
+	switch cm := cm.(type) {
+	case *ipv4.ControlMessage:
+		if cm != nil {
+			if runtime.GOOS != "solaris" {
+				r.Hops = cm.TTL
 			}
+			r.Dst = cm.Dst
+			ifi, _ := net.InterfaceByIndex(cm.IfIndex)
+			r.Interface = ifi
 		}
+	case *ipv6.ControlMessage:
+		if cm != nil {
+			r.TC = cm.TrafficClass
+			r.Hops = cm.HopLimit
+			r.Dst = cm.Dst
+			ifi, _ := net.InterfaceByIndex(cm.IfIndex)
+			r.Interface = ifi
+		}
+	}
+
+	m, err := icmp.ParseMessage(c.protocol, b)
+	if err != nil {
+		r.Error = err
+		return r, 0, true
+	}
+
+	r.ICMP = m
 
-		m, err := icmp.ParseMessage(c.protocol, rb)
+	if r.ICMP.Type == ipv4.ICMPTypeEchoReply || r.ICMP.Type == ipv6.ICMPTypeEchoReply {
+		cookie := icmpCookie(c.protocol, m.Body.(*icmp.Echo).ID, m.Body.(*icmp.Echo).Seq)
+		return r, cookie, runtime.GOOS == "linux" && !c.rawSocket
+	}
+
+	if r.ICMP.Type == ipv6.ICMPTypeNeighborAdvertisement {
+		r.NeighborAdvert, err = parseNeighborAdvert(b)
 		if err != nil {
 			r.Error = err
-			t.writeReport(&r)
-			continue
+			return r, 0, true
 		}
-
-		r.ICMP = m
-		mcookie := cookie(atomic.LoadUint64(&t.cookie))
-
-		if r.ICMP.Type == ipv4.ICMPTypeEchoReply || r.ICMP.Type == ipv6.ICMPTypeEchoReply {
-			cookie := icmpCookie(c.protocol, m.Body.(*icmp.Echo).ID, m.Body.(*icmp.Echo).Seq)
-			if cookie == mcookie || runtime.GOOS == "linux" && !c.rawSocket {
-				t.writeReport(&r)
-			}
-			continue
+		// Neighbor advertisements must not be forwarded by
+		// routers.
+		// See RFC 4861 Section 7.1.2.
+		if r.Hops != 255 {
+			return r, 0, false
 		}
+		return r, ndCookie(r.NeighborAdvert.Target), false
+	}
 
-		r.OrigHeader, r.OrigPayload, err = parseICMPError(m)
+	if r.ICMP.Type == ipv6.ICMPTypeRouterAdvertisement {
+		r.RouterAdvert, err = parseRouterAdvert(b)
 		if err != nil {
 			r.Error = err
-			t.writeReport(&r)
-			continue
+			return r, 0, true
 		}
+		// Router advertisements must be sent from a link-local
+		// address and must not be forwarded by routers.
+		// See RFC 4861 Section 6.1.2.
+		if r.Hops != 255 || !r.Src.IsLinkLocalUnicast() {
+			return r, 0, false
+		}
+		return r, routerCookie, false
+	}
 
-		switch parseOrigIP(r.OrigHeader) {
-		case ianaProtocolICMP, ianaProtocolIPv6ICMP:
-			m, err := icmp.ParseMessage(r.ICMP.Type.Protocol(), r.OrigPayload)
-			if err != nil {
-				r.Error = err
-				t.writeReport(&r)
-				continue
-			}
-			var cookie cookie
-			if echo, ok := m.Body.(*icmp.Echo); ok {
-				cookie = icmpCookie(c.protocol, echo.ID, echo.Seq)
-			}
-			if cookie == mcookie || runtime.GOOS == "linux" && !c.rawSocket {
-				t.writeReport(&r)
-			}
-		case ianaProtocolUDP:
-			sport, dport := parseOrigUDP(r.OrigPayload)
-			cookie := udpCookie(ianaProtocolUDP, sport, dport)
-			if cookie == mcookie {
-				t.writeReport(&r)
-			}
-		default: // e.g., ianaProtocolIPv6Frag
-			t.writeReport(&r)
+	r.OrigHeader, r.OrigSRH, r.OrigPayload, err = parseICMPError(m)
+	if err != nil {
+		r.Error = err
+		return r, 0, true
+	}
+
+	// A non-first fragment carries no upper-layer header.
+	r.OrigFragment = parseOrigFragment(r.OrigHeader, r.OrigPayload)
+	if r.OrigFragment != nil && r.OrigFragment.Offset > 0 {
+		return r, 0, true
+	}
+	// An ICMP fragment reassembly time exceeded message arrives
+	// after the reassembly timeout that is usually longer than
+	// the lifetime of the probe.
+	reassembly := isReassemblyTimeExceeded(m)
+	protocol, payload := parseOrigIP(r.OrigHeader, r.OrigPayload)
+	switch protocol {
+	case ianaProtocolICMP, ianaProtocolIPv6ICMP:
+		m, err := icmp.ParseMessage(r.ICMP.Type.Protocol(), payload)
+		if err != nil {
+			r.Error = err
+			return r, 0, true
+		}
+		var cookie cookie
+		if echo, ok := m.Body.(*icmp.Echo); ok {
+			cookie = icmpCookie(c.protocol, echo.ID, echo.Seq)
 		}
+		return r, cookie, reassembly || runtime.GOOS == "linux" && !c.rawSocket
+	case ianaProtocolUDP:
+		sport, dport := parseOrigUDP(payload)
+		return r, udpCookie(ianaProtocolUDP, sport, dport), reassembly
+	default: // e.g., IPv6Fragment
+		return r, 0, true
 	}
 }
 
 func (t *maint) writeReport(r *Report) {
 	emit := atomic.LoadInt32(&t.emitReport)
 	if emit > 0 {
-		t.report <- *r
+		select {
+		case t.report <- *r:
+		case <-t.done:
+		}
 	}
 }
 
+// tryWriteReport is like writeReport but drops r when the report
+// channel is full, so that a tester not draining the channel doesn't
+// stall the other testers sharing the maintenance endpoint.
+func (t *maint) tryWriteReport(r *Report) {
+	emit := atomic.LoadInt32(&t.emitReport)
+	if emit > 0 {
+		select {
+		case t.report <- *r:
+		default:
+			atomic.AddUint64(&t.dropped, 1)
+		}
+	}
+}
+
+// DroppedReports returns the number of reports dropped because the
+// report channel was full.
+// Only testers created by NewSharedTester drop reports.
+func (t *maint) DroppedReports() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
 // Report returns the buffered test report channel.
 func (t *maint) Report() <-chan Report {
 	return t.report
@@ -0,0 +1,135 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	mldMsgLen       = 24 // length of MLDv1 message
+	mldV2QueryLen   = 28 // length of MLDv2 query without sources
+	mldV2ReportLen  = 8  // length of MLDv2 report without records
+	mldV2RecordLen  = 20 // length of MLDv2 multicast address record without sources
+	mldResponseUnit = time.Millisecond
+)
+
+var errInvalidMLDMessage = errors.New("invalid MLD message")
+
+// marshalMLDQuery returns the binary encoding of MLD query q.
+// The checksum is left to the caller.
+// See RFC 2710 and RFC 3810.
+func marshalMLDQuery(q *MulticastQuery) ([]byte, error) {
+	group := q.Group.To16()
+	if group == nil || group.To4() != nil {
+		group = net.IPv6unspecified
+	}
+	var b []byte
+	switch q.Version {
+	case 1:
+		if len(q.Sources) > 0 {
+			return nil, errors.New("MLDv1 doesn't support source-specific query")
+		}
+		b = make([]byte, mldMsgLen)
+		binary.BigEndian.PutUint16(b[4:6], uint16(minInt(int(q.MaxResponse/mldResponseUnit), 0xffff)))
+	case 2:
+		b = make([]byte, mldV2QueryLen, mldV2QueryLen+16*len(q.Sources))
+		binary.BigEndian.PutUint16(b[4:6], uint16(encodeFloatCode(uint(q.MaxResponse/mldResponseUnit), 12)))
+		if q.SuppressRouterSide {
+			b[24] |= 0x08
+		}
+		b[24] |= byte(minInt(q.Robustness, 7))
+		b[25] = byte(encodeFloatCode(uint(q.Interval/time.Second), 4))
+		binary.BigEndian.PutUint16(b[26:28], uint16(len(q.Sources)))
+		for _, src := range q.Sources {
+			if src.To16() == nil || src.To4() != nil {
+				return nil, errors.New("non-IPv6 source")
+			}
+			b = append(b, src.To16()...)
+		}
+	default:
+		return nil, errors.New("unknown MLD version")
+	}
+	b[0] = byte(ipv6.ICMPTypeMulticastListenerQuery)
+	copy(b[8:24], group)
+	return b, nil
+}
+
+// parseMLD parses the ICMPv6 message b, and returns the version and
+// either the query or the multicast address records.
+// The reports and done messages of MLDv1 are represented as the
+// equivalent MLDv2 multicast address records.
+func parseMLD(b []byte) (int, *MulticastQuery, []MulticastRecord, error) {
+	if len(b) < mldMsgLen {
+		return 0, nil, nil, errInvalidMLDMessage
+	}
+	group := net.IP(append([]byte(nil), b[8:24]...))
+	switch ipv6.ICMPType(b[0]) {
+	case ipv6.ICMPTypeMulticastListenerQuery:
+		if len(b) == mldMsgLen {
+			q := MulticastQuery{Version: 1, Group: group, MaxResponse: time.Duration(binary.BigEndian.Uint16(b[4:6])) * mldResponseUnit}
+			return 1, &q, nil, nil
+		}
+		if len(b) < mldV2QueryLen {
+			return 0, nil, nil, errInvalidMLDMessage
+		}
+		q := MulticastQuery{
+			Version:            2,
+			Group:              group,
+			MaxResponse:        time.Duration(decodeFloatCode(uint(binary.BigEndian.Uint16(b[4:6])), 12)) * mldResponseUnit,
+			SuppressRouterSide: b[24]&0x08 != 0,
+			Robustness:         int(b[24] & 0x07),
+			Interval:           time.Duration(decodeFloatCode(uint(b[25]), 4)) * time.Second,
+		}
+		var err error
+		if q.Sources, err = parseIPv6s(b[mldV2QueryLen:], int(binary.BigEndian.Uint16(b[26:28]))); err != nil {
+			return 0, nil, nil, err
+		}
+		return 2, &q, nil, nil
+	case ipv6.ICMPTypeMulticastListenerReport:
+		return 1, nil, []MulticastRecord{{Type: MulticastModeIsExclude, Group: group}}, nil
+	case ipv6.ICMPTypeMulticastListenerDone:
+		return 1, nil, []MulticastRecord{{Type: MulticastChangeToInclude, Group: group}}, nil
+	case ipv6.ICMPTypeVersion2MulticastListenerReport:
+		n := int(binary.BigEndian.Uint16(b[6:8]))
+		var recs []MulticastRecord
+		for b = b[mldV2ReportLen:]; n > 0; n-- {
+			if len(b) < mldV2RecordLen {
+				return 0, nil, nil, errInvalidMLDMessage
+			}
+			rec := MulticastRecord{Type: MulticastRecordType(b[0]), Group: net.IP(append([]byte(nil), b[4:20]...))}
+			nsrcs, auxLen := int(binary.BigEndian.Uint16(b[2:4])), int(b[1])*4
+			var err error
+			if rec.Sources, err = parseIPv6s(b[mldV2RecordLen:], nsrcs); err != nil {
+				return 0, nil, nil, err
+			}
+			l := mldV2RecordLen + 16*nsrcs + auxLen
+			if len(b) < l {
+				return 0, nil, nil, errInvalidMLDMessage
+			}
+			recs = append(recs, rec)
+			b = b[l:]
+		}
+		return 2, nil, recs, nil
+	default:
+		return 0, nil, nil, errInvalidMLDMessage
+	}
+}
+
+func parseIPv6s(b []byte, n int) ([]net.IP, error) {
+	if len(b) < 16*n {
+		return nil, errInvalidMLDMessage
+	}
+	var ips []net.IP
+	for i := 0; i < n; i++ {
+		ips = append(ips, net.IP(append([]byte(nil), b[16*i:16*i+16]...)))
+	}
+	return ips, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// WellKnownNAT64Prefix is the well-known prefix for IPv4-embedded
+// IPv6 addresses.
+// See RFC 6052.
+var WellKnownNAT64Prefix = &net.IPNet{IP: net.ParseIP("64:ff9b::"), Mask: net.CIDRMask(96, 128)}
+
+// ipv4onlyAddrs holds the well-known IPv4 addresses of ipv4only.arpa.
+var ipv4onlyAddrs = []net.IP{net.IPv4(192, 0, 0, 170), net.IPv4(192, 0, 0, 171)}
+
+var errNoNAT64Prefix = errors.New("no NAT64 prefix found")
+
+// DiscoverNAT64Prefixes discovers the NAT64 prefixes on the network
+// by looking up IPv6 addresses of the well-known name ipv4only.arpa.
+// See RFC 7050.
+func DiscoverNAT64Prefixes() ([]*net.IPNet, error) {
+	ips, err := net.LookupIP("ipv4only.arpa")
+	if err != nil {
+		return nil, err
+	}
+	var prefixes []*net.IPNet
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			continue
+		}
+		for _, l := range []int{96, 64, 56, 48, 40, 32} {
+			prefix := &net.IPNet{IP: ip.Mask(net.CIDRMask(l, 128)), Mask: net.CIDRMask(l, 128)}
+			if isIPv4onlyAddr(NAT64Extract(prefix, ip)) {
+				prefixes = append(prefixes, prefix)
+				break
+			}
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil, errNoNAT64Prefix
+	}
+	return prefixes, nil
+}
+
+func isIPv4onlyAddr(ip net.IP) bool {
+	for _, wka := range ipv4onlyAddrs {
+		if wka.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NAT64Synthesize returns the IPv4-embedded IPv6 address of ip with
+// prefix.
+// The prefix length must be 32, 40, 48, 56, 64 or 96.
+func NAT64Synthesize(prefix *net.IPNet, ip net.IP) (net.IP, error) {
+	pos, err := nat64Positions(prefix)
+	if err != nil {
+		return nil, err
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("non-IPv4 address: %v", ip)
+	}
+	ip6 := make(net.IP, net.IPv6len)
+	copy(ip6, prefix.IP.To16().Mask(prefix.Mask))
+	for i, p := range pos {
+		ip6[p] = ip4[i]
+	}
+	return ip6, nil
+}
+
+// NAT64Extract returns the IPv4 address embedded in ip with prefix.
+// It returns nil when ip is not covered by prefix.
+func NAT64Extract(prefix *net.IPNet, ip net.IP) net.IP {
+	pos, err := nat64Positions(prefix)
+	if err != nil || ip.To4() != nil || !prefix.Contains(ip) {
+		return nil
+	}
+	ip6 := ip.To16()
+	return net.IPv4(ip6[pos[0]], ip6[pos[1]], ip6[pos[2]], ip6[pos[3]])
+}
+
+// nat64Positions returns the byte positions of an IPv4 address in an
+// IPv4-embedded IPv6 address with prefix.
+// The byte at position 8, bits 64 to 71, is reserved.
+func nat64Positions(prefix *net.IPNet) ([]int, error) {
+	l, bits := prefix.Mask.Size()
+	if bits != 8*net.IPv6len || prefix.IP.To4() != nil {
+		return nil, fmt.Errorf("invalid NAT64 prefix: %v", prefix)
+	}
+	switch l {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("invalid NAT64 prefix length: %d", l)
+	}
+	pos := make([]int, 0, net.IPv4len)
+	for i := l / 8; len(pos) < net.IPv4len; i++ {
+		if i != 8 {
+			pos = append(pos, i)
+		}
+	}
+	return pos, nil
+}
+
+// nat64Extract returns the IPv4 address embedded in ip with one of
+// prefixes, nil if not found.
+func nat64Extract(prefixes []*net.IPNet, ip net.IP) net.IP {
+	for _, prefix := range prefixes {
+		if ip4 := NAT64Extract(prefix, ip); ip4 != nil {
+			return ip4
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+func TestNAT64Synthesize(t *testing.T) {
+	ip4 := net.IPv4(192, 0, 2, 33)
+	for _, tt := range []struct {
+		prefix string
+		ip6    string
+	}{ // examples in RFC 6052
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::192.0.2.33"},
+		{"64:ff9b::/96", "64:ff9b::192.0.2.33"},
+	} {
+		_, prefix, _ := net.ParseCIDR(tt.prefix)
+		ip6, err := NAT64Synthesize(prefix, ip4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ip6.Equal(net.ParseIP(tt.ip6)) {
+			t.Errorf("%v: got %v; want %s", prefix, ip6, tt.ip6)
+		}
+		if ip := NAT64Extract(prefix, ip6); !ip.Equal(ip4) {
+			t.Errorf("%v: got %v; want %v", prefix, ip, ip4)
+		}
+	}
+
+	if _, err := NAT64Synthesize(&net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(33, 128)}, ip4); err == nil {
+		t.Error("got nil; want error")
+	}
+	if ip := NAT64Extract(WellKnownNAT64Prefix, net.ParseIP("2001:db8::1")); ip != nil {
+		t.Errorf("got %v; want nil", ip)
+	}
+}
+
+func TestMaintMatchNAT64(t *testing.T) {
+	dst := net.ParseIP("64:ff9b::192.0.2.33")
+	var m maint
+	m.setNAT64Prefixes([]*net.IPNet{WellKnownNAT64Prefix})
+	m.setProbes(probe{cookie: udpCookie(ianaProtocolUDP, 49152, 33434), sent: &sentProbe{dst: dst}, nat64: true})
+	if dsts := m.nat64DstList(); len(dsts) != 1 || !dsts[0].Equal(dst) {
+		t.Fatalf("got %v; want [%v]", dsts, dst)
+	}
+
+	// An ICMPv6 error message translated from an ICMPv4 error
+	// message that quotes a probe packet with a rewritten source
+	// port.
+	r := Report{
+		Src:        net.ParseIP("64:ff9b::198.51.100.1"),
+		ICMP:       &icmp.Message{Type: ipv6.ICMPTypeTimeExceeded},
+		OrigHeader: &ipv6.Header{Dst: dst},
+	}
+	if _, ok := m.match(udpCookie(ianaProtocolUDP, 1024, 33434), &r); !ok {
+		t.Error("got false; want true")
+	}
+	if !r.SrcIPv4.Equal(net.IPv4(198, 51, 100, 1)) {
+		t.Errorf("got %v; want 198.51.100.1", r.SrcIPv4)
+	}
+	r.OrigHeader = &ipv6.Header{Dst: net.ParseIP("64:ff9b::192.0.2.34")}
+	if _, ok := m.match(udpCookie(ianaProtocolUDP, 1024, 33434), &r); ok {
+		t.Error("got true; want false")
+	}
+}
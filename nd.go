@@ -0,0 +1,93 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	ndOptSourceLinkAddr = 1
+	ndOptTargetLinkAddr = 2
+
+	ndNeighborMsgLen = 24 // length of neighbor solicitation or advertisement without options
+)
+
+var errInvalidNeighborAdvert = errors.New("invalid neighbor advertisement")
+
+// A NeighborAdvert represents an IPv6 neighbor advertisement.
+// See RFC 4861.
+type NeighborAdvert struct {
+	Router    bool             // sender is a router
+	Solicited bool             // sent in response to a neighbor solicitation
+	Override  bool             // should override an existing cache entry
+	Target    net.IP           // target address
+	LinkAddr  net.HardwareAddr // target link-layer address, nil if not present
+}
+
+// SolicitedNodeMulticast returns the solicited-node multicast address
+// of the IPv6 address ip.
+func SolicitedNodeMulticast(ip net.IP) net.IP {
+	ip = ip.To16()
+	if ip == nil || ip.To4() != nil {
+		return nil
+	}
+	return net.IP{0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0xff, ip[13], ip[14], ip[15]}
+}
+
+// marshalNeighborSolicit returns the binary encoding of neighbor
+// solicitation for target, with the source link-layer address option
+// when lladdr is not nil.
+// The checksum is left to the kernel.
+func marshalNeighborSolicit(target net.IP, lladdr net.HardwareAddr) ([]byte, error) {
+	b := make([]byte, ndNeighborMsgLen-4)
+	copy(b[4:20], target.To16())
+	if len(lladdr) > 0 {
+		n := (2 + len(lladdr) + 7) &^ 7
+		opt := make([]byte, n)
+		opt[0], opt[1] = ndOptSourceLinkAddr, byte(n/8)
+		copy(opt[2:], lladdr)
+		b = append(b, opt...)
+	}
+	m := icmp.Message{Type: ipv6.ICMPTypeNeighborSolicitation, Body: &icmp.RawBody{Data: b}}
+	return m.Marshal(nil)
+}
+
+// parseNeighborAdvert parses the ICMPv6 message b as a neighbor
+// advertisement.
+func parseNeighborAdvert(b []byte) (*NeighborAdvert, error) {
+	if len(b) < ndNeighborMsgLen || b[0] != byte(ipv6.ICMPTypeNeighborAdvertisement) || b[1] != 0 {
+		return nil, errInvalidNeighborAdvert
+	}
+	na := NeighborAdvert{
+		Router:    b[4]&0x80 != 0,
+		Solicited: b[4]&0x40 != 0,
+		Override:  b[4]&0x20 != 0,
+		Target:    net.IP(append([]byte(nil), b[8:24]...)),
+	}
+	if na.Target.IsMulticast() {
+		return nil, errInvalidNeighborAdvert
+	}
+	for opts := b[ndNeighborMsgLen:]; len(opts) > 0; {
+		if len(opts) < 2 || opts[1] == 0 || len(opts) < int(opts[1])*8 {
+			return nil, errInvalidNeighborAdvert
+		}
+		l := int(opts[1]) * 8
+		if opts[0] == ndOptTargetLinkAddr {
+			na.LinkAddr = net.HardwareAddr(append([]byte(nil), opts[2:l]...))
+			// Trailing zero padding is not a part of
+			// Ethernet addresses.
+			if l == 8 {
+				na.LinkAddr = na.LinkAddr[:6]
+			}
+		}
+		opts = opts[l:]
+	}
+	return &na, nil
+}
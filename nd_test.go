@@ -0,0 +1,87 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/ipv6"
+)
+
+func TestSolicitedNodeMulticast(t *testing.T) {
+	for _, tt := range []struct {
+		ip, group net.IP
+	}{
+		{net.ParseIP("2001:db8::1:800:200e:8c6c"), net.ParseIP("ff02::1:ff0e:8c6c")},
+		{net.ParseIP("fe80::1"), net.ParseIP("ff02::1:ff00:1")},
+		{net.ParseIP("192.0.2.1"), nil},
+	} {
+		if group := SolicitedNodeMulticast(tt.ip); !group.Equal(tt.group) {
+			t.Errorf("%v: got %v; want %v", tt.ip, group, tt.group)
+		}
+	}
+}
+
+func TestParseNeighborAdvert(t *testing.T) {
+	target := net.ParseIP("2001:db8::1")
+	lladdr := net.HardwareAddr{0x02, 0x00, 0x5e, 0x10, 0x00, 0x01}
+	b := make([]byte, ndNeighborMsgLen, ndNeighborMsgLen+8)
+	b[0], b[4] = ianaICMPv6NeighborAdvert, 0xe0
+	copy(b[8:], target)
+	b = append(b, ndOptTargetLinkAddr, 1)
+	b = append(b, lladdr...)
+	na, err := parseNeighborAdvert(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &NeighborAdvert{Router: true, Solicited: true, Override: true, Target: target, LinkAddr: lladdr}
+	if !reflect.DeepEqual(na, want) {
+		t.Errorf("got %+v; want %+v", na, want)
+	}
+
+	for _, b := range [][]byte{
+		b[:ndNeighborMsgLen-1],
+		b[:ndNeighborMsgLen+2],
+		append(b[:ndNeighborMsgLen:ndNeighborMsgLen], ndOptTargetLinkAddr, 0, 0, 0, 0, 0, 0, 0),
+	} {
+		if _, err := parseNeighborAdvert(b); err == nil {
+			t.Errorf("%x: got nil; want error", b)
+		}
+	}
+
+	m, err := marshalNeighborSolicit(target, lladdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != ndNeighborMsgLen+8 || m[0] != 135 || !net.IP(m[8:24]).Equal(target) || m[24] != ndOptSourceLinkAddr || !reflect.DeepEqual(net.HardwareAddr(m[26:32]), lladdr) {
+		t.Errorf("got %x", m)
+	}
+}
+
+func TestNeighborAdvertReport(t *testing.T) {
+	target := net.ParseIP("2001:db8::1")
+	b := make([]byte, ndNeighborMsgLen)
+	b[0], b[4] = ianaICMPv6NeighborAdvert, 0x60
+	copy(b[8:], target)
+	c := &conn{protocol: ianaProtocolIPv6ICMP, rawSocket: true}
+	for _, hops := range []int{255, 254} {
+		r, ck, wildcard := parseReport(c, b, nil, &ipv6.ControlMessage{HopLimit: hops}, &net.IPAddr{IP: target})
+		if r.Error != nil || wildcard {
+			t.Fatalf("%d: got %v, %v", hops, r.Error, wildcard)
+		}
+		if (ck == ndCookie(target)) != (hops == 255) {
+			t.Errorf("%d: got %#x", hops, ck)
+		}
+	}
+
+	if ndCookie(target) == ndCookie(net.ParseIP("2001:db8:1::1")) {
+		t.Error("got the same cookie for different targets")
+	}
+	if c := ndCookie(target); !c.neighbor() || c.ndTarget() != 1 {
+		t.Errorf("got %#x", c)
+	}
+}
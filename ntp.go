@@ -0,0 +1,39 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// ntpEpochOffset is the number of seconds between the NTP epoch,
+// 1900-01-01, and the Unix epoch.
+const ntpEpochOffset = 2208988800
+
+// putNTPTime encodes t into b in the 64-bit NTP timestamp format.
+// It encodes zero when t is the zero time.
+func putNTPTime(b []byte, t time.Time) {
+	if t.IsZero() {
+		binary.BigEndian.PutUint64(b, 0)
+		return
+	}
+	ns := t.UnixNano()
+	secs := uint64(ns/1e9 + ntpEpochOffset)
+	frac := uint64(ns%1e9) << 32 / 1e9
+	binary.BigEndian.PutUint64(b, secs<<32|frac)
+}
+
+// parseNTPTime decodes the 64-bit NTP timestamp in b.
+// It returns the zero time when the timestamp is zero.
+func parseNTPTime(b []byte) time.Time {
+	v := binary.BigEndian.Uint64(b)
+	if v == 0 {
+		return time.Time{}
+	}
+	secs := int64(v>>32) - ntpEpochOffset
+	ns := int64((v & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(secs, ns)
+}
@@ -0,0 +1,960 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// OWAMPPort is the well-known TCP port number for OWAMP-Control.
+const OWAMPPort = 861
+
+// OWAMPModeUnauthenticated is the unauthenticated mode of
+// OWAMP-Control and OWAMP-Test.
+// It is the only mode supported by this package.
+const OWAMPModeUnauthenticated = 1
+
+const (
+	owampGreetingLen       = 64
+	owampSetupResponseLen  = 164
+	owampServerStartLen    = 48
+	owampRequestSessionLen = 112
+	owampSlotLen           = 16
+	owampAcceptSessionLen  = 48
+	owampStartSessionsLen  = 32
+	owampStartAckLen       = 32
+	owampStopSessionsLen   = 16
+	owampStopSessionLen    = 24 // length of session description without skip ranges
+	owampFetchSessionLen   = 48
+	owampFetchAckLen       = 32
+	owampHMACLen           = 16
+	owampRecordLen         = 25
+
+	owampCmdRequestSession = 1
+	owampCmdStartSessions  = 2
+	owampCmdStopSessions   = 3
+	owampCmdFetchSession   = 4
+
+	maxOWAMPCount = 1 << 20 // maximum number of test packets in a session
+	maxOWAMPSlots = 1 << 10 // maximum number of schedule slots in a session
+)
+
+var (
+	errInvalidOWAMPMessage  = errors.New("invalid OWAMP-Control message")
+	errOWAMPModeUnsupported = errors.New("OWAMP unauthenticated mode not supported by server")
+	errUnknownOWAMPSession  = errors.New("unknown OWAMP session")
+	errOWAMPSessionTooLarge = errors.New("OWAMP session too large")
+)
+
+// An OWAMPAccept represents an accept value of OWAMP-Control
+// messages.
+type OWAMPAccept int
+
+const (
+	OWAMPAcceptOK OWAMPAccept = iota
+	OWAMPAcceptFailure
+	OWAMPAcceptInternalError
+	OWAMPAcceptNotSupported
+	OWAMPAcceptPermResourceLimitation
+	OWAMPAcceptTempResourceLimitation
+)
+
+var owampAccepts = map[OWAMPAccept]string{
+	OWAMPAcceptOK:                     "ok",
+	OWAMPAcceptFailure:                "failure",
+	OWAMPAcceptInternalError:          "internal error",
+	OWAMPAcceptNotSupported:           "not supported",
+	OWAMPAcceptPermResourceLimitation: "permanent resource limitation",
+	OWAMPAcceptTempResourceLimitation: "temporary resource limitation",
+}
+
+func (a OWAMPAccept) String() string {
+	if s, ok := owampAccepts[a]; ok {
+		return s
+	}
+	return fmt.Sprintf("accept %d", int(a))
+}
+
+// An OWAMPSID represents an OWAMP session identifier.
+type OWAMPSID [16]byte
+
+func (sid OWAMPSID) String() string {
+	return hex.EncodeToString(sid[:])
+}
+
+// newOWAMPSID returns a new session identifier generated by the
+// receiver at ip.
+func newOWAMPSID(ip net.IP) OWAMPSID {
+	var sid OWAMPSID
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(sid[:4], ip4)
+	} else if len(ip) == net.IPv6len {
+		copy(sid[:4], ip[12:])
+	}
+	putNTPTime(sid[4:12], time.Now())
+	binary.BigEndian.PutUint32(sid[12:16], rand.Uint32())
+	return sid
+}
+
+// An OWAMPSlot represents a schedule slot of OWAMP-Test packets.
+type OWAMPSlot struct {
+	Exponential bool          // true if the interval is the mean of exponential distribution
+	Interval    time.Duration // interval to the next test packet
+}
+
+// An OWAMPSession represents an OWAMP-Test session.
+type OWAMPSession struct {
+	FromServer bool          // true if the server transmits and the client receives test packets
+	Count      int           // number of test packets
+	Padding    int           // length of test packet padding
+	Start      time.Time     // start time of the schedule, zero means when the sessions start
+	Timeout    time.Duration // time to wait for test packets after the last transmission
+	DSCP       int           // DSCP on test packets
+	Schedule   []OWAMPSlot   // schedule slots, repeated until Count test packets
+
+	// These fields are set when the session is accepted.
+	SID      OWAMPSID
+	Sender   *net.UDPAddr
+	Receiver *net.UDPAddr
+}
+
+// Departures returns the departure times of test packets relative to
+// the start time of s.
+// The pseudo-random intervals of exponential slots are derived from
+// the session identifier, but not by the AES-based generator of RFC
+// 4656 section 8; the schedule matches only between ipoam peers, and
+// other implementations compute different departure times for the
+// same session.
+// It returns nil when s.Count is greater than 1<<20.
+func (s *OWAMPSession) Departures() []time.Duration {
+	if len(s.Schedule) == 0 || s.Count <= 0 || s.Count > maxOWAMPCount {
+		return nil
+	}
+	rnd := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(s.SID[:8]) ^ binary.BigEndian.Uint64(s.SID[8:]))))
+	ds := make([]time.Duration, s.Count)
+	var d time.Duration
+	for i := range ds {
+		ds[i] = d
+		slot := s.Schedule[i%len(s.Schedule)]
+		if slot.Exponential {
+			d += time.Duration(rnd.ExpFloat64() * float64(slot.Interval))
+		} else {
+			d += slot.Interval
+		}
+	}
+	return ds
+}
+
+// An OWAMPRecord represents an arrival record of OWAMP-Test packet.
+type OWAMPRecord struct {
+	Seq           uint32
+	Sent          time.Time
+	SentError     STAMPErrorEstimate
+	Received      time.Time // zero when the test packet is lost
+	ReceivedError STAMPErrorEstimate
+	TTL           int // IPv4 TTL or IPv6 hop limit on test packet
+}
+
+// Lost reports whether the test packet is lost.
+func (r *OWAMPRecord) Lost() bool {
+	return r.Received.IsZero()
+}
+
+// Delay returns the one-way delay of the test packet.
+// It is meaningful only when the clocks of both hosts are
+// synchronized.
+func (r *OWAMPRecord) Delay() time.Duration {
+	if r.Lost() {
+		return 0
+	}
+	return r.Received.Sub(r.Sent)
+}
+
+func (r *OWAMPRecord) marshal(b []byte) {
+	binary.BigEndian.PutUint32(b[:4], r.Seq)
+	binary.BigEndian.PutUint16(b[4:6], uint16(r.SentError))
+	putSTAMPTime(b[6:14], r.Sent, r.SentError.PTP())
+	binary.BigEndian.PutUint16(b[14:16], uint16(r.ReceivedError))
+	putSTAMPTime(b[16:24], r.Received, r.ReceivedError.PTP())
+	b[24] = byte(r.TTL)
+}
+
+func parseOWAMPRecord(b []byte) OWAMPRecord {
+	r := OWAMPRecord{
+		Seq:           binary.BigEndian.Uint32(b[:4]),
+		SentError:     STAMPErrorEstimate(binary.BigEndian.Uint16(b[4:6])),
+		ReceivedError: STAMPErrorEstimate(binary.BigEndian.Uint16(b[14:16])),
+		TTL:           int(b[24]),
+	}
+	r.Sent = parseSTAMPTime(b[6:14], r.SentError.PTP())
+	r.Received = parseSTAMPTime(b[16:24], r.ReceivedError.PTP())
+	return r
+}
+
+// putOWAMPDuration encodes d into b in the 64-bit timestamp format.
+func putOWAMPDuration(b []byte, d time.Duration) {
+	secs := uint64(d / time.Second)
+	frac := uint64(d%time.Second) << 32 / uint64(time.Second)
+	binary.BigEndian.PutUint64(b, secs<<32|frac)
+}
+
+// parseOWAMPDuration decodes the 64-bit timestamp format duration in
+// b.
+func parseOWAMPDuration(b []byte) time.Duration {
+	v := binary.BigEndian.Uint64(b)
+	if v>>32 > math.MaxInt64/uint64(time.Second)-1 {
+		return math.MaxInt64
+	}
+	return time.Duration(v>>32)*time.Second + time.Duration((v&0xffffffff)*uint64(time.Second)>>32)
+}
+
+func marshalOWAMPRequestSession(s *OWAMPSession) []byte {
+	b := make([]byte, owampRequestSessionLen+owampSlotLen*len(s.Schedule)+owampHMACLen)
+	b[0] = owampCmdRequestSession
+	b[1] = 4
+	if s.Sender.IP.To4() == nil {
+		b[1] = 6
+	}
+	if s.FromServer {
+		b[2] = 1 // conf-sender
+	} else {
+		b[3] = 1 // conf-receiver
+	}
+	binary.BigEndian.PutUint32(b[4:8], uint32(len(s.Schedule)))
+	binary.BigEndian.PutUint32(b[8:12], uint32(s.Count))
+	binary.BigEndian.PutUint16(b[12:14], uint16(s.Sender.Port))
+	binary.BigEndian.PutUint16(b[14:16], uint16(s.Receiver.Port))
+	if b[1] == 4 {
+		copy(b[16:20], s.Sender.IP.To4())
+		copy(b[32:36], s.Receiver.IP.To4())
+	} else {
+		copy(b[16:32], s.Sender.IP.To16())
+		copy(b[32:48], s.Receiver.IP.To16())
+	}
+	copy(b[48:64], s.SID[:])
+	binary.BigEndian.PutUint32(b[64:68], uint32(s.Padding))
+	putNTPTime(b[68:76], s.Start)
+	putOWAMPDuration(b[76:84], s.Timeout)
+	binary.BigEndian.PutUint32(b[84:88], uint32(s.DSCP&0x3f))
+	for i, slot := range s.Schedule {
+		sb := b[owampRequestSessionLen+owampSlotLen*i:]
+		if !slot.Exponential {
+			sb[0] = 1
+		}
+		putOWAMPDuration(sb[8:16], slot.Interval)
+	}
+	return b
+}
+
+// readOWAMPRequestSession reads the rest of Request-Session message
+// following the first 16 bytes in h.
+// It returns errOWAMPSessionTooLarge after skipping the schedule slots
+// when the message carries more than maxOWAMPSlots slots.
+func readOWAMPRequestSession(r io.Reader, h []byte) (*OWAMPSession, error) {
+	b := make([]byte, owampRequestSessionLen)
+	copy(b, h)
+	if _, err := io.ReadFull(r, b[len(h):]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(b[4:8])
+	if n == 0 || n > 1<<16 || b[2] == b[3] || b[2] > 1 || b[3] > 1 {
+		return nil, errInvalidOWAMPMessage
+	}
+	s := OWAMPSession{
+		FromServer: b[2] == 1,
+		Count:      int(binary.BigEndian.Uint32(b[8:12])),
+		Padding:    int(binary.BigEndian.Uint32(b[64:68])),
+		Start:      parseNTPTime(b[68:76]),
+		Timeout:    parseOWAMPDuration(b[76:84]),
+		Sender:     &net.UDPAddr{Port: int(binary.BigEndian.Uint16(b[12:14]))},
+		Receiver:   &net.UDPAddr{Port: int(binary.BigEndian.Uint16(b[14:16]))},
+	}
+	switch b[1] {
+	case 4:
+		s.Sender.IP, s.Receiver.IP = net.IP(b[16:20]), net.IP(b[32:36])
+	case 6:
+		s.Sender.IP, s.Receiver.IP = net.IP(b[16:32]), net.IP(b[32:48])
+	default:
+		return nil, errInvalidOWAMPMessage
+	}
+	copy(s.SID[:], b[48:64])
+	if tp := binary.BigEndian.Uint32(b[84:88]); tp&^0x3f == 0 {
+		s.DSCP = int(tp)
+	}
+	if n > maxOWAMPSlots {
+		if _, err := io.CopyN(ioutil.Discard, r, int64(owampSlotLen*int(n)+owampHMACLen)); err != nil {
+			return nil, err
+		}
+		return nil, errOWAMPSessionTooLarge
+	}
+	b = make([]byte, owampSlotLen*int(n)+owampHMACLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	for i := 0; i < int(n); i++ {
+		sb := b[owampSlotLen*i:]
+		s.Schedule = append(s.Schedule, OWAMPSlot{Exponential: sb[0] == 0, Interval: parseOWAMPDuration(sb[8:16])})
+	}
+	return &s, nil
+}
+
+// An owampTestSession represents the local endpoint of OWAMP-Test
+// session.
+type owampTestSession struct {
+	*OWAMPSession
+	tc   *testConn
+	ee   STAMPErrorEstimate
+	stop chan struct{} // closed to abort the session
+	done chan struct{} // closed when the sender completes
+
+	stopOnce sync.Once
+	started  bool      // true if the sender has started
+	end      time.Time // time the sender completes
+
+	mu   sync.Mutex
+	next uint32                  // next sequence number
+	recs map[uint32]*OWAMPRecord // arrival records
+}
+
+func newOWAMPTestSession(s *OWAMPSession, tc *testConn, ee STAMPErrorEstimate) *owampTestSession {
+	return &owampTestSession{OWAMPSession: s, tc: tc, ee: ee, stop: make(chan struct{}), done: make(chan struct{}), recs: make(map[uint32]*OWAMPRecord)}
+}
+
+// startSender starts the sender of ts.
+func (ts *owampTestSession) startSender() {
+	start := ts.Start
+	if now := time.Now(); start.Before(now) {
+		start = now
+	}
+	ds := ts.Departures()
+	ts.started = true
+	ts.end = start.Add(ts.Timeout)
+	if len(ds) > 0 {
+		ts.end = ts.end.Add(ds[len(ds)-1])
+	}
+	go ts.send(start, ds)
+}
+
+// waitSender waits for the sender of ts to complete, and aborts the
+// sender when it doesn't complete by the end of the schedule and
+// timeout.
+// It returns immediately when the sender has not started.
+func (ts *owampTestSession) waitSender() {
+	if !ts.started {
+		return
+	}
+	t := time.NewTimer(time.Until(ts.end) + time.Second)
+	defer t.Stop()
+	select {
+	case <-ts.done:
+	case <-t.C:
+		ts.abort()
+		<-ts.done
+	}
+}
+
+// send transmits test packets to the receiver at start plus the
+// departure times ds, and waits for the session timeout.
+func (ts *owampTestSession) send(start time.Time, ds []time.Duration) {
+	defer close(ts.done)
+	ts.tc.setDSCP(ts.DSCP)
+	for i, d := range ds {
+		t := time.NewTimer(time.Until(start.Add(d)))
+		select {
+		case <-ts.stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		p := TWAMPPacket{Seq: uint32(i), Timestamp: time.Now(), ErrorEstimate: ts.ee, Padding: ts.Padding}
+		b, err := p.Marshal()
+		if err != nil {
+			return
+		}
+		ts.tc.c.WriteTo(b, ts.Receiver)
+		ts.mu.Lock()
+		ts.next = uint32(i + 1)
+		ts.mu.Unlock()
+	}
+	t := time.NewTimer(ts.Timeout)
+	defer t.Stop()
+	select {
+	case <-ts.stop:
+	case <-t.C:
+	}
+}
+
+// receive records test packets from the sender until the connection
+// is closed.
+func (ts *owampTestSession) receive() {
+	b := make([]byte, 1<<16)
+	for {
+		n, hops, _, peer, err := ts.tc.readFrom(b)
+		if err != nil {
+			return
+		}
+		now := time.Now()
+		if !peer.(*net.UDPAddr).IP.Equal(ts.Sender.IP) {
+			continue
+		}
+		p, err := ParseTWAMPPacket(b[:n], false)
+		if err != nil || p.Seq >= uint32(ts.Count) {
+			continue
+		}
+		ts.mu.Lock()
+		if _, ok := ts.recs[p.Seq]; !ok {
+			ts.recs[p.Seq] = &OWAMPRecord{Seq: p.Seq, Sent: p.Timestamp, SentError: p.ErrorEstimate, Received: now, ReceivedError: ts.ee, TTL: hops}
+		}
+		ts.mu.Unlock()
+	}
+}
+
+func (ts *owampTestSession) nextSeq() uint32 {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.next
+}
+
+// setNextSeq sets the next sequence number reported by the sender,
+// which is limited to the number of test packets.
+func (ts *owampTestSession) setNextSeq(next uint32) {
+	if next > uint32(ts.Count) {
+		next = uint32(ts.Count)
+	}
+	ts.mu.Lock()
+	ts.next = next
+	ts.mu.Unlock()
+}
+
+// records returns the arrival records of test packets in the range
+// of begin to end inclusive.
+// Test packets that have been transmitted but not received are
+// recorded as lost.
+func (ts *owampTestSession) records(begin, end uint32) []OWAMPRecord {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	var recs []OWAMPRecord
+	for seq := begin; seq < ts.next && seq <= end; seq++ {
+		if r, ok := ts.recs[seq]; ok {
+			recs = append(recs, *r)
+		} else {
+			recs = append(recs, OWAMPRecord{Seq: seq})
+		}
+	}
+	return recs
+}
+
+func (ts *owampTestSession) abort() {
+	ts.stopOnce.Do(func() { close(ts.stop) })
+}
+
+func (ts *owampTestSession) close() {
+	ts.abort()
+	ts.tc.Close()
+}
+
+func marshalOWAMPStopSessions(tss []*owampTestSession) []byte {
+	b := make([]byte, owampStopSessionsLen+owampStopSessionLen*len(tss)+owampHMACLen)
+	b[0] = owampCmdStopSessions
+	binary.BigEndian.PutUint32(b[4:8], uint32(len(tss)))
+	for i, ts := range tss {
+		sb := b[owampStopSessionsLen+owampStopSessionLen*i:]
+		copy(sb[:16], ts.SID[:])
+		binary.BigEndian.PutUint32(sb[16:20], ts.nextSeq())
+	}
+	return b
+}
+
+// readOWAMPStopSessions reads the rest of Stop-Sessions message
+// following the first 16 bytes in h, and returns the next sequence
+// numbers of sessions.
+func readOWAMPStopSessions(r io.Reader, h []byte) (map[OWAMPSID]uint32, error) {
+	n := binary.BigEndian.Uint32(h[4:8])
+	if n > 1<<16 {
+		return nil, errInvalidOWAMPMessage
+	}
+	nexts := make(map[OWAMPSID]uint32)
+	for i := 0; i < int(n); i++ {
+		b := make([]byte, owampStopSessionLen)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		var sid OWAMPSID
+		copy(sid[:], b[:16])
+		nexts[sid] = binary.BigEndian.Uint32(b[16:20])
+		if nskips := binary.BigEndian.Uint32(b[20:24]); nskips > 0 {
+			if nskips > 1<<16 {
+				return nil, errInvalidOWAMPMessage
+			}
+			if _, err := io.ReadFull(r, make([]byte, 8*nskips)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if _, err := io.ReadFull(r, make([]byte, owampHMACLen)); err != nil {
+		return nil, err
+	}
+	return nexts, nil
+}
+
+// An OWAMPServer represents an OWAMP server that implements the roles
+// of Server, Session-Sender and Session-Receiver in unauthenticated
+// mode.
+// See RFC 4656.
+type OWAMPServer struct {
+	ln net.Listener
+	ee STAMPErrorEstimate
+}
+
+// NewOWAMPServer makes a listener for OWAMP-Control connections.
+// The network must be "tcp", "tcp4" or "tcp6".
+// The address usually specifies OWAMPPort.
+func NewOWAMPServer(network, address string) (*OWAMPServer, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &OWAMPServer{ln: ln, ee: NewSTAMPErrorEstimate(false, false, time.Millisecond)}, nil
+}
+
+// SetErrorEstimate sets the error estimate of timestamps on the test
+// packets and arrival records.
+func (s *OWAMPServer) SetErrorEstimate(ee STAMPErrorEstimate) {
+	s.ee = ee
+}
+
+// Addr returns the local network address of s.
+func (s *OWAMPServer) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Close closes the listener of s.
+func (s *OWAMPServer) Close() error {
+	return s.ln.Close()
+}
+
+// Serve accepts OWAMP-Control connections and runs the requested
+// test sessions until s is closed.
+// The fn is called for each test session when it is stopped by the
+// client if it is not nil.
+// The arrival records are passed to fn when the server is the
+// receiver.
+func (s *OWAMPServer) Serve(fn func(peer net.Addr, sess *OWAMPSession, recs []OWAMPRecord)) error {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(c, fn)
+	}
+}
+
+func (s *OWAMPServer) serveConn(c net.Conn, fn func(net.Addr, *OWAMPSession, []OWAMPRecord)) {
+	var tss []*owampTestSession
+	defer func() {
+		for _, ts := range tss {
+			ts.close()
+		}
+		c.Close()
+	}()
+	b := make([]byte, owampGreetingLen)
+	binary.BigEndian.PutUint32(b[12:16], OWAMPModeUnauthenticated)
+	for i := 16; i < 48; i += 4 {
+		binary.BigEndian.PutUint32(b[i:i+4], rand.Uint32()) // challenge and salt
+	}
+	binary.BigEndian.PutUint32(b[48:52], 1024)
+	if _, err := c.Write(b); err != nil {
+		return
+	}
+	b = make([]byte, owampSetupResponseLen)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return
+	}
+	accept := OWAMPAcceptOK
+	if binary.BigEndian.Uint32(b[:4]) != OWAMPModeUnauthenticated {
+		accept = OWAMPAcceptNotSupported
+	}
+	b = make([]byte, owampServerStartLen)
+	b[15] = byte(accept)
+	putNTPTime(b[32:40], time.Now())
+	if _, err := c.Write(b); err != nil || accept != OWAMPAcceptOK {
+		return
+	}
+
+	local, peer := c.LocalAddr().(*net.TCPAddr), c.RemoteAddr().(*net.TCPAddr)
+	for {
+		h := make([]byte, 16)
+		if _, err := io.ReadFull(c, h); err != nil {
+			return
+		}
+		switch h[0] {
+		case owampCmdRequestSession:
+			sess, err := readOWAMPRequestSession(c, h)
+			if err != nil && err != errOWAMPSessionTooLarge {
+				return
+			}
+			var ts *owampTestSession
+			accept := OWAMPAcceptPermResourceLimitation
+			if err == nil {
+				ts, accept = s.acceptSession(sess, local, peer)
+			}
+			b := make([]byte, owampAcceptSessionLen)
+			b[0] = byte(accept)
+			if ts != nil {
+				tss = append(tss, ts)
+				if !sess.FromServer {
+					binary.BigEndian.PutUint16(b[2:4], uint16(sess.Receiver.Port))
+				}
+				copy(b[4:20], sess.SID[:])
+			}
+			if _, err := c.Write(b); err != nil {
+				return
+			}
+		case owampCmdStartSessions:
+			if _, err := io.ReadFull(c, make([]byte, owampStartSessionsLen-16)); err != nil {
+				return
+			}
+			for _, ts := range tss {
+				if ts.FromServer && !ts.started {
+					ts.startSender()
+				}
+			}
+			if _, err := c.Write(make([]byte, owampStartAckLen)); err != nil {
+				return
+			}
+		case owampCmdStopSessions:
+			nexts, err := readOWAMPStopSessions(c, h)
+			if err != nil {
+				return
+			}
+			var senders []*owampTestSession
+			for _, ts := range tss {
+				if ts.FromServer {
+					ts.waitSender()
+					senders = append(senders, ts)
+				} else if next, ok := nexts[ts.SID]; ok {
+					ts.setNextSeq(next)
+				}
+			}
+			if _, err := c.Write(marshalOWAMPStopSessions(senders)); err != nil {
+				return
+			}
+			if fn != nil {
+				for _, ts := range tss {
+					var recs []OWAMPRecord
+					if !ts.FromServer {
+						recs = ts.records(0, math.MaxUint32)
+					}
+					fn(peer, ts.OWAMPSession, recs)
+				}
+			}
+		case owampCmdFetchSession:
+			b := make([]byte, owampFetchSessionLen)
+			copy(b, h)
+			if _, err := io.ReadFull(c, b[16:]); err != nil {
+				return
+			}
+			if err := s.fetchSession(c, tss, b); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// acceptSession prepares the local endpoint of requested session.
+// Test packets are transmitted only to the client to prevent the
+// server from being used as a traffic generator.
+func (s *OWAMPServer) acceptSession(sess *OWAMPSession, local, peer *net.TCPAddr) (*owampTestSession, OWAMPAccept) {
+	if sess.Count <= 0 || sess.Padding < 0 || sess.Padding > 1<<16-twampSenderLen-64 {
+		return nil, OWAMPAcceptNotSupported
+	}
+	if sess.Count > maxOWAMPCount {
+		return nil, OWAMPAcceptPermResourceLimitation
+	}
+	tc, err := listenTestConn("udp", net.JoinHostPort(local.IP.String(), "0"))
+	if err != nil {
+		return nil, OWAMPAcceptTempResourceLimitation
+	}
+	laddr := tc.Addr().(*net.UDPAddr)
+	if sess.FromServer {
+		sess.Sender = laddr
+		sess.Receiver.IP = peer.IP
+	} else {
+		sess.Sender.IP = peer.IP
+		sess.Receiver = laddr
+		sess.SID = newOWAMPSID(laddr.IP)
+	}
+	ts := newOWAMPTestSession(sess, tc, s.ee)
+	if !sess.FromServer {
+		go ts.receive()
+	}
+	return ts, OWAMPAcceptOK
+}
+
+func (s *OWAMPServer) fetchSession(w io.Writer, tss []*owampTestSession, b []byte) error {
+	var sid OWAMPSID
+	copy(sid[:], b[16:32])
+	begin, end := binary.BigEndian.Uint32(b[8:12]), binary.BigEndian.Uint32(b[12:16])
+	var ts *owampTestSession
+	for _, x := range tss {
+		if x.SID == sid && !x.FromServer {
+			ts = x
+		}
+	}
+	ack := make([]byte, owampFetchAckLen)
+	if ts == nil {
+		ack[0] = byte(OWAMPAcceptFailure)
+		_, err := w.Write(ack)
+		return err
+	}
+	recs := ts.records(begin, end)
+	ack[1] = 1 // finished
+	binary.BigEndian.PutUint32(ack[4:8], ts.nextSeq())
+	binary.BigEndian.PutUint32(ack[12:16], uint32(len(recs)))
+	n := owampRecordLen * len(recs)
+	n = (n + 15) &^ 15
+	b = make([]byte, owampFetchAckLen+owampHMACLen+n+owampHMACLen)
+	copy(b, ack)
+	rb := b[owampFetchAckLen+owampHMACLen:]
+	for i := range recs {
+		recs[i].marshal(rb[owampRecordLen*i:])
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// An OWAMPClient represents an OWAMP control-client that also
+// implements the roles of Session-Sender and Session-Receiver in
+// unauthenticated mode.
+type OWAMPClient struct {
+	c   net.Conn
+	ee  STAMPErrorEstimate
+	tss []*owampTestSession
+}
+
+// DialOWAMP connects to the OWAMP server at address and establishes
+// an OWAMP-Control connection.
+// The network must be "tcp", "tcp4" or "tcp6".
+func DialOWAMP(network, address string) (*OWAMPClient, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	c, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, owampGreetingLen)
+	if _, err := io.ReadFull(c, b); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(b[12:16])&OWAMPModeUnauthenticated == 0 {
+		c.Close()
+		return nil, errOWAMPModeUnsupported
+	}
+	b = make([]byte, owampSetupResponseLen)
+	binary.BigEndian.PutUint32(b[:4], OWAMPModeUnauthenticated)
+	if _, err := c.Write(b); err != nil {
+		c.Close()
+		return nil, err
+	}
+	b = make([]byte, owampServerStartLen)
+	if _, err := io.ReadFull(c, b); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if accept := OWAMPAccept(b[15]); accept != OWAMPAcceptOK {
+		c.Close()
+		return nil, fmt.Errorf("OWAMP-Control connection not accepted: %v", accept)
+	}
+	return &OWAMPClient{c: c, ee: NewSTAMPErrorEstimate(false, false, time.Millisecond)}, nil
+}
+
+// SetErrorEstimate sets the error estimate of timestamps on the test
+// packets and arrival records.
+func (c *OWAMPClient) SetErrorEstimate(ee STAMPErrorEstimate) {
+	c.ee = ee
+}
+
+// Close closes the OWAMP-Control connection and the local endpoints
+// of test sessions.
+func (c *OWAMPClient) Close() error {
+	for _, ts := range c.tss {
+		ts.close()
+	}
+	return c.c.Close()
+}
+
+// RequestSession requests the server a test session described by
+// sess.
+// On success, it sets the session identifier and addresses of sess.
+// The session must consist of up to 1<<20 test packets and 1024
+// schedule slots.
+func (c *OWAMPClient) RequestSession(sess *OWAMPSession) error {
+	if sess.Count <= 0 || len(sess.Schedule) == 0 || sess.Padding < 0 {
+		return errInvalidOWAMPMessage
+	}
+	if sess.Count > maxOWAMPCount || len(sess.Schedule) > maxOWAMPSlots {
+		return errOWAMPSessionTooLarge
+	}
+	local, peer := c.c.LocalAddr().(*net.TCPAddr), c.c.RemoteAddr().(*net.TCPAddr)
+	tc, err := listenTestConn("udp", net.JoinHostPort(local.IP.String(), "0"))
+	if err != nil {
+		return err
+	}
+	laddr := tc.Addr().(*net.UDPAddr)
+	if sess.FromServer {
+		sess.Sender = &net.UDPAddr{IP: peer.IP}
+		sess.Receiver = laddr
+		sess.SID = newOWAMPSID(laddr.IP)
+	} else {
+		sess.Sender = laddr
+		sess.Receiver = &net.UDPAddr{IP: peer.IP}
+	}
+	if _, err := c.c.Write(marshalOWAMPRequestSession(sess)); err != nil {
+		tc.Close()
+		return err
+	}
+	b := make([]byte, owampAcceptSessionLen)
+	if _, err := io.ReadFull(c.c, b); err != nil {
+		tc.Close()
+		return err
+	}
+	if accept := OWAMPAccept(b[0]); accept != OWAMPAcceptOK {
+		tc.Close()
+		return fmt.Errorf("OWAMP session not accepted: %v", accept)
+	}
+	if !sess.FromServer {
+		sess.Receiver.Port = int(binary.BigEndian.Uint16(b[2:4]))
+		copy(sess.SID[:], b[4:20])
+	}
+	ts := newOWAMPTestSession(sess, tc, c.ee)
+	if sess.FromServer {
+		go ts.receive()
+	}
+	c.tss = append(c.tss, ts)
+	return nil
+}
+
+// StartSessions starts all the requested test sessions.
+func (c *OWAMPClient) StartSessions() error {
+	b := make([]byte, owampStartSessionsLen)
+	b[0] = owampCmdStartSessions
+	if _, err := c.c.Write(b); err != nil {
+		return err
+	}
+	b = make([]byte, owampStartAckLen)
+	if _, err := io.ReadFull(c.c, b); err != nil {
+		return err
+	}
+	if accept := OWAMPAccept(b[0]); accept != OWAMPAcceptOK {
+		return fmt.Errorf("OWAMP sessions not started: %v", accept)
+	}
+	for _, ts := range c.tss {
+		if !ts.FromServer && !ts.started {
+			ts.startSender()
+		}
+	}
+	return nil
+}
+
+// StopSessions waits for the started test sessions transmitted by c
+// to complete, and stops all the test sessions.
+func (c *OWAMPClient) StopSessions() error {
+	var senders []*owampTestSession
+	for _, ts := range c.tss {
+		if !ts.FromServer {
+			ts.waitSender()
+			senders = append(senders, ts)
+		}
+	}
+	if _, err := c.c.Write(marshalOWAMPStopSessions(senders)); err != nil {
+		return err
+	}
+	h := make([]byte, owampStopSessionsLen)
+	if _, err := io.ReadFull(c.c, h); err != nil {
+		return err
+	}
+	if h[0] != owampCmdStopSessions {
+		return errInvalidOWAMPMessage
+	}
+	nexts, err := readOWAMPStopSessions(c.c, h)
+	if err != nil {
+		return err
+	}
+	for _, ts := range c.tss {
+		if next, ok := nexts[ts.SID]; ok && ts.FromServer {
+			ts.setNextSeq(next)
+		}
+	}
+	return nil
+}
+
+// Records returns the arrival records of the stopped test session
+// sess.
+// It fetches the records from the server when the server is the
+// receiver.
+func (c *OWAMPClient) Records(sess *OWAMPSession) ([]OWAMPRecord, error) {
+	var ts *owampTestSession
+	for _, x := range c.tss {
+		if x.OWAMPSession == sess {
+			ts = x
+		}
+	}
+	if ts == nil {
+		return nil, errUnknownOWAMPSession
+	}
+	if sess.FromServer {
+		return ts.records(0, math.MaxUint32), nil
+	}
+	b := make([]byte, owampFetchSessionLen)
+	b[0] = owampCmdFetchSession
+	binary.BigEndian.PutUint32(b[12:16], math.MaxUint32)
+	copy(b[16:32], sess.SID[:])
+	if _, err := c.c.Write(b); err != nil {
+		return nil, err
+	}
+	b = make([]byte, owampFetchAckLen)
+	if _, err := io.ReadFull(c.c, b); err != nil {
+		return nil, err
+	}
+	if accept := OWAMPAccept(b[0]); accept != OWAMPAcceptOK {
+		return nil, fmt.Errorf("OWAMP session not fetched: %v", accept)
+	}
+	nskips, nrecs := binary.BigEndian.Uint32(b[8:12]), binary.BigEndian.Uint32(b[12:16])
+	if nskips > 1<<16 || nrecs > 1<<24 {
+		return nil, errInvalidOWAMPMessage
+	}
+	n := (8*int(nskips)+15)&^15 + owampHMACLen + (owampRecordLen*int(nrecs)+15)&^15 + owampHMACLen
+	b = make([]byte, n)
+	if _, err := io.ReadFull(c.c, b); err != nil {
+		return nil, err
+	}
+	b = b[(8*int(nskips)+15)&^15+owampHMACLen:]
+	recs := make([]OWAMPRecord, nrecs)
+	for i := range recs {
+		recs[i] = parseOWAMPRecord(b[owampRecordLen*i:])
+	}
+	return recs, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mikioh/ipoam"
+)
+
+func TestOWAMPSessionDepartures(t *testing.T) {
+	s := ipoam.OWAMPSession{Count: 100, Schedule: []ipoam.OWAMPSlot{{Exponential: true, Interval: 10 * time.Millisecond}}}
+	s.SID[15] = 1
+	ds := s.Departures()
+	if len(ds) != s.Count || ds[0] != 0 {
+		t.Fatalf("got %v", ds)
+	}
+	for i := 1; i < len(ds); i++ {
+		if ds[i] < ds[i-1] {
+			t.Fatalf("#%d: got %v after %v", i, ds[i], ds[i-1])
+		}
+	}
+	if !reflect.DeepEqual(ds, s.Departures()) {
+		t.Error("got different schedules for same session")
+	}
+
+	s.Schedule = []ipoam.OWAMPSlot{{Interval: time.Millisecond}, {Interval: 2 * time.Millisecond}}
+	if ds := s.Departures(); ds[4] != 6*time.Millisecond {
+		t.Errorf("got %v; want 6ms", ds[4])
+	}
+}
+
+func TestOWAMPServer(t *testing.T) {
+	srv, err := ipoam.NewOWAMPServer("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	stopped := make(chan *ipoam.OWAMPSession, 2)
+	go srv.Serve(func(_ net.Addr, sess *ipoam.OWAMPSession, _ []ipoam.OWAMPRecord) {
+		stopped <- sess
+	})
+
+	c, err := ipoam.DialOWAMP("tcp4", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var sesss []*ipoam.OWAMPSession
+	for _, fromServer := range []bool{false, true} {
+		sess := ipoam.OWAMPSession{
+			FromServer: fromServer,
+			Count:      5,
+			Padding:    16,
+			Timeout:    200 * time.Millisecond,
+			Schedule:   []ipoam.OWAMPSlot{{Exponential: true, Interval: 5 * time.Millisecond}},
+		}
+		if err := c.RequestSession(&sess); err != nil {
+			t.Fatal(err)
+		}
+		sesss = append(sesss, &sess)
+	}
+	if err := c.StartSessions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StopSessions(); err != nil {
+		t.Fatal(err)
+	}
+	for _, sess := range sesss {
+		recs, err := c.Records(sess)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recs) != sess.Count {
+			t.Fatalf("from server %v: got %d records; want %d", sess.FromServer, len(recs), sess.Count)
+		}
+		for i, r := range recs {
+			if r.Seq != uint32(i) || r.Lost() || r.TTL != 255 || r.Delay() < 0 {
+				t.Errorf("from server %v: #%d: got %+v", sess.FromServer, i, r)
+			}
+		}
+	}
+	for range sesss {
+		select {
+		case <-stopped:
+		case <-time.After(3 * time.Second):
+			t.Fatal("session not stopped on server")
+		}
+	}
+}
+
+func TestOWAMPClientStopWithoutStart(t *testing.T) {
+	srv, err := ipoam.NewOWAMPServer("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	go srv.Serve(nil)
+
+	c, err := ipoam.DialOWAMP("tcp4", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sess := ipoam.OWAMPSession{Count: 1<<20 + 1, Schedule: []ipoam.OWAMPSlot{{Interval: time.Millisecond}}}
+	if err := c.RequestSession(&sess); err == nil {
+		t.Fatal("got nil; want error")
+	}
+	for _, fromServer := range []bool{false, true} {
+		sess := ipoam.OWAMPSession{FromServer: fromServer, Count: 5, Schedule: []ipoam.OWAMPSlot{{Interval: time.Millisecond}}}
+		if err := c.RequestSession(&sess); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- c.StopSessions() }()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("sessions not stopped")
+	}
+}
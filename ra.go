@@ -0,0 +1,252 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	ndOptPrefixInfo = 3
+	ndOptMTU        = 5
+	ndOptRouteInfo  = 24 // RFC 4191
+	ndOptRDNSS      = 25 // RFC 8106
+	ndOptDNSSL      = 31 // RFC 8106
+
+	ndRouterAdvertLen = 16 // length of router advertisement without options
+)
+
+// RAInfiniteLifetime is the lifetime that represents infinity in
+// router advertisements.
+const RAInfiniteLifetime = 0xffffffff * time.Second
+
+var errInvalidRouterAdvert = errors.New("invalid router advertisement")
+
+// A RouterPreference represents a default router preference or a
+// route preference.
+// See RFC 4191.
+type RouterPreference int
+
+const (
+	RouterPreferenceMedium RouterPreference = 0
+	RouterPreferenceHigh   RouterPreference = 1
+	RouterPreferenceLow    RouterPreference = 3
+)
+
+var routerPreferences = map[RouterPreference]string{
+	RouterPreferenceMedium: "medium",
+	RouterPreferenceHigh:   "high",
+	RouterPreferenceLow:    "low",
+}
+
+func (pref RouterPreference) String() string {
+	s, ok := routerPreferences[pref]
+	if !ok {
+		return "<nil>"
+	}
+	return s
+}
+
+// parseRouterPreference returns the preference in the 2-bit field
+// v. The reserved value is treated as medium.
+func parseRouterPreference(v byte) RouterPreference {
+	pref := RouterPreference(v & 0x03)
+	if pref == 2 {
+		return RouterPreferenceMedium
+	}
+	return pref
+}
+
+// A RouterAdvert represents an IPv6 router advertisement.
+// See RFC 4861.
+type RouterAdvert struct {
+	HopLimit      int              // current hop limit, zero if unspecified
+	Managed       bool             // managed address configuration
+	Other         bool             // other configuration
+	Preference    RouterPreference // default router preference
+	Lifetime      time.Duration    // router lifetime, zero if not a default router
+	ReachableTime time.Duration    // zero if unspecified
+	RetransTimer  time.Duration    // zero if unspecified
+	LinkAddr      net.HardwareAddr // source link-layer address, nil if not present
+	MTU           int              // link MTU, zero if not present
+	Prefixes      []RAPrefix
+	Routes        []RARoute
+	RDNSS         []RARDNSS
+	DNSSL         []RADNSSL
+}
+
+// A RAPrefix represents a prefix information option.
+type RAPrefix struct {
+	Prefix            *net.IPNet
+	OnLink            bool // on-link flag
+	Autonomous        bool // autonomous address-configuration flag
+	ValidLifetime     time.Duration
+	PreferredLifetime time.Duration
+}
+
+// A RARoute represents a route information option.
+// See RFC 4191.
+type RARoute struct {
+	Prefix     *net.IPNet
+	Preference RouterPreference
+	Lifetime   time.Duration
+}
+
+// A RARDNSS represents a recursive DNS server option.
+// See RFC 8106.
+type RARDNSS struct {
+	Lifetime time.Duration
+	Servers  []net.IP
+}
+
+// A RADNSSL represents a DNS search list option.
+// See RFC 8106.
+type RADNSSL struct {
+	Lifetime time.Duration
+	Domains  []string
+}
+
+// marshalRouterSolicit returns the binary encoding of router
+// solicitation, with the source link-layer address option when
+// lladdr is not nil.
+// The checksum is left to the kernel.
+func marshalRouterSolicit(lladdr net.HardwareAddr) ([]byte, error) {
+	b := make([]byte, 4)
+	if len(lladdr) > 0 {
+		n := (2 + len(lladdr) + 7) &^ 7
+		opt := make([]byte, n)
+		opt[0], opt[1] = ndOptSourceLinkAddr, byte(n/8)
+		copy(opt[2:], lladdr)
+		b = append(b, opt...)
+	}
+	m := icmp.Message{Type: ipv6.ICMPTypeRouterSolicitation, Body: &icmp.RawBody{Data: b}}
+	return m.Marshal(nil)
+}
+
+// parseRouterAdvert parses the ICMPv6 message b as a router
+// advertisement.
+// Unknown options are ignored.
+func parseRouterAdvert(b []byte) (*RouterAdvert, error) {
+	if len(b) < ndRouterAdvertLen || b[0] != byte(ipv6.ICMPTypeRouterAdvertisement) || b[1] != 0 {
+		return nil, errInvalidRouterAdvert
+	}
+	ra := RouterAdvert{
+		HopLimit:      int(b[4]),
+		Managed:       b[5]&0x80 != 0,
+		Other:         b[5]&0x40 != 0,
+		Preference:    parseRouterPreference(b[5] >> 3),
+		Lifetime:      time.Duration(binary.BigEndian.Uint16(b[6:8])) * time.Second,
+		ReachableTime: time.Duration(binary.BigEndian.Uint32(b[8:12])) * time.Millisecond,
+		RetransTimer:  time.Duration(binary.BigEndian.Uint32(b[12:16])) * time.Millisecond,
+	}
+	lifetime := func(b []byte) time.Duration {
+		return time.Duration(binary.BigEndian.Uint32(b)) * time.Second
+	}
+	for opts := b[ndRouterAdvertLen:]; len(opts) > 0; {
+		if len(opts) < 2 || opts[1] == 0 || len(opts) < int(opts[1])*8 {
+			return nil, errInvalidRouterAdvert
+		}
+		l := int(opts[1]) * 8
+		opt := opts[:l]
+		switch opt[0] {
+		case ndOptSourceLinkAddr:
+			ra.LinkAddr = net.HardwareAddr(append([]byte(nil), opt[2:]...))
+			if l == 8 {
+				ra.LinkAddr = ra.LinkAddr[:6]
+			}
+		case ndOptPrefixInfo:
+			if l != 32 || opt[2] > 128 {
+				return nil, errInvalidRouterAdvert
+			}
+			ra.Prefixes = append(ra.Prefixes, RAPrefix{
+				Prefix:            raPrefix(opt[16:32], int(opt[2])),
+				OnLink:            opt[3]&0x80 != 0,
+				Autonomous:        opt[3]&0x40 != 0,
+				ValidLifetime:     lifetime(opt[4:8]),
+				PreferredLifetime: lifetime(opt[8:12]),
+			})
+		case ndOptMTU:
+			if l != 8 {
+				return nil, errInvalidRouterAdvert
+			}
+			ra.MTU = int(binary.BigEndian.Uint32(opt[4:8]))
+		case ndOptRouteInfo:
+			if l > 24 || opt[2] > 128 || int(opt[2]) > (l-8)*8 {
+				return nil, errInvalidRouterAdvert
+			}
+			// A route with the reserved preference must be
+			// ignored; see RFC 4191 section 2.3.
+			if opt[3]>>3&0x03 == 2 {
+				break
+			}
+			ra.Routes = append(ra.Routes, RARoute{
+				Prefix:     raPrefix(opt[8:], int(opt[2])),
+				Preference: parseRouterPreference(opt[3] >> 3),
+				Lifetime:   lifetime(opt[4:8]),
+			})
+		case ndOptRDNSS:
+			if l < 24 {
+				return nil, errInvalidRouterAdvert
+			}
+			rdnss := RARDNSS{Lifetime: lifetime(opt[4:8])}
+			for a := opt[8:]; len(a) >= net.IPv6len; a = a[net.IPv6len:] {
+				rdnss.Servers = append(rdnss.Servers, net.IP(append([]byte(nil), a[:net.IPv6len]...)))
+			}
+			ra.RDNSS = append(ra.RDNSS, rdnss)
+		case ndOptDNSSL:
+			if l < 16 {
+				return nil, errInvalidRouterAdvert
+			}
+			dnssl := RADNSSL{Lifetime: lifetime(opt[4:8])}
+			var err error
+			if dnssl.Domains, err = parseDomainNames(opt[8:]); err != nil {
+				return nil, err
+			}
+			ra.DNSSL = append(ra.DNSSL, dnssl)
+		}
+		opts = opts[l:]
+	}
+	return &ra, nil
+}
+
+func raPrefix(b []byte, bits int) *net.IPNet {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, b)
+	mask := net.CIDRMask(bits, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// parseDomainNames parses the sequence of domain names in the DNS
+// wire format without compression, which is padded with zeros.
+func parseDomainNames(b []byte) ([]string, error) {
+	var names []string
+	for len(b) > 0 && b[0] != 0 {
+		var labels []string
+		for {
+			if len(b) == 0 || int(b[0]) >= len(b) {
+				return nil, errInvalidRouterAdvert
+			}
+			n := int(b[0])
+			if n == 0 {
+				b = b[1:]
+				break
+			}
+			if n > 63 {
+				return nil, errInvalidRouterAdvert
+			}
+			labels = append(labels, string(b[1:1+n]))
+			b = b[1+n:]
+		}
+		names = append(names, strings.Join(labels, "."))
+	}
+	return names, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv6"
+)
+
+func TestParseRouterAdvert(t *testing.T) {
+	lladdr := net.HardwareAddr{0x02, 0x00, 0x5e, 0x10, 0x00, 0x01}
+	b := []byte{
+		ianaICMPv6RouterAdvert, 0x00, 0x00, 0x00, 64, 0xc8, 0x07, 0x08, 0x00, 0x00, 0x75, 0x30, 0x00, 0x00, 0x03, 0xe8,
+		ndOptSourceLinkAddr, 1, 0x02, 0x00, 0x5e, 0x10, 0x00, 0x01,
+		ndOptMTU, 1, 0, 0, 0x00, 0x00, 0x05, 0xdc,
+		ndOptPrefixInfo, 4, 64, 0xc0, 0x00, 0x01, 0x51, 0x80, 0x00, 0x00, 0x38, 0x40, 0, 0, 0, 0,
+		0x20, 0x01, 0x0d, 0xb8, 0x00, 0x01, 0x00, 0x00, 0xff, 0, 0, 0, 0, 0, 0, 0,
+		ndOptRouteInfo, 2, 48, 0x18, 0xff, 0xff, 0xff, 0xff, 0x20, 0x01, 0x0d, 0xb8, 0x00, 0x02, 0, 0,
+		ndOptRouteInfo, 2, 48, 0x10, 0xff, 0xff, 0xff, 0xff, 0x20, 0x01, 0x0d, 0xb8, 0x00, 0x03, 0, 0,
+		ndOptRDNSS, 3, 0, 0, 0x00, 0x00, 0x0e, 0x10, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x35,
+		ndOptDNSSL, 3, 0, 0, 0x00, 0x00, 0x0e, 0x10, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'o', 'r', 'g', 0, 0, 0, 0,
+		99, 1, 0, 0, 0, 0, 0, 0,
+	}
+	ra, err := parseRouterAdvert(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, prefix, _ := net.ParseCIDR("2001:db8:1::/64")
+	_, route, _ := net.ParseCIDR("2001:db8:2::/48")
+	want := &RouterAdvert{
+		HopLimit:      64,
+		Managed:       true,
+		Other:         true,
+		Preference:    RouterPreferenceHigh,
+		Lifetime:      1800 * time.Second,
+		ReachableTime: 30 * time.Second,
+		RetransTimer:  time.Second,
+		LinkAddr:      lladdr,
+		MTU:           1500,
+		Prefixes:      []RAPrefix{{Prefix: prefix, OnLink: true, Autonomous: true, ValidLifetime: 86400 * time.Second, PreferredLifetime: 14400 * time.Second}},
+		Routes:        []RARoute{{Prefix: route, Preference: RouterPreferenceLow, Lifetime: RAInfiniteLifetime}},
+		RDNSS:         []RARDNSS{{Lifetime: time.Hour, Servers: []net.IP{net.ParseIP("2001:db8::35")}}},
+		DNSSL:         []RADNSSL{{Lifetime: time.Hour, Domains: []string{"example.org"}}},
+	}
+	if !reflect.DeepEqual(ra, want) {
+		t.Errorf("got %+v; want %+v", ra, want)
+	}
+
+	for _, b := range [][]byte{
+		b[:ndRouterAdvertLen-1],
+		b[:ndRouterAdvertLen+2],
+		append(b[:ndRouterAdvertLen:ndRouterAdvertLen], ndOptMTU, 0, 0, 0, 0, 0, 0, 0),
+		append(b[:ndRouterAdvertLen:ndRouterAdvertLen], ndOptRouteInfo, 1, 64, 0, 0, 0, 0, 0),
+		append(b[:ndRouterAdvertLen:ndRouterAdvertLen], ndOptDNSSL, 2, 0, 0, 0, 0, 0, 0, 9, 'e', 'x', 'a', 'm', 'p', 'l', 'e'),
+	} {
+		if _, err := parseRouterAdvert(b); err == nil {
+			t.Errorf("%x: got nil; want error", b)
+		}
+	}
+
+	m, err := marshalRouterSolicit(lladdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 16 || m[0] != 133 || m[8] != ndOptSourceLinkAddr || m[9] != 1 || !reflect.DeepEqual(net.HardwareAddr(m[10:16]), lladdr) {
+		t.Errorf("got %x", m)
+	}
+}
+
+func TestRouterAdvertReport(t *testing.T) {
+	b := []byte{ianaICMPv6RouterAdvert, 0, 0, 0, 64, 0, 0x07, 0x08, 0, 0, 0, 0, 0, 0, 0, 0}
+	c := &conn{protocol: ianaProtocolIPv6ICMP, rawSocket: true}
+	for _, tt := range []struct {
+		src  net.IP
+		hops int
+		ok   bool
+	}{
+		{net.ParseIP("fe80::1"), 255, true},
+		{net.ParseIP("fe80::1"), 254, false},
+		{net.ParseIP("2001:db8::1"), 255, false},
+	} {
+		r, ck, wildcard := parseReport(c, b, nil, &ipv6.ControlMessage{HopLimit: tt.hops}, &net.IPAddr{IP: tt.src})
+		if r.Error != nil || wildcard {
+			t.Fatalf("%v, %d: got %v, %v", tt.src, tt.hops, r.Error, wildcard)
+		}
+		if (ck == routerCookie) != tt.ok {
+			t.Errorf("%v, %d: got %#x", tt.src, tt.hops, ck)
+		}
+	}
+}
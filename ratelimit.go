@@ -0,0 +1,94 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"math"
+	"time"
+)
+
+// A RateSample represents the result of a probe burst transmitted by
+// ProbeBurst.
+type RateSample struct {
+	Rate     float64 // transmission rate in packets per second
+	Sent     int     // number of probe packets transmitted
+	Received int     // number of ICMP messages received
+}
+
+// A RateLimit represents an estimated token bucket that a node uses to
+// limit the rate of ICMP message generation.
+type RateLimit struct {
+	Rate  float64 // token rate in messages per second
+	Burst int     // bucket depth in messages
+}
+
+// Interval returns the minimum interval between probe packets that
+// the node answers without exhausting the bucket.
+func (rl *RateLimit) Interval() time.Duration {
+	if rl.Rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / rl.Rate)
+}
+
+// EstimateRateLimit estimates the ICMP rate limit of a node from the
+// results of probe bursts at different rates.
+// It assumes that a burst of n probe packets transmitted over d
+// seconds is answered by min(n, Burst + Rate*d) messages.
+// It returns nil when no burst shows loss, or no burst is answered.
+func EstimateRateLimit(samples []RateSample) *RateLimit {
+	var lossless float64
+	var ds, rs []float64
+	for _, s := range samples {
+		if s.Sent < 2 || s.Rate <= 0 {
+			continue
+		}
+		if s.Received >= s.Sent {
+			lossless = math.Max(lossless, s.Rate)
+			continue
+		}
+		if s.Received > 0 {
+			ds = append(ds, float64(s.Sent-1)/s.Rate)
+			rs = append(rs, float64(s.Received))
+		}
+	}
+	if len(ds) == 0 {
+		return nil
+	}
+
+	var rate, burst float64
+	if len(ds) > 1 { // least squares fit of received = burst + rate*d
+		var md, mr float64
+		for i := range ds {
+			md += ds[i]
+			mr += rs[i]
+		}
+		md /= float64(len(ds))
+		mr /= float64(len(ds))
+		var cov, vd float64
+		for i := range ds {
+			cov += (ds[i] - md) * (rs[i] - mr)
+			vd += (ds[i] - md) * (ds[i] - md)
+		}
+		if vd > 0 {
+			rate = cov / vd
+			burst = mr - rate*md
+		}
+	}
+	if rate <= 0 || burst < 0 {
+		i := len(ds) - 1 // the burst at the lowest lossy rate
+		for j := range ds {
+			if ds[j] > ds[i] {
+				i = j
+			}
+		}
+		rate = lossless
+		if rate <= 0 || rate*ds[i] > rs[i] {
+			rate = rs[i] / ds[i]
+		}
+		burst = rs[i] - rate*ds[i]
+	}
+	return &RateLimit{Rate: rate, Burst: int(math.Max(1, math.Floor(burst+0.5)))}
+}
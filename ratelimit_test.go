@@ -0,0 +1,50 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/mikioh/ipoam"
+)
+
+func TestEstimateRateLimit(t *testing.T) {
+	const n = 20
+	bucket := func(rate float64, burst int, rates ...float64) []ipoam.RateSample {
+		var samples []ipoam.RateSample
+		for _, r := range rates {
+			rcvd := int(math.Min(n, float64(burst)+rate*float64(n-1)/r))
+			samples = append(samples, ipoam.RateSample{Rate: r, Sent: n, Received: rcvd})
+		}
+		return samples
+	}
+
+	if rl := ipoam.EstimateRateLimit(bucket(1000, 100, 10, 20, 50)); rl != nil {
+		t.Errorf("got %+v; want nil", rl)
+	}
+	for _, tt := range []struct {
+		rate  float64
+		burst int
+		rates []float64
+	}{
+		{10, 5, []float64{5, 20, 50, 100, 200}},
+		{100, 10, []float64{50, 200, 500, 1000}},
+		{2, 6, []float64{5, 10, 20}},
+	} {
+		rl := ipoam.EstimateRateLimit(bucket(tt.rate, tt.burst, tt.rates...))
+		if rl == nil {
+			t.Errorf("got nil for %v/s, %d", tt.rate, tt.burst)
+			continue
+		}
+		if math.Abs(rl.Rate-tt.rate) > tt.rate*0.3 || rl.Burst < tt.burst-2 || rl.Burst > tt.burst+2 {
+			t.Errorf("got %+v; want %v/s, %d", rl, tt.rate, tt.burst)
+		}
+		if rl.Interval() <= 0 || rl.Interval() > 2*time.Duration(float64(time.Second)/tt.rate) {
+			t.Errorf("got %v for %+v", rl.Interval(), rl)
+		}
+	}
+}
@@ -17,14 +17,32 @@ import (
 
 // A Report represents a test report for IP-layer OAM.
 type Report struct {
-	Error error         // on-link operation error
-	Time  time.Time     // time packet received
-	Src   net.IP        // source address on received packet
-	ICMP  *icmp.Message // received ICMP message
+	Error   error         // on-link operation error
+	Time    time.Time     // time packet received
+	Src     net.IP        // source address on received packet
+	SrcIPv4 net.IP        // IPv4 address embedded in Src with a NAT64 prefix, nil if not embedded
+	Group   net.IP        // multicast or broadcast destination of probe packet, nil for unicast
+	ICMP    *icmp.Message // received ICMP message
 
 	// Original datagram fields when ICMP is an error message.
-	OrigHeader  interface{} // IP header, either ipv4.Header or ipv6.Header
-	OrigPayload []byte      // IP payload
+	OrigHeader   interface{}           // IP header, either ipv4.Header or ipv6.Header
+	OrigPayload  []byte                // IP payload
+	OrigSRH      *SegmentRoutingHeader // IPv6 segment routing header, nil if not present
+	OrigFragment *IPFragment           // fragmentation fields, nil if not a fragment
+
+	// NeighborAdvert is set only when ICMP is an IPv6 neighbor
+	// advertisement.
+	NeighborAdvert *NeighborAdvert
+
+	// RouterAdvert is set only when ICMP is an IPv6 router
+	// advertisement.
+	RouterAdvert *RouterAdvert
+
+	// HeaderChanges holds the header fields of probe packet that
+	// are modified along the path.
+	// It is set only when ICMP is an error message that relates
+	// to an outstanding probe.
+	HeaderChanges []HeaderChange
 
 	// These fields may not be set when the tester is configured
 	// to use non-privileged datagram-oriented ICMP endpoint.
@@ -32,9 +50,57 @@ type Report struct {
 	Hops      int            // IPv4 TTL or IPv6 hop-limit on receievd packet
 	Dst       net.IP         // destinaion address on received packet
 	Interface *net.Interface // inbound interface on received packet
+
+	// IPv4 options on received packet.
+	// These fields are set only when the tester is configured
+	// to use raw IPv4 sockets and the received packet carries
+	// the options.
+	RecordRoute *RecordRoute
+	Timestamp   *Timestamp
+}
+
+// InitialTTL returns the most likely initial IPv4 TTL or IPv6 hop
+// limit of a packet received with the TTL or hop limit hops.
+// It assumes that the sender uses one of the common initial values;
+// 64, 128 or 255.
+// It returns -1 when hops is out of range.
+func InitialTTL(hops int) int {
+	for _, ttl := range []int{64, 128, 255} {
+		if hops > 0 && hops <= ttl {
+			return ttl
+		}
+	}
+	return -1
 }
 
-func parseICMPError(m *icmp.Message) (interface{}, []byte, error) {
+// ReverseHops returns the estimated number of hops on the reverse
+// path from the sender of the received packet, which is comparable
+// to the TTL or hop limit of the probe packet that reached the
+// sender.
+// It returns -1 when the Hops field is not set.
+func (r *Report) ReverseHops() int {
+	ttl := InitialTTL(r.Hops)
+	if ttl < 0 {
+		return -1
+	}
+	return ttl - r.Hops + 1
+}
+
+// Asymmetric reports whether the estimated number of hops on the
+// reverse path differs from hops, the number of hops on the forward
+// path, by more than slack.
+// It returns false when the number of hops on the reverse path is
+// unknown.
+func (r *Report) Asymmetric(hops, slack int) bool {
+	rev := r.ReverseHops()
+	if rev < 0 {
+		return false
+	}
+	d := rev - hops
+	return d > slack || d < -slack
+}
+
+func parseICMPError(m *icmp.Message) (interface{}, *SegmentRoutingHeader, []byte, error) {
 	var b []byte
 	switch body := m.Body.(type) {
 	case *icmp.DstUnreach:
@@ -48,39 +114,90 @@ func parseICMPError(m *icmp.Message) (interface{}, []byte, error) {
 	}
 
 	var iph interface{}
+	var srh *SegmentRoutingHeader
 	switch m.Type.Protocol() {
 	case ianaProtocolICMP:
 		h, err := icmp.ParseIPv4Header(b) // cannot use ipv4.ParseHeader for this purpose
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 		if len(b) < ipv4.HeaderLen+len(h.Options)+8 {
-			return nil, nil, fmt.Errorf("ICMP error message too short: %v, %d", m.Type, m.Code)
+			return nil, nil, nil, fmt.Errorf("ICMP error message too short: %v, %d", m.Type, m.Code)
 		}
 		b = b[ipv4.HeaderLen+len(h.Options):]
 		iph = h
 	case ianaProtocolIPv6ICMP:
 		h, err := ipv6.ParseHeader(b)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 		if len(b) < ipv6.HeaderLen+8 {
-			return nil, nil, fmt.Errorf("ICMP error message too short: %v, %d", m.Type, m.Code)
+			return nil, nil, nil, fmt.Errorf("ICMP error message too short: %v, %d", m.Type, m.Code)
 		}
 		b = b[ipv6.HeaderLen:]
 		iph = h
+		srh = parseOrigSRH(h.NextHeader, b)
 	}
-	return iph, b, nil
+	return iph, srh, b, nil
 }
 
-func parseOrigIP(iph interface{}) int {
+// parseOrigSRH returns the segment routing header in the original
+// IPv6 datagram, nil if not present.
+func parseOrigSRH(nh int, b []byte) *SegmentRoutingHeader {
+	for {
+		if nh == IPv6Routing {
+			srh, err := parseSRH(b)
+			if err != nil {
+				return nil
+			}
+			return srh
+		}
+		var ok bool
+		if nh, b, ok = nextExtHeader(nh, b); !ok {
+			return nil
+		}
+	}
+}
+
+// parseOrigIP returns the upper-layer protocol number and payload of
+// the original datagram.
+// It skips IPv6 extension headers, and returns IPv6Fragment
+// when the original datagram is a non-first fragment.
+func parseOrigIP(iph interface{}, b []byte) (int, []byte) {
 	switch h := iph.(type) {
 	case *ipv4.Header:
-		return h.Protocol
+		return h.Protocol, b
 	case *ipv6.Header:
-		return h.NextHeader
+		nh := h.NextHeader
+		for {
+			next, rest, ok := nextExtHeader(nh, b)
+			if !ok {
+				return nh, b
+			}
+			nh, b = next, rest
+		}
 	}
-	return -1
+	return -1, nil
+}
+
+// nextExtHeader returns the type of the header following the IPv6
+// extension header nh at the head of b, and the rest of b.
+// It returns false when nh is not an extension header, b is too
+// short, or nh is a fragment header of a non-first fragment.
+func nextExtHeader(nh int, b []byte) (int, []byte, bool) {
+	switch nh {
+	case IPv6HopByHop, IPv6Routing, IPv6DstOpts:
+		if len(b) < 2 || len(b) < (int(b[1])+1)*8 {
+			return nh, b, false
+		}
+		return int(b[0]), b[(int(b[1])+1)*8:], true
+	case IPv6Fragment:
+		if len(b) < 8 || binary.BigEndian.Uint16(b[2:4])&0xfff8 != 0 {
+			return nh, b, false
+		}
+		return int(b[0]), b[8:], true
+	}
+	return nh, b, false
 }
 
 func parseOrigUDP(b []byte) (sport, dport int) {
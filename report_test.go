@@ -0,0 +1,40 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam_test
+
+import (
+	"testing"
+
+	"github.com/mikioh/ipoam"
+)
+
+func TestReverseHops(t *testing.T) {
+	for _, tt := range []struct {
+		hops    int
+		initial int
+		rev     int
+	}{
+		{0, -1, -1},
+		{1, 64, 64},
+		{64, 64, 1},
+		{60, 64, 5},
+		{65, 128, 64},
+		{126, 128, 3},
+		{250, 255, 6},
+		{256, -1, -1},
+	} {
+		if ttl := ipoam.InitialTTL(tt.hops); ttl != tt.initial {
+			t.Errorf("InitialTTL(%d) = %d; want %d", tt.hops, ttl, tt.initial)
+		}
+		r := ipoam.Report{Hops: tt.hops}
+		if rev := r.ReverseHops(); rev != tt.rev {
+			t.Errorf("ReverseHops with %d = %d; want %d", tt.hops, rev, tt.rev)
+		}
+	}
+	r := ipoam.Report{Hops: 250}
+	if !r.Asymmetric(3, 1) || r.Asymmetric(6, 0) || r.Asymmetric(5, 1) {
+		t.Error("unexpected asymmetry")
+	}
+}
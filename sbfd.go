@@ -0,0 +1,313 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// SBFDPort is the well-known UDP port number for S-BFD control
+// packets.
+const SBFDPort = 7784
+
+// An SBFDReport represents a test report of S-BFD initiator.
+type SBFDReport struct {
+	// Report holds the time and source address of received
+	// packet.
+	// Its ICMP field is set when the packet is an ICMP error
+	// message related to the probe packet.
+	Report
+
+	RemoteDiscriminator uint32        // discriminator of reflector, zero if unknown
+	State               BFDState      // state of reflector
+	Diag                BFDDiag       // diagnostic code of reflector
+	RequiredMinRx       time.Duration // minimum interval the reflector supports
+	RTT                 time.Duration // round-trip time, zero if unknown
+}
+
+type sbfdTarget struct {
+	ip   string
+	disc uint32
+}
+
+// An SBFDInitiator represents an S-BFD initiator.
+// See RFC 7880 and RFC 7881.
+type SBFDInitiator struct {
+	ipt    *Tester
+	disc   uint32
+	report chan SBFDReport
+	done   chan struct{}
+
+	closeOnce sync.Once
+
+	mu   sync.Mutex
+	sent map[sbfdTarget]time.Time // transmission time of latest probe packet
+}
+
+// NewSBFDInitiator makes a tester for an S-BFD initiator with the
+// local discriminator disc.
+// The network must be "udp", "udp4" or "udp6".
+// When the address has no port or port 0, a source port in the range
+// of 49152 through 65535 is chosen.
+// A random discriminator is used when disc is zero.
+func NewSBFDInitiator(network, address string, disc uint32) (*SBFDInitiator, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, "0"
+	}
+	var ipt *Tester
+	for i := 0; i < 64; i++ {
+		p := port
+		if p == "0" {
+			p = strconv.Itoa(49152 + rand.Intn(16384))
+		}
+		if ipt, err = NewTester(network, net.JoinHostPort(host, p)); err == nil || port != "0" {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// S-BFD control packets are transmitted with the IPv4 TTL or
+	// IPv6 hop limit of 255.
+	if p := ipt.IPv4PacketConn(); p != nil {
+		p.SetTTL(255)
+	}
+	if p := ipt.IPv6PacketConn(); p != nil {
+		p.SetHopLimit(255)
+	}
+	for disc == 0 {
+		disc = rand.Uint32()
+	}
+	in := SBFDInitiator{ipt: ipt, disc: disc, report: make(chan SBFDReport, 1), done: make(chan struct{}), sent: make(map[sbfdTarget]time.Time)}
+	go in.readReplies()
+	go in.relayReports()
+	return &in, nil
+}
+
+// LocalDiscriminator returns the local discriminator of in.
+func (in *SBFDInitiator) LocalDiscriminator() uint32 {
+	return in.disc
+}
+
+// Report returns the buffered test report channel.
+func (in *SBFDInitiator) Report() <-chan SBFDReport {
+	return in.report
+}
+
+// Close closes the underlying tester.
+func (in *SBFDInitiator) Close() error {
+	err := error(syscall.EINVAL)
+	in.closeOnce.Do(func() {
+		close(in.done)
+		err = in.ipt.Close()
+	})
+	return err
+}
+
+// Probe transmits an S-BFD control packet to the reflector at ip
+// with the remote discriminator disc via ifi.
+func (in *SBFDInitiator) Probe(ip net.IP, disc uint32, ifi *net.Interface) error {
+	m := BFDControl{
+		State:             BFDUp,
+		Demand:            true,
+		DetectMult:        3,
+		MyDiscriminator:   in.disc,
+		YourDiscriminator: disc,
+		DesiredMinTx:      time.Second,
+	}
+	b, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	in.mu.Lock()
+	in.sent[sbfdTarget{ip: ip.String(), disc: disc}] = time.Now()
+	in.mu.Unlock()
+	return in.ipt.Probe(b, &ControlMessage{Port: SBFDPort}, ip, ifi)
+}
+
+func (in *SBFDInitiator) emit(r *SBFDReport) {
+	select {
+	case in.report <- *r:
+	case <-in.done:
+	}
+}
+
+// readReplies reads S-BFD control packets from reflectors.
+func (in *SBFDInitiator) readReplies() {
+	b := make([]byte, 1<<16)
+	for {
+		n, peer, err := in.ipt.ReadFrom(b)
+		if err != nil {
+			select {
+			case <-in.done:
+			default:
+				in.emit(&SBFDReport{Report: Report{Error: err, Time: time.Now()}})
+			}
+			return
+		}
+		now := time.Now()
+		m, err := ParseBFDControl(b[:n])
+		if err != nil || m.YourDiscriminator != in.disc {
+			continue
+		}
+		ip := peer.(*net.UDPAddr).IP
+		r := SBFDReport{
+			Report:              Report{Time: now, Src: ip},
+			RemoteDiscriminator: m.MyDiscriminator,
+			State:               m.State,
+			Diag:                m.Diag,
+			RequiredMinRx:       m.RequiredMinRx,
+		}
+		in.mu.Lock()
+		if t, ok := in.sent[sbfdTarget{ip: ip.String(), disc: m.MyDiscriminator}]; ok {
+			r.RTT = now.Sub(t)
+		}
+		in.mu.Unlock()
+		in.emit(&r)
+	}
+}
+
+// relayReports relays the ICMP error reports of underlying tester.
+func (in *SBFDInitiator) relayReports() {
+	for {
+		select {
+		case <-in.done:
+			return
+		case r := <-in.ipt.Report():
+			sr := SBFDReport{Report: r}
+			// The quoted control packet tells the remote
+			// discriminator when it's long enough.
+			if protocol, b := parseOrigIP(r.OrigHeader, r.OrigPayload); protocol == ianaProtocolUDP && len(b) >= 8+bfdHeaderLen {
+				sr.RemoteDiscriminator = binary.BigEndian.Uint32(b[8+8 : 8+12])
+			}
+			in.emit(&sr)
+		}
+	}
+}
+
+// An SBFDReflector represents an S-BFD reflector.
+// It responds to the control packets that carry one of the
+// discriminators in its table as the your discriminator.
+type SBFDReflector struct {
+	*testConn
+
+	mu        sync.RWMutex
+	discs     map[uint32]bool
+	adminDown bool
+	minRx     time.Duration
+}
+
+// NewSBFDReflector makes a network connection for an S-BFD
+// reflector.
+// The network must be "udp", "udp4" or "udp6".
+// The address usually specifies SBFDPort.
+func NewSBFDReflector(network, address string) (*SBFDReflector, error) {
+	c, err := listenTestConn(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &SBFDReflector{testConn: c, discs: make(map[uint32]bool), minRx: time.Millisecond}, nil
+}
+
+// AddDiscriminator adds the discriminator disc to the table of r.
+func (r *SBFDReflector) AddDiscriminator(disc uint32) {
+	r.mu.Lock()
+	r.discs[disc] = true
+	r.mu.Unlock()
+}
+
+// RemoveDiscriminator removes the discriminator disc from the table
+// of r.
+func (r *SBFDReflector) RemoveDiscriminator(disc uint32) {
+	r.mu.Lock()
+	delete(r.discs, disc)
+	r.mu.Unlock()
+}
+
+// Discriminators returns the discriminators in the table of r.
+func (r *SBFDReflector) Discriminators() []uint32 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var discs []uint32
+	for disc := range r.discs {
+		discs = append(discs, disc)
+	}
+	sort.Slice(discs, func(i, j int) bool { return discs[i] < discs[j] })
+	return discs
+}
+
+// SetAdminDown sets the reflector state to AdminDown when down is
+// true, otherwise Up.
+func (r *SBFDReflector) SetAdminDown(down bool) {
+	r.mu.Lock()
+	r.adminDown = down
+	r.mu.Unlock()
+}
+
+// SetRequiredMinRx sets the minimum interval between control packets
+// that r supports.
+func (r *SBFDReflector) SetRequiredMinRx(d time.Duration) {
+	r.mu.Lock()
+	r.minRx = d
+	r.mu.Unlock()
+}
+
+// Serve receives control packets from initiators and transmits
+// responses until r is closed.
+// The fn is called for each response when it is not nil.
+func (r *SBFDReflector) Serve(fn func(req, rep *BFDControl, peer net.Addr)) error {
+	b := make([]byte, 1<<16)
+	for {
+		n, _, _, peer, err := r.readFrom(b)
+		if err != nil {
+			return err
+		}
+		req, err := ParseBFDControl(b[:n])
+		if err != nil || req.MyDiscriminator == 0 || req.Auth != nil {
+			continue
+		}
+		r.mu.RLock()
+		ok, adminDown, minRx := r.discs[req.YourDiscriminator], r.adminDown, r.minRx
+		r.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		rep := BFDControl{
+			State:             BFDUp,
+			Final:             req.Poll,
+			DetectMult:        req.DetectMult,
+			MyDiscriminator:   req.YourDiscriminator,
+			YourDiscriminator: req.MyDiscriminator,
+			DesiredMinTx:      req.DesiredMinTx,
+			RequiredMinRx:     minRx,
+		}
+		if adminDown {
+			rep.State, rep.Diag = BFDAdminDown, BFDDiagAdminDown
+		}
+		wb, err := rep.Marshal()
+		if err != nil {
+			continue
+		}
+		if _, err := r.c.WriteTo(wb, peer); err != nil {
+			continue
+		}
+		if fn != nil {
+			fn(req, &rep, peer)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam_test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mikioh/ipoam"
+)
+
+func TestSBFD(t *testing.T) {
+	r, err := ipoam.NewSBFDReflector("udp4", fmt.Sprintf("127.0.0.1:%d", ipoam.SBFDPort))
+	if err != nil {
+		t.Skip(err)
+	}
+	defer r.Close()
+	r.AddDiscriminator(0x7f000001)
+	go r.Serve(nil)
+
+	in, err := ipoam.NewSBFDInitiator("udp4", "127.0.0.1:0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	for i, tt := range []struct {
+		adminDown bool
+		state     ipoam.BFDState
+	}{
+		{false, ipoam.BFDUp},
+		{true, ipoam.BFDAdminDown},
+	} {
+		r.SetAdminDown(tt.adminDown)
+		if err := in.Probe(net.IPv4(127, 0, 0, 1), 0x7f000001, nil); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case rep := <-in.Report():
+			if rep.Error != nil || rep.ICMP != nil {
+				t.Fatalf("#%d: got %+v", i, rep)
+			}
+			if rep.RemoteDiscriminator != 0x7f000001 || rep.State != tt.state || rep.RTT <= 0 {
+				t.Errorf("#%d: got %+v; want state %v", i, rep, tt.state)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("#%d: timeout", i)
+		}
+	}
+
+	// Control packets with unknown discriminators must be
+	// discarded.
+	if err := in.Probe(net.IPv4(127, 0, 0, 1), 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case rep := <-in.Report():
+		t.Errorf("got %+v; want no reply", rep)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,560 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// STAMPPort is the UDP port number for STAMP.
+const STAMPPort = 862
+
+// A STAMPErrorEstimate represents an error estimate of STAMP
+// timestamp.
+// See RFC 4656, section 4.1.2.
+type STAMPErrorEstimate uint16
+
+// NewSTAMPErrorEstimate returns the error estimate of timestamps with
+// the error d.
+// The synced specifies whether the clock is synchronized to UTC, and
+// the ptp specifies whether timestamps are in the truncated PTP
+// format instead of the NTP format.
+func NewSTAMPErrorEstimate(synced, ptp bool, d time.Duration) STAMPErrorEstimate {
+	var ee STAMPErrorEstimate
+	if synced {
+		ee |= 0x8000
+	}
+	if ptp {
+		ee |= 0x4000
+	}
+	// The error is multiplier*2^(scale-32) seconds, and the
+	// multiplier must not be zero.
+	v := math.Ceil(d.Seconds() * (1 << 32))
+	scale := 0
+	for v > 255 && scale < 63 {
+		v = math.Ceil(v / 2)
+		scale++
+	}
+	if v < 1 {
+		v = 1
+	}
+	return ee | STAMPErrorEstimate(scale)<<8 | STAMPErrorEstimate(v)
+}
+
+// Synced reports whether the clock is synchronized to UTC.
+func (ee STAMPErrorEstimate) Synced() bool { return ee&0x8000 != 0 }
+
+// PTP reports whether timestamps are in the truncated PTP format.
+func (ee STAMPErrorEstimate) PTP() bool { return ee&0x4000 != 0 }
+
+// Duration returns the estimated error of timestamps.
+func (ee STAMPErrorEstimate) Duration() time.Duration {
+	scale, mult := int(ee>>8&0x3f), float64(ee&0xff)
+	return time.Duration(mult * math.Pow(2, float64(scale-32)) * float64(time.Second))
+}
+
+// STAMP TLV types.
+const (
+	STAMPTLVExtraPadding      = 1 // extra padding
+	STAMPTLVLocation          = 2 // location
+	STAMPTLVTimestampInfo     = 3 // timestamp information
+	STAMPTLVClassOfService    = 4 // class of service
+	STAMPTLVDirectMeasurement = 5 // direct measurement
+	STAMPTLVAccessReport      = 6 // access report
+	STAMPTLVFollowUpTelemetry = 7 // follow-up telemetry
+	STAMPTLVHMAC              = 8 // HMAC
+)
+
+// STAMP TLV flags.
+const (
+	STAMPTLVUnrecognized = 0x80 // set by session-reflector when it doesn't understand the TLV
+	STAMPTLVMalformed    = 0x40 // set by session-reflector when the TLV is malformed
+	STAMPTLVIntegrity    = 0x20 // set by session-reflector when the integrity check fails
+)
+
+// Synchronization sources and timestamp methods of Timestamp
+// Information TLV.
+const (
+	STAMPSyncNTP       = 1 // NTP
+	STAMPSyncPTP       = 2 // PTP
+	STAMPSyncFreeRun   = 5 // local free-running oscillator
+	STAMPStampHWAssist = 1 // hardware assisted
+	STAMPStampSWLocal  = 2 // software local
+)
+
+// A STAMPTLV represents a STAMP TLV.
+// See RFC 8972.
+type STAMPTLV struct {
+	Flags int
+	Type  int
+	Value []byte
+}
+
+// A STAMPPacket represents a STAMP session-sender or
+// session-reflector test packet.
+// See RFC 8762 and RFC 8972.
+type STAMPPacket struct {
+	Reflected     bool // true if the packet is a session-reflector test packet
+	Seq           uint32
+	Timestamp     time.Time
+	ErrorEstimate STAMPErrorEstimate
+	SSID          int // session-sender identifier
+
+	// These fields are set only on session-reflector test
+	// packets.
+	Received            time.Time // time the session-sender test packet received
+	SenderSeq           uint32
+	SenderTimestamp     time.Time
+	SenderErrorEstimate STAMPErrorEstimate
+	SenderTTL           int // IPv4 TTL or IPv6 hop limit on session-sender test packet
+
+	TLVs []STAMPTLV
+}
+
+const (
+	stampLen     = 44  // length of unauthenticated test packet
+	stampAuthLen = 112 // length of authenticated test packet
+	stampHMACLen = 16
+)
+
+var (
+	errInvalidSTAMPPacket = errors.New("invalid STAMP test packet")
+	errSTAMPAuthFailed    = errors.New("STAMP authentication failed")
+)
+
+// stampLayout represents the field offsets of STAMP test packet.
+type stampLayout struct {
+	ts, ee, ssid, rcvd, sseq, sts, see, sttl int
+}
+
+var (
+	stampSenderLayout        = stampLayout{ts: 4, ee: 12, ssid: 14}
+	stampAuthSenderLayout    = stampLayout{ts: 16, ee: 24, ssid: 26}
+	stampReflectorLayout     = stampLayout{ts: 4, ee: 12, ssid: 14, rcvd: 16, sseq: 24, sts: 28, see: 36, sttl: 40}
+	stampAuthReflectorLayout = stampLayout{ts: 16, ee: 24, ssid: 26, rcvd: 32, sseq: 48, sts: 64, see: 72, sttl: 80}
+)
+
+func stampLayoutOf(reflected, authenticated bool) (stampLayout, int) {
+	switch {
+	case reflected && authenticated:
+		return stampAuthReflectorLayout, stampAuthLen
+	case reflected:
+		return stampReflectorLayout, stampLen
+	case authenticated:
+		return stampAuthSenderLayout, stampAuthLen
+	default:
+		return stampSenderLayout, stampLen
+	}
+}
+
+// Marshal returns the binary encoding of p.
+// It returns the authenticated test packet when key is not nil.
+func (p *STAMPPacket) Marshal(key []byte) ([]byte, error) {
+	l, n := stampLayoutOf(p.Reflected, key != nil)
+	b := make([]byte, n)
+	binary.BigEndian.PutUint32(b[:4], p.Seq)
+	putSTAMPTime(b[l.ts:l.ts+8], p.Timestamp, p.ErrorEstimate.PTP())
+	binary.BigEndian.PutUint16(b[l.ee:l.ee+2], uint16(p.ErrorEstimate))
+	binary.BigEndian.PutUint16(b[l.ssid:l.ssid+2], uint16(p.SSID))
+	if p.Reflected {
+		putSTAMPTime(b[l.rcvd:l.rcvd+8], p.Received, p.ErrorEstimate.PTP())
+		binary.BigEndian.PutUint32(b[l.sseq:l.sseq+4], p.SenderSeq)
+		putSTAMPTime(b[l.sts:l.sts+8], p.SenderTimestamp, p.SenderErrorEstimate.PTP())
+		binary.BigEndian.PutUint16(b[l.see:l.see+2], uint16(p.SenderErrorEstimate))
+		b[l.sttl] = byte(p.SenderTTL)
+	}
+	if key != nil {
+		copy(b[n-stampHMACLen:], stampHMAC(key, b[:n-stampHMACLen]))
+	}
+	for _, tlv := range p.TLVs {
+		if tlv.Type == STAMPTLVHMAC || len(tlv.Value) > 0xffff {
+			continue
+		}
+		b = appendSTAMPTLV(b, tlv.Flags, tlv.Type, tlv.Value)
+	}
+	if key != nil && len(p.TLVs) > 0 {
+		// The HMAC TLV protects the sequence number and the
+		// preceding TLVs.
+		// See RFC 8972, section 4.8.
+		b = appendSTAMPTLV(b, 0, STAMPTLVHMAC, stampTLVHMAC(key, b[:4], b[n:]))
+	}
+	return b, nil
+}
+
+func appendSTAMPTLV(b []byte, flags, typ int, v []byte) []byte {
+	b = append(b, byte(flags), byte(typ), byte(len(v)>>8), byte(len(v)))
+	return append(b, v...)
+}
+
+// stampHMAC returns the HMAC-SHA-256 of b, truncated to 128 bits.
+func stampHMAC(key, b []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(b)
+	return h.Sum(nil)[:stampHMACLen]
+}
+
+func stampTLVHMAC(key, seq, tlvs []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(seq)
+	h.Write(tlvs)
+	return h.Sum(nil)[:stampHMACLen]
+}
+
+// ParseSTAMPPacket parses b as a STAMP session-sender test packet, or
+// a session-reflector test packet when reflected is true.
+// It parses b as an authenticated test packet and verifies the HMAC
+// when key is not nil.
+func ParseSTAMPPacket(b []byte, reflected bool, key []byte) (*STAMPPacket, error) {
+	l, n := stampLayoutOf(reflected, key != nil)
+	if len(b) < n {
+		return nil, errInvalidSTAMPPacket
+	}
+	if key != nil && !hmac.Equal(b[n-stampHMACLen:n], stampHMAC(key, b[:n-stampHMACLen])) {
+		return nil, errSTAMPAuthFailed
+	}
+	p := STAMPPacket{
+		Reflected:     reflected,
+		Seq:           binary.BigEndian.Uint32(b[:4]),
+		ErrorEstimate: STAMPErrorEstimate(binary.BigEndian.Uint16(b[l.ee : l.ee+2])),
+		SSID:          int(binary.BigEndian.Uint16(b[l.ssid : l.ssid+2])),
+	}
+	p.Timestamp = parseSTAMPTime(b[l.ts:l.ts+8], p.ErrorEstimate.PTP())
+	if reflected {
+		p.Received = parseSTAMPTime(b[l.rcvd:l.rcvd+8], p.ErrorEstimate.PTP())
+		p.SenderSeq = binary.BigEndian.Uint32(b[l.sseq : l.sseq+4])
+		p.SenderErrorEstimate = STAMPErrorEstimate(binary.BigEndian.Uint16(b[l.see : l.see+2]))
+		p.SenderTimestamp = parseSTAMPTime(b[l.sts:l.sts+8], p.SenderErrorEstimate.PTP())
+		p.SenderTTL = int(b[l.sttl])
+	}
+	for tlvs := b[n:]; len(tlvs) > 0; {
+		if len(tlvs) < 4 {
+			return nil, errInvalidSTAMPPacket
+		}
+		vl := int(binary.BigEndian.Uint16(tlvs[2:4]))
+		if len(tlvs) < 4+vl {
+			return nil, errInvalidSTAMPPacket
+		}
+		tlv := STAMPTLV{Flags: int(tlvs[0]), Type: int(tlvs[1]), Value: append([]byte(nil), tlvs[4:4+vl]...)}
+		if tlv.Type == STAMPTLVHMAC && key != nil {
+			if !hmac.Equal(tlv.Value, stampTLVHMAC(key, b[:4], b[n:len(b)-len(tlvs)])) {
+				return nil, errSTAMPAuthFailed
+			}
+		} else {
+			p.TLVs = append(p.TLVs, tlv)
+		}
+		tlvs = tlvs[4+vl:]
+	}
+	return &p, nil
+}
+
+// Delays returns the round-trip delay, and the forward and backward
+// one-way delays of the session-reflector test packet p received at
+// t.
+// The one-way delays are meaningful only when the clocks of both
+// hosts are synchronized.
+func (p *STAMPPacket) Delays(t time.Time) (rtt, forward, backward time.Duration) {
+	forward = p.Received.Sub(p.SenderTimestamp)
+	backward = t.Sub(p.Timestamp)
+	rtt = t.Sub(p.SenderTimestamp) - p.Timestamp.Sub(p.Received)
+	return
+}
+
+// putSTAMPTime encodes t into b in the NTP timestamp format, or the
+// truncated PTP timestamp format when ptp is true.
+func putSTAMPTime(b []byte, t time.Time, ptp bool) {
+	if !ptp {
+		putNTPTime(b, t)
+		return
+	}
+	if t.IsZero() {
+		binary.BigEndian.PutUint64(b, 0)
+		return
+	}
+	binary.BigEndian.PutUint32(b[:4], uint32(t.Unix()))
+	binary.BigEndian.PutUint32(b[4:8], uint32(t.Nanosecond()))
+}
+
+func parseSTAMPTime(b []byte, ptp bool) time.Time {
+	if !ptp {
+		return parseNTPTime(b)
+	}
+	if binary.BigEndian.Uint64(b) == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(binary.BigEndian.Uint32(b[:4])), int64(binary.BigEndian.Uint32(b[4:8])))
+}
+
+// A STAMPReflector represents a STAMP session-reflector.
+type STAMPReflector struct {
+	*testConn
+	key      []byte
+	stateful bool
+	ptp      bool
+
+	mu       sync.Mutex
+	sessions map[stampSessionKey]*stampSession
+}
+
+type stampSessionKey struct {
+	peer string
+	ssid int
+}
+
+// A stampSession represents the state of stateful session-reflector.
+type stampSession struct {
+	seq      uint32    // next session-reflector sequence number
+	rcvd, tx uint32    // counters for Direct Measurement TLV
+	last     time.Time // time the last test packet received
+}
+
+const (
+	maxReflectorSessions = 1024            // maximum number of sessions kept by session-reflector
+	reflectorSessionIdle = 5 * time.Minute // idle time after which a session may be removed
+)
+
+// session returns the session for k, or nil when r already keeps
+// maxReflectorSessions sessions that are not idle.
+// The caller must hold r.mu.
+func (r *STAMPReflector) session(k stampSessionKey, now time.Time) *stampSession {
+	if ss := r.sessions[k]; ss != nil {
+		return ss
+	}
+	if len(r.sessions) >= maxReflectorSessions {
+		for k, ss := range r.sessions {
+			if now.Sub(ss.last) > reflectorSessionIdle {
+				delete(r.sessions, k)
+			}
+		}
+		if len(r.sessions) >= maxReflectorSessions {
+			return nil
+		}
+	}
+	ss := &stampSession{}
+	r.sessions[k] = ss
+	return ss
+}
+
+// NewSTAMPReflector makes a network connection for a STAMP
+// session-reflector.
+// The network must be "udp", "udp4" or "udp6".
+// The address usually specifies STAMPPort.
+// The reflector authenticates test packets with key when key is not
+// nil.
+// A stateful reflector numbers its test packets per session, which
+// allows the session-sender to tell forward loss from backward loss;
+// a stateless reflector copies the sequence number of session-sender.
+// A stateful reflector keeps up to 1024 sessions, removes the sessions
+// idle for 5 minutes to make room for new ones, and reflects the test
+// packets of further sessions statelessly.
+func NewSTAMPReflector(network, address string, stateful bool, key []byte) (*STAMPReflector, error) {
+	c, err := listenTestConn(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &STAMPReflector{testConn: c, key: key, stateful: stateful, sessions: make(map[stampSessionKey]*stampSession)}, nil
+}
+
+// A testConn represents a network connection that transmits and
+// receives test packets.
+type testConn struct {
+	c  net.PacketConn
+	p4 *ipv4.PacketConn
+	p6 *ipv6.PacketConn
+}
+
+func listenTestConn(network, address string) (*testConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	c, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	r := testConn{c: c}
+	// Test packets should be sent with the IPv4 TTL or IPv6 hop
+	// limit of 255.
+	if ip := c.LocalAddr().(*net.UDPAddr).IP; ip.To4() != nil {
+		r.p4 = ipv4.NewPacketConn(c)
+		r.p4.SetTTL(255)
+		r.p4.SetControlMessage(ipv4.FlagTTL, true)
+	} else {
+		r.p6 = ipv6.NewPacketConn(c)
+		r.p6.SetHopLimit(255)
+		r.p6.SetControlMessage(ipv6.FlagHopLimit|ipv6.FlagTrafficClass, true)
+		if network == "udp" {
+			ipv4.NewPacketConn(c).SetTTL(255)
+		}
+	}
+	return &r, nil
+}
+
+// readFrom reads a test packet into b, and returns the IPv4 TTL or
+// IPv6 hop limit, and the IPv6 traffic class, or -1 if unknown, on
+// the received packet.
+func (r *testConn) readFrom(b []byte) (n, hops, tc int, peer net.Addr, err error) {
+	if r.p4 != nil {
+		var cm *ipv4.ControlMessage
+		n, cm, peer, err = r.p4.ReadFrom(b)
+		if cm != nil {
+			hops = cm.TTL
+		}
+		return n, hops, -1, peer, err
+	}
+	var cm *ipv6.ControlMessage
+	n, cm, peer, err = r.p6.ReadFrom(b)
+	if cm != nil {
+		hops, tc = cm.HopLimit, cm.TrafficClass
+	}
+	return n, hops, tc, peer, err
+}
+
+// setDSCP sets the DSCP on transmitted test packets.
+func (r *testConn) setDSCP(dscp int) {
+	if r.p4 != nil {
+		r.p4.SetTOS(dscp << 2)
+	} else {
+		r.p6.SetTrafficClass(dscp << 2)
+	}
+}
+
+// Addr returns the local network address of r.
+func (r *testConn) Addr() net.Addr {
+	return r.c.LocalAddr()
+}
+
+// Close closes the network connection of r.
+func (r *testConn) Close() error {
+	return r.c.Close()
+}
+
+// SetPTP sets the timestamp format of r to the truncated PTP format
+// when ptp is true, otherwise the NTP format.
+func (r *STAMPReflector) SetPTP(ptp bool) {
+	r.ptp = ptp
+}
+
+// Serve receives session-sender test packets and transmits
+// session-reflector test packets until r is closed.
+// The fn is called for each reflected test packet when it is not nil.
+func (r *STAMPReflector) Serve(fn func(req, rep *STAMPPacket, peer net.Addr)) error {
+	b := make([]byte, 1<<16)
+	for {
+		n, hops, tc, peer, err := r.readFrom(b)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		req, err := ParseSTAMPPacket(b[:n], false, r.key)
+		if err != nil {
+			continue
+		}
+		rep := r.reflect(req, peer, hops, tc, now)
+		wb, err := rep.Marshal(r.key)
+		if err != nil {
+			continue
+		}
+		r.setDSCP(stampDSCP(rep))
+		if _, err := r.c.WriteTo(wb, peer); err != nil {
+			continue
+		}
+		if fn != nil {
+			fn(req, rep, peer)
+		}
+	}
+}
+
+// stampDSCP returns DSCP1 of the Class of Service TLV in the reflected
+// test packet p, or zero when p doesn't carry it.
+func stampDSCP(p *STAMPPacket) int {
+	var dscp int
+	for _, tlv := range p.TLVs {
+		if tlv.Type == STAMPTLVClassOfService && tlv.Flags&STAMPTLVMalformed == 0 {
+			dscp = int(tlv.Value[0] >> 2)
+		}
+	}
+	return dscp
+}
+
+// reflect returns the session-reflector test packet for req received
+// from peer at now with the IPv4 TTL or IPv6 hop limit hops, and the
+// IPv6 traffic class tc, or -1 if unknown.
+func (r *STAMPReflector) reflect(req *STAMPPacket, peer net.Addr, hops, tc int, now time.Time) *STAMPPacket {
+	var ss *stampSession
+	if r.stateful {
+		r.mu.Lock()
+		if s := r.session(stampSessionKey{peer: peer.String(), ssid: req.SSID}, now); s != nil {
+			s.last = now
+			s.rcvd++
+			s.tx++
+			ss = &stampSession{seq: s.seq, rcvd: s.rcvd, tx: s.tx}
+			s.seq++
+		}
+		r.mu.Unlock()
+	}
+	rep := STAMPPacket{
+		Reflected:           true,
+		Seq:                 req.Seq,
+		ErrorEstimate:       NewSTAMPErrorEstimate(false, r.ptp, time.Millisecond),
+		SSID:                req.SSID,
+		Received:            now,
+		SenderSeq:           req.Seq,
+		SenderTimestamp:     req.Timestamp,
+		SenderErrorEstimate: req.ErrorEstimate,
+		SenderTTL:           hops,
+	}
+	if ss != nil {
+		rep.Seq = ss.seq
+	}
+	for _, tlv := range req.TLVs {
+		tlv.Flags &^= STAMPTLVUnrecognized | STAMPTLVMalformed | STAMPTLVIntegrity
+		switch tlv.Type {
+		case STAMPTLVExtraPadding:
+		case STAMPTLVTimestampInfo:
+			if len(tlv.Value) != 4 {
+				tlv.Flags |= STAMPTLVMalformed
+				break
+			}
+			tlv.Value[0], tlv.Value[1] = STAMPSyncFreeRun, STAMPStampSWLocal
+			tlv.Value[2], tlv.Value[3] = STAMPSyncFreeRun, STAMPStampSWLocal
+		case STAMPTLVClassOfService:
+			if len(tlv.Value) != 4 {
+				tlv.Flags |= STAMPTLVMalformed
+				break
+			}
+			// DSCP2 and ECN hold the values on the received
+			// packet, which are known only for IPv6.
+			if tc >= 0 {
+				tlv.Value[0] = tlv.Value[0]&0xfc | byte(tc>>6)
+				tlv.Value[1] = byte(tc>>2&0x0f)<<4 | byte(tc&0x03)<<2 | tlv.Value[1]&0x03
+			}
+		case STAMPTLVDirectMeasurement:
+			if len(tlv.Value) != 12 {
+				tlv.Flags |= STAMPTLVMalformed
+				break
+			}
+			if ss != nil {
+				binary.BigEndian.PutUint32(tlv.Value[4:8], ss.rcvd)
+				binary.BigEndian.PutUint32(tlv.Value[8:12], ss.tx)
+			}
+		default:
+			tlv.Flags |= STAMPTLVUnrecognized
+		}
+		rep.TLVs = append(rep.TLVs, tlv)
+	}
+	rep.Timestamp = time.Now()
+	return &rep
+}
@@ -0,0 +1,135 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam_test
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mikioh/ipoam"
+)
+
+func TestSTAMPErrorEstimate(t *testing.T) {
+	for _, tt := range []struct {
+		synced, ptp bool
+		d           time.Duration
+	}{
+		{false, false, time.Millisecond},
+		{true, true, time.Microsecond},
+		{true, false, time.Second},
+	} {
+		ee := ipoam.NewSTAMPErrorEstimate(tt.synced, tt.ptp, tt.d)
+		if ee.Synced() != tt.synced || ee.PTP() != tt.ptp {
+			t.Errorf("%#x: got %v, %v; want %v, %v", uint16(ee), ee.Synced(), ee.PTP(), tt.synced, tt.ptp)
+		}
+		if d := ee.Duration(); d < tt.d || d > tt.d+tt.d/64+time.Nanosecond {
+			t.Errorf("%#x: got %v; want %v", uint16(ee), d, tt.d)
+		}
+	}
+}
+
+func TestSTAMPPacket(t *testing.T) {
+	t1 := time.Unix(1500000000, 123456789)
+	for _, key := range [][]byte{nil, []byte("secret")} {
+		for _, ptp := range []bool{false, true} {
+			p := ipoam.STAMPPacket{
+				Reflected:           true,
+				Seq:                 1,
+				Timestamp:           t1.Add(2 * time.Millisecond),
+				ErrorEstimate:       ipoam.NewSTAMPErrorEstimate(true, ptp, time.Millisecond),
+				SSID:                2,
+				Received:            t1.Add(time.Millisecond),
+				SenderSeq:           3,
+				SenderTimestamp:     t1,
+				SenderErrorEstimate: ipoam.NewSTAMPErrorEstimate(false, !ptp, time.Millisecond),
+				SenderTTL:           64,
+				TLVs:                []ipoam.STAMPTLV{{Type: ipoam.STAMPTLVExtraPadding, Value: make([]byte, 8)}},
+			}
+			b, err := p.Marshal(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ipoam.ParseSTAMPPacket(b, true, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Seq != p.Seq || got.SSID != p.SSID || got.SenderSeq != p.SenderSeq || got.SenderTTL != p.SenderTTL || len(got.TLVs) != 1 {
+				t.Errorf("got %+v; want %+v", got, p)
+			}
+			for _, ts := range [][2]time.Time{{got.Timestamp, p.Timestamp}, {got.Received, p.Received}, {got.SenderTimestamp, p.SenderTimestamp}} {
+				if d := ts[0].Sub(ts[1]); d > time.Microsecond || d < -time.Microsecond {
+					t.Errorf("got %v; want %v", ts[0], ts[1])
+				}
+			}
+			rtt, fwd, bwd := got.Delays(t1.Add(4 * time.Millisecond))
+			if rtt.Round(time.Microsecond) != 3*time.Millisecond || fwd.Round(time.Microsecond) != time.Millisecond || bwd.Round(time.Microsecond) != 2*time.Millisecond {
+				t.Errorf("got %v, %v, %v; want 3ms, 1ms, 2ms", rtt, fwd, bwd)
+			}
+			if key != nil {
+				b[len(b)-1] ^= 0xff
+				if _, err := ipoam.ParseSTAMPPacket(b, true, key); err == nil {
+					t.Error("got nil; want error")
+				}
+			}
+		}
+	}
+}
+
+func TestSTAMPReflector(t *testing.T) {
+	key := []byte("secret")
+	r, err := ipoam.NewSTAMPReflector("udp4", "127.0.0.1:0", true, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go r.Serve(nil)
+
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		seq := uint32(i * 2) // every other test packet is lost
+		req := ipoam.STAMPPacket{
+			Seq:           seq,
+			Timestamp:     time.Now(),
+			ErrorEstimate: ipoam.NewSTAMPErrorEstimate(false, false, time.Millisecond),
+			SSID:          7,
+			TLVs: []ipoam.STAMPTLV{
+				{Type: ipoam.STAMPTLVDirectMeasurement, Value: make([]byte, 12)},
+				{Type: 200, Value: []byte{1, 2, 3, 4}},
+			},
+		}
+		b, err := req.Marshal(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.WriteTo(b, r.Addr()); err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, _, err := c.ReadFrom(b[:cap(b)])
+		if err != nil {
+			t.Fatal(err)
+		}
+		rep, err := ipoam.ParseSTAMPPacket(b[:n], true, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Seq != uint32(i) || rep.SenderSeq != seq || rep.SSID != req.SSID || rep.Received.IsZero() || len(rep.TLVs) != 2 {
+			t.Fatalf("#%d: got %+v", i, rep)
+		}
+		if rxc := binary.BigEndian.Uint32(rep.TLVs[0].Value[4:8]); rxc != uint32(i+1) {
+			t.Errorf("#%d: got R-RxC %d; want %d", i, rxc, i+1)
+		}
+		if rep.TLVs[1].Flags&ipoam.STAMPTLVUnrecognized == 0 {
+			t.Errorf("#%d: got flags %#x; want U flag", i, rep.TLVs[1].Flags)
+		}
+	}
+}
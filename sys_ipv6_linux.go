@@ -0,0 +1,21 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import "syscall"
+
+var sockoptIPv6ExtHeaders = map[int]int{
+	IPv6HopByHop: syscall.IPV6_HOPOPTS,
+	IPv6Routing:  syscall.IPV6_RTHDR,
+	IPv6DstOpts:  syscall.IPV6_DSTOPTS,
+}
+
+func setsockoptIPv6ExtHeader(s uintptr, typ int, b []byte) error {
+	return syscall.SetsockoptString(int(s), syscall.IPPROTO_IPV6, sockoptIPv6ExtHeaders[typ], string(b))
+}
+
+func setsockoptIPv6MTU(s uintptr, mtu int) error {
+	return syscall.SetsockoptInt(int(s), syscall.IPPROTO_IPV6, syscall.IPV6_MTU, mtu)
+}
@@ -0,0 +1,18 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package ipoam
+
+import "errors"
+
+func setsockoptIPv6ExtHeader(s uintptr, typ int, b []byte) error {
+	return errors.New("not implemented")
+}
+
+func setsockoptIPv6MTU(s uintptr, mtu int) error {
+	return errors.New("not implemented")
+}
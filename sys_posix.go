@@ -0,0 +1,18 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package ipoam
+
+import "syscall"
+
+func setsockoptBroadcast(s uintptr) error {
+	return syscall.SetsockoptInt(int(s), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+}
+
+func setsockoptIPv4Options(s uintptr, b []byte) error {
+	return syscall.SetsockoptString(int(s), syscall.IPPROTO_IP, syscall.IP_OPTIONS, string(b))
+}
@@ -0,0 +1,18 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package ipoam
+
+import "errors"
+
+func setsockoptBroadcast(s uintptr) error {
+	return errors.New("not implemented")
+}
+
+func setsockoptIPv4Options(s uintptr, b []byte) error {
+	return errors.New("not implemented")
+}
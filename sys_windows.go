@@ -0,0 +1,15 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import "syscall"
+
+func setsockoptBroadcast(s uintptr) error {
+	return syscall.SetsockoptInt(syscall.Handle(s), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+}
+
+func setsockoptIPv4Options(s uintptr, b []byte) error {
+	return syscall.EWINDOWS
+}
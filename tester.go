@@ -5,12 +5,14 @@
 package ipoam
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"net"
 	"os"
-	"runtime"
 	"sync"
 	"syscall"
+	"time"
 
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
@@ -22,18 +24,66 @@ type ControlMessage struct {
 	ID   int // ICMP echo identifier
 	Seq  int // ICMP echo sequence number
 	Port int // UDP destination port
+
+	// IPv4Options specifies the IPv4 options on probe packet,
+	// such as the binary encoding of RecordRoute or Timestamp.
+	IPv4Options []byte
+
+	// IPv6ExtHeaders specifies the IPv6 extension headers on
+	// probe packet.
+	// The kernel places the extension headers in the order
+	// recommended by RFC 8200 regardless of the order of
+	// IPv6ExtHeaders.
+	IPv6ExtHeaders []IPv6ExtHeader
 }
 
 // A Tester represents a tester for IP-layer OAM.
 type Tester struct {
-	initOnce sync.Once
-	pconn    *conn // probe connection
-	mconn    *conn // maintenance connection
-	*maint         // maintenance endpoint
+	initOnce  sync.Once
+	closeOnce sync.Once
+	pconn     *conn  // probe connection
+	mconn     *conn  // maintenance connection
+	demux     *demux // shared maintenance endpoint, nil if not shared
+	*maint           // maintenance endpoint
+
+	fmu   sync.Mutex
+	fconn *fragConn // fragment connection, nil if not used
 }
 
 func (t *Tester) init() {
-	go t.monitor(t.mconn)
+	if t.demux == nil {
+		go monitor(t.mconn, t.maint)
+	}
+}
+
+func (t *Tester) setProbes(ps ...probe) error {
+	t.maint.setProbes(ps...)
+	if t.demux != nil {
+		return t.demux.setProbeFilter()
+	}
+	cs := make([]cookie, len(ps))
+	for i := range ps {
+		cs[i] = ps[i].cookie
+	}
+	return t.mconn.setProbeFilter(cs, t.maint.nat64DstList())
+}
+
+// SetNAT64Prefixes sets the NAT64 prefixes of IPv4-embedded IPv6
+// addresses.
+// Reports on ICMP messages sent from IPv4-embedded IPv6 addresses
+// carry the embedded IPv4 addresses, and ICMP error messages related
+// to probe packets to IPv4-embedded IPv6 addresses are matched by the
+// destination address when a translator rewrites the ICMP echo
+// identifier or UDP source port.
+// See RFC 6052, RFC 6146 and RFC 7915.
+func (t *Tester) SetNAT64Prefixes(prefixes ...*net.IPNet) error {
+	for _, prefix := range prefixes {
+		if _, err := nat64Positions(prefix); err != nil {
+			return err
+		}
+	}
+	t.maint.setNAT64Prefixes(prefixes)
+	return nil
 }
 
 // IPv4PacketConn returns the ipv4.PacketConn of the probe network
@@ -50,16 +100,52 @@ func (t *Tester) IPv6PacketConn() *ipv6.PacketConn {
 	return t.pconn.p6
 }
 
+// ReadFrom reads a UDP datagram addressed to the probe network
+// connection, such as an application-level reply to probe packets.
+// It returns an error when t is not created as a tester using UDP.
+func (t *Tester) ReadFrom(b []byte) (int, net.Addr, error) {
+	if t.pconn.protocol != ianaProtocolUDP {
+		return 0, nil, net.UnknownNetworkError(t.pconn.c.LocalAddr().Network())
+	}
+	return t.pconn.c.ReadFrom(b)
+}
+
+// SetReadDeadline sets the deadline for future ReadFrom calls.
+func (t *Tester) SetReadDeadline(tm time.Time) error {
+	return t.pconn.c.SetReadDeadline(tm)
+}
+
 // Close closes both the maintenance and probe network connections.
+// The shared maintenance network connection is closed when t is the
+// last tester using it.
 func (t *Tester) Close() error {
 	if t == nil || t.pconn == nil || t.mconn == nil {
 		return syscall.EINVAL
 	}
+	err := error(syscall.EINVAL)
+	t.closeOnce.Do(func() {
+		close(t.done)
+		err = t.close()
+	})
+	return err
+}
+
+func (t *Tester) close() error {
 	perr := t.pconn.close()
+	t.fmu.Lock()
+	if t.fconn != nil {
+		t.fconn.c.Close()
+	}
+	t.fmu.Unlock()
 	if t.pconn == t.mconn {
 		return perr
 	}
-	merr := t.mconn.close()
+	var merr error
+	if t.demux != nil {
+		merr = t.demux.release(t.maint)
+	} else {
+		merr = t.mconn.close()
+	}
 	if perr != nil {
 		return perr
 	}
@@ -67,33 +153,242 @@ func (t *Tester) Close() error {
 }
 
 // Probe transmits a single probe packet to ip via ifi.
+// The ip can be a unicast, multicast or IPv4 broadcast address.
+// When ip is a multicast or broadcast address, each reply from
+// responders is reported with the Group field set to ip.
 // Each call updates the internal receive packet filter on the
 // maintenance network connection automatically.
+// On Linux, the filter is also installed into the kernel as a BPF
+// program when the maintenance network connection is a raw socket.
 func (t *Tester) Probe(b []byte, cm *ControlMessage, ip net.IP, ifi *net.Interface) error {
 	t.initOnce.Do(t.init)
 
-	var zone string
-	if ifi != nil {
-		zone = ifi.Name
+	if cm == nil {
+		cm = &ControlMessage{ID: os.Getpid() & 0xffff, Seq: 1, Port: 33434}
+	}
+	t.pconn.resetSockState()
+	wb, dst, p, err := t.marshalProbe(b, cm, ip, ifi)
+	if err != nil {
+		return err
+	}
+	if err := t.setProbes(p); err != nil {
+		return err
 	}
+	_, err = t.pconn.writeTo(wb, dst, ifi)
+	return err
+}
+
+// ProbeBatch transmits multiple probe packets via ifi, each of which
+// is addressed to ips[i] and built with cms[i], using as few system
+// calls as possible.
+// It returns the number of probe packets transmitted.
+// Each call updates the internal receive packet filter on the
+// maintenance network connection to accept replies for all the probe
+// packets in the batch.
+// All of cms must have the same IPv4 options and IPv6 extension
+// headers, and ips must be the same address when cms carry a routing
+// header.
+//
+// On Linux, it uses batch I/O operations. On other platforms, it
+// transmits probe packets one by one.
+func (t *Tester) ProbeBatch(b []byte, cms []ControlMessage, ips []net.IP, ifi *net.Interface) (int, error) {
+	t.initOnce.Do(t.init)
+
+	if len(cms) != len(ips) {
+		return 0, fmt.Errorf("mismatched number of control messages and destinations: %d, %d", len(cms), len(ips))
+	}
+	for i := range cms {
+		if !bytes.Equal(cms[i].IPv4Options, cms[0].IPv4Options) {
+			return 0, errors.New("mixed IPv4 options in batch")
+		}
+		if !equalIPv6ExtHeaders(cms[i].IPv6ExtHeaders, cms[0].IPv6ExtHeaders) {
+			return 0, errors.New("mixed IPv6 extension headers in batch")
+		}
+		if hasIPv6ExtHeader(cms[i].IPv6ExtHeaders, IPv6Routing) && !ips[i].Equal(ips[0]) {
+			return 0, errors.New("routing header with multiple destinations in batch")
+		}
+	}
+	t.pconn.resetSockState()
+	bs := make([][]byte, len(ips))
+	dsts := make([]net.Addr, len(ips))
+	ps := make([]probe, len(ips))
+	for i, ip := range ips {
+		var err error
+		bs[i], dsts[i], ps[i], err = t.marshalProbe(b, &cms[i], ip, ifi)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := t.setProbes(ps...); err != nil {
+		return 0, err
+	}
+	return t.pconn.writeBatch(bs, dsts, ifi)
+}
+
+// ProbeBurst transmits n probe packets to ip via ifi at the
+// interval.
+// The probe packets are built with cm, except that the ICMP echo
+// sequence number and UDP destination port of the i-th probe packet
+// are incremented by i.
+// Unlike Probe, the internal receive packet filter accepts replies
+// for all the probe packets in the burst until the next call to
+// Probe, ProbeBatch or ProbeBurst.
+// It returns the number of probe packets transmitted.
+func (t *Tester) ProbeBurst(b []byte, cm *ControlMessage, ip net.IP, ifi *net.Interface, n int, interval time.Duration) (int, error) {
+	t.initOnce.Do(t.init)
+
 	if cm == nil {
 		cm = &ControlMessage{ID: os.Getpid() & 0xffff, Seq: 1, Port: 33434}
 	}
+	t.pconn.resetSockState()
+	bs := make([][]byte, n)
+	dsts := make([]net.Addr, n)
+	ps := make([]probe, n)
+	for i := range bs {
+		m := *cm
+		m.Seq = (cm.Seq + i) & 0xffff
+		m.Port = (cm.Port + i) & 0xffff
+		var err error
+		bs[i], dsts[i], ps[i], err = t.marshalProbe(b, &m, ip, ifi)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := t.setProbes(ps...); err != nil {
+		return 0, err
+	}
+	next := time.Now()
+	for i := range bs {
+		if i > 0 {
+			next = next.Add(interval)
+			time.Sleep(time.Until(next))
+		}
+		if _, err := t.pconn.writeTo(bs[i], dsts[i], ifi); err != nil {
+			return i, err
+		}
+	}
+	return n, nil
+}
+
+// ProbeNeighbor transmits an IPv6 neighbor solicitation for target
+// via ifi.
+// The solicitation is addressed to target when unicast is true,
+// otherwise to the solicited-node multicast address of target, and
+// carries the link-layer address of ifi.
+// Each neighbor advertisement for target is reported with the
+// NeighborAdvert field set, and with the Group field set to the
+// solicited-node multicast address when unicast is false.
+// It returns an error when t is not created as a tester using a raw
+// ICMPv6 socket.
+func (t *Tester) ProbeNeighbor(target net.IP, unicast bool, ifi *net.Interface) error {
+	t.initOnce.Do(t.init)
+
+	if t.pconn.protocol != ianaProtocolIPv6ICMP || !t.pconn.rawSocket {
+		return net.UnknownNetworkError(t.pconn.c.LocalAddr().Network())
+	}
+	if ifi == nil {
+		return errors.New("no interface for neighbor solicitation")
+	}
+	dst := SolicitedNodeMulticast(target)
+	if dst == nil {
+		return errors.New("non-IPv6 neighbor solicitation target")
+	}
+	b, err := marshalNeighborSolicit(target, ifi.HardwareAddr)
+	if err != nil {
+		return err
+	}
+	p := probe{cookie: ndCookie(target), group: dst}
+	if unicast {
+		dst, p.group = target, nil
+	}
+	if err := t.setProbes(p); err != nil {
+		return err
+	}
+	// Neighbor discovery messages must be transmitted with the
+	// hop limit of 255.
+	// See RFC 4861.
+	cm := ipv6.ControlMessage{HopLimit: 255, IfIndex: ifi.Index}
+	_, err = t.pconn.p6.WriteTo(b, &cm, &net.IPAddr{IP: dst, Zone: ifi.Name})
+	return err
+}
+
+// ProbeRouter transmits an IPv6 router solicitation to the
+// link-local all-routers multicast address via ifi.
+// Each router advertisement, solicited or not, is reported with the
+// RouterAdvert field set.
+// It returns an error when t is not created as a tester using a raw
+// ICMPv6 socket.
+func (t *Tester) ProbeRouter(ifi *net.Interface) error {
+	if ifi == nil {
+		return errors.New("no interface for router solicitation")
+	}
+	if err := t.ListenRouters(); err != nil {
+		return err
+	}
+	b, err := marshalRouterSolicit(ifi.HardwareAddr)
+	if err != nil {
+		return err
+	}
+	// Neighbor discovery messages must be transmitted with the
+	// hop limit of 255.
+	// See RFC 4861.
+	cm := ipv6.ControlMessage{HopLimit: 255, IfIndex: ifi.Index}
+	_, err = t.pconn.p6.WriteTo(b, &cm, &net.IPAddr{IP: net.IPv6linklocalallrouters, Zone: ifi.Name})
+	return err
+}
+
+// ListenRouters makes t report each router advertisement with the
+// RouterAdvert field set, without transmitting router solicitations.
+// It returns an error when t is not created as a tester using a raw
+// ICMPv6 socket.
+func (t *Tester) ListenRouters() error {
+	t.initOnce.Do(t.init)
+
+	if t.pconn.protocol != ianaProtocolIPv6ICMP || !t.pconn.rawSocket {
+		return net.UnknownNetworkError(t.pconn.c.LocalAddr().Network())
+	}
+	return t.setProbes(probe{cookie: routerCookie})
+}
+
+func (t *Tester) marshalProbe(b []byte, cm *ControlMessage, ip net.IP, ifi *net.Interface) ([]byte, net.Addr, probe, error) {
+	var zone string
+	if ifi != nil {
+		zone = ifi.Name
+	}
 	var dst net.Addr
+	var p probe
 	if !t.pconn.rawSocket {
 		dst = &net.UDPAddr{IP: ip, Port: cm.Port, Zone: zone}
-		t.setUDPCookie(ianaProtocolUDP, t.pconn.sport, cm.Port)
+		p.cookie = udpCookie(ianaProtocolUDP, t.pconn.sport, cm.Port)
 	} else {
 		dst = &net.IPAddr{IP: ip, Zone: zone}
 	}
+	if ip.To4() != nil {
+		if err := t.pconn.setIPv4Options(cm.IPv4Options); err != nil {
+			return nil, nil, p, err
+		}
+	} else {
+		if err := t.pconn.setIPv6ExtHeaders(cm.IPv6ExtHeaders, ip); err != nil {
+			return nil, nil, p, err
+		}
+	}
+	p.nat64 = t.isNAT64(ip)
+	if ip.IsMulticast() {
+		p.group = ip
+	} else if isBroadcast(ip) {
+		if err := t.pconn.setBroadcast(); err != nil {
+			return nil, nil, p, err
+		}
+		p.group = ip
+	}
 
 	switch t.pconn.protocol {
 	case ianaProtocolUDP:
-		_, err := t.pconn.writeTo(b, dst, ifi)
-		return err
+		p.sent = newSentProbe(t.pconn, b, ip, cm.Port, p.group != nil)
+		return b, dst, p, nil
 	case ianaProtocolICMP, ianaProtocolIPv6ICMP:
 		echo := icmp.Echo{ID: cm.ID, Seq: cm.Seq, Data: b}
-		t.setICMPCookie(t.pconn.protocol, echo.ID, echo.Seq)
+		p.cookie = icmpCookie(t.pconn.protocol, echo.ID, echo.Seq)
 		m := icmp.Message{Code: 0, Body: &echo}
 		if ip.To4() != nil {
 			m.Type = ipv4.ICMPTypeEcho
@@ -103,7 +398,7 @@ func (t *Tester) Probe(b []byte, cm *ControlMessage, ip net.IP, ifi *net.Interfa
 		}
 		b, err := m.Marshal(nil)
 		if err != nil {
-			return err
+			return nil, nil, p, err
 		}
 		if ip.IsMulticast() && ifi != nil {
 			var err error
@@ -114,13 +409,13 @@ func (t *Tester) Probe(b []byte, cm *ControlMessage, ip net.IP, ifi *net.Interfa
 				err = t.pconn.p6.SetMulticastInterface(ifi)
 			}
 			if err != nil {
-				return err
+				return nil, nil, p, err
 			}
 		}
-		_, err = t.pconn.writeTo(b, dst, ifi)
-		return err
+		p.sent = newSentProbe(t.pconn, b, ip, 0, p.group != nil)
+		return b, dst, p, nil
 	default:
-		return fmt.Errorf("unknown protocol: %d", t.pconn.protocol)
+		return nil, nil, p, fmt.Errorf("unknown protocol: %d", t.pconn.protocol)
 	}
 }
 
@@ -136,7 +431,29 @@ func (t *Tester) Probe(b []byte, cm *ControlMessage, ip net.IP, ifi *net.Interfa
 //	NewTester("udp", "0.0.0.0")
 //	NewTester("ip6:58", "2001:db8::1")
 func NewTester(network, address string) (*Tester, error) {
-	t := Tester{maint: &maint{emitReport: 1, report: make(chan Report, 1)}}
+	return newTester(network, address, false)
+}
+
+// NewSharedTester is like NewTester but shares a maintenance network
+// connection among all the testers created by NewSharedTester that
+// use the same address family and address in the process.
+// Each tester receives only reports related to its own probe
+// packets, therefore testers should use distinct ICMP echo
+// identifiers or UDP source ports.
+//
+// Reports are delivered in turn to each tester without blocking; a
+// report is dropped and counted by DroppedReports when the report
+// channel of the tester is full.
+func NewSharedTester(network, address string) (*Tester, error) {
+	return newTester(network, address, true)
+}
+
+func newTester(network, address string, shared bool) (*Tester, error) {
+	n := 1
+	if shared {
+		n = sharedReportLen
+	}
+	t := Tester{maint: &maint{emitReport: 1, report: make(chan Report, n), done: make(chan struct{})}}
 
 	var err error
 	t.pconn, err = newProbeConn(network, address)
@@ -144,78 +461,50 @@ func NewTester(network, address string) (*Tester, error) {
 		return nil, err
 	}
 
+	var mnetwork string
 	switch network {
 	case "ip4:icmp", "ip4:1":
-		if t.pconn.p4 != nil {
+		mnetwork = "ip4:icmp"
+		if t.pconn.p4 != nil && (!shared || !t.pconn.rawSocket) {
 			t.mconn = t.pconn
-		} else {
-			t.mconn, err = newMaintConn(network, t.pconn.ip.String())
-			if err != nil {
-				t.pconn.close()
-				return nil, err
-			}
 		}
 	case "ip6:ipv6-icmp", "ip6:58":
-		t.mconn = t.pconn
-	case "udp":
-		t.mconn, err = newMaintConn("ip4:icmp+ip6:ipv6-icmp", t.pconn.ip.String())
-		if err != nil {
-			t.pconn.close()
-			return nil, err
+		mnetwork = "ip6:ipv6-icmp"
+		if !shared || !t.pconn.rawSocket {
+			t.mconn = t.pconn
 		}
+	case "udp":
+		mnetwork = "ip4:icmp+ip6:ipv6-icmp"
 	case "udp4":
-		t.mconn, err = newMaintConn("ip4:icmp", t.pconn.ip.String())
-		if err != nil {
-			t.pconn.close()
-			return nil, err
-		}
+		mnetwork = "ip4:icmp"
 	case "udp6":
-		t.mconn, err = newMaintConn("ip6:ipv6-icmp", t.pconn.ip.String())
-		if err != nil {
-			t.pconn.close()
-			return nil, err
-		}
+		mnetwork = "ip6:ipv6-icmp"
 	default:
 		t.pconn.close()
 		return nil, net.UnknownNetworkError(network)
 	}
 
-	if t.mconn.ip.To4() != nil {
-		if runtime.GOOS == "linux" {
-			var f ipv4.ICMPFilter
-			f.SetAll(true)
-			f.Accept(ipv4.ICMPTypeEchoReply)
-			f.Accept(ipv4.ICMPTypeDestinationUnreachable)
-			f.Accept(ipv4.ICMPTypeTimeExceeded)
-			f.Accept(ipv4.ICMPTypeParameterProblem)
-			if t.mconn.r4 != nil {
-				t.mconn.r4.SetICMPFilter(&f)
-			} else {
-				t.mconn.p4.SetICMPFilter(&f)
+	if t.mconn == nil {
+		if shared {
+			t.demux, err = acquireDemux(mnetwork, t.pconn.ip.String(), t.maint)
+			if err == nil {
+				t.mconn = t.demux.c
 			}
-		}
-		f := ipv4.FlagSrc | ipv4.FlagDst | ipv4.FlagInterface
-		if runtime.GOOS != "solaris" {
-			// It looks like IP_RECVTTL doesn't work well
-			// on Solaris.
-			f |= ipv4.FlagTTL
-		}
-		if t.mconn.r4 != nil {
-			t.mconn.r4.SetControlMessage(f, true)
 		} else {
-			t.mconn.p4.SetControlMessage(f, true)
+			t.mconn, err = newMaintConn(mnetwork, t.pconn.ip.String())
+		}
+		if err != nil {
+			t.pconn.close()
+			return nil, err
 		}
 	}
-	if t.mconn.ip.To16() != nil && t.mconn.ip.To4() == nil {
-		var f ipv6.ICMPFilter
-		f.SetAll(true)
-		f.Accept(ipv6.ICMPTypeEchoReply)
-		f.Accept(ipv6.ICMPTypeDestinationUnreachable)
-		f.Accept(ipv6.ICMPTypePacketTooBig)
-		f.Accept(ipv6.ICMPTypeTimeExceeded)
-		f.Accept(ipv6.ICMPTypeParameterProblem)
-		t.mconn.p6.SetICMPFilter(&f)
-		t.mconn.p6.SetControlMessage(ipv6.FlagTrafficClass|ipv6.FlagHopLimit|ipv6.FlagSrc|ipv6.FlagDst|ipv6.FlagInterface, true)
+	if t.demux != nil {
+		if t.pconn.rawSocket && t.pconn.protocol != ianaProtocolUDP {
+			t.pconn.blockICMP()
+		}
+		return &t, nil
 	}
+
+	t.mconn.setMaintOptions()
 	return &t, nil
 }
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/mikioh/ipoam"
+	"golang.org/x/net/icmp"
 )
 
 func TestTesterGlobalUnicast(t *testing.T) {
@@ -124,3 +125,105 @@ func TestTesterGlobalUnicast(t *testing.T) {
 		})
 	}
 }
+
+func TestSharedTester(t *testing.T) {
+	for _, tt := range []struct {
+		name             string
+		network, address string
+		ip               net.IP
+	}{
+		{"IPv4", "ip4:icmp", "0.0.0.0", net.IPv4(127, 0, 0, 1)},
+		{"IPv6", "ip6:ipv6-icmp", "::", net.IPv6loopback},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var ipts [3]*ipoam.Tester
+			for i := range ipts {
+				ipt, err := ipoam.NewSharedTester(tt.network, tt.address)
+				if err != nil {
+					t.Log(err)
+					return
+				}
+				defer ipt.Close()
+				ipts[i] = ipt
+			}
+
+			for i, ipt := range ipts {
+				cm := ipoam.ControlMessage{ID: os.Getpid()&0xffff + i, Seq: 1}
+				if err := ipt.Probe([]byte("HELLO-R-U-THERE"), &cm, tt.ip, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i, ipt := range ipts {
+				wait := time.NewTimer(250 * time.Millisecond)
+				select {
+				case <-wait.C:
+					t.Errorf("#%d: timed out", i)
+				case r := <-ipt.Report():
+					if r.Error != nil {
+						t.Fatalf("#%d: %v", i, r.Error)
+					}
+					echo, ok := r.ICMP.Body.(*icmp.Echo)
+					if !ok || echo.ID != os.Getpid()&0xffff+i {
+						t.Errorf("#%d: got %+v; want echo.id=%d", i, r.ICMP.Body, os.Getpid()&0xffff+i)
+					}
+				}
+				wait.Stop()
+			}
+		})
+	}
+}
+
+func TestTesterConcurrentClose(t *testing.T) {
+	ipt, err := ipoam.NewTester("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() { errs <- ipt.Close() }()
+	}
+	var n int
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err == nil {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("got %d successful closes; want 1", n)
+	}
+}
+
+func TestProbeBatchMixedOptions(t *testing.T) {
+	ipt, err := ipoam.NewTester("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ipt.Close()
+
+	dst := net.ParseIP("2001:db8::1")
+	for i, tt := range []struct {
+		cms []ipoam.ControlMessage
+		ips []net.IP
+	}{
+		{
+			[]ipoam.ControlMessage{{Port: 33434, IPv4Options: []byte{0x94, 0x04, 0, 0}}, {Port: 33435}},
+			[]net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 1)},
+		},
+		{
+			[]ipoam.ControlMessage{{Port: 33434}, {Port: 33435, IPv6ExtHeaders: []ipoam.IPv6ExtHeader{{Type: ipoam.IPv6DstOpts}}}},
+			[]net.IP{dst, dst},
+		},
+		{
+			[]ipoam.ControlMessage{{Port: 33434, IPv6ExtHeaders: []ipoam.IPv6ExtHeader{{Type: ipoam.IPv6Routing}}}, {Port: 33435, IPv6ExtHeaders: []ipoam.IPv6ExtHeader{{Type: ipoam.IPv6Routing}}}},
+			[]net.IP{dst, net.ParseIP("2001:db8::2")},
+		},
+		{
+			[]ipoam.ControlMessage{{Port: 33434}},
+			[]net.IP{dst, dst},
+		},
+	} {
+		if n, err := ipt.ProbeBatch(nil, tt.cms, tt.ips, nil); n != 0 || err == nil {
+			t.Errorf("#%d: got %d, %v; want error", i, n, err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// TWAMPPort is the well-known UDP port number for TWAMP-Light test
+// packets.
+const TWAMPPort = 862
+
+const (
+	twampSenderLen    = 14 // length of unauthenticated session-sender test packet without padding
+	twampReflectorLen = 41 // length of unauthenticated session-reflector test packet without padding
+)
+
+var errInvalidTWAMPPacket = errors.New("invalid TWAMP test packet")
+
+// A TWAMPPacket represents a TWAMP-Light session-sender or
+// session-reflector test packet in unauthenticated mode.
+// See RFC 5357.
+type TWAMPPacket struct {
+	Reflected     bool // true if the packet is a session-reflector test packet
+	Seq           uint32
+	Timestamp     time.Time
+	ErrorEstimate STAMPErrorEstimate
+
+	// These fields are set only on session-reflector test
+	// packets.
+	Received            time.Time // time the session-sender test packet received
+	SenderSeq           uint32
+	SenderTimestamp     time.Time
+	SenderErrorEstimate STAMPErrorEstimate
+	SenderTTL           int // IPv4 TTL or IPv6 hop limit on session-sender test packet
+
+	Padding int // length of packet padding
+}
+
+// Marshal returns the binary encoding of p.
+func (p *TWAMPPacket) Marshal() ([]byte, error) {
+	if p.Padding < 0 {
+		return nil, errInvalidTWAMPPacket
+	}
+	n := twampSenderLen
+	if p.Reflected {
+		n = twampReflectorLen
+	}
+	b := make([]byte, n+p.Padding)
+	binary.BigEndian.PutUint32(b[:4], p.Seq)
+	putSTAMPTime(b[4:12], p.Timestamp, p.ErrorEstimate.PTP())
+	binary.BigEndian.PutUint16(b[12:14], uint16(p.ErrorEstimate))
+	if p.Reflected {
+		putSTAMPTime(b[16:24], p.Received, p.ErrorEstimate.PTP())
+		binary.BigEndian.PutUint32(b[24:28], p.SenderSeq)
+		putSTAMPTime(b[28:36], p.SenderTimestamp, p.SenderErrorEstimate.PTP())
+		binary.BigEndian.PutUint16(b[36:38], uint16(p.SenderErrorEstimate))
+		b[40] = byte(p.SenderTTL)
+	}
+	return b, nil
+}
+
+// ParseTWAMPPacket parses b as a TWAMP-Light session-sender test
+// packet, or a session-reflector test packet when reflected is true.
+func ParseTWAMPPacket(b []byte, reflected bool) (*TWAMPPacket, error) {
+	n := twampSenderLen
+	if reflected {
+		n = twampReflectorLen
+	}
+	if len(b) < n {
+		return nil, errInvalidTWAMPPacket
+	}
+	p := TWAMPPacket{
+		Reflected:     reflected,
+		Seq:           binary.BigEndian.Uint32(b[:4]),
+		ErrorEstimate: STAMPErrorEstimate(binary.BigEndian.Uint16(b[12:14])),
+		Padding:       len(b) - n,
+	}
+	p.Timestamp = parseSTAMPTime(b[4:12], p.ErrorEstimate.PTP())
+	if reflected {
+		p.Received = parseSTAMPTime(b[16:24], p.ErrorEstimate.PTP())
+		p.SenderSeq = binary.BigEndian.Uint32(b[24:28])
+		p.SenderErrorEstimate = STAMPErrorEstimate(binary.BigEndian.Uint16(b[36:38]))
+		p.SenderTimestamp = parseSTAMPTime(b[28:36], p.SenderErrorEstimate.PTP())
+		p.SenderTTL = int(b[40])
+	}
+	return &p, nil
+}
+
+// Delays returns the round-trip delay, and the forward and backward
+// one-way delays of the session-reflector test packet p received at
+// t.
+// The one-way delays are meaningful only when the clocks of both
+// hosts are synchronized.
+func (p *TWAMPPacket) Delays(t time.Time) (rtt, forward, backward time.Duration) {
+	forward = p.Received.Sub(p.SenderTimestamp)
+	backward = t.Sub(p.Timestamp)
+	rtt = t.Sub(p.SenderTimestamp) - p.Timestamp.Sub(p.Received)
+	return
+}
+
+// A TWAMPReflector represents a TWAMP-Light session-reflector.
+// It numbers its test packets per session-sender, and transmits them
+// with the DSCP on the session-sender test packets when it's known.
+type TWAMPReflector struct {
+	*testConn
+	ee STAMPErrorEstimate
+
+	mu       sync.Mutex
+	sessions map[string]*twampSession
+}
+
+// A twampSession represents the state of session-reflector per
+// session-sender.
+type twampSession struct {
+	seq  uint32    // next session-reflector sequence number
+	last time.Time // time the last test packet received
+}
+
+// session returns the session for peer, or nil when r already keeps
+// maxReflectorSessions sessions that are not idle.
+// The caller must hold r.mu.
+func (r *TWAMPReflector) session(peer string, now time.Time) *twampSession {
+	if ts := r.sessions[peer]; ts != nil {
+		return ts
+	}
+	if len(r.sessions) >= maxReflectorSessions {
+		for peer, ts := range r.sessions {
+			if now.Sub(ts.last) > reflectorSessionIdle {
+				delete(r.sessions, peer)
+			}
+		}
+		if len(r.sessions) >= maxReflectorSessions {
+			return nil
+		}
+	}
+	ts := &twampSession{}
+	r.sessions[peer] = ts
+	return ts
+}
+
+// NewTWAMPReflector makes a network connection for a TWAMP-Light
+// session-reflector.
+// The network must be "udp", "udp4" or "udp6".
+// The address usually specifies TWAMPPort.
+// The reflector keeps up to 1024 session-senders, removes the ones
+// idle for 5 minutes to make room for new ones, and copies the
+// sequence number of further session-senders.
+func NewTWAMPReflector(network, address string) (*TWAMPReflector, error) {
+	c, err := listenTestConn(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &TWAMPReflector{testConn: c, ee: NewSTAMPErrorEstimate(false, false, time.Millisecond), sessions: make(map[string]*twampSession)}, nil
+}
+
+// SetErrorEstimate sets the error estimate of timestamps on the
+// session-reflector test packets.
+func (r *TWAMPReflector) SetErrorEstimate(ee STAMPErrorEstimate) {
+	r.ee = ee
+}
+
+// Serve receives session-sender test packets and transmits
+// session-reflector test packets until r is closed.
+// The fn is called for each reflected test packet when it is not nil.
+func (r *TWAMPReflector) Serve(fn func(req, rep *TWAMPPacket, peer net.Addr)) error {
+	b := make([]byte, 1<<16)
+	for {
+		n, hops, tc, peer, err := r.readFrom(b)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		req, err := ParseTWAMPPacket(b[:n], false)
+		if err != nil {
+			continue
+		}
+		seq := req.Seq
+		r.mu.Lock()
+		if ts := r.session(peer.String(), now); ts != nil {
+			seq = ts.seq
+			ts.seq++
+			ts.last = now
+		}
+		r.mu.Unlock()
+		rep := TWAMPPacket{
+			Reflected:           true,
+			Seq:                 seq,
+			ErrorEstimate:       r.ee,
+			Received:            now,
+			SenderSeq:           req.Seq,
+			SenderTimestamp:     req.Timestamp,
+			SenderErrorEstimate: req.ErrorEstimate,
+			SenderTTL:           hops,
+		}
+		// The padding is truncated to keep the test packets in
+		// both directions the same size.
+		// See RFC 6038.
+		if req.Padding > twampReflectorLen-twampSenderLen {
+			rep.Padding = req.Padding - (twampReflectorLen - twampSenderLen)
+		}
+		if tc >= 0 {
+			r.setDSCP(tc >> 2)
+		}
+		rep.Timestamp = time.Now()
+		wb, err := rep.Marshal()
+		if err != nil {
+			continue
+		}
+		if _, err := r.c.WriteTo(wb, peer); err != nil {
+			continue
+		}
+		if fn != nil {
+			fn(req, &rep, peer)
+		}
+	}
+}
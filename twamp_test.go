@@ -0,0 +1,66 @@
+// Copyright 2015 Mikio Hara. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipoam_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mikioh/ipoam"
+)
+
+func TestTWAMPReflector(t *testing.T) {
+	r, err := ipoam.NewTWAMPReflector("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go r.Serve(nil)
+
+	c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i, padding := range []int{0, 27, 100} {
+		req := ipoam.TWAMPPacket{
+			Seq:           uint32(i + 10),
+			Timestamp:     time.Now(),
+			ErrorEstimate: ipoam.NewSTAMPErrorEstimate(true, i%2 == 1, time.Microsecond),
+			Padding:       padding,
+		}
+		b, err := req.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.WriteTo(b, r.Addr()); err != nil {
+			t.Fatal(err)
+		}
+		b = make([]byte, 1500)
+		c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, _, err := c.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rep, err := ipoam.ParseTWAMPPacket(b[:n], true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Seq != uint32(i) || rep.SenderSeq != req.Seq || rep.SenderErrorEstimate != req.ErrorEstimate || rep.SenderTTL == 0 {
+			t.Errorf("#%d: got %+v; want %+v", i, rep, req)
+		}
+		if want := 14 + padding; padding >= 27 && n != want {
+			t.Errorf("#%d: got %d bytes; want %d", i, n, want)
+		}
+		if d := rep.SenderTimestamp.Sub(req.Timestamp); d > time.Microsecond || d < -time.Microsecond {
+			t.Errorf("#%d: got %v; want %v", i, rep.SenderTimestamp, req.Timestamp)
+		}
+		if rtt, _, _ := rep.Delays(time.Now()); rtt <= 0 {
+			t.Errorf("#%d: got %v; want positive round-trip delay", i, rtt)
+		}
+	}
+}